@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditResult is the outcome of a publish attempt
+type AuditResult string
+
+const (
+	AuditOK     AuditResult = "ok"
+	AuditDenied AuditResult = "denied"
+	AuditLocked AuditResult = "locked" // denied without checking the secret because of previous failures of the address
+)
+
+// AuditEntry records a single publish attempt
+type AuditEntry struct {
+	Time   time.Time   `json:"time"`
+	Slug   string      `json:"slug"`
+	App    string      `json:"app"`
+	Addr   string      `json:"addr,omitempty"` // publisher address as reported by the ingest server
+	Result AuditResult `json:"result"`
+	Key    string      `json:"key,omitempty"` // id of the matching key or token
+}
+
+// defaultAuditLimit is the number of entries returned by queries without limit
+const defaultAuditLimit = 100
+
+// AuditFilter selects audit entries, empty fields match everything
+type AuditFilter struct {
+	Slug   string
+	Addr   string
+	Result AuditResult
+	Since  time.Time
+	Limit  int
+}
+
+func (f *AuditFilter) match(entry *AuditEntry) bool {
+	return (f.Slug == "" || f.Slug == entry.Slug) &&
+		(f.Addr == "" || f.Addr == entry.Addr) &&
+		(f.Result == "" || f.Result == entry.Result) &&
+		!entry.Time.Before(f.Since)
+}
+
+// auditLog appends entries as json lines to a size rotated file
+type auditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+
+	// rotation is held while renaming files, so queries don't block appends
+	rotation sync.RWMutex
+}
+
+func newAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+	l := &auditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotatedPath returns the path of the i-th rotated file, 0 is the current file
+func (l *auditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// rotate shifts path.N-1 to path.N, ..., path to path.1 and reopens path,
+// without rotated files path starts over
+func (l *auditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for i := l.maxFiles - 1; i >= 0; i-- {
+		err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Record logs the entry and appends it to the audit file
+func (l *auditLog) Record(entry AuditEntry) {
+	event := log.Debug()
+	if entry.Result != AuditOK {
+		event = log.Info()
+	}
+	event.Str("slug", entry.Slug).Str("app", entry.App).Str("addr", entry.Addr).
+		Str("key", entry.Key).Str("result", string(entry.Result)).Msg("auth: publish")
+
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Err(err).Msg("auth: audit marshal")
+		return
+	}
+	data = append(data, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize && l.size > 0 {
+		l.rotation.Lock()
+		err := l.rotate()
+		l.rotation.Unlock()
+		if err != nil {
+			log.Error().Err(err).Msg("auth: audit rotate")
+			return
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Error().Err(err).Msg("auth: audit write")
+	}
+}
+
+// Query returns the newest entries matching filter from all audit files, newest first
+func (l *auditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	l.rotation.RLock()
+	defer l.rotation.RUnlock()
+
+	var entries []AuditEntry
+	for i := 0; i <= l.maxFiles; i++ {
+		f, err := os.Open(l.rotatedPath(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if filter.match(&entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+func (l *auditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// ParseAuditFilter parses a filter from url query parameters
+func ParseAuditFilter(query url.Values) (AuditFilter, error) {
+	filter := AuditFilter{
+		Slug:   query.Get("slug"),
+		Addr:   query.Get("addr"),
+		Result: AuditResult(query.Get("result")),
+		Limit:  defaultAuditLimit,
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %w", err)
+		}
+		filter.Since = t
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return filter, fmt.Errorf("invalid limit")
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// Values encodes the filter as url query parameters
+func (f *AuditFilter) Values() url.Values {
+	query := url.Values{}
+	if f.Slug != "" {
+		query.Set("slug", f.Slug)
+	}
+	if f.Addr != "" {
+		query.Set("addr", f.Addr)
+	}
+	if f.Result != "" {
+		query.Set("result", string(f.Result))
+	}
+	if !f.Since.IsZero() {
+		query.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if f.Limit > 0 {
+		query.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return query
+}
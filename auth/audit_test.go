@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// small enough to rotate every few entries
+	audit, err := newAuditLog(path, 300, 2)
+	assert.NilError(t, err)
+	defer audit.Close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		result := AuditDenied
+		if i%2 == 0 {
+			result = AuditOK
+		}
+		audit.Record(AuditEntry{Time: start.Add(time.Second * time.Duration(i)), Slug: "s1", App: "stream", Addr: "10.0.0.1", Result: result})
+	}
+	assert.Assert(t, audit.size <= 300)
+
+	// older entries are rotated away
+	entries, err := audit.Query(AuditFilter{})
+	assert.NilError(t, err)
+	assert.Assert(t, len(entries) < 10)
+	assert.Assert(t, entries[0].Time.After(entries[1].Time))
+
+	entries, err = audit.Query(AuditFilter{Result: AuditDenied, Limit: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Result, AuditDenied)
+	assert.Assert(t, entries[0].Time.Equal(start.Add(time.Second*9)))
+}
+
+func TestAuditLogWithoutRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(path, 300, 0)
+	assert.NilError(t, err)
+	defer audit.Close()
+
+	for i := 0; i < 10; i++ {
+		audit.Record(AuditEntry{Time: time.Now(), Slug: "s1", App: "stream", Addr: "10.0.0.1", Result: AuditDenied})
+	}
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Assert(t, info.Size() <= 300)
+	_, err = os.Stat(path + ".1")
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestLockout(t *testing.T) {
+	audit, err := newAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	assert.NilError(t, err)
+	defer audit.Close()
+	limiter := newLimiter(config.LockoutConfig{
+		MaxFailuresPerAddr: 3,
+		MaxFailuresPerSlug: 5,
+		Window:             time.Minute,
+		Duration:           time.Minute,
+	})
+	handler := authHandler(newTestWatcher(), nil, limiter, audit, nil)
+	publish := func(addr string, secret string) int {
+		return postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"s1"}, "addr": {addr}, "auth": {secret}})
+	}
+
+	// success resets the counter
+	assert.Equal(t, publish("10.0.0.1", "wrong"), http.StatusForbidden)
+	assert.Equal(t, publish("10.0.0.1", "wrong"), http.StatusForbidden)
+	assert.Equal(t, publish("10.0.0.1", "secret"), http.StatusOK)
+
+	// address lockout, even with the correct secret
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, publish("10.0.0.1", "wrong"), http.StatusForbidden)
+	}
+	assert.Equal(t, publish("10.0.0.1", "secret"), http.StatusForbidden)
+	assert.Equal(t, publish("10.0.0.2", "secret"), http.StatusOK)
+
+	// failures for a slug across addresses don't lock out the publisher
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, publish("10.0.1."+string(rune('0'+i)), "wrong"), http.StatusForbidden)
+	}
+	assert.Equal(t, publish("10.0.0.2", "secret"), http.StatusOK)
+
+	// lockout expires
+	assert.Assert(t, limiter.Locked("10.0.0.1", time.Now()))
+	assert.Assert(t, !limiter.Locked("10.0.0.1", time.Now().Add(time.Minute*2)))
+
+	entries, err := audit.Query(AuditFilter{Result: AuditLocked})
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Slug, "s1")
+}
+
+func TestAuditToken(t *testing.T) {
+	audit, err := newAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	assert.NilError(t, err)
+	defer audit.Close()
+	handler := requireToken("token", auditHandler(audit))
+
+	for auth, status := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer token": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/audit", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		handler(w, r)
+		assert.Equal(t, w.Code, status, auth)
+	}
+}
@@ -2,18 +2,32 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/voc/stream-api/auth/token"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
+	"github.com/voc/stream-api/stream"
 )
 
+var log = logging.Module("auth")
+
 // Auth subscribes to stream settings and responds to auth request over http
 type Auth struct {
 	watcher *watcher
+	tokens  *token.Keyring
+	limiter *limiter
+	audit   *auditLog
+	events  *eventlog.Log
 	name    string
 	api     client.ServiceAPI
 	done    sync.WaitGroup
@@ -21,19 +35,64 @@ type Auth struct {
 
 var defaultScrapeInterval = time.Second * 3
 
-// New creates a new Auth
-func New(ctx context.Context, api client.ServiceAPI, name string, conf config.AuthConfig) *Auth {
+// New creates a new Auth, it returns an error if the config can't be applied or an address can't be listened on
+func New(ctx context.Context, api client.ServiceAPI, name string, conf config.AuthConfig, events *eventlog.Log) (*Auth, error) {
+	tokens, err := token.NewKeyring(conf.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("tokens: %w", err)
+	}
+	var audit *auditLog
+	if conf.AuditLog != "" {
+		audit, err = newAuditLog(conf.AuditLog, conf.AuditMaxSize, conf.AuditMaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("audit log: %w", err)
+		}
+	}
+	addresses := []string{conf.Address}
+	if conf.AuditAddress != "" {
+		addresses = append(addresses, conf.AuditAddress)
+	}
+	listeners, err := listen(addresses)
+	if err != nil {
+		if audit != nil {
+			audit.Close()
+		}
+		return nil, err
+	}
 	a := &Auth{
-		watcher: newWatcher(ctx, api),
+		tokens:  tokens,
+		limiter: newLimiter(conf.Lockout),
+		audit:   audit,
+		events:  events,
+		watcher: newWatcher(ctx, api, stream.ScheduleWindow{Lead: conf.ScheduleLead, Grace: conf.ScheduleGrace}),
 		name:    name,
 		api:     api,
 	}
 
 	// watch settings updates
 	a.done.Add(1)
-	go a.run(ctx, &conf)
+	go a.run(ctx, &conf, listeners)
 
-	return a
+	return a, nil
+}
+
+// listen listens on all addresses, it closes the listeners opened already if one fails
+func listen(addresses []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		if address == "" {
+			address = ":http" // like http.Server
+		}
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
 }
 
 func (a *Auth) Wait() {
@@ -41,53 +100,142 @@ func (a *Auth) Wait() {
 	a.done.Wait()
 }
 
-func (a *Auth) run(parentContext context.Context, conf *config.AuthConfig) {
+func (a *Auth) run(parentContext context.Context, conf *config.AuthConfig, listeners []net.Listener) {
 	defer a.done.Done()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", authHandler(a.watcher))
-
-	srv := &http.Server{Addr: conf.Address, Handler: mux}
+	mux.HandleFunc("/", authHandler(a.watcher, a.tokens, a.limiter, a.audit, a.events))
+	servers := []*http.Server{{Handler: mux}}
+
+	// the audit log is only served on a separate listener, the hook listener is reachable by the ingest servers
+	if conf.AuditAddress != "" {
+		auditMux := http.NewServeMux()
+		auditMux.HandleFunc("GET /audit", requireToken(conf.AuditToken, auditHandler(a.audit)))
+		servers = append(servers, &http.Server{Handler: auditMux})
+	}
 
-	a.done.Add(1)
-	go func() {
-		defer a.done.Done()
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal().Msgf("ListenAndServe(): %v", err)
-		}
-	}()
+	for i, srv := range servers {
+		a.done.Add(1)
+		go func() {
+			defer a.done.Done()
+			if err := srv.Serve(listeners[i]); err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("auth: serve")
+			}
+		}()
+	}
 
 	<-parentContext.Done()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	err := srv.Shutdown(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("auth: server shutdown")
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("auth: server shutdown")
+		}
+	}
+	if a.audit != nil {
+		a.audit.Close()
 	}
 }
 
-func authHandler(watcher *watcher) http.HandlerFunc {
+func authHandler(watcher *watcher, tokens *token.Keyring, limiter *limiter, audit *auditLog, events *eventlog.Log) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseForm()
+		req, err := parseHookRequest(r)
 		if err != nil {
 			log.Error().Err(err).Msg("auth: parse")
-			http.Error(w, "Invalid form", http.StatusUnauthorized)
+			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
 
-		app := r.PostForm.Get("app")
-		name := r.PostForm.Get("name")
-		auth := r.PostForm.Get("auth")
+		if !req.publish {
+			if !req.allowed() {
+				log.Debug().Msgf("auth: %s/%s %s denied", req.app, req.name, req.action)
+				req.deny(w)
+				return
+			}
+			log.Debug().Msgf("auth: %s/%s %s ok", req.app, req.name, req.action)
+			return
+		}
 
-		log.Debug().Msgf("auth: %s/%s, secret '%s'", app, name, auth)
+		now := time.Now()
+		entry := AuditEntry{Time: now, Slug: req.name, App: req.app, Addr: req.addr}
+		if limiter.Locked(req.addr, now) {
+			entry.Result = AuditLocked
+			audit.Record(entry)
+			req.deny(w)
+			return
+		}
 
-		success := watcher.Auth(app, name, auth)
+		keyID, success := authenticate(watcher, tokens, req, now)
 		if !success {
-			log.Debug().Msgf("auth: %s/%s unauthorized", app, name)
+			limiter.Fail(req.addr, req.name, now)
+			entry.Result = AuditDenied
+			audit.Record(entry)
+			events.Append(eventlog.Event{Slug: req.name, Module: "auth", Type: eventlog.PublishDenied,
+				Fields: map[string]string{"app": req.app, "addr": req.addr}})
+			req.deny(w)
+			return
+		}
+
+		limiter.Success(req.addr, req.name)
+		entry.Result = AuditOK
+		entry.Key = keyID
+		audit.Record(entry)
+		events.Append(eventlog.Event{Slug: req.name, Module: "auth", Type: eventlog.PublishAllowed,
+			Fields: map[string]string{"app": req.app, "addr": req.addr, "key": keyID}})
+	}
+}
+
+// authenticate checks the secret of a publish request, it returns the id of the matching key or token
+func authenticate(watcher *watcher, tokens *token.Keyring, req *hookRequest, now time.Time) (string, bool) {
+	if tokens != nil && token.IsToken(req.secret) {
+		claims, err := tokens.Verify(req.secret, now)
+		if err != nil {
+			log.Debug().Err(err).Msgf("auth: %s/%s invalid token", req.app, req.name)
+			return "", false
+		}
+		if claims.Slug != req.name || claims.IngestType != req.app {
+			return "", false
+		}
+		return "token:" + claims.ID, true
+	}
+
+	return watcher.Auth(req.app, req.name, req.secret)
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		next(w, r)
+	}
+}
 
-		log.Debug().Msgf("auth: %s/%s ok", app, name)
+// auditHandler serves the audit log filtered by the slug, addr, result, since and limit query parameters
+func auditHandler(audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil {
+			http.Error(w, "audit log disabled", http.StatusNotFound)
+			return
+		}
+		filter, err := ParseAuditFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries, err := audit.Query(filter)
+		if err != nil {
+			log.Error().Err(err).Msg("auth: audit query")
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
 	}
 }
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/auth/token"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+func newTestWatcher() *watcher {
+	return &watcher{
+		settings: map[string]*stream.Settings{
+			"s1": {Slug: "s1", IngestType: "stream", Secret: "secret"},
+		},
+	}
+}
+
+func postForm(t *testing.T, handler http.HandlerFunc, values url.Values) int {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec.Code
+}
+
+func postJSON(t *testing.T, handler http.HandlerFunc, body string) int {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec.Code
+}
+
+func TestNginxRTMP(t *testing.T) {
+	handler := authHandler(newTestWatcher(), nil, nil, nil, nil)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"s1"}, "auth": {"secret"}}), http.StatusOK)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"s1"}, "auth": {"wrong"}}), http.StatusForbidden)
+	assert.Equal(t, postForm(t, handler, url.Values{"app": {"relay"}, "name": {"s1"}, "auth": {"secret"}}), http.StatusForbidden)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"play"}, "app": {"stream"}, "name": {"s1"}}), http.StatusOK)
+}
+
+// srtrelay posts the mode of the streamid as call, its configured application,
+// the stream name and the password, but not the address of the client
+func TestSrtrelay(t *testing.T) {
+	limiter := newLimiter(config.LockoutConfig{MaxFailuresPerAddr: 3, Window: time.Minute, Duration: time.Minute})
+	handler := authHandler(newTestWatcher(), nil, limiter, nil, nil)
+	srtrelay := func(mode string, name string, password string) int {
+		return postForm(t, handler, url.Values{"call": {mode}, "app": {"stream"}, "name": {name}, "auth": {password}})
+	}
+	assert.Equal(t, srtrelay("publish", "s1", "secret"), http.StatusOK)
+	assert.Equal(t, srtrelay("publish", "s2", "secret"), http.StatusForbidden)
+	assert.Equal(t, srtrelay("play", "s1", ""), http.StatusOK)
+
+	// failures without address don't lock out the other publishers of the relay
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, srtrelay("publish", "s1", "wrong"), http.StatusForbidden)
+	}
+	assert.Equal(t, srtrelay("publish", "s1", "secret"), http.StatusOK)
+}
+
+func TestMediaMTX(t *testing.T) {
+	handler := authHandler(newTestWatcher(), nil, nil, nil, nil)
+	assert.Equal(t, postJSON(t, handler, `{"action":"publish","path":"stream/s1","protocol":"srt","query":"auth=secret"}`), http.StatusOK)
+	assert.Equal(t, postJSON(t, handler, `{"action":"publish","path":"stream/s1","protocol":"rtmp","password":"secret"}`), http.StatusOK)
+	assert.Equal(t, postJSON(t, handler, `{"action":"publish","path":"stream/s1","protocol":"rtmp","password":"wrong"}`), http.StatusUnauthorized)
+	assert.Equal(t, postJSON(t, handler, `{"action":"read","path":"stream/s1","protocol":"hls"}`), http.StatusOK)
+	assert.Equal(t, postJSON(t, handler, `{"action":"api"}`), http.StatusUnauthorized)
+	assert.Equal(t, postJSON(t, handler, `not json`), http.StatusBadRequest)
+}
+
+func TestTokens(t *testing.T) {
+	tokens, err := token.NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{
+		{ID: "k1", Algorithm: token.AlgorithmHS256, Secret: "0123456789abcdef0123456789abcdef"},
+	}})
+	assert.NilError(t, err)
+	mint := func(slug string, ingestType string, ttl time.Duration) string {
+		claims, err := token.NewClaims(slug, ingestType, time.Now(), ttl)
+		assert.NilError(t, err)
+		signed, err := tokens.Sign(claims)
+		assert.NilError(t, err)
+		return signed
+	}
+	handler := authHandler(newTestWatcher(), tokens, nil, nil, nil)
+
+	// tokens don't need stream settings
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"talk"}, "auth": {mint("talk", "stream", time.Hour)}}), http.StatusOK)
+	assert.Equal(t, postJSON(t, handler, `{"action":"publish","path":"stream/talk","protocol":"srt","token":"`+mint("talk", "stream", time.Hour)+`"}`), http.StatusOK)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"other"}, "auth": {mint("talk", "stream", time.Hour)}}), http.StatusForbidden)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"relay"}, "name": {"talk"}, "auth": {mint("talk", "stream", time.Hour)}}), http.StatusForbidden)
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"talk"}, "auth": {mint("talk", "stream", -time.Minute)}}), http.StatusForbidden)
+
+	// stream secrets still work
+	assert.Equal(t, postForm(t, handler, url.Values{"call": {"publish"}, "app": {"stream"}, "name": {"s1"}, "auth": {"secret"}}), http.StatusOK)
+}
+
+func TestHashedKeys(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	hash := func(secret string) string {
+		h, err := stream.HashSecret(secret)
+		assert.NilError(t, err)
+		return h
+	}
+
+	w := &watcher{
+		window:   stream.ScheduleWindow{Lead: time.Minute * 30, Grace: time.Minute * 30},
+		verifier: stream.NewVerifier(3),
+		settings: map[string]*stream.Settings{
+			"s1": {Slug: "s1", IngestType: "stream", Keys: []stream.StreamKey{
+				{ID: "old", Hash: hash("old"), NotAfter: &future},
+				{ID: "new", Hash: hash("new")},
+				{ID: "expired", Hash: hash("expired"), NotAfter: &past},
+				{ID: "upcoming", Hash: hash("upcoming"), NotBefore: &future},
+			}},
+			"s2": {Slug: "s2", IngestType: "stream",
+				Schedule: &stream.Schedule{Start: now.Add(time.Minute * 20), End: now.Add(time.Hour)},
+				Keys:     []stream.StreamKey{{ID: "talk", Hash: hash("talk"), Scheduled: true}},
+			},
+			"s3": {Slug: "s3", IngestType: "stream",
+				Schedule: &stream.Schedule{Start: now.Add(time.Hour), End: now.Add(time.Hour * 2)},
+				Keys:     []stream.StreamKey{{ID: "talk", Hash: hash("talk"), Scheduled: true}},
+			},
+		},
+	}
+
+	// rotation, both keys are valid
+	id, ok := w.Auth("stream", "s1", "old")
+	assert.Assert(t, ok)
+	assert.Equal(t, id, "old")
+	id, ok = w.Auth("stream", "s1", "new")
+	assert.Assert(t, ok)
+	assert.Equal(t, id, "new")
+
+	// cached results, the cache is cleared when full
+	for i := 0; i < 3; i++ {
+		id, ok = w.Auth("stream", "s1", "new")
+		assert.Assert(t, ok)
+		assert.Equal(t, id, "new")
+		_, ok = w.Auth("stream", "s1", "wrong")
+		assert.Assert(t, !ok)
+	}
+
+	// validity windows
+	_, ok = w.Auth("stream", "s1", "expired")
+	assert.Assert(t, !ok)
+	_, ok = w.Auth("stream", "s1", "upcoming")
+	assert.Assert(t, !ok)
+	_, ok = w.Auth("stream", "s1", "")
+	assert.Assert(t, !ok)
+
+	// schedule with lead time
+	_, ok = w.Auth("stream", "s2", "talk")
+	assert.Assert(t, ok)
+	_, ok = w.Auth("stream", "s3", "talk")
+	assert.Assert(t, !ok)
+}
+
+func TestRedacted(t *testing.T) {
+	settings := stream.Settings{Secret: "secret", Keys: []stream.StreamKey{{ID: "a", Hash: "hash"}}}
+	redacted := settings.Redacted()
+	assert.Equal(t, redacted.Secret, "<redacted>")
+	assert.Equal(t, redacted.Keys[0].Hash, "<redacted>")
+	// original is untouched
+	assert.Equal(t, settings.Keys[0].Hash, "hash")
+}
+
+func TestListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+
+	_, err = New(context.Background(), clienttest.NewKV(nil), "auth1", config.AuthConfig{Address: l.Addr().String()}, nil)
+	assert.ErrorContains(t, err, "listen")
+}
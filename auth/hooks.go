@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hook formats of the supported ingest servers
+type hookFormat int
+
+const (
+	// nginx-rtmp on_publish/on_play and srtrelay http auth,
+	// both send url encoded forms and deny any non 2xx response
+	hookFormatForm hookFormat = iota
+	// MediaMTX external http authentication,
+	// sends json and expects 401 on failed authentication
+	hookFormatMediaMTX
+)
+
+// passwordParam is the query/form parameter carrying the stream secret
+const passwordParam = "auth"
+
+// hookRequest is an ingest server auth request in a common format
+type hookRequest struct {
+	format  hookFormat
+	action  string
+	publish bool // whether the client wants to publish
+	app     string
+	name    string
+	secret  string
+	addr    string
+}
+
+// mediaMTXRequest is the body sent by MediaMTX external authentication
+type mediaMTXRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	IP       string `json:"ip"`
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	Protocol string `json:"protocol"`
+	ID       string `json:"id"`
+	Query    string `json:"query"`
+}
+
+// parseHookRequest parses an auth request depending on its content type
+func parseHookRequest(r *http.Request) (*hookRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		return parseMediaMTXRequest(r)
+	}
+	return parseFormRequest(r)
+}
+
+// parseFormRequest parses nginx-rtmp and srtrelay requests
+func parseFormRequest(r *http.Request) (*hookRequest, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	call := r.PostForm.Get("call")
+	return &hookRequest{
+		format: hookFormatForm,
+		action: call,
+		// nginx-rtmp on_publish doesn't send a call in older versions
+		publish: call == "" || call == "publish",
+		app:     r.PostForm.Get("app"),
+		name:    r.PostForm.Get("name"),
+		secret:  r.PostForm.Get(passwordParam),
+		addr:    r.PostForm.Get("addr"),
+	}, nil
+}
+
+// parseMediaMTXRequest parses MediaMTX json requests
+func parseMediaMTXRequest(r *http.Request) (*hookRequest, error) {
+	var req mediaMTXRequest
+	data, err := io.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	// paths are expected in the form app/slug
+	app, name, found := strings.Cut(req.Path, "/")
+	if !found {
+		app, name = "", req.Path
+	}
+
+	// accept the secret from the query, the password or a bearer token
+	secret := req.Password
+	if query, err := url.ParseQuery(req.Query); err == nil && query.Get(passwordParam) != "" {
+		secret = query.Get(passwordParam)
+	} else if req.Token != "" {
+		secret = req.Token
+	}
+
+	return &hookRequest{
+		format:  hookFormatMediaMTX,
+		action:  req.Action,
+		publish: req.Action == "publish",
+		app:     app,
+		name:    name,
+		secret:  secret,
+		addr:    req.IP,
+	}, nil
+}
+
+// allowed reports whether a non-publish request is permitted,
+// playback is not restricted by ingest authentication
+func (h *hookRequest) allowed() bool {
+	if h.format == hookFormatMediaMTX {
+		// MediaMTX also asks for api, metrics and pprof access which we don't grant
+		return h.action == "read" || h.action == "playback"
+	}
+	return true
+}
+
+// deny writes the rejection status expected by the ingest server
+func (h *hookRequest) deny(w http.ResponseWriter) {
+	if h.format == hookFormatMediaMTX {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
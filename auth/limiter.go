@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/voc/stream-api/config"
+)
+
+// failures tracks failed attempts of a single address or slug
+type failures struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// limiter locks out addresses after repeated failed attempts.
+// Failures per slug are only counted and logged, locking out a slug would let anyone block its publisher.
+type limiter struct {
+	conf config.LockoutConfig
+
+	mutex     sync.Mutex
+	addrs     map[string]*failures
+	slugs     map[string]*failures
+	lastPrune time.Time
+}
+
+func newLimiter(conf config.LockoutConfig) *limiter {
+	return &limiter{
+		conf:  conf,
+		addrs: make(map[string]*failures),
+		slugs: make(map[string]*failures),
+	}
+}
+
+// Locked reports whether attempts from addr are currently locked out
+func (l *limiter) Locked(addr string, now time.Time) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.prune(now)
+	f, ok := l.addrs[addr]
+	return ok && addr != "" && now.Before(f.lockedUntil)
+}
+
+// Fail records a failed attempt
+func (l *limiter) Fail(addr string, slug string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// the address is unknown for some ingest servers, don't lock them out as a whole
+	if addr != "" && l.fail(l.addrs, addr, l.conf.MaxFailuresPerAddr, now) {
+		log.Warn().Str("addr", addr).Str("slug", slug).Msg("auth: address locked out")
+	}
+	if l.fail(l.slugs, slug, l.conf.MaxFailuresPerSlug, now) {
+		log.Warn().Str("slug", slug).Msg("auth: repeated failures for slug")
+	}
+}
+
+// fail counts a failure of key, it reports whether the limit was reached
+func (l *limiter) fail(m map[string]*failures, key string, max int, now time.Time) bool {
+	if max <= 0 {
+		return false
+	}
+	f, ok := m[key]
+	if !ok || now.Sub(f.windowStart) > l.conf.Window {
+		f = &failures{windowStart: now}
+		m[key] = f
+	}
+	f.count++
+	if f.count >= max {
+		f.lockedUntil = now.Add(l.conf.Duration)
+		f.count = 0
+		f.windowStart = now
+		return true
+	}
+	return false
+}
+
+// Success resets the failures of addr and slug
+func (l *limiter) Success(addr string, slug string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.addrs, addr)
+	delete(l.slugs, slug)
+}
+
+// prune drops expired entries once per window
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.conf.Window {
+		return
+	}
+	l.lastPrune = now
+	for _, m := range []map[string]*failures{l.addrs, l.slugs} {
+		for key, f := range m {
+			if now.Sub(f.windowStart) > l.conf.Window && now.After(f.lockedUntil) {
+				delete(m, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package token implements signed publish tokens for ingest authentication.
+//
+// Tokens are compact JWTs signed with HS256 or EdDSA (Ed25519), they encode the
+// stream slug, the ingest type and an expiry, so publishers can be admitted
+// without storing a secret in the stream settings.
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/voc/stream-api/config"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+
+	// minimum length of HS256 secrets
+	minSecretSize = 32
+)
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrSignature  = errors.New("invalid token signature")
+	ErrExpired    = errors.New("token expired")
+	ErrUnknownKey = errors.New("unknown token key")
+	ErrNoSigner   = errors.New("no signing key configured")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Claims are the token contents
+type Claims struct {
+	Slug       string `json:"sub"`           // stream slug
+	IngestType string `json:"ingest"`        // ingest type/application
+	IssuedAt   int64  `json:"iat"`           // unix time
+	ExpiresAt  int64  `json:"exp"`           // unix time
+	ID         string `json:"jti,omitempty"` // token id, used for logging
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+type key struct {
+	id        string
+	algorithm string
+	secret    []byte
+	public    ed25519.PublicKey
+	private   ed25519.PrivateKey
+}
+
+// canSign reports whether the key holds signing material
+func (k *key) canSign() bool {
+	return k.algorithm == AlgorithmHS256 || k.private != nil
+}
+
+// Keyring signs and verifies tokens with the configured keys
+type Keyring struct {
+	keys   []*key
+	maxTTL time.Duration
+}
+
+// NewKeyring parses the token keys from conf, it returns nil if no keys are configured
+func NewKeyring(conf config.TokenConfig) (*Keyring, error) {
+	if len(conf.Keys) == 0 {
+		return nil, nil
+	}
+	k := &Keyring{maxTTL: conf.MaxTTL}
+	for i, kc := range conf.Keys {
+		parsed, err := parseKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("token key %d: %w", i, err)
+		}
+		k.keys = append(k.keys, parsed)
+	}
+	return k, nil
+}
+
+func parseKey(conf config.TokenKeyConfig) (*key, error) {
+	k := &key{id: conf.ID, algorithm: conf.Algorithm}
+	switch conf.Algorithm {
+	case AlgorithmHS256:
+		if len(conf.Secret) < minSecretSize {
+			return nil, fmt.Errorf("secret must be at least %d bytes", minSecretSize)
+		}
+		k.secret = []byte(conf.Secret)
+	case AlgorithmEdDSA:
+		if conf.PrivateKey != "" {
+			seed, err := base64.StdEncoding.DecodeString(conf.PrivateKey)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid private key")
+			}
+			k.private = ed25519.NewKeyFromSeed(seed)
+			k.public = k.private.Public().(ed25519.PublicKey)
+		}
+		if conf.PublicKey != "" {
+			public, err := base64.StdEncoding.DecodeString(conf.PublicKey)
+			if err != nil || len(public) != ed25519.PublicKeySize {
+				return nil, errors.New("invalid public key")
+			}
+			if k.public != nil && !k.public.Equal(ed25519.PublicKey(public)) {
+				return nil, errors.New("public key doesn't match private key")
+			}
+			k.public = public
+		}
+		if k.public == nil {
+			return nil, errors.New("missing public or private key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm '%s'", conf.Algorithm)
+	}
+	return k, nil
+}
+
+// MaxTTL returns the maximum token lifetime, 0 means unlimited
+func (k *Keyring) MaxTTL() time.Duration {
+	return k.maxTTL
+}
+
+// Sign mints a token for claims with the first key that can sign
+func (k *Keyring) Sign(claims Claims) (string, error) {
+	var signer *key
+	for _, candidate := range k.keys {
+		if candidate.canSign() {
+			signer = candidate
+			break
+		}
+	}
+	if signer == nil {
+		return "", ErrNoSigner
+	}
+
+	h, err := json.Marshal(header{Algorithm: signer.algorithm, Type: "JWT", KeyID: signer.id})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return payload + "." + encoding.EncodeToString(signer.sign([]byte(payload))), nil
+}
+
+func (k *key) sign(payload []byte) []byte {
+	if k.algorithm == AlgorithmHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(payload)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, payload)
+}
+
+func (k *key) verify(payload []byte, signature []byte) bool {
+	if k.algorithm == AlgorithmHS256 {
+		return hmac.Equal(k.sign(payload), signature)
+	}
+	return ed25519.Verify(k.public, payload, signature)
+}
+
+// Verify checks the token signature and expiry and returns its claims
+func (k *Keyring) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	data, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	// the algorithm is bound to the key, never trust the header alone
+	var verifier *key
+	for _, candidate := range k.keys {
+		if candidate.id == h.KeyID && candidate.algorithm == h.Algorithm {
+			verifier = candidate
+			break
+		}
+	}
+	if verifier == nil {
+		return nil, ErrUnknownKey
+	}
+	if !verifier.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrSignature
+	}
+
+	data, err = encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+// IsToken reports whether secret looks like a token rather than a stream secret
+func IsToken(secret string) bool {
+	return strings.Count(secret, ".") == 2 && strings.HasPrefix(secret, "eyJ")
+}
+
+// NewClaims creates claims for slug valid for ttl from now
+func NewClaims(slug string, ingestType string, now time.Time, ttl time.Duration) (Claims, error) {
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return Claims{}, err
+	}
+	return Claims{
+		Slug:       slug,
+		IngestType: ingestType,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+		ID:         encoding.EncodeToString(id),
+	}, nil
+}
+
+// GenerateKey creates a new Ed25519 key pair as base64 strings for the config
+func GenerateKey() (private string, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
@@ -0,0 +1,102 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/config"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestKeyring(t *testing.T) *Keyring {
+	private, public, err := GenerateKey()
+	assert.NilError(t, err)
+	k, err := NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{
+		{ID: "ed", Algorithm: AlgorithmEdDSA, PrivateKey: private, PublicKey: public},
+		{ID: "hs", Algorithm: AlgorithmHS256, Secret: testSecret},
+	}})
+	assert.NilError(t, err)
+	return k
+}
+
+func TestSignVerify(t *testing.T) {
+	k := newTestKeyring(t)
+	now := time.Now()
+	claims, err := NewClaims("s1", "stream", now, time.Hour)
+	assert.NilError(t, err)
+	signed, err := k.Sign(claims)
+	assert.NilError(t, err)
+	assert.Assert(t, IsToken(signed))
+
+	verified, err := k.Verify(signed, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *verified, claims)
+
+	_, err = k.Verify(signed, now.Add(time.Hour))
+	assert.ErrorIs(t, err, ErrExpired)
+
+	// tampered claims
+	other, err := k.Sign(Claims{Slug: "s2", IngestType: "stream", ExpiresAt: claims.ExpiresAt})
+	assert.NilError(t, err)
+	parts, otherParts := strings.Split(signed, "."), strings.Split(other, ".")
+	_, err = k.Verify(parts[0]+"."+otherParts[1]+"."+parts[2], now)
+	assert.ErrorIs(t, err, ErrSignature)
+}
+
+func TestVerifyOnly(t *testing.T) {
+	private, public, err := GenerateKey()
+	assert.NilError(t, err)
+	signer, err := NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{
+		{ID: "ed", Algorithm: AlgorithmEdDSA, PrivateKey: private},
+	}})
+	assert.NilError(t, err)
+	verifier, err := NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{
+		{ID: "ed", Algorithm: AlgorithmEdDSA, PublicKey: public},
+	}})
+	assert.NilError(t, err)
+
+	now := time.Now()
+	claims, err := NewClaims("s1", "stream", now, time.Hour)
+	assert.NilError(t, err)
+	signed, err := signer.Sign(claims)
+	assert.NilError(t, err)
+	_, err = verifier.Verify(signed, now)
+	assert.NilError(t, err)
+
+	_, err = verifier.Sign(claims)
+	assert.ErrorIs(t, err, ErrNoSigner)
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	hs, err := NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{
+		{ID: "ed", Algorithm: AlgorithmHS256, Secret: testSecret},
+	}})
+	assert.NilError(t, err)
+	k := newTestKeyring(t)
+
+	// token claims to be from key "ed" but uses HS256
+	now := time.Now()
+	claims, err := NewClaims("s1", "stream", now, time.Hour)
+	assert.NilError(t, err)
+	signed, err := hs.Sign(claims)
+	assert.NilError(t, err)
+	_, err = k.Verify(signed, now)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestInvalidKeys(t *testing.T) {
+	_, err := NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{{Algorithm: AlgorithmHS256, Secret: "short"}}})
+	assert.ErrorContains(t, err, "at least")
+	_, err = NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{{Algorithm: "none"}}})
+	assert.ErrorContains(t, err, "unsupported algorithm")
+	_, err = NewKeyring(config.TokenConfig{Keys: []config.TokenKeyConfig{{Algorithm: AlgorithmEdDSA}}})
+	assert.ErrorContains(t, err, "missing")
+
+	k, err := NewKeyring(config.TokenConfig{})
+	assert.NilError(t, err)
+	assert.Assert(t, k == nil)
+}
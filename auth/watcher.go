@@ -4,24 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"sync"
+	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/stream"
 )
 
+// verifierSize is the number of cached secret verifications
+const verifierSize = 4096
+
 type watcher struct {
-	api  client.WatchAPI
-	done sync.WaitGroup
+	api      client.WatchAPI
+	done     sync.WaitGroup
+	window   stream.ScheduleWindow
+	verifier *stream.Verifier
 
 	// local state
 	mutex    sync.Mutex
 	settings map[string]*stream.Settings
 }
 
-func newWatcher(ctx context.Context, api client.ServiceAPI) *watcher {
+func newWatcher(ctx context.Context, api client.ServiceAPI, window stream.ScheduleWindow) *watcher {
 	t := &watcher{
 		api:      api,
+		window:   window,
+		verifier: stream.NewVerifier(verifierSize),
 		settings: make(map[string]*stream.Settings),
 	}
 
@@ -70,7 +77,7 @@ func (w *watcher) handleStreamSettings(ctx context.Context, update *client.Watch
 	}
 	path := string(update.KV.Key())
 	name := client.ParseStreamName(path)
-	log.Debug().Msgf("stream settings update %v", update.KV.Value())
+	log.Debug().Msgf("stream settings update %s", path)
 	if name == "" {
 		return
 	}
@@ -91,16 +98,13 @@ func (w *watcher) handleStreamSettings(ctx context.Context, update *client.Watch
 	}
 }
 
-func (w *watcher) Auth(app string, slug string, secret string) bool {
+// Auth checks the secret against the stream settings, it returns the id of the matching key
+func (w *watcher) Auth(app string, slug string, secret string) (string, bool) {
 	w.mutex.Lock()
-	defer w.mutex.Unlock()
-
 	settings, ok := w.settings[slug]
-	if !ok {
-		return false
-	}
-	if app != settings.IngestType || secret != settings.Secret {
-		return false
+	w.mutex.Unlock()
+	if !ok || app != settings.IngestType {
+		return "", false
 	}
-	return true
+	return settings.Authenticate(secret, time.Now(), w.window, w.verifier)
 }
@@ -2,8 +2,12 @@ package client
 
 import (
 	"context"
+	"errors"
 )
 
+// ErrModified is returned by compare-and-swap writes if the key changed since it was read
+var ErrModified = errors.New("key was modified concurrently")
+
 type UpdateType int
 
 const (
@@ -45,6 +49,12 @@ type KVAPI interface {
 	Put(ctx context.Context, key string, value []byte) error
 	PutWithSession(ctx context.Context, key string, value []byte) error
 	Delete(ctx context.Context, key string) error
+	// GetWithIndex returns the value and modify index of key, nil and 0 if it doesn't exist
+	GetWithIndex(ctx context.Context, key string) ([]byte, uint64, error)
+	// CompareAndSwap writes value if key still has the modify index, index 0 only creates the key
+	CompareAndSwap(ctx context.Context, key string, value []byte, index uint64) error
+	// CompareAndDelete deletes key if it still has the modify index
+	CompareAndDelete(ctx context.Context, key string, index uint64) error
 }
 
 type ServiceAPI interface {
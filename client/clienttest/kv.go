@@ -0,0 +1,193 @@
+// Package clienttest provides an in-memory client.ServiceAPI for tests
+package clienttest
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/voc/stream-api/client"
+)
+
+type keyValue struct {
+	key   string
+	value []byte
+}
+
+func (kv keyValue) Key() string   { return kv.key }
+func (kv keyValue) Value() []byte { return kv.value }
+
+type watcher struct {
+	prefix string
+	ch     client.UpdateChan
+}
+
+// KV is an in-memory kv store, it may be shared by multiple clients.
+// Changes are sent to all watchers of a matching prefix.
+type KV struct {
+	mutex    sync.Mutex
+	data     map[string][]byte
+	indexes  map[string]uint64 // modify index by key
+	index    uint64            // last modify index
+	watchers []watcher
+}
+
+// NewKV returns a store containing data, data may be nil
+func NewKV(data map[string][]byte) *KV {
+	if data == nil {
+		data = make(map[string][]byte)
+	}
+	f := &KV{data: data, indexes: make(map[string]uint64)}
+	for key := range data {
+		f.index++
+		f.indexes[key] = f.index
+	}
+	return f
+}
+
+func (f *KV) Watch(ctx context.Context, prefix string) (client.UpdateChan, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ch := make(client.UpdateChan, 100)
+	f.watchers = append(f.watchers, watcher{prefix: prefix, ch: ch})
+	return ch, nil
+}
+
+func (f *KV) notify(t client.UpdateType, key string, value []byte) {
+	for _, w := range f.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			w.ch <- []*client.WatchUpdate{{Type: t, KV: keyValue{key: key, value: value}}}
+		}
+	}
+}
+
+func (f *KV) Get(ctx context.Context, key string) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.data[key], nil
+}
+
+// GetWithPrefix returns the fields sorted by key like consul
+func (f *KV) GetWithPrefix(ctx context.Context, prefix string) ([]client.Field, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var fields []client.Field
+	for key, value := range f.data {
+		if strings.HasPrefix(key, prefix) {
+			fields = append(fields, client.Field{Key: []byte(key), Value: value})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return string(fields[i].Key) < string(fields[j].Key) })
+	return fields, nil
+}
+
+func (f *KV) Put(ctx context.Context, key string, value []byte) error {
+	f.Set(key, value)
+	return nil
+}
+
+func (f *KV) PutWithSession(ctx context.Context, key string, value []byte) error {
+	return f.Put(ctx, key, value)
+}
+
+func (f *KV) Delete(ctx context.Context, key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.delete(key)
+	return nil
+}
+
+func (f *KV) GetWithIndex(ctx context.Context, key string) ([]byte, uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.data[key], f.indexes[key], nil
+}
+
+func (f *KV) CompareAndSwap(ctx context.Context, key string, value []byte, index uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.indexes[key] != index {
+		return client.ErrModified
+	}
+	f.set(key, value)
+	return nil
+}
+
+func (f *KV) CompareAndDelete(ctx context.Context, key string, index uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.indexes[key] != index {
+		return client.ErrModified
+	}
+	f.delete(key)
+	return nil
+}
+
+// Set stores value at key
+func (f *KV) Set(key string, value []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.set(key, value)
+}
+
+func (f *KV) set(key string, value []byte) {
+	f.index++
+	f.data[key] = value
+	f.indexes[key] = f.index
+	f.notify(client.UpdateTypePut, key, value)
+}
+
+func (f *KV) delete(key string) {
+	if _, ok := f.data[key]; !ok {
+		return
+	}
+	delete(f.data, key)
+	delete(f.indexes, key)
+	f.notify(client.UpdateTypeDelete, key, nil)
+}
+
+// SetJSON stores v encoded as json at key
+func (f *KV) SetJSON(t *testing.T, key string, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Set(key, data)
+}
+
+// Value returns the value at key
+func (f *KV) Value(key string) ([]byte, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	value, ok := f.data[key]
+	return value, ok
+}
+
+// GetJSON decodes the value at key into v, it reports whether the key exists
+func (f *KV) GetJSON(t *testing.T, key string, v interface{}) bool {
+	t.Helper()
+	data, ok := f.Value(key)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// Keys returns all keys in order
+func (f *KV) Keys() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keys := make([]string, 0, len(f.data))
+	for key := range f.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -3,30 +3,37 @@ package client
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/api/watch"
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("client")
+
 type ConsulClient struct {
 	client     *api.Client
 	conf       config.Network
 	sessionTTL string
 	sessionId  string
+	metrics    *Metrics
+	planMutex  sync.Mutex // guards watch plan restarts
 	done       sync.WaitGroup
 }
 
-func NewConsulClient(parentContext context.Context, conf config.Network) (*ConsulClient, error) {
+func NewConsulClient(parentContext context.Context, conf config.Network, reg prometheus.Registerer) (*ConsulClient, error) {
 	client, err := api.NewClient(&api.Config{})
 	if err != nil {
 		return nil, err
 	}
-	cc := &ConsulClient{client: client, conf: conf, sessionTTL: "10s"}
+	cc := &ConsulClient{client: client, conf: conf, sessionTTL: "10s", metrics: NewMetrics(reg)}
 	err = cc.renewSession()
 	if err != nil {
 		return nil, err
@@ -52,15 +59,37 @@ func (cc *ConsulClient) renewSession() error {
 }
 
 func (cc *ConsulClient) keepaliveSession(ctx context.Context) {
+	defer cc.done.Done()
 	session := cc.client.Session()
 	for {
 		err := session.RenewPeriodic(cc.sessionTTL, cc.sessionId, nil, ctx.Done())
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
 		log.Warn().Err(err).Msg("failed to renew session")
 		time.Sleep(time.Second * 3)
-		cc.renewSession()
+		if err := cc.renewSession(); err != nil {
+			log.Error().Err(err).Msg("failed to create session")
+			continue
+		}
+		cc.metrics.sessionRenewals.Inc()
 	}
 }
 
+// Health checks the connection to the consul cluster
+func (cc *ConsulClient) Health() error {
+	leader, err := cc.client.Status().Leader()
+	if err != nil {
+		return err
+	}
+	if leader == "" {
+		return errors.New("no cluster leader")
+	}
+	return nil
+}
+
 func (cc *ConsulClient) Errors() <-chan error {
 	return make(chan error)
 }
@@ -118,22 +147,44 @@ func (cc *ConsulClient) Watch(ctx context.Context, prefix string) (UpdateChan, e
 	}
 	log.Debug().Str("prefix", prefix).Msg("watch")
 	ch := make(UpdateChan)
-	plan.HybridHandler = cc.makeWatchHandler(ch)
+	handler := cc.makeWatchHandler(ch)
+	plan.HybridHandler = handler
 
-	// run plan
+	// run plan, restart on failure
 	go func() {
-		err := plan.RunWithClientAndHclog(cc.client, nil)
-		select {
-		case <-ctx.Done():
-		default:
-			log.Error().Err(err).Msg("watch stopped")
+		for {
+			err := plan.RunWithClientAndHclog(cc.client, nil)
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			log.Error().Err(err).Str("prefix", prefix).Msg("watch stopped, reconnecting")
+			cc.metrics.watchReconnects.WithLabelValues(prefix).Inc()
+			time.Sleep(time.Second * 3)
+
+			newPlan, err := watch.Parse(query)
+			if err != nil {
+				log.Error().Err(err).Msg("watch parse")
+				continue
+			}
+			newPlan.HybridHandler = handler
+			cc.planMutex.Lock()
+			if ctx.Err() != nil {
+				cc.planMutex.Unlock()
+				return
+			}
+			plan = newPlan
+			cc.planMutex.Unlock()
 		}
 	}()
 
 	// stop plan
 	go func() {
 		<-ctx.Done()
+		cc.planMutex.Lock()
 		plan.Stop()
+		cc.planMutex.Unlock()
 	}()
 	return ch, nil
 }
@@ -169,7 +220,12 @@ func (cc *ConsulClient) makeWatchHandler(ch UpdateChan) watch.HybridHandlerFunc
 					continue
 				}
 				// add new
-				log.Debug().Msgf("watch update %s %s", pair.Key, string(pair.Value))
+				if strings.HasPrefix(pair.Key, StreamSettingsPrefix) {
+					// settings contain stream secrets
+					log.Debug().Msgf("watch update %s", pair.Key)
+				} else {
+					log.Debug().Msgf("watch update %s %s", pair.Key, string(pair.Value))
+				}
 				update = append(update, &WatchUpdate{
 					KV: &ConsulKV{kv: pair},
 				})
@@ -210,9 +266,56 @@ func (cc *ConsulClient) Get(ctx context.Context, key string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if res == nil {
+		// key does not exist
+		return nil, nil
+	}
 	return res.Value, nil
 }
 
+func (cc *ConsulClient) GetWithIndex(ctx context.Context, key string) ([]byte, uint64, error) {
+	opts, cancel := queryOptsWithTimeout(ctx, time.Second)
+	defer cancel()
+	res, _, err := cc.client.KV().Get(key, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res == nil {
+		return nil, 0, nil
+	}
+	return res.Value, res.ModifyIndex, nil
+}
+
+// kv check-and-set
+func (cc *ConsulClient) CompareAndSwap(ctx context.Context, key string, value []byte, index uint64) error {
+	p := &api.KVPair{Key: key, Value: value, ModifyIndex: index}
+	opts, cancel := writeOptsWithTimeout(ctx, time.Second)
+	defer cancel()
+	success, _, err := cc.client.KV().CAS(p, opts)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return ErrModified
+	}
+	return nil
+}
+
+// kv check-and-delete
+func (cc *ConsulClient) CompareAndDelete(ctx context.Context, key string, index uint64) error {
+	p := &api.KVPair{Key: key, ModifyIndex: index}
+	opts, cancel := writeOptsWithTimeout(ctx, time.Second)
+	defer cancel()
+	success, _, err := cc.client.KV().DeleteCAS(p, opts)
+	if err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+	if !success {
+		return ErrModified
+	}
+	return nil
+}
+
 func (cc *ConsulClient) GetWithPrefix(ctx context.Context, prefix string) ([]Field, error) {
 	opts, cancel := queryOptsWithTimeout(ctx, time.Second)
 	defer cancel()
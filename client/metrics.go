@@ -0,0 +1,29 @@
+package client
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the prometheus metrics of the backend client
+type Metrics struct {
+	sessionRenewals prometheus.Counter
+	watchReconnects *prometheus.CounterVec
+}
+
+// NewMetrics creates and registers the client metrics
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Metrics{
+		sessionRenewals: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "consul_session_renewals_total",
+			Help: "Total number of sessions created after the previous session failed to renew",
+		}),
+		watchReconnects: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "consul_watch_reconnects_total",
+			Help: "Total number of restarted watches after a watch failed",
+		}, []string{"prefix"}),
+	}
+}
@@ -1,17 +1,24 @@
 package client
 
 import (
+	"fmt"
 	"path"
 	"strings"
+	"time"
 )
 
 // prefixes
 const (
-	TranscoderPrefix     = "transcoders/"
-	SourcePrefix         = "service/source/"
-	StreamPrefix         = "stream/"
-	StreamSettingsPrefix = "streamSettings/"
-	servicePrefix        = "service/"
+	TranscoderDrainPrefix = "transcoderDrain/"
+	SourcePrefix          = "service/source/"
+	StreamPrefix          = "stream/"
+	StreamSettingsPrefix  = "streamSettings/"
+	SettingsHistoryPrefix = "streamSettingsHistory/"
+	RejectedStreamPrefix  = "rejectedStream/"
+	AlertSilencePrefix    = "alertSilences/"
+	StreamEventPrefix     = "streamEvents/"
+	UploadOriginPrefix    = "uploadOrigin/"
+	servicePrefix         = "service/"
 )
 
 // ParseServiceName parses service name from path, returns "" if path is not a service path
@@ -24,15 +31,6 @@ func ParseServiceName(path string) string {
 	return parts[2]
 }
 
-func ParseTranscoderName(path string) (string, bool) {
-	parts := strings.Split(path, "/")
-	if len(parts) != 2 {
-		return "", false
-	}
-
-	return parts[1], true
-}
-
 func ParseStreamName(path string) string {
 	parts := strings.Split(path, "/")
 	if len(parts) <= 1 {
@@ -67,6 +65,14 @@ func PathIsStreamTranscoder(path string) bool {
 	return true
 }
 
+func PathIsStreamPlacement(path string) bool {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] != "stream" || parts[2] != "placement" {
+		return false
+	}
+	return true
+}
+
 func PathIsStreamSettings(path string) bool {
 	parts := strings.Split(path, "/")
 	if len(parts) != 3 || parts[0] != "stream" || parts[2] != "settings" {
@@ -87,10 +93,48 @@ func StreamTranscoderPath(name string) string {
 	return path.Join(StreamPrefix, name, "transcoder")
 }
 
+// StreamPlacementPath returns the path of the transcoder a stream should be moved to
+func StreamPlacementPath(name string) string {
+	return path.Join(StreamPrefix, name, "placement")
+}
+
 func StreamSettingsPath(name string) string {
 	return path.Join(StreamSettingsPrefix, name)
 }
 
+// SettingsHistoryPath returns the path of a settings version, versions sort lexically
+func SettingsHistoryPath(name string, version int) string {
+	return path.Join(SettingsHistoryPrefix, name, fmt.Sprintf("%010d", version))
+}
+
+// StreamEventBucket returns the hourly bucket of events at t, buckets sort lexically
+func StreamEventBucket(t time.Time) string {
+	return t.UTC().Format("2006010215")
+}
+
+// StreamEventPath returns the path of a stream event, events of a stream sort by time
+func StreamEventPath(slug string, t time.Time, id string) string {
+	return path.Join(StreamEventPrefix, slug, StreamEventBucket(t), t.UTC().Format("20060102T150405.000000000")+"-"+id)
+}
+
+// TranscoderDrainPath returns the path marking a transcoder as drained
+func TranscoderDrainPath(name string) string {
+	return path.Join(TranscoderDrainPrefix, name)
+}
+
+// UploadOriginPath returns the path of the upload origin owning a stream
+func UploadOriginPath(slug string) string {
+	return path.Join(UploadOriginPrefix, slug)
+}
+
+func AlertSilencePath(id string) string {
+	return path.Join(AlertSilencePrefix, id)
+}
+
+func RejectedStreamPath(name string) string {
+	return path.Join(RejectedStreamPrefix, name)
+}
+
 func ServicePrefix(prefix string) string {
 	return path.Join(servicePrefix, prefix)
 }
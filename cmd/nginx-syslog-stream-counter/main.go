@@ -4,7 +4,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -14,16 +13,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/voc/stream-api/logging"
 	"github.com/voc/stream-api/logreceiver"
 	"golang.org/x/sys/unix"
 )
 
+var log = logging.Slog("stream-counter")
+
 // maxSegmentDuration is the maximum duration of a segment to expect
 const maxSegmentDuration = time.Second * 5
 
 func main() {
 	if err := run(); err != nil {
-		slog.Error("collector failed", "err", err)
+		log.Error("collector failed", "err", err)
 		os.Exit(1)
 	}
 }
@@ -32,19 +34,21 @@ func run() error {
 	slidingWindow := flag.Duration("sliding-window-duration", time.Second*30, "duration of the sliding window for the counting")
 	prometheusListen := flag.String("prometheus-listen", ":9273", "listen address of the prometheus endpoint")
 	socket := flag.String("socket", "/var/log/relay.sock", "syslog socket")
-	debug := flag.Bool("debug", false, "enable debug mode")
+	debug := flag.Bool("debug", false, "enable debug mode, short for -log-level debug")
+	var logConf logging.Config
+	logConf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
 	defer cancel()
 
-	logOpts := &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}
 	if *debug {
-		logOpts.Level = slog.LevelDebug
+		logConf.Level = "debug"
+	}
+	hostname, _ := os.Hostname()
+	if err := logging.Setup(logConf, hostname); err != nil {
+		return fmt.Errorf("logging: %w", err)
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, logOpts)))
 
 	reg := prometheus.NewPedanticRegistry()
 
@@ -76,11 +80,11 @@ func run() error {
 		return fmt.Errorf("failed to listen on %s: %w", *prometheusListen, err)
 	}
 	defer listener.Close()
-	slog.Info("serving metrics on", "addr", *prometheusListen)
+	log.Info("serving metrics on", "addr", *prometheusListen)
 
 	go func() {
 		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			slog.Error("failed to serve prometheus metrics", "err", err)
+			log.Error("failed to serve prometheus metrics", "err", err)
 			cancel()
 		}
 	}()
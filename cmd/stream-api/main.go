@@ -4,23 +4,31 @@ import (
 	// "crypto/tls"
 	"context"
 	"flag"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 
 	_ "net/http/pprof"
 
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
 
 	"github.com/Showmax/go-fqdn"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
-	"github.com/voc/stream-api/monitor"
-	"github.com/voc/stream-api/publish"
-	"github.com/voc/stream-api/transcode"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("stream-api")
+
 func handleSignal(ctx context.Context, cancel context.CancelFunc) {
 	// Set up channel on which to send signal notifications.
 	// We must use a buffered channel or risk missing the signal
@@ -61,21 +69,73 @@ type Service interface {
 	Wait()
 }
 
+// serveMetrics serves prometheus metrics and the backend health on addr
+func serveMetrics(addr string, reg *prometheus.Registry, cli *client.ConsulClient) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := cli.Health(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, err.Error())
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Str("addr", addr).Msg("failed to listen for metrics")
+		return
+	}
+	srv := &http.Server{Handler: mux}
+	log.Info().Str("addr", addr).Msg("metrics server listening")
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("metrics server failed")
+	}
+}
+
+// reportConfig prints the config problems or the effective config, it returns the exit code
+func reportConfig(cfg config.Config, err error, dump bool) int {
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "config:", line)
+		}
+		return 1
+	}
+	if !dump {
+		fmt.Println("config ok")
+		return 0
+	}
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
 func main() {
 	name := getHostname()
 	configPath := flag.String("config", "config.yml", "path to configuration file")
-	debug := flag.Bool("debug", false, "sets log level to debug")
+	debug := flag.Bool("debug", false, "sets log level to debug, short for -log-level debug")
 	profile := flag.String("profile", "", "set pprof address")
+	metricsAddr := flag.String("metrics", "localhost:9276", "Enable metrics server on this address")
 	flag.StringVar(&name, "name", name, "set network name (defaults to fqdn)")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	dumpConfig := flag.Bool("dump-config", false, "print the effective configuration with redacted secrets and exit")
+	var logConf logging.Config
+	logConf.RegisterFlags(flag.CommandLine)
 	// var action = flag.String("action", "watch", "action: (watch|write)")
 	flag.Parse()
 	exitCode := 0
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if *debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		logConf.Level = "debug"
+	}
+	if err := logging.Setup(logConf, name); err != nil {
+		fmt.Fprintln(os.Stderr, "logging:", err)
+		os.Exit(2)
 	}
 
 	if *profile != "" {
@@ -84,10 +144,19 @@ func main() {
 
 	// parse config
 	cfg, err := config.Parse(*configPath)
+	if *checkConfig || *dumpConfig {
+		os.Exit(reportConfig(cfg, err, *dumpConfig))
+	}
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Err(err).Msg("invalid config")
 	}
 
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	)
+
 	// setup etcd context
 	cliCtx, cliCancel := context.WithCancel(context.Background())
 	defer cliCancel()
@@ -95,16 +164,19 @@ func main() {
 	// connect to etcd
 	cfg.Network.Name = name
 	log.Debug().Interface("config", cfg.Network).Msgf("Creating client")
-	cli, err := client.NewConsulClient(cliCtx, cfg.Network)
+	cli, err := client.NewConsulClient(cliCtx, cfg.Network, reg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("client:")
 	}
 
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr, reg, cli)
+	}
+
 	// setup service context
 	ctx, cancel := context.WithCancel(context.Background())
 	handleSignal(ctx, cancel)
 	defer cancel()
-	var services []Service
 
 	// shutdown app on etcd client errors
 	go func() {
@@ -120,22 +192,13 @@ func main() {
 		}
 	}()
 
-	// setup monitor
-	if cfg.Monitor.Enable {
-		log.Debug().Msgf("Creating monitor %v", cfg.Monitor)
-		services = append(services, monitor.New(ctx, cfg.Monitor, cli))
-	}
-
-	// setup publisher
-	if cfg.Publisher.Enable {
-		log.Debug().Msgf("Creating publisher %v", cfg.Publisher)
-		services = append(services, publish.New(ctx, &cfg.Publisher, cli, name))
-	}
+	// stream lifecycle events
+	events := eventlog.New(ctx, cfg.Events, cli, name, reg)
 
-	// setup transcoder
-	if cfg.Transcode.Enable {
-		log.Debug().Msgf("Creating transcoder %v", cfg.Transcode)
-		services = append(services, transcode.New(ctx, cfg.Transcode, cli, name))
+	// setup monitor, publisher, ingest auth and transcoder
+	n := newNode(name, cfg, cli, reg, events)
+	if err := n.start(ctx); err != nil {
+		log.Fatal().Err(err).Msg("start")
 	}
 
 	// // setup fanout
@@ -144,11 +207,26 @@ func main() {
 	// 	services = append(services, fanout.New(ctx, cfg.Fanout, cli, name))
 	// }
 
-	// Wait for graceful shutdown
-	<-ctx.Done()
-	for _, service := range services {
-		service.Wait()
+	// apply config changes on SIGHUP until shutdown
+	signalReload := make(chan os.Signal, 1)
+	signal.Notify(signalReload, syscall.SIGHUP)
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-signalReload:
+			log.Info().Msg("reloading config")
+			next, err := config.Parse(*configPath)
+			if err != nil {
+				log.Error().Err(err).Msg("reload: invalid config, keeping the current config")
+				continue
+			}
+			n.reload(ctx, next)
+		}
 	}
+
+	// Wait for graceful shutdown
+	n.wait()
+	events.Wait()
 	cliCancel()
 	log.Debug().Msgf("exitcode: %d", exitCode)
 	os.Exit(exitCode)
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/voc/stream-api/auth"
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/monitor"
+	"github.com/voc/stream-api/publish"
+	"github.com/voc/stream-api/transcode"
+)
+
+// registry tracks the collectors registered by a subsystem, so they can be unregistered when it stops
+type registry struct {
+	prometheus.Registerer
+	mutex      sync.Mutex
+	collectors []prometheus.Collector
+}
+
+func (r *registry) Register(c prometheus.Collector) error {
+	if err := r.Registerer.Register(c); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *registry) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *registry) unregister() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range r.collectors {
+		r.Registerer.Unregister(c)
+	}
+	r.collectors = nil
+}
+
+// subsystem describes how a service is started and reloaded
+type subsystem struct {
+	name    string
+	enabled func(cfg *config.Config) bool
+	// creates the service from cfg
+	create func(ctx context.Context, n *node, cfg *config.Config, reg prometheus.Registerer) (Service, error)
+	// applies a changed config in place, services without reload are restarted if restart reports a change
+	reload  func(service Service, cfg *config.Config)
+	restart func(old *config.Config, cfg *config.Config) bool
+}
+
+var subsystems = []subsystem{
+	{
+		name:    "monitor",
+		enabled: func(cfg *config.Config) bool { return cfg.Monitor.Enable },
+		create: func(ctx context.Context, n *node, cfg *config.Config, reg prometheus.Registerer) (Service, error) {
+			return monitor.New(ctx, cfg.Monitor, cfg.Auth.Tokens, n.api, reg)
+		},
+		restart: func(old *config.Config, cfg *config.Config) bool {
+			return !reflect.DeepEqual(old.Monitor, cfg.Monitor) || !reflect.DeepEqual(old.Auth.Tokens, cfg.Auth.Tokens)
+		},
+	},
+	{
+		name:    "publisher",
+		enabled: func(cfg *config.Config) bool { return cfg.Publisher.Enable },
+		create: func(ctx context.Context, n *node, cfg *config.Config, reg prometheus.Registerer) (Service, error) {
+			conf := cfg.Publisher
+			return publish.New(ctx, &conf, n.api, n.name, reg, n.events), nil
+		},
+		reload: func(service Service, cfg *config.Config) {
+			conf := cfg.Publisher
+			service.(*publish.Publisher).Reload(&conf)
+		},
+	},
+	{
+		name:    "auth",
+		enabled: func(cfg *config.Config) bool { return cfg.Auth.Enable },
+		create: func(ctx context.Context, n *node, cfg *config.Config, reg prometheus.Registerer) (Service, error) {
+			return auth.New(ctx, n.api, n.name, cfg.Auth, n.events)
+		},
+		restart: func(old *config.Config, cfg *config.Config) bool {
+			return !reflect.DeepEqual(old.Auth, cfg.Auth)
+		},
+	},
+	{
+		name:    "transcoder",
+		enabled: func(cfg *config.Config) bool { return cfg.Transcode.Enable },
+		create: func(ctx context.Context, n *node, cfg *config.Config, reg prometheus.Registerer) (Service, error) {
+			return transcode.New(ctx, cfg.Transcode, n.api, n.name, reg, n.events), nil
+		},
+		reload: func(service Service, cfg *config.Config) {
+			service.(*transcode.Transcoder).Reload(cfg.Transcode)
+		},
+	},
+}
+
+// running is a started subsystem
+type running struct {
+	cancel  context.CancelFunc
+	service Service
+	reg     *registry
+	cfg     config.Config // config the service was created or last reloaded with
+}
+
+func (r *running) stop() {
+	r.cancel()
+	r.service.Wait()
+	r.reg.unregister()
+}
+
+// node runs the enabled subsystems and applies config changes
+type node struct {
+	name    string
+	cfg     config.Config
+	api     client.ServiceAPI
+	reg     prometheus.Registerer
+	events  *eventlog.Log
+	running map[string]*running
+}
+
+func newNode(name string, cfg config.Config, api client.ServiceAPI, reg prometheus.Registerer, events *eventlog.Log) *node {
+	return &node{name: name, cfg: cfg, api: api, reg: reg, events: events, running: make(map[string]*running)}
+}
+
+// start starts the enabled subsystems
+func (n *node) start(ctx context.Context) error {
+	for _, sub := range subsystems {
+		if !sub.enabled(&n.cfg) {
+			continue
+		}
+		if err := n.startSubsystem(ctx, sub, n.cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *node) startSubsystem(ctx context.Context, sub subsystem, cfg config.Config) error {
+	log.Debug().Msgf("Creating %s", sub.name)
+	ctx, cancel := context.WithCancel(ctx)
+	reg := &registry{Registerer: n.reg}
+	service, err := sub.create(ctx, n, &cfg, reg)
+	if err != nil {
+		cancel()
+		reg.unregister()
+		return fmt.Errorf("%s: %w", sub.name, err)
+	}
+	n.running[sub.name] = &running{cancel: cancel, service: service, reg: reg, cfg: cfg}
+	return nil
+}
+
+func (n *node) stopSubsystem(sub subsystem) {
+	n.running[sub.name].stop()
+	delete(n.running, sub.name)
+}
+
+// reload applies cfg, subsystems are started, stopped, reloaded or restarted as needed
+func (n *node) reload(ctx context.Context, cfg config.Config) {
+	cfg.Network.Name = n.name
+	if !reflect.DeepEqual(cfg.Network, n.cfg.Network) || !reflect.DeepEqual(cfg.Events, n.cfg.Events) {
+		log.Warn().Msg("reload: network and events changes require a restart")
+		cfg.Network = n.cfg.Network
+		cfg.Events = n.cfg.Events
+	}
+	n.cfg = cfg
+
+	for _, sub := range subsystems {
+		r := n.running[sub.name]
+		switch {
+		case !sub.enabled(&cfg):
+			if r != nil {
+				log.Info().Msgf("reload: stopping %s", sub.name)
+				n.stopSubsystem(sub)
+			}
+		case r == nil:
+			log.Info().Msgf("reload: starting %s", sub.name)
+			if err := n.startSubsystem(ctx, sub, cfg); err != nil {
+				log.Error().Err(err).Msg("reload: start failed")
+			}
+		case sub.reload != nil:
+			sub.reload(r.service, &cfg)
+			r.cfg = cfg
+		case sub.restart(&r.cfg, &cfg):
+			log.Info().Msgf("reload: restarting %s", sub.name)
+			n.restartSubsystem(ctx, sub, cfg)
+		}
+	}
+}
+
+// restartSubsystem restarts a subsystem with cfg, it is started with its previous config again if that fails.
+// The old service is stopped first, as both may listen on the same address.
+func (n *node) restartSubsystem(ctx context.Context, sub subsystem, cfg config.Config) {
+	previous := n.running[sub.name].cfg
+	n.stopSubsystem(sub)
+	err := n.startSubsystem(ctx, sub, cfg)
+	if err == nil {
+		return
+	}
+	log.Error().Err(err).Msg("reload: restart failed, keeping the previous config")
+	if err := n.startSubsystem(ctx, sub, previous); err != nil {
+		log.Error().Err(err).Msgf("reload: %s stopped", sub.name)
+	}
+}
+
+// wait waits until all subsystems stopped after the node context is done
+func (n *node) wait() {
+	for _, sub := range subsystems {
+		if r := n.running[sub.name]; r != nil {
+			r.service.Wait()
+		}
+	}
+}
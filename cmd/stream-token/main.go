@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/voc/stream-api/auth/token"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	configPath := flag.String("config", "config.yml", "path to stream-api configuration file")
+	slug := flag.String("slug", "", "stream slug the token is valid for")
+	ingestType := flag.String("ingest", "stream", "ingest type/application the token is valid for")
+	ttl := flag.Duration("ttl", time.Hour*6, "token lifetime")
+	genkey := flag.Bool("genkey", false, "generate a new Ed25519 key pair instead of a token")
+	hash := flag.Bool("hash", false, "hash a password read from stdin, e.g. for monitor users")
+	flag.Parse()
+
+	if *hash {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		hashed, err := stream.HashSecret(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			return err
+		}
+		fmt.Println(hashed)
+		return nil
+	}
+
+	if *genkey {
+		private, public, err := token.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("privateKey: %s\npublicKey: %s\n", private, public)
+		return nil
+	}
+
+	if *slug == "" {
+		return fmt.Errorf("missing -slug")
+	}
+	cfg, err := config.Parse(*configPath)
+	if err != nil {
+		return err
+	}
+	tokens, err := token.NewKeyring(cfg.Auth.Tokens)
+	if err != nil {
+		return err
+	}
+	if tokens == nil {
+		return fmt.Errorf("no token keys configured in %s", *configPath)
+	}
+	if maxTTL := tokens.MaxTTL(); maxTTL > 0 && *ttl > maxTTL {
+		return fmt.Errorf("ttl exceeds maximum of %s", maxTTL)
+	}
+
+	claims, err := token.NewClaims(*slug, *ingestType, time.Now(), *ttl)
+	if err != nil {
+		return err
+	}
+	signed, err := tokens.Sign(claims)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/monitor"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/transcode"
+)
+
+// streamInfo is a stream joined with its claim
+type streamInfo struct {
+	stream.Stream
+	Transcoder string `json:"transcoder,omitempty"`
+}
+
+// claimInfo is the transcoder claim of a stream
+type claimInfo struct {
+	Slug       string `json:"slug"`
+	Transcoder string `json:"transcoder,omitempty"`
+	MovingTo   string `json:"movingTo,omitempty"` // target of a pending move
+}
+
+// listStreams returns the streams and claims sorted by slug
+func (c *ctl) listStreams(ctx context.Context) ([]streamInfo, []claimInfo, error) {
+	fields, err := c.api.GetWithPrefix(ctx, client.StreamPrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get failed: %w", err)
+	}
+	var streams []stream.Stream
+	claims := make(map[string]*claimInfo)
+	claim := func(slug string) *claimInfo {
+		if claims[slug] == nil {
+			claims[slug] = &claimInfo{Slug: slug}
+		}
+		return claims[slug]
+	}
+	for _, field := range fields {
+		path := string(field.Key)
+		slug := client.ParseStreamName(path)
+		switch {
+		case client.PathIsStream(path):
+			var s stream.Stream
+			if err := json.Unmarshal(field.Value, &s); err != nil {
+				return nil, nil, fmt.Errorf("invalid stream %s: %w", slug, err)
+			}
+			streams = append(streams, s)
+		case client.PathIsStreamTranscoder(path):
+			claim(slug).Transcoder = string(field.Value)
+		case client.PathIsStreamPlacement(path):
+			claim(slug).MovingTo = string(field.Value)
+		}
+	}
+
+	infos := []streamInfo{}
+	for _, s := range streams {
+		info := streamInfo{Stream: s}
+		if claims[s.Slug] != nil {
+			info.Transcoder = claims[s.Slug].Transcoder
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Slug < infos[j].Slug })
+	list := []claimInfo{}
+	for _, claim := range claims {
+		list = append(list, *claim)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Slug < list[j].Slug })
+	return infos, list, nil
+}
+
+func (c *ctl) streams(ctx context.Context) error {
+	streams, _, err := c.listStreams(ctx)
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"SLUG", "FORMAT", "SOURCE", "HEALTH", "TRANSCODER"}}
+	for _, s := range streams {
+		health := "-"
+		if s.Health != nil {
+			health = string(s.Health.Status)
+		}
+		rows = append(rows, []string{s.Slug, s.Format, s.Source, health, orDash(s.Transcoder)})
+	}
+	return c.print(streams, rows)
+}
+
+// listTranscoders returns the announced transcoders sorted by name, drained transcoders are marked as draining
+func (c *ctl) listTranscoders(ctx context.Context) ([]transcode.TranscoderStatus, error) {
+	prefix := client.ServicePrefix("transcode") + "/"
+	fields, err := c.api.GetWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+	drains, err := c.api.GetWithPrefix(ctx, client.TranscoderDrainPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+	drained := make(map[string]bool)
+	for _, field := range drains {
+		drained[strings.TrimPrefix(string(field.Key), client.TranscoderDrainPrefix)] = true
+	}
+
+	transcoders := []transcode.TranscoderStatus{}
+	for _, field := range fields {
+		var status transcode.TranscoderStatus
+		if err := json.Unmarshal(field.Value, &status); err != nil {
+			return nil, fmt.Errorf("invalid transcoder %s: %w", strings.TrimPrefix(string(field.Key), prefix), err)
+		}
+		status.Draining = status.Draining || drained[status.Name]
+		transcoders = append(transcoders, status)
+	}
+	sort.Slice(transcoders, func(i, j int) bool { return transcoders[i].Name < transcoders[j].Name })
+	return transcoders, nil
+}
+
+func (c *ctl) transcoders(ctx context.Context) error {
+	transcoders, err := c.listTranscoders(ctx)
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"NAME", "STREAMS", "CAPACITY", "DRAINING"}}
+	for _, t := range transcoders {
+		rows = append(rows, []string{t.Name, fmt.Sprint(t.NumStreams), fmt.Sprint(t.Capacity), fmt.Sprint(t.Draining)})
+	}
+	return c.print(transcoders, rows)
+}
+
+func (c *ctl) claims(ctx context.Context) error {
+	_, claims, err := c.listStreams(ctx)
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"SLUG", "TRANSCODER", "MOVING TO"}}
+	for _, claim := range claims {
+		rows = append(rows, []string{claim.Slug, orDash(claim.Transcoder), orDash(claim.MovingTo)})
+	}
+	return c.print(claims, rows)
+}
+
+// getSettings prints the redacted settings of slug, settings are always printed as json
+func (c *ctl) getSettings(ctx context.Context, slug string) error {
+	data, err := c.api.Get(ctx, client.StreamSettingsPath(slug))
+	if err != nil {
+		return fmt.Errorf("get failed: %w", err)
+	}
+	if data == nil {
+		return fmt.Errorf("no settings for %s", slug)
+	}
+	var settings stream.Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("unmarshal failed: %w", err)
+	}
+	return c.printJSON(settings.Redacted())
+}
+
+// setSettings stores settings read from in, redacted keys keep their stored hash
+func (c *ctl) setSettings(ctx context.Context, slug string, in io.Reader) error {
+	var settings stream.Settings
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&settings); err != nil {
+		return fmt.Errorf("invalid settings: %w", err)
+	}
+	stored, err := monitor.SetSettings(ctx, c.api, slug, &settings, author())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "stored settings of %s as version %d\n", slug, stored.Version)
+	return nil
+}
+
+func (c *ctl) deleteSettings(ctx context.Context, slug string) error {
+	if _, err := monitor.SetSettings(ctx, c.api, slug, nil, author()); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "deleted settings of %s\n", slug)
+	return nil
+}
+
+// release deletes the transcoder claim of slug, which makes the transcoders claim it again
+func (c *ctl) release(ctx context.Context, slug string) error {
+	owner, index, err := c.api.GetWithIndex(ctx, client.StreamTranscoderPath(slug))
+	if err != nil {
+		return fmt.Errorf("get failed: %w", err)
+	}
+	if owner == nil {
+		return fmt.Errorf("stream %s is not claimed", slug)
+	}
+	// a claim made in the meantime is kept
+	err = c.api.CompareAndDelete(ctx, client.StreamTranscoderPath(slug), index)
+	if errors.Is(err, client.ErrModified) {
+		return fmt.Errorf("claim of %s changed, try again", slug)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "released claim of %s by %s\n", slug, owner)
+	return nil
+}
+
+// move makes target the only transcoder to claim slug and releases the current claim
+func (c *ctl) move(ctx context.Context, slug string, target string) error {
+	data, err := c.api.Get(ctx, client.StreamPath(slug))
+	if err != nil {
+		return fmt.Errorf("get failed: %w", err)
+	}
+	if data == nil {
+		return fmt.Errorf("stream %s does not exist", slug)
+	}
+	transcoders, err := c.listTranscoders(ctx)
+	if err != nil {
+		return err
+	}
+	var found *transcode.TranscoderStatus
+	for i := range transcoders {
+		if transcoders[i].Name == target {
+			found = &transcoders[i]
+		}
+	}
+	switch {
+	case found == nil:
+		return fmt.Errorf("transcoder %s is not announced", target)
+	case found.Draining:
+		return fmt.Errorf("transcoder %s is draining", target)
+	case found.Capacity > 0 && found.NumStreams >= found.Capacity:
+		return fmt.Errorf("transcoder %s is at full capacity", target)
+	}
+
+	owner, index, err := c.api.GetWithIndex(ctx, client.StreamTranscoderPath(slug))
+	if err != nil {
+		return fmt.Errorf("get failed: %w", err)
+	}
+	if string(owner) == target {
+		return fmt.Errorf("stream %s is already claimed by %s", slug, target)
+	}
+	// the target removes the placement after claiming the stream
+	if err := c.api.Put(ctx, client.StreamPlacementPath(slug), []byte(target)); err != nil {
+		return fmt.Errorf("put failed: %w", err)
+	}
+	if owner != nil {
+		err := c.api.CompareAndDelete(ctx, client.StreamTranscoderPath(slug), index)
+		if errors.Is(err, client.ErrModified) {
+			// keep the new claim and let the other transcoders claim the stream again
+			if err := c.api.Delete(ctx, client.StreamPlacementPath(slug)); err != nil {
+				return err
+			}
+			return fmt.Errorf("claim of %s changed, try again", slug)
+		} else if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(c.out, "moving %s from %s to %s\n", slug, orDash(string(owner)), target)
+	return nil
+}
+
+// drain marks a transcoder as drained, drained transcoders release their streams and claim no new ones
+func (c *ctl) drain(ctx context.Context, name string, drain bool) error {
+	if !drain {
+		if err := c.api.Delete(ctx, client.TranscoderDrainPath(name)); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%s claims streams again\n", name)
+		return nil
+	}
+	value := []byte(time.Now().UTC().Format(time.RFC3339) + " " + author())
+	if err := c.api.Put(ctx, client.TranscoderDrainPath(name), value); err != nil {
+		return fmt.Errorf("put failed: %w", err)
+	}
+	_, claims, err := c.listStreams(ctx)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, claim := range claims {
+		if claim.Transcoder == name {
+			n++
+		}
+	}
+	fmt.Fprintf(c.out, "draining %s, releasing %d streams\n", name, n)
+	return nil
+}
+
+// events prints the events of a stream and optionally follows new events
+func (c *ctl) events(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	since := flags.Duration("since", 0, "only print events of the last duration")
+	types := flags.String("type", "", "comma separated event types to print")
+	limit := flags.Int("n", 50, "number of events to print, 0 for all")
+	follow := flags.Bool("f", false, "keep printing new events")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: events [flags] <slug>")
+	}
+	slug := flags.Arg(0)
+
+	q := eventlog.Query{Limit: *limit}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	if *types != "" {
+		q.Types = strings.Split(*types, ",")
+	}
+	events, err := eventlog.List(ctx, c.api, slug, q)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		c.printEvent(e)
+	}
+	if !*follow {
+		return nil
+	}
+
+	last := q.Since
+	if len(events) > 0 {
+		last = events[len(events)-1].Time
+	}
+	updates, err := c.api.Watch(ctx, client.StreamEventPrefix+slug+"/")
+	if err != nil {
+		return fmt.Errorf("watch failed: %w", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case batch, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("watch closed")
+			}
+			var next []eventlog.Event
+			for _, update := range batch {
+				if update.Type != client.UpdateTypePut || update.KV == nil {
+					continue
+				}
+				var e eventlog.Event
+				if err := json.Unmarshal(update.KV.Value(), &e); err != nil {
+					continue
+				}
+				if e.Time.After(last) && (len(q.Types) == 0 || contains(q.Types, e.Type)) {
+					next = append(next, e)
+				}
+			}
+			sort.Slice(next, func(i, j int) bool { return next[i].Time.Before(next[j].Time) })
+			for _, e := range next {
+				c.printEvent(e)
+				last = e.Time
+			}
+		}
+	}
+}
+
+// printEvent prints an event as a single line or json object
+func (c *ctl) printEvent(e eventlog.Event) {
+	if c.json {
+		data, _ := json.Marshal(e)
+		fmt.Fprintln(c.out, string(data))
+		return
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	line := fmt.Sprintf("%s %-15s %-10s %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Type, e.Module, e.Source)
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=%s", key, e.Fields[key])
+	}
+	if e.Message != "" {
+		line += " " + e.Message
+	}
+	fmt.Fprintln(c.out, line)
+}
+
+// author returns the name recorded for changes made with streamctl
+func author() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	return "streamctl:" + user
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
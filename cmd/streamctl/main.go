@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/logging"
+)
+
+const usage = `usage: streamctl [-o table|json] <command> [arguments]
+
+Inspect and operate the stream-api cluster via Consul, the agent address is
+taken from the CONSUL_HTTP_ADDR environment variable.
+
+commands:
+  streams                         list streams with their transcoder
+  transcoders                     list transcoders with their load
+  claims                          list transcoder claims
+  settings get <slug>             print the stored settings of a stream
+  settings set <slug> [file]      store settings read from file or stdin
+  settings delete <slug>          delete the settings of a stream
+  release <slug>                  release the transcoder claim of a stream
+  move <slug> <transcoder>        move a stream to another transcoder
+  drain <transcoder>              release all streams of a transcoder
+  undrain <transcoder>            let a drained transcoder claim streams again
+  events [flags] <slug>           print the lifecycle events of a stream
+
+flags:
+`
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	output := flag.String("o", "table", "output format: table or json")
+	// only report client errors
+	logConf := logging.Config{Level: "warn"}
+	logConf.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("invalid output format %q", *output)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if err := logging.Setup(logConf, hostname); err != nil {
+		return fmt.Errorf("logging: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	cli, err := client.NewConsulClient(ctx, config.Network{Name: "streamctl@" + hostname}, prometheus.NewRegistry())
+	if err != nil {
+		return fmt.Errorf("failed to connect to consul: %w", err)
+	}
+	defer cli.Close()
+
+	c := &ctl{api: cli, out: os.Stdout, in: os.Stdin, json: *output == "json"}
+	return c.run(ctx, flag.Args())
+}
+
+// ctl runs the streamctl commands against the cluster
+type ctl struct {
+	api  client.ServiceAPI
+	out  io.Writer
+	in   io.Reader
+	json bool // print json instead of tables
+}
+
+func (c *ctl) run(ctx context.Context, args []string) error {
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "streams":
+		return c.streams(ctx)
+	case "transcoders":
+		return c.transcoders(ctx)
+	case "claims":
+		return c.claims(ctx)
+	case "settings":
+		if len(args) == 0 {
+			return fmt.Errorf("missing settings command")
+		}
+		switch args[0] {
+		case "get":
+			return withSlug(args[1:], func(slug string) error { return c.getSettings(ctx, slug) })
+		case "set":
+			if len(args) < 2 || len(args) > 3 {
+				return fmt.Errorf("usage: settings set <slug> [file]")
+			}
+			in := c.in
+			if len(args) == 3 && args[2] != "-" {
+				f, err := os.Open(args[2])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			return c.setSettings(ctx, args[1], in)
+		case "delete":
+			return withSlug(args[1:], func(slug string) error { return c.deleteSettings(ctx, slug) })
+		}
+		return fmt.Errorf("unknown settings command %q", args[0])
+	case "release":
+		return withSlug(args, func(slug string) error { return c.release(ctx, slug) })
+	case "move":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: move <slug> <transcoder>")
+		}
+		return c.move(ctx, args[0], args[1])
+	case "drain":
+		return withSlug(args, func(name string) error { return c.drain(ctx, name, true) })
+	case "undrain":
+		return withSlug(args, func(name string) error { return c.drain(ctx, name, false) })
+	case "events":
+		return c.events(ctx, args)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// withSlug calls fn with the single argument of a command
+func withSlug(args []string, fn func(string) error) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	return fn(args[0])
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/transcode"
+)
+
+func newTestCtl(t *testing.T) (*ctl, *clienttest.KV, *bytes.Buffer) {
+	kv := clienttest.NewKV(nil)
+	kv.SetJSON(t, client.StreamPath("s1"), stream.Stream{Slug: "s1", Format: "matroska", Source: "srt://a"})
+	kv.SetJSON(t, client.StreamPath("s2"), stream.Stream{Slug: "s2", Format: "flv", Source: "rtmp://b"})
+	kv.Set(client.StreamTranscoderPath("s1"), []byte("t1"))
+	kv.SetJSON(t, client.ServicePath("transcode", "t1"), transcode.TranscoderStatus{Name: "t1", Capacity: 2, NumStreams: 1})
+	kv.SetJSON(t, client.ServicePath("transcode", "t2"), transcode.TranscoderStatus{Name: "t2", Capacity: 2})
+	out := &bytes.Buffer{}
+	return &ctl{api: kv, out: out}, kv, out
+}
+
+func TestList(t *testing.T) {
+	c, _, out := newTestCtl(t)
+	ctx := context.Background()
+
+	assert.NilError(t, c.run(ctx, []string{"streams"}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, len(lines), 3)
+	assert.Assert(t, strings.HasPrefix(lines[1], "s1"))
+	assert.Assert(t, strings.HasSuffix(lines[1], "t1"))
+	assert.Assert(t, strings.HasSuffix(lines[2], "-"))
+
+	out.Reset()
+	c.json = true
+	assert.NilError(t, c.run(ctx, []string{"transcoders"}))
+	var transcoders []transcode.TranscoderStatus
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &transcoders))
+	assert.Equal(t, len(transcoders), 2)
+	assert.Equal(t, transcoders[1].Name, "t2")
+
+	assert.ErrorContains(t, c.run(ctx, []string{"unknown"}), "unknown command")
+}
+
+func TestMove(t *testing.T) {
+	c, kv, _ := newTestCtl(t)
+	ctx := context.Background()
+
+	assert.ErrorContains(t, c.run(ctx, []string{"move", "s1", "t3"}), "not announced")
+	assert.ErrorContains(t, c.run(ctx, []string{"move", "s1", "t1"}), "already claimed")
+	assert.NilError(t, c.run(ctx, []string{"move", "s1", "t2"}))
+	placement, _ := kv.Value(client.StreamPlacementPath("s1"))
+	assert.Equal(t, string(placement), "t2")
+	_, claimed := kv.Value(client.StreamTranscoderPath("s1"))
+	assert.Assert(t, !claimed)
+
+	// drained transcoders are no move targets
+	assert.NilError(t, c.run(ctx, []string{"drain", "t2"}))
+	assert.ErrorContains(t, c.run(ctx, []string{"move", "s2", "t2"}), "draining")
+	assert.NilError(t, c.run(ctx, []string{"undrain", "t2"}))
+	assert.NilError(t, c.run(ctx, []string{"move", "s2", "t2"}))
+}
+
+// claimingKV claims a stream for another transcoder right after the claim was read
+type claimingKV struct {
+	*clienttest.KV
+	slug  string
+	owner string
+}
+
+func (k *claimingKV) GetWithIndex(ctx context.Context, key string) ([]byte, uint64, error) {
+	value, index, err := k.KV.GetWithIndex(ctx, key)
+	if key == client.StreamTranscoderPath(k.slug) {
+		k.Set(key, []byte(k.owner))
+	}
+	return value, index, err
+}
+
+func TestConcurrentClaim(t *testing.T) {
+	c, kv, _ := newTestCtl(t)
+	c.api = &claimingKV{KV: kv, slug: "s1", owner: "t3"}
+	ctx := context.Background()
+
+	assert.ErrorContains(t, c.run(ctx, []string{"release", "s1"}), "claim of s1 changed")
+	assert.ErrorContains(t, c.run(ctx, []string{"move", "s1", "t2"}), "claim of s1 changed")
+	owner, _ := kv.Value(client.StreamTranscoderPath("s1"))
+	assert.Equal(t, string(owner), "t3")
+	_, placed := kv.Value(client.StreamPlacementPath("s1"))
+	assert.Assert(t, !placed)
+}
+
+func TestSettings(t *testing.T) {
+	c, kv, out := newTestCtl(t)
+	ctx := context.Background()
+
+	c.in = strings.NewReader(`{"slug":"s1","ingestType":"stream","secret":"password"}`)
+	assert.NilError(t, c.run(ctx, []string{"settings", "set", "s1"}))
+	var stored stream.Settings
+	assert.Assert(t, kv.GetJSON(t, client.StreamSettingsPath("s1"), &stored))
+	assert.Equal(t, stored.Version, 1)
+	assert.Equal(t, stored.Secret, "")
+	assert.Equal(t, len(stored.Keys), 1)
+
+	// printed settings are redacted
+	out.Reset()
+	assert.NilError(t, c.run(ctx, []string{"settings", "get", "s1"}))
+	assert.Assert(t, !strings.Contains(out.String(), stored.Keys[0].Hash))
+
+	assert.NilError(t, c.run(ctx, []string{"settings", "delete", "s1"}))
+	assert.ErrorContains(t, c.run(ctx, []string{"settings", "get", "s1"}), "no settings")
+}
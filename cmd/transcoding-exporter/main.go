@@ -4,7 +4,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -15,30 +14,36 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sys/unix"
+
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Slog("transcoding-exporter")
+
 func main() {
 	if err := run(); err != nil {
-		slog.Error("exporter failed", "err", err)
+		log.Error("exporter failed", "err", err)
 		os.Exit(1)
 	}
 }
 
 func run() error {
 	metricsListen := flag.String("listen", "localhost:9274", "listen address for prometheus metrics and FFmpeg progress endpoint")
-	debug := flag.Bool("debug", false, "enable debug logging")
+	debug := flag.Bool("debug", false, "enable debug logging, short for -log-level debug")
+	var logConf logging.Config
+	logConf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
 	defer cancel()
 
-	logOpts := &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}
 	if *debug {
-		logOpts.Level = slog.LevelDebug
+		logConf.Level = "debug"
+	}
+	hostname, _ := os.Hostname()
+	if err := logging.Setup(logConf, hostname); err != nil {
+		return fmt.Errorf("logging: %w", err)
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, logOpts)))
 
 	reg := prometheus.NewPedanticRegistry()
 	reg.MustRegister(
@@ -56,32 +61,32 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", *metricsListen, err)
 	}
-	slog.Info("listening on address", "addr", listener.Addr())
+	log.Info("listening on address", "addr", listener.Addr())
 	defer listener.Close()
 
 	server := &http.Server{
 		Handler: mux,
 	}
 
-	slog.Info("serving metrics and progress endpoint", "addr", *metricsListen)
+	log.Info("serving metrics and progress endpoint", "addr", *metricsListen)
 
 	// Run HTTP server in background
 	go func() {
 		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			slog.Error("metrics server error", "err", err)
+			log.Error("metrics server error", "err", err)
 			cancel()
 		}
 	}()
 
 	// Wait for shutdown signal
 	<-ctx.Done()
-	slog.Info("shutdown signal received")
+	log.Info("shutdown signal received")
 
 	// Graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
 	defer shutdownCancel()
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		slog.Error("error during shutdown", "err", err)
+		log.Error("error during shutdown", "err", err)
 		return err
 	}
 	return nil
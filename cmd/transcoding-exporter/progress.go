@@ -3,7 +3,6 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -37,7 +36,7 @@ func NewProgressHandler(metrics *Metrics) *ProgressHandler {
 func (h *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		slog.Warn("invalid method for progress handler", "method", r.Method)
+		log.Warn("invalid method for progress handler", "method", r.Method)
 		return
 	}
 
@@ -45,13 +44,13 @@ func (h *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/progress/"), "/")
 	if len(pathParts) == 0 || pathParts[0] == "" {
 		http.Error(w, "stream_id required in path", http.StatusBadRequest)
-		slog.Warn("progress request missing stream_id", "path", r.URL.Path)
+		log.Warn("progress request missing stream_id", "path", r.URL.Path)
 		return
 	}
 
 	streamID := pathParts[0]
 	remoteAddr := r.RemoteAddr
-	slog.Info("progress request received", "stream_id", streamID, "remote_addr", remoteAddr)
+	log.Info("progress request received", "stream_id", streamID, "remote_addr", remoteAddr)
 
 	// Parse progress data from request body
 	scanner := bufio.NewScanner(r.Body)
@@ -66,7 +65,7 @@ func (h *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if line == "" {
 			continue
 		}
-		slog.Debug("progress line", "stream_id", streamID, "text", line)
+		log.Debug("progress line", "stream_id", streamID, "text", line)
 
 		// Parse key=value pairs
 		parts := strings.SplitN(line, "=", 2)
@@ -87,7 +86,7 @@ func (h *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		slog.Warn("error reading progress data", "stream_id", streamID, "err", err)
+		log.Warn("error reading progress data", "stream_id", streamID, "err", err)
 		http.Error(w, "error reading body", http.StatusBadRequest)
 		return
 	}
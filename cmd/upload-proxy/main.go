@@ -8,25 +8,30 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("upload-proxy")
+
 func main() {
 	conf := Config{}
 	configPath := flag.String("config", "config.toml", "Set path to proxy config")
 	authConfigPath := flag.String("auth-config", "", "Set path to separate auth config (optional)")
-	debug := flag.Bool("debug", false, "sets log level to debug")
+	debug := flag.Bool("debug", false, "sets log level to debug, short for -log-level debug")
 	flag.StringVar(&conf.ListenAddress, "addr", ":8080", "Set listen address")
+	var logConf logging.Config
+	logConf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if *debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		logConf.Level = "debug"
+	}
+	hostname, _ := os.Hostname()
+	if err := logging.Setup(logConf, hostname); err != nil {
+		fmt.Fprintln(os.Stderr, "logging:", err)
+		os.Exit(2)
 	}
 
 	if err := conf.Load(*configPath, *authConfigPath); err != nil {
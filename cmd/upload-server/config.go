@@ -5,14 +5,22 @@ import (
 	"time"
 
 	"github.com/pelletier/go-toml"
-	"github.com/rs/zerolog/log"
 
+	"github.com/voc/stream-api/config"
 	"github.com/voc/stream-api/upload"
 )
 
 type Config struct {
-	Server upload.ServerConfig
-	Auth   upload.AuthConfig
+	Server  upload.ServerConfig
+	Auth    upload.AuthConfig
+	Events  config.EventsConfig
+	Cluster ClusterConfig
+}
+
+// ClusterConfig coordinates upload-servers behind the same proxy
+type ClusterConfig struct {
+	// enforce stream origin exclusivity across all upload-servers via consul
+	Enable bool
 }
 
 func defaultConfig() Config {
@@ -26,6 +34,10 @@ func defaultConfig() Config {
 			StreamOriginDuration: time.Second * 6,
 			PlaylistSize:         10,
 		},
+		Events: config.EventsConfig{
+			Retention: time.Hour * 24 * 7,
+			MaxEvents: 500,
+		},
 	}
 }
 
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/upload"
+)
+
+// connect connects to consul if events or the cluster are enabled, it returns nil otherwise
+func connect(ctx context.Context, conf Config, name string, reg prometheus.Registerer) client.ServiceAPI {
+	if !conf.Events.Enable && !conf.Cluster.Enable {
+		return nil
+	}
+	if name == "" {
+		log.Fatal().Msg("hostname unknown")
+	}
+	cli, err := client.NewConsulClient(ctx, config.Network{Name: name}, reg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to consul")
+	}
+	return cli
+}
+
+// newOriginRegistry returns the cluster-wide stream origins, it returns nil if the cluster is disabled
+func newOriginRegistry(ctx context.Context, conf Config, api client.ServiceAPI, name string) *upload.OriginRegistry {
+	if !conf.Cluster.Enable {
+		return nil
+	}
+	origins, err := upload.NewOriginRegistry(ctx, api, name, conf.Server.StreamOriginDuration)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load stream origins")
+	}
+	return origins
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
@@ -11,26 +12,32 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
 	"github.com/voc/stream-api/upload"
 	"github.com/voc/stream-api/util"
 )
 
+var log = logging.Module("upload-server")
+
 func main() {
 	config := defaultConfig()
 	configPath := flag.String("config", "config.toml", "Set path to auth config")
-	debug := flag.Bool("debug", false, "sets log level to debug")
+	debug := flag.Bool("debug", false, "sets log level to debug, short for -log-level debug")
 	metricsAddr := flag.String("metrics", "localhost:9275", "Enable metrics server on this address")
 	flag.StringVar(&config.Server.Addr, "addr", config.Server.Addr, "Set listen address")
 	flag.StringVar(&config.Server.OutputPath, "path", config.Server.OutputPath, "Set upload storage path")
+	var logConf logging.Config
+	logConf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if *debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		logConf.Level = "debug"
+	}
+	hostname, _ := os.Hostname()
+	if err := logging.Setup(logConf, hostname); err != nil {
+		fmt.Fprintln(os.Stderr, "logging:", err)
+		os.Exit(2)
 	}
 
 	err := parseConfig(*configPath, &config)
@@ -62,14 +69,20 @@ func main() {
 		}()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api := connect(ctx, config, hostname, config.Server.Registerer)
+	events := eventlog.New(ctx, config.Events, api, hostname, config.Server.Registerer)
+	config.Server.Events = events
+	origins := newOriginRegistry(ctx, config, api, hostname)
+	config.Server.Origins = origins
+
 	auth := upload.NewStaticAuth(config.Auth)
 	server, err := upload.NewServer(auth, config.Server)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	go func() {
 		select {
 		case <-ctx.Done():
@@ -81,5 +94,8 @@ func main() {
 
 	util.GracefulShutdown(ctx, func() {
 		server.Stop()
+		cancel()
+		events.Wait()
+		origins.Wait()
 	}, time.Second*2)
 }
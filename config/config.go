@@ -1,12 +1,17 @@
 package config
 
 import (
+	"errors"
+	"net/url"
 	"os"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// RedactedValue replaces secrets in redacted configs
+const RedactedValue = "<redacted>"
+
 type TLSConfig struct {
 	CertFile      string `yaml:"certFile"`
 	KeyFile       string `yaml:"keyFile"`
@@ -20,15 +25,30 @@ type Network struct {
 }
 
 type SourceConfig struct {
-	Type string `yaml:"type"`
-	URL  string `yaml:"url"`
+	Type     string `yaml:"type"`
+	URL      string `yaml:"url"`
+	Priority int    `yaml:"priority"` // higher priority sources win slug conflicts
+}
+
+type ProbeConfig struct {
+	Enable     bool          `yaml:"enable"`
+	Duration   time.Duration `yaml:"duration"`   // how long to read from a source
+	Timeout    time.Duration `yaml:"timeout"`    // connection timeout in addition to duration
+	Interval   time.Duration `yaml:"interval"`   // how often to re-probe a published stream
+	MinBitrate int           `yaml:"minBitrate"` // minimum bitrate in bits per second, 0 disables the check
 }
 
 type PublisherConfig struct {
-	Enable   bool           `yaml:"enable"`
-	Sources  []SourceConfig `yaml:"sources"`
-	Interval time.Duration  `yaml:"interval"`
-	Timeout  time.Duration  `yaml:"timeout"`
+	Enable      bool           `yaml:"enable"`
+	Sources     []SourceConfig `yaml:"sources"`
+	Interval    time.Duration  `yaml:"interval"`
+	Timeout     time.Duration  `yaml:"timeout"`
+	KeepBackups bool           `yaml:"keepBackups"` // publish conflicting sources as backups
+	Probe       ProbeConfig    `yaml:"probe"`
+
+	// only publish streams with stream settings or matching one of the allowlist wildcards
+	RequireSettings bool     `yaml:"requireSettings"`
+	Allowlist       []string `yaml:"allowlist"`
 }
 
 type TranscodeConfig struct {
@@ -47,11 +67,137 @@ type FanoutConfig struct {
 type MonitorConfig struct {
 	Enable  bool   `yaml:"enable"`
 	Address string `yaml:"address"`
+
+	// audit listeners of the auth servers to query for the publish audit log, e.g. http://ingest1:8082
+	AuditSources []string `yaml:"auditSources"`
+	AuditToken   string   `yaml:"auditToken"` // bearer token of the audit listeners
+
+	// number of settings versions kept per stream
+	SettingsHistory int `yaml:"settingsHistory"`
+
+	Auth   MonitorAuthConfig   `yaml:"auth"`
+	Scrape MonitorScrapeConfig `yaml:"scrape"`
+	Alerts MonitorAlertsConfig `yaml:"alerts"`
+}
+
+// MonitorAlertsConfig configures the alert rules evaluated by the monitor
+type MonitorAlertsConfig struct {
+	Interval time.Duration `yaml:"interval"` // how often the rules are evaluated
+
+	Unclaimed         time.Duration `yaml:"unclaimed"`         // time a published stream may stay unclaimed
+	TranscoderMissing time.Duration `yaml:"transcoderMissing"` // time a claiming transcoder may not report
+	FlapCount         int           `yaml:"flapCount"`         // claim changes of a stream within flapWindow considered flapping
+	FlapWindow        time.Duration `yaml:"flapWindow"`
+	ScheduleGrace     time.Duration `yaml:"scheduleGrace"` // time after the scheduled start until a stream has to be live
+
+	// urls receiving firing and resolved alerts as JSON POST
+	Webhooks []string `yaml:"webhooks"`
+}
+
+// MonitorScrapeConfig configures the exporters scraped for the stream status
+type MonitorScrapeConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// upload-server metrics urls, e.g. http://upload1:9275/metrics
+	Upload []string `yaml:"upload"`
+	// nginx-syslog-stream-counter metrics urls, e.g. http://relay1:9273/metrics
+	Viewers []string `yaml:"viewers"`
+}
+
+// MonitorAuthConfig configures authentication of monitor users
+type MonitorAuthConfig struct {
+	// one of none, static, proxy or oidc
+	Mode string `yaml:"mode"`
+
+	// role for authenticated users without a mapped role, empty denies access.
+	// With mode none the role of everyone, viewer if empty
+	DefaultRole string `yaml:"defaultRole"`
+	// maps user or group names to roles (viewer, operator, admin) for proxy and oidc
+	Roles map[string]string `yaml:"roles"`
+
+	Users []MonitorUserConfig `yaml:"users"`
+	Proxy MonitorProxyConfig  `yaml:"proxy"`
+	OIDC  MonitorOIDCConfig   `yaml:"oidc"`
+
+	// origins allowed to open the websocket in addition to the monitor itself
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+}
+
+// MonitorUserConfig is a static user authenticated via http basic auth
+type MonitorUserConfig struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"` // hash as produced by stream-token -hash
+	Role     string `yaml:"role"`
+}
+
+// MonitorProxyConfig trusts user headers set by a reverse proxy
+type MonitorProxyConfig struct {
+	TrustedProxies []string `yaml:"trustedProxies"` // CIDRs
+	UserHeader     string   `yaml:"userHeader"`
+	GroupsHeader   string   `yaml:"groupsHeader"` // comma separated groups
+}
+
+// MonitorOIDCConfig authenticates users with an OpenID Connect provider
+type MonitorOIDCConfig struct {
+	Issuer        string        `yaml:"issuer"`
+	ClientID      string        `yaml:"clientID"`
+	ClientSecret  string        `yaml:"clientSecret"`
+	RedirectURL   string        `yaml:"redirectURL"`   // public url of /auth/callback
+	GroupsClaim   string        `yaml:"groupsClaim"`   // id token claim holding the groups
+	SessionSecret string        `yaml:"sessionSecret"` // signs session cookies, random if empty
+	SessionTTL    time.Duration `yaml:"sessionTTL"`
 }
 
 type AuthConfig struct {
 	Enable  bool   `yaml:"enable"`
 	Address string `yaml:"address"`
+
+	// window around the stream schedule in which scheduled keys are valid
+	ScheduleLead  time.Duration `yaml:"scheduleLead"`
+	ScheduleGrace time.Duration `yaml:"scheduleGrace"`
+
+	// signed publish tokens, also used by the monitor to mint tokens
+	Tokens TokenConfig `yaml:"tokens"`
+
+	// audit log of publish attempts, disabled if empty
+	AuditLog      string `yaml:"auditLog"`
+	AuditMaxSize  int64  `yaml:"auditMaxSize"`  // size in bytes before the log is rotated
+	AuditMaxFiles int    `yaml:"auditMaxFiles"` // number of rotated logs to keep
+
+	// separate listener serving the audit log to the monitor, disabled if empty
+	AuditAddress string `yaml:"auditAddress"`
+	AuditToken   string `yaml:"auditToken"` // bearer token required by the audit listener
+
+	Lockout LockoutConfig `yaml:"lockout"`
+}
+
+// LockoutConfig limits failed publish attempts, a limit of 0 disables the lockout
+type LockoutConfig struct {
+	MaxFailuresPerAddr int           `yaml:"maxFailuresPerAddr"`
+	MaxFailuresPerSlug int           `yaml:"maxFailuresPerSlug"` // only logged, slugs are never locked out
+	Window             time.Duration `yaml:"window"`             // failures are counted within this window
+	Duration           time.Duration `yaml:"duration"`           // how long to lock out after reaching the limit
+}
+
+type TokenConfig struct {
+	Keys   []TokenKeyConfig `yaml:"keys"`
+	MaxTTL time.Duration    `yaml:"maxTTL"` // maximum lifetime of minted tokens
+}
+
+type TokenKeyConfig struct {
+	ID         string `yaml:"id"`
+	Algorithm  string `yaml:"algorithm"`  // HS256 or EdDSA
+	Secret     string `yaml:"secret"`     // HS256 shared secret
+	PublicKey  string `yaml:"publicKey"`  // EdDSA base64 public key
+	PrivateKey string `yaml:"privateKey"` // EdDSA base64 private key seed, only needed to mint tokens
+}
+
+// EventsConfig configures the stream lifecycle event log in the KV store
+type EventsConfig struct {
+	Enable    bool          `yaml:"enable"`
+	Retention time.Duration `yaml:"retention"` // how long events are kept
+	MaxEvents int           `yaml:"maxEvents"` // events kept per stream
 }
 
 type Config struct {
@@ -60,24 +206,130 @@ type Config struct {
 	Transcode TranscodeConfig
 	Fanout    FanoutConfig
 	Monitor   MonitorConfig
+	Auth      AuthConfig
+	Events    EventsConfig
 }
 
-// Parse parses the config from a yaml file at path
-func Parse(path string) (Config, error) {
-	// default config
-	cfg := Config{
+// Defaults returns the config used for unset fields
+func Defaults() Config {
+	return Config{
+		Events: EventsConfig{
+			Enable:    true,
+			Retention: time.Hour * 24 * 7,
+			MaxEvents: 500,
+		},
+		Monitor: MonitorConfig{
+			SettingsHistory: 100,
+			Scrape: MonitorScrapeConfig{
+				Interval: time.Second * 15,
+				Timeout:  time.Second * 5,
+			},
+			Alerts: MonitorAlertsConfig{
+				Interval:          time.Second * 10,
+				Unclaimed:         time.Second * 30,
+				TranscoderMissing: time.Second * 30,
+				FlapCount:         4,
+				FlapWindow:        time.Minute * 10,
+				ScheduleGrace:     time.Minute * 2,
+			},
+			Auth: MonitorAuthConfig{
+				Mode: "none",
+				Proxy: MonitorProxyConfig{
+					UserHeader: "X-Forwarded-User",
+				},
+				OIDC: MonitorOIDCConfig{
+					GroupsClaim: "groups",
+					SessionTTL:  time.Hour * 12,
+				},
+			},
+		},
 		Publisher: PublisherConfig{
 			Interval: time.Second * 3,
 			Timeout:  time.Second * 15,
+			Probe: ProbeConfig{
+				Duration: time.Second * 3,
+				Timeout:  time.Second * 5,
+				Interval: time.Minute,
+			},
+		},
+		Auth: AuthConfig{
+			ScheduleLead:  time.Minute * 30,
+			ScheduleGrace: time.Minute * 30,
+			Tokens: TokenConfig{
+				MaxTTL: time.Hour * 24,
+			},
+			AuditMaxSize:  10 * 1024 * 1024,
+			AuditMaxFiles: 5,
+			Lockout: LockoutConfig{
+				MaxFailuresPerAddr: 10,
+				MaxFailuresPerSlug: 50,
+				Window:             time.Minute * 5,
+				Duration:           time.Minute * 15,
+			},
 		},
 	}
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return cfg, err
+}
+
+// Parse parses the config from a yaml file at path on top of the defaults, applies the environment overrides
+// and validates the result. Unknown keys are rejected, an empty path only uses the defaults and the environment.
+func Parse(path string) (Config, error) {
+	cfg := Defaults()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, err
+		}
 	}
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
+	if errs := applyEnv(&cfg, environ()); len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
 		return cfg, err
 	}
 	return cfg, nil
 }
+
+// Redacted returns a copy of the config safe for printing
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = RedactedValue
+		}
+	}
+	redact(&c.Monitor.Auth.OIDC.ClientSecret)
+	redact(&c.Monitor.Auth.OIDC.SessionSecret)
+	redact(&c.Monitor.AuditToken)
+	redact(&c.Auth.AuditToken)
+	users := make([]MonitorUserConfig, len(c.Monitor.Auth.Users))
+	for i, user := range c.Monitor.Auth.Users {
+		redact(&user.Password)
+		users[i] = user
+	}
+	c.Monitor.Auth.Users = users
+	keys := make([]TokenKeyConfig, len(c.Auth.Tokens.Keys))
+	for i, key := range c.Auth.Tokens.Keys {
+		redact(&key.Secret)
+		redact(&key.PrivateKey)
+		keys[i] = key
+	}
+	c.Auth.Tokens.Keys = keys
+	// webhook urls usually contain a token in the path, query or userinfo
+	webhooks := make([]string, len(c.Monitor.Alerts.Webhooks))
+	for i, webhook := range c.Monitor.Alerts.Webhooks {
+		webhooks[i] = redactURL(webhook)
+	}
+	c.Monitor.Alerts.Webhooks = webhooks
+	return c
+}
+
+// redactURL keeps only the scheme and host of a url
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return RedactedValue
+	}
+	return u.Scheme + "://" + u.Host + "/" + RedactedValue
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding config fields
+const EnvPrefix = "STREAM_API_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// environ returns the environment variables with EnvPrefix
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, EnvPrefix) {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// applyEnv overrides the fields of cfg with the environment variables named after their yaml path,
+// e.g. STREAM_API_PUBLISHER_PROBE_MIN_BITRATE sets publisher.probe.minBitrate.
+// Elements of lists are addressed by index, e.g. STREAM_API_PUBLISHER_SOURCES_0_URL,
+// lists of strings are comma separated and maps are comma separated key=value pairs.
+func applyEnv(cfg *Config, env map[string]string) []error {
+	return setEnv(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvPrefix, "_"), env)
+}
+
+func setEnv(v reflect.Value, name string, env map[string]string) []error {
+	switch {
+	case v.Kind() == reflect.Struct:
+		var errs []error
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			tag := yamlName(field)
+			if tag == "-" {
+				continue
+			}
+			errs = append(errs, setEnv(v.Field(i), name+"_"+envName(tag), env)...)
+		}
+		return errs
+
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		if v.IsNil() {
+			if !hasEnvPrefix(env, name+"_") {
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setEnv(v.Elem(), name, env)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		var errs []error
+		for i := 0; ; i++ {
+			elem := fmt.Sprintf("%s_%d", name, i)
+			if i >= v.Len() {
+				if !hasEnvPrefix(env, elem+"_") {
+					break
+				}
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			errs = append(errs, setEnv(v.Index(i), elem, env)...)
+		}
+		return errs
+	}
+
+	value, ok := env[name]
+	if !ok {
+		return nil
+	}
+	if err := setValue(v, value); err != nil {
+		return []error{fmt.Errorf("%s: %w", name, err)}
+	}
+	return nil
+}
+
+// setValue parses value into a field
+func setValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean '%s'", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", value)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range splitList(value) {
+			list = reflect.Append(list, reflect.ValueOf(item))
+		}
+		v.Set(list)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitList(value) {
+			key, val, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("invalid map entry '%s', expected key=value", item)
+			}
+			m.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(val))
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// yamlName returns the key of a field as decoded by yaml
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// envName converts a camel case yaml key to upper snake case, e.g. trustedCaFile to TRUSTED_CA_FILE
+func envName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower && unicode.IsUpper(runes[i-1]) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for key := range env {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, ignoring empty items
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// problems collects validation errors prefixed with the yaml path of the field
+type problems []error
+
+func (p *problems) add(field string, format string, args ...interface{}) {
+	*p = append(*p, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (p *problems) positive(field string, value int64) {
+	if value <= 0 {
+		p.add(field, "must be positive")
+	}
+}
+
+func (p *problems) notNegative(field string, value int64) {
+	if value < 0 {
+		p.add(field, "must not be negative")
+	}
+}
+
+func (p *problems) required(field string, value string) {
+	if value == "" {
+		p.add(field, "is required")
+	}
+}
+
+func (p *problems) oneOf(field string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	p.add(field, "unknown value '%s', expected one of %v", value, allowed)
+}
+
+func (p *problems) url(field string, value string) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		p.add(field, "invalid url '%s'", value)
+	}
+}
+
+// Validate checks the config for consistency, it reports all problems at once.
+// Sections which are not enabled are not checked.
+func (c *Config) Validate() error {
+	var p problems
+	if c.Publisher.Enable {
+		c.Publisher.validate(&p)
+	}
+	if c.Transcode.Enable {
+		p.notNegative("transcode.capacity", int64(c.Transcode.Capacity))
+		p.required("transcode.configPath", c.Transcode.ConfigPath)
+	}
+	if c.Fanout.Enable {
+		p.required("fanout.configPath", c.Fanout.ConfigPath)
+	}
+	if c.Monitor.Enable {
+		c.Monitor.validate(&p)
+	}
+	if c.Auth.Enable {
+		c.Auth.validate(&p)
+	}
+	if c.Events.Enable {
+		p.positive("events.retention", int64(c.Events.Retention))
+		p.notNegative("events.maxEvents", int64(c.Events.MaxEvents))
+	}
+	return errors.Join(p...)
+}
+
+func (c *PublisherConfig) validate(p *problems) {
+	p.positive("publisher.interval", int64(c.Interval))
+	// streams expire after timeout/interval missed scrapes
+	if c.Interval > 0 && c.Timeout < c.Interval {
+		p.add("publisher.timeout", "must be at least the interval of %s", c.Interval)
+	}
+	for i, source := range c.Sources {
+		field := fmt.Sprintf("publisher.sources[%d]", i)
+		p.oneOf(field+".type", source.Type, "icecast", "srtrelay")
+		p.url(field+".url", source.URL)
+	}
+	if c.Probe.Enable {
+		p.positive("publisher.probe.duration", int64(c.Probe.Duration))
+		p.positive("publisher.probe.timeout", int64(c.Probe.Timeout))
+		p.positive("publisher.probe.interval", int64(c.Probe.Interval))
+		p.notNegative("publisher.probe.minBitrate", int64(c.Probe.MinBitrate))
+	}
+}
+
+func (c *MonitorConfig) validate(p *problems) {
+	p.notNegative("monitor.settingsHistory", int64(c.SettingsHistory))
+	for i, source := range c.AuditSources {
+		p.url(fmt.Sprintf("monitor.auditSources[%d]", i), source)
+	}
+	if len(c.AuditSources) > 0 {
+		p.required("monitor.auditToken", c.AuditToken)
+	}
+
+	auth := c.Auth
+	p.oneOf("monitor.auth.mode", auth.Mode, "", "none", "static", "proxy", "oidc")
+	roles := []string{"viewer", "operator", "admin"}
+	if auth.DefaultRole != "" {
+		p.oneOf("monitor.auth.defaultRole", auth.DefaultRole, roles...)
+	}
+	for name, role := range auth.Roles {
+		p.oneOf("monitor.auth.roles."+name, role, roles...)
+	}
+	switch auth.Mode {
+	case "static":
+		if len(auth.Users) == 0 {
+			p.add("monitor.auth.users", "static auth requires users")
+		}
+		for i, user := range auth.Users {
+			field := fmt.Sprintf("monitor.auth.users[%d]", i)
+			p.required(field+".name", user.Name)
+			p.required(field+".password", user.Password)
+			if user.Role != "" {
+				p.oneOf(field+".role", user.Role, roles...)
+			}
+		}
+	case "proxy":
+		p.required("monitor.auth.proxy.userHeader", auth.Proxy.UserHeader)
+		if len(auth.Proxy.TrustedProxies) == 0 {
+			p.add("monitor.auth.proxy.trustedProxies", "proxy auth requires trusted proxies")
+		}
+		for i, cidr := range auth.Proxy.TrustedProxies {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				p.add(fmt.Sprintf("monitor.auth.proxy.trustedProxies[%d]", i), "invalid cidr '%s'", cidr)
+			}
+		}
+	case "oidc":
+		p.url("monitor.auth.oidc.issuer", auth.OIDC.Issuer)
+		p.required("monitor.auth.oidc.clientID", auth.OIDC.ClientID)
+		p.url("monitor.auth.oidc.redirectURL", auth.OIDC.RedirectURL)
+		p.positive("monitor.auth.oidc.sessionTTL", int64(auth.OIDC.SessionTTL))
+	}
+
+	if len(c.Scrape.Upload) > 0 || len(c.Scrape.Viewers) > 0 {
+		p.positive("monitor.scrape.interval", int64(c.Scrape.Interval))
+		p.positive("monitor.scrape.timeout", int64(c.Scrape.Timeout))
+	}
+	for i, target := range c.Scrape.Upload {
+		p.url(fmt.Sprintf("monitor.scrape.upload[%d]", i), target)
+	}
+	for i, target := range c.Scrape.Viewers {
+		p.url(fmt.Sprintf("monitor.scrape.viewers[%d]", i), target)
+	}
+
+	// an interval of 0 disables the alerts
+	if c.Alerts.Interval > 0 {
+		p.notNegative("monitor.alerts.unclaimed", int64(c.Alerts.Unclaimed))
+		p.notNegative("monitor.alerts.transcoderMissing", int64(c.Alerts.TranscoderMissing))
+		p.notNegative("monitor.alerts.flapCount", int64(c.Alerts.FlapCount))
+		if c.Alerts.FlapCount > 0 {
+			p.positive("monitor.alerts.flapWindow", int64(c.Alerts.FlapWindow))
+		}
+		p.notNegative("monitor.alerts.scheduleGrace", int64(c.Alerts.ScheduleGrace))
+		for i, webhook := range c.Alerts.Webhooks {
+			p.url(fmt.Sprintf("monitor.alerts.webhooks[%d]", i), webhook)
+		}
+	}
+}
+
+func (c *AuthConfig) validate(p *problems) {
+	p.notNegative("auth.scheduleLead", int64(c.ScheduleLead))
+	p.notNegative("auth.scheduleGrace", int64(c.ScheduleGrace))
+	p.notNegative("auth.tokens.maxTTL", int64(c.Tokens.MaxTTL))
+
+	ids := make(map[string]bool)
+	for i, key := range c.Tokens.Keys {
+		field := fmt.Sprintf("auth.tokens.keys[%d]", i)
+		if key.ID == "" {
+			p.add(field+".id", "is required")
+		} else if ids[key.ID] {
+			p.add(field+".id", "duplicate key id '%s'", key.ID)
+		}
+		ids[key.ID] = true
+		p.oneOf(field+".algorithm", key.Algorithm, "HS256", "EdDSA")
+		switch key.Algorithm {
+		case "HS256":
+			p.required(field+".secret", key.Secret)
+		case "EdDSA":
+			if key.PublicKey == "" && key.PrivateKey == "" {
+				p.add(field, "requires a publicKey or privateKey")
+			}
+		}
+	}
+
+	if c.AuditLog != "" {
+		p.notNegative("auth.auditMaxSize", c.AuditMaxSize)
+		p.notNegative("auth.auditMaxFiles", int64(c.AuditMaxFiles))
+	}
+	if c.AuditAddress != "" {
+		p.required("auth.auditLog", c.AuditLog)
+		p.required("auth.auditToken", c.AuditToken)
+	}
+	lockout := c.Lockout
+	p.notNegative("auth.lockout.maxFailuresPerAddr", int64(lockout.MaxFailuresPerAddr))
+	p.notNegative("auth.lockout.maxFailuresPerSlug", int64(lockout.MaxFailuresPerSlug))
+	if lockout.MaxFailuresPerAddr > 0 || lockout.MaxFailuresPerSlug > 0 {
+		p.positive("auth.lockout.window", int64(lockout.Window))
+		p.positive("auth.lockout.duration", int64(lockout.Duration))
+	}
+}
@@ -0,0 +1,242 @@
+// Package eventlog records the lifecycle events of streams in the KV store
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/logging"
+)
+
+var log = logging.Module("eventlog")
+
+// event types
+const (
+	Registered     = "registered"     // publisher registered the stream
+	Failover       = "failover"       // publisher switched the stream source
+	Rejected       = "rejected"       // publisher refused to register the stream
+	Unhealthy      = "unhealthy"      // publisher probe found no usable media
+	Expired        = "expired"        // publisher removed the stream after its sources stopped announcing it
+	Claimed        = "claimed"        // transcoder claimed the stream
+	Restarted      = "restarted"      // transcoder restarted the stream after a change
+	Stopped        = "stopped"        // transcoder stopped transcoding the stream
+	Released       = "released"       // transcoder released its claim
+	PublishAllowed = "publishAllowed" // auth accepted a publish request
+	PublishDenied  = "publishDenied"  // auth rejected a publish request
+	UploadStarted  = "uploadStarted"  // upload server received the first upload
+	OriginChanged  = "originChanged"  // upload server accepted uploads from a new origin
+	UploadExpired  = "uploadExpired"  // upload server removed the stream after the last upload timed out
+)
+
+const (
+	queueSize     = 256
+	writeTimeout  = 2 * time.Second
+	pruneInterval = 10 * time.Minute
+)
+
+// Event is a lifecycle event of a stream
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Slug    string            `json:"slug"`
+	Module  string            `json:"module"` // publisher, transcoder, auth or upload
+	Source  string            `json:"source"` // name of the recording instance
+	Type    string            `json:"type"`
+	Message string            `json:"message,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Log writes events to the KV store in the background,
+// a nil Log discards all events
+type Log struct {
+	api       client.KVAPI
+	name      string
+	retention time.Duration
+	maxEvents int
+	queue     chan Event
+	metrics   *Metrics
+	done      sync.WaitGroup
+
+	// last prune by slug, only accessed by run
+	pruned map[string]time.Time
+}
+
+// New creates an event log writing as name, it returns nil if the log is disabled
+func New(ctx context.Context, conf config.EventsConfig, api client.KVAPI, name string, reg prometheus.Registerer) *Log {
+	if !conf.Enable {
+		return nil
+	}
+	l := &Log{
+		api:       api,
+		name:      name,
+		retention: conf.Retention,
+		maxEvents: conf.MaxEvents,
+		queue:     make(chan Event, queueSize),
+		metrics:   NewMetrics(reg),
+		pruned:    make(map[string]time.Time),
+	}
+	l.done.Add(1)
+	go l.run(ctx)
+	return l
+}
+
+// Wait waits until the queued events are written
+func (l *Log) Wait() {
+	if l == nil {
+		return
+	}
+	l.done.Wait()
+}
+
+// Append queues an event without blocking, time and source are set by the log
+func (l *Log) Append(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Source = l.name
+	select {
+	case l.queue <- e:
+	default:
+		l.metrics.dropped.Inc()
+	}
+}
+
+func (l *Log) run(ctx context.Context) {
+	defer l.done.Done()
+	for {
+		select {
+		case e := <-l.queue:
+			l.write(e)
+		case <-ctx.Done():
+			// write what was queued before shutdown
+			for {
+				select {
+				case e := <-l.queue:
+					l.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Log) write(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msg("eventlog: marshal")
+		return
+	}
+	key := client.StreamEventPath(e.Slug, e.Time, e.Module+"-"+e.Source)
+	if err := l.api.Put(ctx, key, data); err != nil {
+		log.Error().Err(err).Str("slug", e.Slug).Msg("eventlog: write")
+		l.metrics.writeErrors.Inc()
+		return
+	}
+	l.metrics.appended.WithLabelValues(e.Module, e.Type).Inc()
+
+	if time.Since(l.pruned[e.Slug]) < pruneInterval {
+		return
+	}
+	l.pruned[e.Slug] = time.Now()
+	n, err := prune(ctx, l.api, e.Slug, time.Now().Add(-l.retention), l.maxEvents)
+	if err != nil {
+		log.Error().Err(err).Str("slug", e.Slug).Msg("eventlog: prune")
+	}
+	l.metrics.pruned.Add(float64(n))
+}
+
+// prune deletes the events of a stream in buckets before cutoff and the oldest events exceeding max
+func prune(ctx context.Context, api client.KVAPI, slug string, cutoff time.Time, max int) (int, error) {
+	prefix := client.StreamEventPrefix + slug + "/"
+	fields, err := api.GetWithPrefix(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, string(field.Key))
+	}
+	sort.Strings(keys)
+
+	oldest := client.StreamEventBucket(cutoff)
+	var expired []string
+	for i, key := range keys {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		if bucket >= oldest && (max <= 0 || len(keys)-i <= max) {
+			break
+		}
+		expired = append(expired, key)
+	}
+	for i, key := range expired {
+		if err := api.Delete(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// Query selects events of a stream
+type Query struct {
+	Since time.Time // only events after since
+	Types []string  // only events of these types, empty for all
+	Limit int       // only the newest events, 0 for all
+}
+
+// List returns the events of a stream matching q in chronological order
+func List(ctx context.Context, api client.KVAPI, slug string, q Query) ([]Event, error) {
+	prefix := client.StreamEventPrefix + slug + "/"
+	fields, err := api.GetWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+	since := ""
+	if !q.Since.IsZero() {
+		since = prefix + client.StreamEventBucket(q.Since)
+	}
+	sort.Slice(fields, func(i, j int) bool { return string(fields[i].Key) < string(fields[j].Key) })
+
+	events := []Event{}
+	for _, field := range fields {
+		// skip whole buckets before since
+		if string(field.Key) < since {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(field.Value, &e); err != nil {
+			log.Error().Err(err).Str("key", string(field.Key)).Msg("eventlog: unmarshal")
+			continue
+		}
+		if !e.Time.After(q.Since) || !matchType(q.Types, e.Type) {
+			continue
+		}
+		events = append(events, e)
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+func matchType(types []string, t string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package eventlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/config"
+)
+
+// putEvent stores e like Append
+func putEvent(t *testing.T, kv *clienttest.KV, e Event) {
+	kv.SetJSON(t, client.StreamEventPath(e.Slug, e.Time, e.Module+"-"+e.Source), e)
+}
+
+func TestAppend(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	l := New(ctx, config.EventsConfig{Enable: true, Retention: time.Hour, MaxEvents: 10}, kv, "host1", prometheus.NewRegistry())
+	l.Append(Event{Slug: "s1", Module: "publisher", Type: Registered})
+	l.Append(Event{Slug: "s1", Module: "transcoder", Type: Claimed, Fields: map[string]string{"source": "srt://a"}})
+	cancel()
+	l.Wait()
+
+	events, err := List(context.Background(), kv, "s1", Query{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Type, Registered)
+	assert.Equal(t, events[0].Source, "host1")
+	assert.Equal(t, events[1].Fields["source"], "srt://a")
+
+	// disabled logs discard events
+	var disabled *Log
+	disabled.Append(Event{Slug: "s1"})
+	disabled.Wait()
+}
+
+func TestPrune(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	now := time.Date(2024, 12, 27, 12, 30, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		putEvent(t, kv, Event{Time: now.Add(-time.Duration(i) * time.Hour), Slug: "s1", Module: "publisher", Source: "host1", Type: Registered})
+	}
+	putEvent(t, kv, Event{Time: now.Add(-10 * time.Hour), Slug: "s2", Module: "publisher", Source: "host1", Type: Registered})
+
+	// buckets older than the cutoff are removed
+	n, err := prune(context.Background(), kv, "s1", now.Add(-2*time.Hour), 0)
+	assert.NilError(t, err)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, len(kv.Keys()), 4)
+
+	// the oldest events beyond the limit are removed
+	n, err = prune(context.Background(), kv, "s1", now.Add(-24*time.Hour), 2)
+	assert.NilError(t, err)
+	assert.Equal(t, n, 1)
+	events, err := List(context.Background(), kv, "s1", Query{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Assert(t, events[0].Time.Equal(now.Add(-time.Hour)))
+}
+
+func TestList(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	now := time.Date(2024, 12, 27, 12, 30, 0, 0, time.UTC)
+	types := []string{Registered, Claimed, Stopped, Released, Expired}
+	for i, typ := range types {
+		putEvent(t, kv, Event{Time: now.Add(time.Duration(i) * 20 * time.Minute), Slug: "s1", Module: "m", Source: "host1", Type: typ})
+	}
+
+	events, err := List(context.Background(), kv, "s1", Query{Since: now.Add(30 * time.Minute)})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 3)
+	assert.Equal(t, events[0].Type, Stopped)
+
+	events, err = List(context.Background(), kv, "s1", Query{Types: []string{Claimed, Released}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[1].Type, Released)
+
+	events, err = List(context.Background(), kv, "s1", Query{Limit: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[1].Type, Expired)
+
+	events, err = List(context.Background(), kv, "s2", Query{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 0)
+}
@@ -0,0 +1,39 @@
+package eventlog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the prometheus metrics of the event log
+type Metrics struct {
+	appended    *prometheus.CounterVec
+	dropped     prometheus.Counter
+	writeErrors prometheus.Counter
+	pruned      prometheus.Counter
+}
+
+// NewMetrics creates and registers the event log metrics
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Metrics{
+		appended: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "eventlog_events_total",
+			Help: "Total number of stream lifecycle events written",
+		}, []string{"module", "type"}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "eventlog_dropped_total",
+			Help: "Total number of events dropped because the write queue was full",
+		}),
+		writeErrors: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "eventlog_write_errors_total",
+			Help: "Total number of events which couldn't be written",
+		}),
+		pruned: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "eventlog_pruned_total",
+			Help: "Total number of events deleted because of the retention limits",
+		}),
+	}
+}
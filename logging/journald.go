@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends entries to journald using its native protocol,
+// fields become journal fields, e.g. slug is stored as SLUG
+type journalWriter struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+func newJournalWriter(socket string) (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("journald: %w", err)
+	}
+	return &journalWriter{conn: conn, identifier: filepath.Base(os.Args[0])}, nil
+}
+
+// priorities by zerolog level, see syslog(3)
+var journalPriorities = map[zerolog.Level]int{
+	zerolog.TraceLevel: 7,
+	zerolog.DebugLevel: 7,
+	zerolog.InfoLevel:  6,
+	zerolog.WarnLevel:  4,
+	zerolog.ErrorLevel: 3,
+	zerolog.FatalLevel: 2,
+	zerolog.PanicLevel: 0,
+	zerolog.NoLevel:    6,
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *journalWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	msg, err := journalEntry(w.identifier, level, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.conn.Write(msg); err != nil {
+		// keep the entry if journald is unavailable or the entry too large for a datagram
+		os.Stderr.Write(p)
+		return len(p), nil
+	}
+	return len(p), nil
+}
+
+// journalEntry converts a json log entry to the native journal format
+func journalEntry(identifier string, level zerolog.Level, p []byte) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return nil, fmt.Errorf("journald: %w", err)
+	}
+	var buf bytes.Buffer
+	priority, ok := journalPriorities[level]
+	if !ok {
+		priority = 6
+	}
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(priority))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", identifier)
+	if msg, ok := fields[zerolog.MessageFieldName].(string); ok {
+		writeJournalField(&buf, "MESSAGE", msg)
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		switch key {
+		case zerolog.MessageFieldName, zerolog.LevelFieldName, zerolog.TimestampFieldName:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := fields[key].(string)
+		if !ok {
+			data, _ := json.Marshal(fields[key])
+			value = string(data)
+		}
+		writeJournalField(&buf, journalFieldName(key), value)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJournalField appends a field, values with newlines use the binary format
+func writeJournalField(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts a field name to a valid journal field name
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	// fields must not start with an underscore or digit
+	if name == "" || name[0] == '_' || name[0] >= '0' && name[0] <= '9' {
+		name = "F" + name
+	}
+	return name
+}
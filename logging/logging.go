@@ -0,0 +1,180 @@
+// Package logging configures the structured logging of all binaries.
+//
+// Packages log through a module logger, which adds the module field and has its own level:
+//
+//	var log = logging.Module("publisher")
+//
+// Packages logging through slog use logging.Slog("logreceiver") instead, records of the
+// default slog logger carry the slog module.
+//
+// Every entry carries the node field set by Setup, entries about a stream use the slug field.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	stdlog "log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// field names shared by all binaries
+const (
+	NodeField   = "node"
+	ModuleField = "module"
+	SlugField   = "slug"
+)
+
+// Config selects the output format and levels
+type Config struct {
+	Format  string            // console, json or journald
+	Level   string            // default level of all modules
+	Modules map[string]string // level by module name
+}
+
+// RegisterFlags registers the -log-format, -log-level and -log-modules flags
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	if c.Format == "" {
+		c.Format = "console"
+	}
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	fs.StringVar(&c.Format, "log-format", c.Format, "log output format: console, json or journald")
+	fs.StringVar(&c.Level, "log-level", c.Level, "log level: trace, debug, info, warn or error")
+	fs.Var((*modulesFlag)(&c.Modules), "log-modules", "comma separated module levels, e.g. publisher=debug,client=warn")
+}
+
+// modulesFlag parses module=level pairs
+type modulesFlag map[string]string
+
+func (f *modulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*f))
+	for module, level := range *f {
+		pairs = append(pairs, module+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *modulesFlag) Set(value string) error {
+	if *f == nil {
+		*f = make(map[string]string)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		module, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid module level '%s', expected module=level", pair)
+		}
+		(*f)[module] = level
+	}
+	return nil
+}
+
+var (
+	mutex   sync.Mutex
+	base    = log.Logger
+	levels  = make(map[string]zerolog.Level)
+	modules = make(map[string]*zerolog.Logger)
+)
+
+// Module returns the logger of a module, it follows the config of later Setup calls
+func Module(name string) *zerolog.Logger {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if l, ok := modules[name]; ok {
+		return l
+	}
+	l := newModule(name)
+	modules[name] = &l
+	return &l
+}
+
+// newModule must be called with mutex held
+func newModule(name string) zerolog.Logger {
+	l := base.With().Str(ModuleField, name).Logger()
+	if level, ok := levels[name]; ok {
+		l = l.Level(level)
+	}
+	return l
+}
+
+// Setup configures the global, module, slog and stdlib loggers, node is added to every entry.
+// It must be called before logging starts, as module loggers are replaced in place.
+func Setup(conf Config, node string) error {
+	level, err := parseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	moduleLevels := make(map[string]zerolog.Level, len(conf.Modules))
+	for module, name := range conf.Modules {
+		l, err := parseLevel(name)
+		if err != nil {
+			return fmt.Errorf("module %s: %w", module, err)
+		}
+		moduleLevels[module] = l
+	}
+
+	var w zerolog.LevelWriter
+	switch conf.Format {
+	case "", "console":
+		w = zerolog.MultiLevelWriter(zerolog.ConsoleWriter{Out: os.Stderr})
+	case "json":
+		w = zerolog.MultiLevelWriter(os.Stderr)
+	case "journald":
+		w, err = newJournalWriter(journalSocket)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown log format '%s'", conf.Format)
+	}
+	setup(w, level, moduleLevels, node)
+	return nil
+}
+
+// setup replaces the loggers
+func setup(w zerolog.LevelWriter, level zerolog.Level, moduleLevels map[string]zerolog.Level, node string) {
+	// module levels may be lower than the default level
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	ctx := zerolog.New(w).With().Timestamp()
+	if node != "" {
+		ctx = ctx.Str(NodeField, node)
+	}
+
+	mutex.Lock()
+	base = ctx.Logger().Level(level)
+	levels = moduleLevels
+	for name, l := range modules {
+		*l = newModule(name)
+	}
+	mutex.Unlock()
+
+	log.Logger = base
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(Module("stdlib"))
+	slog.SetDefault(Slog("slog"))
+}
+
+func parseLevel(name string) (zerolog.Level, error) {
+	if name == "" {
+		return zerolog.InfoLevel, nil
+	}
+	level, err := zerolog.ParseLevel(name)
+	if err != nil || level == zerolog.NoLevel {
+		return zerolog.InfoLevel, fmt.Errorf("unknown log level '%s'", name)
+	}
+	return level, nil
+}
@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+)
+
+// capture sets up the loggers to write json to the returned buffer
+func capture(t *testing.T, level zerolog.Level, moduleLevels map[string]zerolog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	setup(zerolog.MultiLevelWriter(&buf), level, moduleLevels, "node1")
+	t.Cleanup(func() { assert.NilError(t, Setup(Config{}, "")) })
+	return &buf
+}
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		assert.NilError(t, json.Unmarshal([]byte(line), &e))
+		res = append(res, e)
+	}
+	return res
+}
+
+func TestModuleLevels(t *testing.T) {
+	publisher := Module("publisher")
+	client := Module("client")
+	buf := capture(t, zerolog.InfoLevel, map[string]zerolog.Level{"publisher": zerolog.DebugLevel, "client": zerolog.WarnLevel})
+
+	publisher.Debug().Str(SlugField, "s1").Msg("publish")
+	client.Info().Msg("connected")
+	client.Warn().Msg("retry")
+	Module("auth").Debug().Msg("hidden")
+
+	res := entries(t, buf)
+	assert.Equal(t, len(res), 2)
+	assert.Equal(t, res[0][ModuleField], "publisher")
+	assert.Equal(t, res[0][SlugField], "s1")
+	assert.Equal(t, res[0][NodeField], "node1")
+	assert.Equal(t, res[1]["message"], "retry")
+}
+
+func TestModulesFlag(t *testing.T) {
+	var f modulesFlag
+	assert.NilError(t, f.Set("publisher=debug, client=warn"))
+	assert.Equal(t, f.String(), "client=warn,publisher=debug")
+	assert.ErrorContains(t, f.Set("publisher"), "expected module=level")
+
+	assert.ErrorContains(t, Setup(Config{Level: "loud"}, ""), "unknown log level 'loud'")
+	assert.ErrorContains(t, Setup(Config{Modules: map[string]string{"publisher": "loud"}}, ""), "module publisher: unknown log level")
+	assert.ErrorContains(t, Setup(Config{Format: "xml"}, ""), "unknown log format 'xml'")
+}
+
+func TestSlog(t *testing.T) {
+	buf := capture(t, zerolog.InfoLevel, nil)
+
+	slog.Debug("hidden")
+	slog.With("slug", "s1").WithGroup("req").Warn("slow", "ms", 1200, slog.Group("src", "host", "relay"))
+
+	res := entries(t, buf)
+	assert.Equal(t, len(res), 1)
+	assert.Equal(t, res[0]["level"], "warn")
+	assert.Equal(t, res[0][ModuleField], "slog")
+	assert.Equal(t, res[0]["slug"], "s1")
+	assert.Equal(t, res[0]["req.ms"], float64(1200))
+	assert.Equal(t, res[0]["req.src.host"], "relay")
+}
+
+func TestSlogModule(t *testing.T) {
+	receiver := Slog("logreceiver")
+	buf := capture(t, zerolog.InfoLevel, map[string]zerolog.Level{"logreceiver": zerolog.DebugLevel})
+
+	receiver.Debug("fetching manifest", "path", "/s1.mpd")
+	slog.Debug("hidden")
+
+	res := entries(t, buf)
+	assert.Equal(t, len(res), 1)
+	assert.Equal(t, res[0][ModuleField], "logreceiver")
+	assert.Equal(t, res[0][NodeField], "node1")
+	assert.Equal(t, res[0]["path"], "/s1.mpd")
+}
+
+func TestJournalEntry(t *testing.T) {
+	msg, err := journalEntry("stream-api", zerolog.WarnLevel,
+		[]byte(`{"level":"warn","node":"n1","slug":"s1","upload-host":"h","count":3,"message":"two\nlines"}`))
+	assert.NilError(t, err)
+
+	var value bytes.Buffer
+	value.WriteString("MESSAGE\n")
+	_ = binary.Write(&value, binary.LittleEndian, uint64(9))
+	value.WriteString("two\nlines\n")
+
+	assert.Equal(t, string(msg), "PRIORITY=4\nSYSLOG_IDENTIFIER=stream-api\n"+value.String()+
+		"COUNT=3\nNODE=n1\nSLUG=s1\nUPLOAD_HOST=h\n")
+	assert.Equal(t, journalFieldName("_id"), "F_ID")
+}
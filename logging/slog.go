@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/rs/zerolog"
+)
+
+// slogHandler writes slog records to a module logger, it follows the config of later Setup calls
+type slogHandler struct {
+	logger *zerolog.Logger
+	attrs  []prefixedAttr // added by WithAttrs
+	prefix string         // group of the following attributes
+}
+
+type prefixedAttr struct {
+	prefix string
+	attr   slog.Attr
+}
+
+// Slog returns a slog logger of a module, for packages logging through slog
+func Slog(module string) *slog.Logger {
+	return slog.New(newSlogHandler(Module(module)))
+}
+
+func newSlogHandler(logger *zerolog.Logger) *slogHandler {
+	return &slogHandler{logger: logger}
+}
+
+func slogLevel(level slog.Level) zerolog.Level {
+	switch {
+	case level >= slog.LevelError:
+		return zerolog.ErrorLevel
+	case level >= slog.LevelWarn:
+		return zerolog.WarnLevel
+	case level >= slog.LevelInfo:
+		return zerolog.InfoLevel
+	}
+	return zerolog.DebugLevel
+}
+
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	l := slogLevel(level)
+	return l >= h.logger.GetLevel() && l >= zerolog.GlobalLevel()
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	e := h.logger.WithLevel(slogLevel(r.Level))
+	for _, a := range h.attrs {
+		addAttr(e, a.prefix, a.attr)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(e, h.prefix, a)
+		return true
+	})
+	e.Msg(r.Message)
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = make([]prefixedAttr, 0, len(h.attrs)+len(attrs))
+	c.attrs = append(c.attrs, h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, prefixedAttr{prefix: h.prefix, attr: a})
+	}
+	return &c
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// addAttr adds an attribute to e, groups are flattened into dotted keys
+func addAttr(e *zerolog.Event, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		for _, attr := range v.Group() {
+			addAttr(e, prefix+a.Key+".", attr)
+		}
+	case slog.KindString:
+		e.Str(prefix+a.Key, v.String())
+	case slog.KindInt64:
+		e.Int64(prefix+a.Key, v.Int64())
+	case slog.KindFloat64:
+		e.Float64(prefix+a.Key, v.Float64())
+	case slog.KindBool:
+		e.Bool(prefix+a.Key, v.Bool())
+	case slog.KindDuration:
+		e.Dur(prefix+a.Key, v.Duration())
+	default:
+		if err, ok := v.Any().(error); ok {
+			e.AnErr(prefix+a.Key, err)
+			return
+		}
+		e.Interface(prefix+a.Key, v.Any())
+	}
+}
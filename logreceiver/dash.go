@@ -3,7 +3,6 @@ package logreceiver
 import (
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
@@ -33,7 +32,7 @@ func (s *Streams) getManifest(segmentPath string) DashManifest {
 				return
 			}
 
-			log.Println(err.Error())
+			log.Warn("failed to get manifest", "base", b, "err", err)
 			s.cache.Delete(b)
 		}(base)
 	}
@@ -44,7 +43,7 @@ func (s *Streams) getManifest(segmentPath string) DashManifest {
 func (s *Streams) getManifestInBackground(base string) error {
 	path, err := url.JoinPath("http://127.0.0.1/", base, "manifest.mpd")
 
-	log.Printf("try to get %s\n", path)
+	log.Debug("fetching manifest", "path", path)
 
 	if err != nil {
 		return fmt.Errorf("failed to get manifest path: %s", err)
@@ -112,7 +111,7 @@ func (s *Streams) RefreshRoutine() {
 
 			err := s.getManifestInBackground(base)
 			if err != nil {
-				log.Println(err.Error())
+				log.Warn("failed to refresh manifest", "base", base, "err", err)
 				s.cache.Delete(base)
 			}
 
@@ -3,7 +3,6 @@ package logreceiver
 import (
 	"context"
 	"fmt"
-	"log/slog"
 	"net/http"
 	"path"
 	"strings"
@@ -57,7 +56,7 @@ func (h *HLSParser) updatePlaylists(ctx context.Context, streamTimeout time.Dura
 			h.mutex.Lock()
 			for slug, stream := range h.streams {
 				if time.Since(stream.lastUsed.Load().(time.Time)) > streamTimeout {
-					slog.Info("expiring stream", "slug", slug)
+					log.Info("expiring stream", "slug", slug)
 					delete(h.streams, slug)
 					continue
 				}
@@ -69,21 +68,21 @@ func (h *HLSParser) updatePlaylists(ctx context.Context, streamTimeout time.Dura
 }
 
 func (h *HLSParser) updateMasterPlaylist(slug string, stream *HLSStream) {
-	slog.Debug("updating master playlist", "slug", slug)
+	log.Debug("updating master playlist", "slug", slug)
 	playlistUrl, err := h.masterPlaylistUrl(stream.transport, slug)
 	if err != nil {
-		slog.Warn("failed to get master playlist url", "slug", slug, "err", err)
+		log.Warn("failed to get master playlist url", "slug", slug, "err", err)
 		return
 	}
 	playlist, err := h.fetchPlaylist(playlistUrl)
 	if err != nil {
-		slog.Warn("failed to fetch playlist", "slug", slug, "path", playlistUrl, "err", err)
+		log.Warn("failed to fetch playlist", "slug", slug, "path", playlistUrl, "err", err)
 		return
 	}
 
 	// handle only master playlists
 	if !playlist.IsMaster() {
-		slog.Warn("fetched playlist is not master", "slug", slug, "path", playlistUrl)
+		log.Warn("fetched playlist is not master", "slug", slug, "path", playlistUrl)
 		return
 	}
 
@@ -182,7 +181,7 @@ func (h *HLSParser) fetchPlaylist(path string) (*m3u8.Playlist, error) {
 func (h *HLSParser) GetQuality(slug string, transport StreamTransport, file string) (*StreamId, bool) {
 	// we only care about segment files
 	if !strings.HasSuffix(file, ".ts") && !strings.HasSuffix(file, ".m4s") && !strings.HasSuffix(file, ".mp4") {
-		// slog.Debug("not a segment file, wrong suffix", "file", file)
+		// log.Debug("not a segment file, wrong suffix", "file", file)
 		return nil, false
 	}
 	h.mutex.RLock()
@@ -199,12 +198,12 @@ func (h *HLSParser) GetQuality(slug string, transport StreamTransport, file stri
 
 	qualityName, err := h.qualityFromSegmentURI(file, transport)
 	if err != nil {
-		slog.Warn("failed to get quality from segment uri", "file", file, "err", err)
+		log.Warn("failed to get quality from segment uri", "file", file, "err", err)
 		return nil, false
 	}
 	quality, ok := stream.qualities[qualityName]
 	if !ok {
-		slog.Debug("quality not found in stream", "qualityName", qualityName, "quality", quality)
+		log.Debug("quality not found in stream", "qualityName", qualityName, "quality", quality)
 		return nil, false
 	}
 
@@ -224,5 +223,5 @@ func (h *HLSParser) addStream(slug string, transport StreamTransport) {
 	}
 	stream.lastUsed.Store(time.Now())
 	h.streams[slug] = stream
-	slog.Info("adding stream", "slug", slug)
+	log.Info("adding stream", "slug", slug)
 }
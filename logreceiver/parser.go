@@ -3,7 +3,6 @@ package logreceiver
 import (
 	"context"
 	"encoding/json"
-	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -16,8 +15,12 @@ import (
 
 	"github.com/influxdata/go-syslog/v3/rfc3164"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Slog("logreceiver")
+
 type ParserConfig struct {
 	// path to the syslog socket to listen on
 	SocketPath string
@@ -131,7 +134,7 @@ func NewParser(ctx context.Context, conf ParserConfig) (*Parser, error) {
 		return nil, err
 	}
 	unix.Umask(0o022)
-	slog.Info("logparser listening on", "address", listener.LocalAddr(), "config", conf)
+	log.Info("logparser listening on", "address", listener.LocalAddr(), "config", conf)
 	p := &Parser{
 		listener: listener,
 		conf:     conf,
@@ -156,38 +159,38 @@ func (p *Parser) run(ctx context.Context) {
 		}
 		err := p.listener.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
 		if err != nil {
-			slog.Error("failed to set read deadline", "err", err)
+			log.Error("failed to set read deadline", "err", err)
 		}
 		n, _, err := p.listener.ReadFrom(buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
-			slog.Error("failed to read", "err", err)
+			log.Error("failed to read", "err", err)
 			continue
 		}
 
 		m, err := sysParser.Parse(buf[0:n])
 		if err != nil {
-			slog.Error("failed to parse", "err", err)
+			log.Error("failed to parse", "err", err)
 			continue
 		}
 
 		parsed, ok := m.(*rfc3164.SyslogMessage)
 		if !ok || parsed == nil || parsed.Message == nil {
-			slog.Warn("got invalid syslog msg")
+			log.Warn("got invalid syslog msg")
 			continue
 		}
 
 		var point NginxLogEntry
 		err = json.Unmarshal([]byte(*parsed.Message), &point)
 		if err != nil {
-			slog.Error("failed to unmarshal json", "err", err)
+			log.Error("failed to unmarshal json", "err", err)
 			continue
 		}
 
 		p.parseEntry(point)
-		// slog.Debug("parsed", "entry", point)
+		// log.Debug("parsed", "entry", point)
 	}
 }
 
@@ -200,7 +203,7 @@ func (p *Parser) parseEntry(point NginxLogEntry) {
 
 	groups := uriRegexp.FindStringSubmatch(point.Uri)
 	if groups == nil {
-		slog.Warn("regex doesn't match", "url", point.Uri)
+		log.Warn("regex doesn't match", "url", point.Uri)
 		return
 	}
 
@@ -210,7 +213,7 @@ func (p *Parser) parseEntry(point NginxLogEntry) {
 	var stream *StreamId
 	var ok bool
 
-	// slog.Debug("match", "transport", streamTransport, "slug", slug, "file", file, "event", point)
+	// log.Debug("match", "transport", streamTransport, "slug", slug, "file", file, "event", point)
 
 	switch streamTransport {
 	case "dash":
@@ -222,7 +225,7 @@ func (p *Parser) parseEntry(point NginxLogEntry) {
 	default:
 		return
 	}
-	slog.Debug("entry", "transport", streamTransport, "slug", slug, "file", file, "stream", stream, "ok", ok)
+	log.Debug("entry", "transport", streamTransport, "slug", slug, "file", file, "stream", stream, "ok", ok)
 
 	if !ok {
 		return
@@ -258,7 +261,7 @@ func (p *Parser) Collect(ch chan<- prometheus.Metric) {
 	defer p.metricMutex.Unlock()
 	// only count every 3 seconds
 	if time.Since(p.lastCount) > time.Second*3 {
-		slog.Debug("counting")
+		log.Debug("counting")
 		p.count()
 	}
 	for s, count := range p.viewers {
@@ -304,7 +307,7 @@ func (p *Parser) count() {
 		}
 
 		if removeSegments == len(segments) {
-			slog.Debug("expire", "user", userId)
+			log.Debug("expire", "user", userId)
 			delete(p.segments, userId)
 			continue
 		}
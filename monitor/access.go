@@ -0,0 +1,279 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// role is the access level of a monitor user, higher roles include the lower ones
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+func parseRole(name string) (role, error) {
+	switch name {
+	case "":
+		return roleNone, nil
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleNone, fmt.Errorf("unknown role '%s'", name)
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// principal is an authenticated monitor user
+type principal struct {
+	name string
+	role role
+}
+
+type principalKey struct{}
+
+// userFromContext returns the authenticated user of a request
+func userFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// userName returns the name of the authenticated user for logging
+func userName(r *http.Request) string {
+	if p := userFromContext(r.Context()); p != nil {
+		return p.name
+	}
+	return "-"
+}
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// authenticator identifies the user of a request
+type authenticator interface {
+	// authenticate returns the user or errUnauthenticated
+	authenticate(r *http.Request) (*principal, error)
+	// challenge asks an unauthenticated client to log in
+	challenge(w http.ResponseWriter, r *http.Request)
+}
+
+// newAuthenticator creates the authenticator for the configured mode
+func newAuthenticator(conf config.MonitorAuthConfig) (authenticator, error) {
+	roles, err := newRoleMap(conf)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.Mode {
+	case "", "none":
+		// anonymous admin access has to be enabled explicitly
+		if roles.defaultRole == roleNone {
+			return &noAuth{role: roleViewer}, nil
+		}
+		return &noAuth{role: roles.defaultRole}, nil
+	case "static":
+		return newStaticAuth(conf.Users)
+	case "proxy":
+		return newProxyAuth(conf.Proxy, roles)
+	case "oidc":
+		return newOIDCAuth(conf.OIDC, roles)
+	}
+	return nil, fmt.Errorf("unknown auth mode '%s'", conf.Mode)
+}
+
+// roleMap resolves the role of externally authenticated users
+type roleMap struct {
+	names       map[string]role
+	defaultRole role
+}
+
+func newRoleMap(conf config.MonitorAuthConfig) (*roleMap, error) {
+	m := &roleMap{names: make(map[string]role)}
+	var err error
+	m.defaultRole, err = parseRole(conf.DefaultRole)
+	if err != nil {
+		return nil, err
+	}
+	for name, roleName := range conf.Roles {
+		r, err := parseRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		m.names[name] = r
+	}
+	return m, nil
+}
+
+// resolve returns the highest role of the user and its groups
+func (m *roleMap) resolve(user string, groups []string) role {
+	best := m.defaultRole
+	for _, name := range append([]string{user}, groups...) {
+		if r, ok := m.names[name]; ok && r > best {
+			best = r
+		}
+	}
+	return best
+}
+
+// noAuth grants everyone the same role
+type noAuth struct {
+	role role
+}
+
+func (a *noAuth) authenticate(r *http.Request) (*principal, error) {
+	return &principal{name: "anonymous", role: a.role}, nil
+}
+
+func (a *noAuth) challenge(w http.ResponseWriter, r *http.Request) {}
+
+// staticAuth checks http basic auth against the configured users
+type staticAuth struct {
+	users map[string]config.MonitorUserConfig
+	roles map[string]role
+}
+
+func newStaticAuth(users []config.MonitorUserConfig) (*staticAuth, error) {
+	a := &staticAuth{
+		users: make(map[string]config.MonitorUserConfig),
+		roles: make(map[string]role),
+	}
+	for _, user := range users {
+		r, err := parseRole(user.Role)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		a.users[user.Name] = user
+		a.roles[user.Name] = r
+	}
+	return a, nil
+}
+
+func (a *staticAuth) authenticate(r *http.Request) (*principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	user, ok := a.users[name]
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	valid, err := stream.VerifySecret(user.Password, password)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", name, err)
+	}
+	if !valid {
+		return nil, errUnauthenticated
+	}
+	return &principal{name: name, role: a.roles[name]}, nil
+}
+
+func (a *staticAuth) challenge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="stream-api monitor", charset="UTF-8"`)
+}
+
+// proxyAuth trusts the user headers of a reverse proxy
+type proxyAuth struct {
+	conf    config.MonitorProxyConfig
+	proxies []*net.IPNet
+	roles   *roleMap
+}
+
+func newProxyAuth(conf config.MonitorProxyConfig, roles *roleMap) (*proxyAuth, error) {
+	a := &proxyAuth{conf: conf, roles: roles}
+	for _, cidr := range conf.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		a.proxies = append(a.proxies, network)
+	}
+	if len(a.proxies) == 0 {
+		return nil, errors.New("proxy auth requires trustedProxies")
+	}
+	return a, nil
+}
+
+func (a *proxyAuth) trusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *proxyAuth) authenticate(r *http.Request) (*principal, error) {
+	if !a.trusted(r.RemoteAddr) {
+		return nil, errUnauthenticated
+	}
+	user := r.Header.Get(a.conf.UserHeader)
+	if user == "" {
+		return nil, errUnauthenticated
+	}
+	var groups []string
+	if a.conf.GroupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(a.conf.GroupsHeader), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return &principal{name: user, role: a.roles.resolve(user, groups)}, nil
+}
+
+func (a *proxyAuth) challenge(w http.ResponseWriter, r *http.Request) {}
+
+// require wraps handler to only allow users with at least the given role
+func (s *server) require(minRole role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.auth.authenticate(r)
+		if err != nil {
+			if !errors.Is(err, errUnauthenticated) {
+				log.Error().Err(err).Msg("monitor: authenticate")
+			}
+			s.auth.challenge(w, r)
+			if w.Header().Get("Location") != "" {
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.role < minRole {
+			log.Debug().Msgf("monitor: %s (%s) denied %s %s", user.name, user.role, r.Method, r.URL.Path)
+			writeError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, user)))
+	}
+}
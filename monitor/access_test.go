@@ -0,0 +1,269 @@
+package monitor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+func ok(w http.ResponseWriter, r *http.Request) {}
+
+// serve runs a request through handler and returns the response
+func serve(handler http.HandlerFunc, req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec.Result()
+}
+
+func TestStaticAuth(t *testing.T) {
+	hash, err := stream.HashSecret("password")
+	assert.NilError(t, err)
+	a, err := newAuthenticator(config.MonitorAuthConfig{Mode: "static", Users: []config.MonitorUserConfig{
+		{Name: "alice", Password: hash, Role: "operator"},
+	}})
+	assert.NilError(t, err)
+	s := &server{auth: a}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	res := serve(s.require(roleViewer, ok), req)
+	assert.Equal(t, res.StatusCode, http.StatusUnauthorized)
+	assert.Assert(t, strings.HasPrefix(res.Header.Get("WWW-Authenticate"), "Basic"))
+
+	req.SetBasicAuth("alice", "wrong")
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusUnauthorized)
+
+	req.SetBasicAuth("alice", "password")
+	assert.Equal(t, serve(s.require(roleOperator, ok), req).StatusCode, http.StatusOK)
+	assert.Equal(t, serve(s.require(roleAdmin, ok), req).StatusCode, http.StatusForbidden)
+}
+
+func TestNoAuth(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	a, err := newAuthenticator(config.MonitorAuthConfig{Mode: "none"})
+	assert.NilError(t, err)
+	s := &server{auth: a}
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusOK)
+	assert.Equal(t, serve(s.require(roleOperator, ok), req).StatusCode, http.StatusForbidden)
+
+	// anonymous admins are opt-in
+	a, err = newAuthenticator(config.MonitorAuthConfig{Mode: "none", DefaultRole: "admin"})
+	assert.NilError(t, err)
+	s = &server{auth: a}
+	assert.Equal(t, serve(s.require(roleAdmin, ok), req).StatusCode, http.StatusOK)
+}
+
+// publish credentials can only be created by admins
+func TestCredentialRoutes(t *testing.T) {
+	hash, err := stream.HashSecret("password")
+	assert.NilError(t, err)
+	a, err := newAuthenticator(config.MonitorAuthConfig{Mode: "static", Users: []config.MonitorUserConfig{
+		{Name: "alice", Password: hash, Role: "operator"},
+		{Name: "bob", Password: hash, Role: "admin"},
+	}})
+	assert.NilError(t, err)
+	s := &server{auth: a}
+	router, err := s.router(&config.MonitorConfig{})
+	assert.NilError(t, err)
+
+	for _, path := range []string{"/stream/s1/token", "/api/v1/streams/s1/token", "/stream/s1/keys", "/api/v1/settings/s1/keys"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+		req.SetBasicAuth("alice", "password")
+		assert.Equal(t, serve(router.ServeHTTP, req).StatusCode, http.StatusForbidden, path)
+	}
+	req := httptest.NewRequest("POST", "/api/v1/streams/s1/token", strings.NewReader("{}"))
+	req.SetBasicAuth("bob", "password")
+	assert.Equal(t, serve(router.ServeHTTP, req).StatusCode, http.StatusNotImplemented)
+}
+
+func TestProxyAuth(t *testing.T) {
+	a, err := newAuthenticator(config.MonitorAuthConfig{
+		Mode:        "proxy",
+		DefaultRole: "viewer",
+		Roles:       map[string]string{"voc-admins": "admin"},
+		Proxy: config.MonitorProxyConfig{
+			TrustedProxies: []string{"127.0.0.1/32"},
+			UserHeader:     "X-Forwarded-User",
+			GroupsHeader:   "X-Forwarded-Groups",
+		},
+	})
+	assert.NilError(t, err)
+	s := &server{auth: a}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-User", "bob")
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusOK)
+	assert.Equal(t, serve(s.require(roleOperator, ok), req).StatusCode, http.StatusForbidden)
+
+	req.Header.Set("X-Forwarded-Groups", "users, voc-admins")
+	assert.Equal(t, serve(s.require(roleAdmin, ok), req).StatusCode, http.StatusOK)
+
+	// headers from untrusted clients are ignored
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusUnauthorized)
+
+	_, err = newAuthenticator(config.MonitorAuthConfig{Mode: "proxy"})
+	assert.ErrorContains(t, err, "trustedProxies")
+}
+
+// oidcStandIn is a minimal OpenID Connect provider for tests
+type oidcStandIn struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+}
+
+func newOIDCStandIn(t *testing.T) *oidcStandIn {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+	p := &oidcStandIn{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jwk{{
+			Kty: "RSA",
+			Kid: "k1",
+			N:   b64.EncodeToString(key.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code" || r.PostFormValue("client_secret") != "secret" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(t, "carol", []string{"voc"}, p.nonce)})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *oidcStandIn) idToken(t *testing.T, user string, groups []string, nonce string) string {
+	header := b64.EncodeToString([]byte(`{"alg":"RS256","kid":"k1","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":                p.URL,
+		"aud":                "monitor",
+		"sub":                "id-" + user,
+		"preferred_username": user,
+		"groups":             groups,
+		"nonce":              nonce,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	})
+	assert.NilError(t, err)
+	payload := header + "." + b64.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	assert.NilError(t, err)
+	return payload + "." + b64.EncodeToString(sig)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	provider := newOIDCStandIn(t)
+	defer provider.Close()
+	a, err := newAuthenticator(config.MonitorAuthConfig{
+		Mode:  "oidc",
+		Roles: map[string]string{"voc": "operator"},
+		OIDC: config.MonitorOIDCConfig{
+			Issuer:       provider.URL,
+			ClientID:     "monitor",
+			ClientSecret: "secret",
+			RedirectURL:  "http://monitor/auth/callback",
+			GroupsClaim:  "groups",
+			SessionTTL:   time.Hour,
+		},
+	})
+	assert.NilError(t, err)
+	oidc := a.(*oidcAuth)
+	s := &server{auth: a}
+
+	// browsers are redirected to the login
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html")
+	res := serve(s.require(roleViewer, ok), req)
+	assert.Equal(t, res.StatusCode, http.StatusFound)
+	assert.Equal(t, res.Header.Get("Location"), "/auth/login")
+
+	// login flow
+	res = serve(oidc.handleLogin, httptest.NewRequest("GET", "/auth/login", nil))
+	assert.Equal(t, res.StatusCode, http.StatusFound)
+	location, err := url.Parse(res.Header.Get("Location"))
+	assert.NilError(t, err)
+	assert.Equal(t, location.Path, "/authorize")
+	state := location.Query().Get("state")
+	provider.nonce = location.Query().Get("nonce")
+
+	req = httptest.NewRequest("GET", "/auth/callback?code=code&state="+state, nil)
+	for _, cookie := range res.Cookies() {
+		req.AddCookie(cookie)
+	}
+	res = serve(oidc.handleCallback, req)
+	assert.Equal(t, res.StatusCode, http.StatusFound)
+
+	var session *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookie {
+			session = cookie
+		}
+	}
+	assert.Assert(t, session != nil)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(session)
+	assert.Equal(t, serve(s.require(roleOperator, ok), req).StatusCode, http.StatusOK)
+	assert.Equal(t, serve(s.require(roleAdmin, ok), req).StatusCode, http.StatusForbidden)
+
+	// tampered session
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "e30." + strings.Split(session.Value, ".")[1]})
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusUnauthorized)
+
+	// wrong state
+	req = httptest.NewRequest("GET", "/auth/callback?code=code&state=other", nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: state})
+	assert.Equal(t, serve(oidc.handleCallback, req).StatusCode, http.StatusBadRequest)
+
+	// bearer tokens for api clients
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+provider.idToken(t, "dave", []string{"voc"}, ""))
+	assert.Equal(t, serve(s.require(roleOperator, ok), req).StatusCode, http.StatusOK)
+	req.Header.Set("Authorization", "Bearer "+provider.idToken(t, "eve", nil, ""))
+	assert.Equal(t, serve(s.require(roleViewer, ok), req).StatusCode, http.StatusForbidden)
+}
+
+func TestFilterState(t *testing.T) {
+	state := map[string]interface{}{"streams": 1, "rejectedStreams": 2}
+	assert.DeepEqual(t, filterState(state, roleViewer), map[string]interface{}{"streams": 1})
+	assert.DeepEqual(t, filterState(state, roleOperator), state)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin([]string{"https://dashboard.example.org"})
+	req := httptest.NewRequest("GET", "http://monitor.example.org/ws", nil)
+	assert.Assert(t, check(req))
+	req.Header.Set("Origin", "http://monitor.example.org")
+	assert.Assert(t, check(req))
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	assert.Assert(t, check(req))
+	req.Header.Set("Origin", "https://evil.example.org")
+	assert.Assert(t, !check(req))
+}
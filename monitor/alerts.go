@@ -0,0 +1,512 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/transcode"
+)
+
+// alert rules
+const (
+	ruleUnclaimed         = "unclaimed"
+	ruleTranscoderMissing = "transcoderMissing"
+	ruleClaimFlapping     = "claimFlapping"
+	ruleCapacityExhausted = "capacityExhausted"
+	ruleScheduleMissed    = "scheduleMissed"
+)
+
+// alertRules lists the rules for validation and documentation
+var alertRules = []string{ruleUnclaimed, ruleTranscoderMissing, ruleClaimFlapping, ruleCapacityExhausted, ruleScheduleMissed}
+
+// alert is a firing alert
+type alert struct {
+	ID           string           `json:"id"` // rule:subject
+	Rule         string           `json:"rule"`
+	Subject      string           `json:"subject"` // stream slug, transcoder name or cluster
+	Severity     string           `json:"severity"`
+	Message      string           `json:"message"`
+	Since        time.Time        `json:"since"`
+	Acknowledged *acknowledgement `json:"acknowledged,omitempty"`
+	Silenced     bool             `json:"silenced"`
+}
+
+type acknowledgement struct {
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+}
+
+// silence suppresses notifications of matching alerts until it expires
+type silence struct {
+	ID      string    `json:"id"`
+	Rule    string    `json:"rule,omitempty"`    // empty matches all rules
+	Subject string    `json:"subject,omitempty"` // empty matches all subjects
+	Until   time.Time `json:"until"`
+	Author  string    `json:"author"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+func (s *silence) matches(a *alert) bool {
+	return (s.Rule == "" || s.Rule == a.Rule) && (s.Subject == "" || s.Subject == a.Subject)
+}
+
+// notification is posted to the webhooks
+type notification struct {
+	Status string `json:"status"` // firing or resolved
+	Alert  alert  `json:"alert"`
+}
+
+// condition is a rule currently matching a subject
+type condition struct {
+	rule     string
+	subject  string
+	severity string
+	message  string
+	hold     time.Duration // how long the condition has to match before firing
+}
+
+func (c condition) id() string {
+	return c.rule + ":" + c.subject
+}
+
+// clusterState is the part of the hub state the rules are evaluated against
+type clusterState struct {
+	streams     map[string]stream.Stream
+	claims      map[string]string
+	transcoders map[string]transcode.TranscoderStatus
+	claimed     []string // slugs whose claim changed since the last evaluation
+}
+
+// alertEngine evaluates the alert rules against the monitor state
+type alertEngine struct {
+	conf    config.MonitorAlertsConfig
+	api     client.KVAPI
+	inspect func(ctx context.Context, fn func(*hub)) bool
+	client  *http.Client
+
+	mutex   sync.Mutex
+	alerts  map[string]*alert      // firing alerts by id
+	pending map[string]time.Time   // matching conditions not firing yet
+	flaps   map[string][]time.Time // claim changes per slug within the flap window
+
+	// position in the hub change stream
+	epoch string
+	seq   uint64
+}
+
+func newAlertEngine(conf config.MonitorAlertsConfig, api client.KVAPI, inspect func(ctx context.Context, fn func(*hub)) bool) *alertEngine {
+	return &alertEngine{
+		conf:    conf,
+		api:     api,
+		inspect: inspect,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		alerts:  make(map[string]*alert),
+		pending: make(map[string]time.Time),
+		flaps:   make(map[string][]time.Time),
+	}
+}
+
+func (e *alertEngine) run(ctx context.Context) {
+	if e.conf.Interval <= 0 {
+		log.Info().Msg("monitor: alerting disabled")
+		return
+	}
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.evaluate(ctx, time.Now())
+		}
+	}
+}
+
+// observe copies the state the rules need, it runs in the hub loop
+func (e *alertEngine) observe(h *hub) clusterState {
+	st := clusterState{
+		streams:     make(map[string]stream.Stream),
+		claims:      make(map[string]string),
+		transcoders: make(map[string]transcode.TranscoderStatus),
+	}
+	for slug, value := range h.state["streams"] {
+		if s, ok := value.(stream.Stream); ok {
+			st.streams[slug] = s
+		}
+	}
+	for slug, value := range h.state["streamTranscoders"] {
+		if name, ok := value.(string); ok {
+			st.claims[slug] = name
+		}
+	}
+	for name, value := range h.state["transcoders"] {
+		if status, ok := value.(transcode.TranscoderStatus); ok {
+			st.transcoders[name] = status
+		}
+	}
+	// claim changes since the last evaluation, the first evaluation only sets the position
+	if e.epoch == h.epoch {
+		for _, ch := range h.backlog {
+			if ch.seq > e.seq && ch.Topic == "streamTranscoders" {
+				st.claimed = append(st.claimed, ch.Key)
+			}
+		}
+	}
+	e.epoch, e.seq = h.epoch, h.seq
+	return st
+}
+
+// evaluate applies the rules and publishes the changed alerts
+func (e *alertEngine) evaluate(ctx context.Context, now time.Time) {
+	var st clusterState
+	if !e.inspect(ctx, func(h *hub) { st = e.observe(h) }) {
+		return
+	}
+	settings, err := listStreamSettings(ctx, e.api)
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: alert settings")
+	}
+	silences, err := e.silences(ctx, now)
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: alert silences")
+	}
+
+	e.mutex.Lock()
+	conditions := e.conditions(st, settings, now)
+	var changes []change
+	var notifications []notification
+	active := make(map[string]bool)
+	for _, c := range conditions {
+		id := c.id()
+		active[id] = true
+		a, firing := e.alerts[id]
+		if !firing {
+			if _, ok := e.pending[id]; !ok {
+				e.pending[id] = now
+			}
+			if now.Sub(e.pending[id]) < c.hold {
+				continue
+			}
+			a = &alert{ID: id, Rule: c.rule, Subject: c.subject, Severity: c.severity, Since: e.pending[id]}
+			e.alerts[id] = a
+			delete(e.pending, id)
+			log.Warn().Str("alert", id).Str("reason", c.message).Msg("monitor: alert firing")
+		}
+		silenced := isSilenced(silences, a)
+		if firing && a.Message == c.message && a.Silenced == silenced {
+			continue
+		}
+		// notify new alerts and alerts whose silence ended
+		notify := !silenced && (!firing || a.Silenced)
+		a.Message, a.Silenced = c.message, silenced
+		if notify {
+			notifications = append(notifications, notification{Status: "firing", Alert: *a})
+		}
+		changes = append(changes, change{Topic: "alerts", Key: id, Value: *a})
+	}
+	for id, a := range e.alerts {
+		if active[id] {
+			continue
+		}
+		delete(e.alerts, id)
+		log.Info().Str("alert", id).Msg("monitor: alert resolved")
+		if !a.Silenced {
+			notifications = append(notifications, notification{Status: "resolved", Alert: *a})
+		}
+		changes = append(changes, change{Topic: "alerts", Key: id})
+	}
+	for id := range e.pending {
+		if !active[id] {
+			delete(e.pending, id)
+		}
+	}
+	// publish while locked, so acknowledgements are not overwritten by older values
+	e.publish(ctx, changes)
+	e.mutex.Unlock()
+
+	for _, n := range notifications {
+		e.notify(n)
+	}
+}
+
+// conditions returns the matching rules
+func (e *alertEngine) conditions(st clusterState, settings []stream.Settings, now time.Time) []condition {
+	var conditions []condition
+	for slug := range st.streams {
+		name, claimed := st.claims[slug]
+		if !claimed {
+			conditions = append(conditions, condition{rule: ruleUnclaimed, subject: slug, severity: "critical",
+				message: fmt.Sprintf("stream %s is not claimed by a transcoder", slug), hold: e.conf.Unclaimed})
+			continue
+		}
+		if _, ok := st.transcoders[name]; !ok {
+			conditions = append(conditions, condition{rule: ruleTranscoderMissing, subject: slug, severity: "critical",
+				message: fmt.Sprintf("stream %s is claimed by transcoder %s which is not reporting", slug, name), hold: e.conf.TranscoderMissing})
+		}
+	}
+
+	// claim flapping
+	for _, slug := range st.claimed {
+		e.flaps[slug] = append(e.flaps[slug], now)
+	}
+	for slug, times := range e.flaps {
+		for len(times) > 0 && now.Sub(times[0]) > e.conf.FlapWindow {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(e.flaps, slug)
+			continue
+		}
+		e.flaps[slug] = times
+		// a flap count of 0 disables the rule
+		if e.conf.FlapCount > 0 && len(times) >= e.conf.FlapCount {
+			conditions = append(conditions, condition{rule: ruleClaimFlapping, subject: slug, severity: "warning",
+				message: fmt.Sprintf("claim of stream %s changed %d times within %s", slug, len(times), e.conf.FlapWindow)})
+		}
+	}
+
+	// capacity
+	capacity, load := 0, 0
+	for _, status := range st.transcoders {
+		if status.Capacity > 0 {
+			capacity += status.Capacity
+			load += status.NumStreams
+		}
+	}
+	if capacity > 0 && load >= capacity {
+		conditions = append(conditions, condition{rule: ruleCapacityExhausted, subject: "cluster", severity: "warning",
+			message: fmt.Sprintf("all transcoders are busy, %d of %d streams", load, capacity)})
+	}
+
+	// scheduled streams
+	for _, s := range settings {
+		if s.Schedule == nil {
+			continue
+		}
+		if now.Before(s.Schedule.Start.Add(e.conf.ScheduleGrace)) || now.After(s.Schedule.End) {
+			continue
+		}
+		if _, ok := st.streams[s.Slug]; !ok {
+			conditions = append(conditions, condition{rule: ruleScheduleMissed, subject: s.Slug, severity: "critical",
+				message: fmt.Sprintf("stream %s is scheduled since %s but not live", s.Slug, s.Schedule.Start.Format(time.RFC3339))})
+		}
+	}
+	return conditions
+}
+
+func isSilenced(silences []silence, a *alert) bool {
+	for i := range silences {
+		if silences[i].matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish applies the alert changes to the hub
+func (e *alertEngine) publish(ctx context.Context, changes []change) {
+	if len(changes) == 0 {
+		return
+	}
+	e.inspect(ctx, func(h *hub) {
+		for _, ch := range changes {
+			h.apply(ch)
+		}
+	})
+}
+
+// notify posts a notification to all webhooks
+func (e *alertEngine) notify(n notification) {
+	if len(e.conf.Webhooks) == 0 {
+		return
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: alert marshal")
+		return
+	}
+	for _, url := range e.conf.Webhooks {
+		go func(url string) {
+			res, err := e.client.Post(url, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Error().Err(err).Str("url", url).Msg("monitor: alert webhook")
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				log.Error().Str("url", url).Int("status", res.StatusCode).Msg("monitor: alert webhook")
+			}
+		}(url)
+	}
+}
+
+// list returns the firing alerts sorted by id
+func (e *alertEngine) list() []alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	alerts := make([]alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].ID < alerts[j].ID })
+	return alerts
+}
+
+// count returns the number of firing alerts
+func (e *alertEngine) count() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.alerts)
+}
+
+// acknowledge marks a firing alert as acknowledged until it resolves
+func (e *alertEngine) acknowledge(ctx context.Context, id string, author string) (*alert, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	a, ok := e.alerts[id]
+	if !ok {
+		return nil, &httpError{http.StatusNotFound, fmt.Sprintf("alert %s is not firing", id)}
+	}
+	a.Acknowledged = &acknowledgement{Author: author, Time: time.Now()}
+	acked := *a
+	log.Info().Str("alert", id).Str("user", author).Msg("monitor: alert acknowledged")
+	e.publish(ctx, []change{{Topic: "alerts", Key: id, Value: acked}})
+	return &acked, nil
+}
+
+// silences returns the active silences and deletes expired ones
+func (e *alertEngine) silences(ctx context.Context, now time.Time) ([]silence, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	fields, err := e.api.GetWithPrefix(ctx, client.AlertSilencePrefix)
+	if err != nil {
+		return nil, err
+	}
+	silences := []silence{}
+	for _, field := range fields {
+		var s silence
+		if err := json.Unmarshal(field.Value, &s); err != nil {
+			log.Error().Err(err).Str("key", string(field.Key)).Msg("monitor: silence unmarshal")
+			continue
+		}
+		if now.After(s.Until) {
+			if err := e.api.Delete(ctx, string(field.Key)); err != nil {
+				log.Error().Err(err).Msg("monitor: silence expire")
+			}
+			continue
+		}
+		silences = append(silences, s)
+	}
+	sort.Slice(silences, func(i, j int) bool { return silences[i].Until.Before(silences[j].Until) })
+	return silences, nil
+}
+
+type silenceRequest struct {
+	Rule     string `json:"rule"`
+	Subject  string `json:"subject"`
+	Duration string `json:"duration"` // go duration, e.g. "2h"
+	Comment  string `json:"comment"`
+}
+
+func (s *server) handleListAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.alerts.list())
+}
+
+func (s *server) handleAckAlert(w http.ResponseWriter, r *http.Request) {
+	a, err := s.alerts.acknowledge(r.Context(), mux.Vars(r)["id"], userName(r))
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *server) handleListSilences(w http.ResponseWriter, r *http.Request) {
+	silences, err := s.alerts.silences(r.Context(), time.Now())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, silences)
+}
+
+// handleCreateSilence silences the alerts matching rule and subject for a duration
+func (s *server) handleCreateSilence(w http.ResponseWriter, r *http.Request) {
+	var req silenceRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Rule != "" && !contains(alertRules, req.Rule) {
+		writeError(w, fmt.Sprintf("unknown rule '%s'", req.Rule), http.StatusUnprocessableEntity)
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		writeError(w, "invalid duration", http.StatusUnprocessableEntity)
+		return
+	}
+	sil := silence{
+		ID:      newKeyID(),
+		Rule:    req.Rule,
+		Subject: req.Subject,
+		Until:   time.Now().Add(duration),
+		Author:  userName(r),
+		Comment: req.Comment,
+	}
+	data, err := json.Marshal(sil)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	if err := s.api.Put(ctx, client.AlertSilencePath(sil.ID), data); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("rule", sil.Rule).Str("subject", sil.Subject).Str("user", sil.Author).Time("until", sil.Until).Msg("monitor: silence created")
+	writeJSON(w, http.StatusCreated, sil)
+}
+
+func (s *server) handleDeleteSilence(w http.ResponseWriter, r *http.Request) {
+	key := client.AlertSilencePath(mux.Vars(r)["id"])
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	data, err := s.api.Get(ctx, key)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		writeError(w, "silence not found", http.StatusNotFound)
+		return
+	}
+	if err := s.api.Delete(ctx, key); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("silence", mux.Vars(r)["id"]).Str("user", userName(r)).Msg("monitor: silence deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
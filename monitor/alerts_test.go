@@ -0,0 +1,111 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/transcode"
+)
+
+func TestAlerts(t *testing.T) {
+	notifications := make(chan notification, 16)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		assert.Check(t, json.NewDecoder(r.Body).Decode(&n))
+		notifications <- n
+	}))
+	defer webhook.Close()
+
+	kv := clienttest.NewKV(nil)
+	s, updates := newStateServer(t)
+	s.api = kv
+	s.alerts = newAlertEngine(config.MonitorAlertsConfig{
+		Unclaimed:         30 * time.Second,
+		TranscoderMissing: 30 * time.Second,
+		FlapCount:         2,
+		FlapWindow:        time.Minute,
+		Webhooks:          []string{webhook.URL},
+	}, kv, s.inspect)
+	api := mux.NewRouter()
+	s.registerAPI(api, &config.MonitorConfig{})
+	ctx := context.Background()
+	now := time.Now()
+
+	firing := func() []alert {
+		var alerts []alert
+		assert.Equal(t, request(t, api, "GET", "/alerts", "", &alerts), http.StatusOK)
+		return alerts
+	}
+
+	// unclaimed streams fire after the hold time
+	updates <- change{Topic: "streams", Key: "s1", Value: stream.Stream{Slug: "s1"}}
+	s.alerts.evaluate(ctx, now)
+	assert.Equal(t, len(firing()), 0)
+	s.alerts.evaluate(ctx, now.Add(31*time.Second))
+	alerts := firing()
+	assert.Equal(t, len(alerts), 1)
+	assert.Equal(t, alerts[0].ID, "unclaimed:s1")
+	n := <-notifications
+	assert.Equal(t, n.Status, "firing")
+	assert.Equal(t, n.Alert.Message, "stream s1 is not claimed by a transcoder")
+
+	// alerts are part of the monitor state
+	res := poll(t, s, "topics=alerts")
+	assert.Equal(t, len(res.Snapshot["alerts"]), 1)
+
+	var acked alert
+	assert.Equal(t, request(t, api, "POST", "/alerts/unclaimed:s1/ack", "", &acked), http.StatusOK)
+	assert.Equal(t, acked.Acknowledged.Author, "anonymous")
+	assert.Equal(t, request(t, api, "POST", "/alerts/unclaimed:s2/ack", "", nil), http.StatusNotFound)
+
+	// silenced alerts don't notify
+	var sil silence
+	assert.Equal(t, request(t, api, "POST", "/silences", `{"rule":"capacityExhausted","duration":"1h"}`, &sil), http.StatusCreated)
+	assert.Equal(t, request(t, api, "POST", "/silences", `{"rule":"unknown","duration":"1h"}`, nil), http.StatusUnprocessableEntity)
+	updates <- change{Topic: "transcoders", Key: "t1", Value: transcode.TranscoderStatus{Name: "t1", Capacity: 1, NumStreams: 1}}
+	s.alerts.evaluate(ctx, now.Add(40*time.Second))
+	alerts = firing()
+	assert.Equal(t, len(alerts), 2)
+	assert.Equal(t, alerts[0].ID, "capacityExhausted:cluster")
+	assert.Assert(t, alerts[0].Silenced)
+
+	// claiming resolves the alert, flapping claims fire
+	updates <- change{Topic: "streamTranscoders", Key: "s1", Value: "t1"}
+	s.alerts.evaluate(ctx, now.Add(50*time.Second))
+	n = <-notifications
+	assert.Equal(t, n.Status, "resolved")
+	assert.Equal(t, n.Alert.ID, "unclaimed:s1")
+	updates <- change{Topic: "streamTranscoders", Key: "s1", Value: "t2"}
+	s.alerts.evaluate(ctx, now.Add(60*time.Second))
+	alerts = firing()
+	assert.Equal(t, len(alerts), 2)
+	assert.Equal(t, alerts[1].ID, "claimFlapping:s1")
+	n = <-notifications
+	assert.Equal(t, n.Alert.ID, "claimFlapping:s1")
+
+	// deleted silences are gone
+	assert.Equal(t, request(t, api, "DELETE", "/silences/"+sil.ID, "", nil), http.StatusNoContent)
+	var silences []silence
+	assert.Equal(t, request(t, api, "GET", "/silences", "", &silences), http.StatusOK)
+	assert.Equal(t, len(silences), 0)
+}
+
+func TestFlappingDisabled(t *testing.T) {
+	e := newAlertEngine(config.MonitorAlertsConfig{FlapWindow: time.Minute}, nil, nil)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		st := clusterState{claimed: []string{"s1"}}
+		conditions := e.conditions(st, nil, now.Add(time.Duration(i)*time.Second))
+		assert.Equal(t, len(conditions), 0)
+	}
+}
@@ -0,0 +1,495 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/transcode"
+)
+
+const apiPrefix = "/api/v1"
+
+// apiRoute describes a versioned api endpoint, the table is used for routing and the OpenAPI document
+type apiRoute struct {
+	method   string
+	path     string
+	summary  string
+	role     role
+	query    []string    // query parameters
+	request  interface{} // request body type, nil if none
+	response interface{} // response body type, nil if none
+	status   int         // success status
+	handler  http.HandlerFunc
+}
+
+// claim is the transcoder assignment of a stream
+type claim struct {
+	Slug       string `json:"slug"`
+	Transcoder string `json:"transcoder"`
+}
+
+func (s *server) apiRoutes(conf *config.MonitorConfig) []apiRoute {
+	return []apiRoute{
+		{method: "GET", path: "/settings", summary: "List stream settings", role: roleOperator,
+			response: []stream.Settings{}, status: http.StatusOK, handler: HandleGetAllStreamSettings(s.api)},
+		{method: "POST", path: "/settings", summary: "Create stream settings", role: roleAdmin,
+			request: stream.Settings{}, response: stream.Settings{}, status: http.StatusCreated, handler: handleCreateSettings(s.settings)},
+		{method: "GET", path: "/settings/{slug}", summary: "Get stream settings", role: roleOperator,
+			response: stream.Settings{}, status: http.StatusOK, handler: HandleGetStreamSettings(s.api)},
+		{method: "PUT", path: "/settings/{slug}", summary: "Create or replace stream settings, omitted keys are kept", role: roleAdmin,
+			request: stream.Settings{}, response: stream.Settings{}, status: http.StatusOK, handler: handlePutSettings(s.settings)},
+		{method: "DELETE", path: "/settings/{slug}", summary: "Delete stream settings", role: roleAdmin,
+			status: http.StatusNoContent, handler: handleDeleteSettings(s.settings)},
+		{method: "POST", path: "/settings/{slug}/keys", summary: "Add a stream key", role: roleAdmin,
+			request: addStreamKeyRequest{}, response: stream.Settings{}, status: http.StatusOK, handler: HandleAddStreamKey(s.settings)},
+		{method: "DELETE", path: "/settings/{slug}/keys/{id}", summary: "Revoke a stream key", role: roleAdmin,
+			response: stream.Settings{}, status: http.StatusOK, handler: HandleDeleteStreamKey(s.settings)},
+		{method: "GET", path: "/settings/{slug}/history", summary: "List previous versions of stream settings, newest first", role: roleOperator,
+			response: []settingsVersion{}, status: http.StatusOK, handler: handleListHistory(s.settings)},
+		{method: "GET", path: "/settings/{slug}/history/{version}", summary: "Get a previous version of stream settings", role: roleOperator,
+			response: settingsVersion{}, status: http.StatusOK, handler: handleGetHistory(s.settings)},
+		{method: "POST", path: "/settings/{slug}/history/{version}/restore", summary: "Restore a previous version of stream settings", role: roleAdmin,
+			response: stream.Settings{}, status: http.StatusOK, handler: handleRestoreSettings(s.settings)},
+		{method: "GET", path: "/streams", summary: "List published streams", role: roleViewer,
+			response: []stream.Stream{}, status: http.StatusOK, handler: handleListStreams(s.api)},
+		{method: "GET", path: "/streams/{slug}", summary: "Get a published stream", role: roleViewer,
+			response: stream.Stream{}, status: http.StatusOK, handler: handleGetStream(s.api)},
+		{method: "GET", path: "/streams/{slug}/events", summary: "Lifecycle events of a stream in chronological order", role: roleViewer,
+			query: []string{"since", "type", "limit"}, response: []eventlog.Event{}, status: http.StatusOK, handler: handleStreamEvents(s.api)},
+		{method: "POST", path: "/streams/{slug}/token", summary: "Mint a publish token", role: roleAdmin,
+			request: mintTokenRequest{}, response: mintTokenResponse{}, status: http.StatusOK, handler: HandleMintToken(s.api, s.tokens)},
+		{method: "GET", path: "/claims", summary: "List transcoder claims", role: roleViewer,
+			response: []claim{}, status: http.StatusOK, handler: handleListClaims(s.api)},
+		{method: "DELETE", path: "/streams/{slug}/claim", summary: "Release the transcoder claim of a stream", role: roleOperator,
+			status: http.StatusNoContent, handler: handleReleaseClaim(s.api)},
+		{method: "GET", path: "/transcoders", summary: "List transcoders", role: roleViewer,
+			response: []transcode.TranscoderStatus{}, status: http.StatusOK, handler: handleListTranscoders(s.api)},
+		{method: "GET", path: "/status", summary: "List the joined status of all streams", role: roleViewer,
+			response: []streamStatus{}, status: http.StatusOK, handler: s.handleListStatus},
+		{method: "GET", path: "/status/{slug}", summary: "Get the joined status of a stream", role: roleViewer,
+			response: streamStatus{}, status: http.StatusOK, handler: s.handleGetStatus},
+		{method: "GET", path: "/alerts", summary: "List firing alerts", role: roleViewer,
+			response: []alert{}, status: http.StatusOK, handler: s.handleListAlerts},
+		{method: "POST", path: "/alerts/{id}/ack", summary: "Acknowledge a firing alert", role: roleOperator,
+			response: alert{}, status: http.StatusOK, handler: s.handleAckAlert},
+		{method: "GET", path: "/silences", summary: "List active silences", role: roleViewer,
+			response: []silence{}, status: http.StatusOK, handler: s.handleListSilences},
+		{method: "POST", path: "/silences", summary: "Silence notifications of matching alerts", role: roleOperator,
+			request: silenceRequest{}, response: silence{}, status: http.StatusCreated, handler: s.handleCreateSilence},
+		{method: "DELETE", path: "/silences/{id}", summary: "Delete a silence", role: roleOperator,
+			status: http.StatusNoContent, handler: s.handleDeleteSilence},
+		{method: "GET", path: "/events", summary: "Stream state changes as server-sent events, see the websocket protocol", role: roleViewer,
+			query: []string{"topics", "slugs", "epoch", "since"}, status: http.StatusOK, handler: s.handleEvents},
+		{method: "GET", path: "/state", summary: "Long-poll state changes after index", role: roleViewer,
+			query: []string{"topics", "slugs", "epoch", "index", "wait"}, response: pollResponse{}, status: http.StatusOK, handler: s.handlePoll},
+		{method: "GET", path: "/audit", summary: "Query the ingest auth audit log", role: roleOperator,
+			query: []string{"slug", "addr", "result", "since", "limit"}, response: auditResponse{}, status: http.StatusOK,
+			handler: HandleGetAuditLog(conf.AuditSources, conf.AuditToken)},
+	}
+}
+
+// registerAPI adds the api routes and the OpenAPI document to router
+func (s *server) registerAPI(router *mux.Router, conf *config.MonitorConfig) {
+	routes := s.apiRoutes(conf)
+	api := router.PathPrefix(apiPrefix).Subrouter()
+	for _, route := range routes {
+		api.HandleFunc(route.path, s.require(route.role, route.handler)).Methods(route.method)
+	}
+	doc, err := json.Marshal(openAPIDocument(routes))
+	if err != nil {
+		log.Fatal().Err(err).Msg("openapi")
+	}
+	api.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}).Methods("GET")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, "not found", http.StatusNotFound)
+	})
+}
+
+func handleCreateSettings(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var settings stream.Settings
+		if err := decodeJSON(r.Body, &settings); err != nil {
+			writeError(w, fmt.Sprintf("parse failed: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if !stream.ValidSlug(settings.Slug) {
+			writeError(w, fmt.Sprintf("invalid slug '%s'", settings.Slug), http.StatusUnprocessableEntity)
+			return
+		}
+		entry := settingsVersion{Author: userName(r)}
+		stored, err := store.update(r.Context(), settings.Slug, 0, entry, func(current *stream.Settings) (*stream.Settings, error) {
+			if current != nil {
+				return nil, &httpError{http.StatusConflict, fmt.Sprintf("settings for %s already exist", settings.Slug)}
+			}
+			return &settings, mergeKeys(&settings, nil)
+		})
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, stored.Slug).Interface("settings", stored.Redacted()).Msg("created settings")
+		writeSettings(w, http.StatusCreated, stored)
+	}
+}
+
+// HandleSetStreamSettings creates or replaces the settings of a stream
+func HandleSetStreamSettings(store *settingsStore) http.HandlerFunc {
+	return handlePutSettings(store)
+}
+
+func handlePutSettings(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		slug := mux.Vars(r)["slug"]
+		expected, err := ifMatch(r)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		var settings stream.Settings
+		if err := decodeJSON(r.Body, &settings); err != nil {
+			writeError(w, fmt.Sprintf("parse failed: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if settings.Slug == "" {
+			settings.Slug = slug
+		}
+		if settings.Slug != slug {
+			writeError(w, "slug doesn't match path", http.StatusUnprocessableEntity)
+			return
+		}
+		// settings read from the api carry their version
+		if expected == 0 {
+			expected = settings.Version
+		}
+		entry := settingsVersion{Author: userName(r)}
+		stored, err := store.update(r.Context(), slug, expected, entry, func(current *stream.Settings) (*stream.Settings, error) {
+			return &settings, mergeKeys(&settings, current)
+		})
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, stored.Slug).Interface("settings", stored.Redacted()).Msg("set settings")
+		writeSettings(w, http.StatusOK, stored)
+	}
+}
+
+// mergeKeys completes the keys of settings from the stored settings,
+// omitted keys are kept and keys without hash keep the hash of the stored key.
+// A new legacy secret replaces the omitted keys, so changing the secret revokes the old one.
+func mergeKeys(settings *stream.Settings, stored *stream.Settings) error {
+	newSecret := settings.Secret != "" && settings.Secret != stream.RedactedValue
+	if settings.Keys == nil && stored != nil && !newSecret {
+		settings.Keys = stored.Keys
+	}
+	for i := range settings.Keys {
+		key := &settings.Keys[i]
+		if key.Hash != "" && key.Hash != stream.RedactedValue {
+			continue
+		}
+		key.Hash = ""
+		if stored != nil {
+			for _, old := range stored.Keys {
+				if old.ID == key.ID {
+					key.Hash = old.Hash
+				}
+			}
+		}
+		if key.Hash == "" {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("unknown key '%s'", key.ID)}
+		}
+	}
+	if settings.Secret == stream.RedactedValue {
+		settings.Secret = ""
+	}
+	return nil
+}
+
+func handleDeleteSettings(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		expected, err := ifMatch(r)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		entry := settingsVersion{Author: userName(r)}
+		_, err = store.update(r.Context(), slug, expected, entry, func(current *stream.Settings) (*stream.Settings, error) {
+			if current == nil {
+				return nil, &httpError{http.StatusNotFound, fmt.Sprintf("no settings for %s", slug)}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Msg("deleted settings")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleListHistory(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		versions, err := store.versions(r.Context(), slug)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// newest first
+		res := make([]settingsVersion, len(versions))
+		for i, v := range versions {
+			res[len(versions)-1-i] = v.redacted()
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// getVersion returns the settings version addressed by the request path
+func getVersion(r *http.Request, store *settingsStore) (*settingsVersion, error) {
+	params := mux.Vars(r)
+	version, err := strconv.Atoi(params["version"])
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, "invalid version"}
+	}
+	v, err := store.version(r.Context(), params["slug"], version)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, &httpError{http.StatusNotFound, fmt.Sprintf("version %d not found", version)}
+	}
+	return v, nil
+}
+
+func handleGetHistory(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := getVersion(r, store)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, v.redacted())
+	}
+}
+
+// handleRestoreSettings stores the settings of a previous version as new version
+func handleRestoreSettings(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		expected, err := ifMatch(r)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		v, err := getVersion(r, store)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		if v.Settings == nil {
+			writeError(w, fmt.Sprintf("version %d deleted the settings", v.Version), http.StatusUnprocessableEntity)
+			return
+		}
+		entry := settingsVersion{Author: userName(r), Action: "restore", RestoredFrom: v.Version}
+		stored, err := store.update(r.Context(), slug, expected, entry, func(current *stream.Settings) (*stream.Settings, error) {
+			revoked, err := store.revokedKeys(r.Context(), slug, v)
+			if err != nil {
+				return nil, err
+			}
+			restored := *v.Settings
+			restored.Keys = nil
+			for _, key := range v.Settings.Keys {
+				if !revoked[key.Hash] {
+					restored.Keys = append(restored.Keys, key)
+				}
+			}
+			return &restored, nil
+		})
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Int("version", v.Version).Msg("restored version")
+		writeSettings(w, http.StatusOK, stored)
+	}
+}
+
+// listStreamKeys returns the stream registrations and claims below the stream prefix
+func listStreamKeys(ctx context.Context, api client.KVAPI) ([]stream.Stream, []claim, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	fields, err := api.GetWithPrefix(ctx, client.StreamPrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get failed: %w", err)
+	}
+	streams := []stream.Stream{}
+	claims := []claim{}
+	for _, field := range fields {
+		path := string(field.Key)
+		if client.PathIsStream(path) {
+			var s stream.Stream
+			if err := json.Unmarshal(field.Value, &s); err != nil {
+				log.Error().Err(err).Str("key", path).Msg("stream unmarshal")
+				continue
+			}
+			streams = append(streams, s)
+		} else if client.PathIsStreamTranscoder(path) {
+			claims = append(claims, claim{Slug: client.ParseStreamName(path), Transcoder: string(field.Value)})
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Slug < streams[j].Slug })
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Slug < claims[j].Slug })
+	return streams, claims, nil
+}
+
+func handleListStreams(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		streams, _, err := listStreamKeys(r.Context(), api)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, streams)
+	}
+}
+
+func handleGetStream(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		data, err := api.Get(ctx, client.StreamPath(slug))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if data == nil {
+			writeError(w, fmt.Sprintf("stream %s not found", slug), http.StatusNotFound)
+			return
+		}
+		var s stream.Stream
+		if err := json.Unmarshal(data, &s); err != nil {
+			writeError(w, fmt.Sprintf("unmarshal failed: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	}
+}
+
+// defaultEventLimit is the number of events returned without limit
+const defaultEventLimit = 200
+
+// handleStreamEvents returns the newest lifecycle events of a stream
+func handleStreamEvents(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := eventlog.Query{Limit: defaultEventLimit}
+		if since := query.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid since: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+			q.Since = t
+		}
+		for _, param := range query["type"] {
+			q.Types = append(q.Types, splitList(param)...)
+		}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				writeError(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			q.Limit = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*2)
+		defer cancel()
+		events, err := eventlog.List(ctx, api, mux.Vars(r)["slug"], q)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	}
+}
+
+func handleListClaims(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := listStreamKeys(r.Context(), api)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, claims)
+	}
+}
+
+// handleReleaseClaim deletes the transcoder claim of a stream, which makes the transcoders claim it again
+func handleReleaseClaim(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		data, err := api.Get(ctx, client.StreamTranscoderPath(slug))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if data == nil {
+			writeError(w, fmt.Sprintf("stream %s is not claimed", slug), http.StatusNotFound)
+			return
+		}
+		if err := api.Delete(ctx, client.StreamTranscoderPath(slug)); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Str("transcoder", string(data)).Msg("released claim")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleListTranscoders(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		prefix := client.ServicePrefix("transcode") + "/"
+		fields, err := api.GetWithPrefix(ctx, prefix)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transcoders := []transcode.TranscoderStatus{}
+		for _, field := range fields {
+			var status transcode.TranscoderStatus
+			if err := json.Unmarshal(field.Value, &status); err != nil {
+				log.Error().Err(err).Str("transcoder", strings.TrimPrefix(string(field.Key), prefix)).Msg("transcoder unmarshal")
+				continue
+			}
+			transcoders = append(transcoders, status)
+		}
+		sort.Slice(transcoders, func(i, j int) bool { return transcoders[i].Name < transcoders[j].Name })
+		writeJSON(w, http.StatusOK, transcoders)
+	}
+}
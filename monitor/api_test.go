@@ -0,0 +1,245 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// storedSettings returns the stored settings of slug, or nil
+func storedSettings(t *testing.T, kv *clienttest.KV, slug string) *stream.Settings {
+	var s stream.Settings
+	if !kv.GetJSON(t, client.StreamSettingsPath(slug), &s) {
+		return nil
+	}
+	return &s
+}
+
+// newTestAPI returns a router serving the api for an admin
+func newTestAPI(kv *clienttest.KV) http.Handler {
+	s := &server{api: kv, auth: &noAuth{role: roleAdmin}, settings: newSettingsStore(kv, 3)}
+	router := mux.NewRouter()
+	s.registerAPI(router, &config.MonitorConfig{})
+	return router
+}
+
+func request(t *testing.T, handler http.Handler, method string, path string, body string, out interface{}) int {
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if out != nil {
+		assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), out), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestSettingsAPI(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	api := newTestAPI(kv)
+
+	var settings stream.Settings
+	code := request(t, api, "POST", "/settings", `{"slug":"s1","ingestType":"rtmp","secret":"pw"}`, &settings)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, settings.Keys[0].Hash, stream.RedactedValue)
+	stored := storedSettings(t, kv, "s1")
+	assert.Equal(t, stored.Secret, "")
+	assert.Equal(t, len(stored.Keys), 1)
+	hash := stored.Keys[0].Hash
+
+	var apiErr apiError
+	code = request(t, api, "POST", "/settings", `{"slug":"s1"}`, &apiErr)
+	assert.Equal(t, code, http.StatusConflict)
+	assert.Equal(t, apiErr.Status, http.StatusConflict)
+
+	code = request(t, api, "POST", "/settings", `{"slug":"../s2"}`, &apiErr)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Assert(t, strings.Contains(apiErr.Message, "slug"), apiErr.Message)
+
+	code = request(t, api, "POST", "/settings", `{"slug":`, &apiErr)
+	assert.Equal(t, code, http.StatusBadRequest)
+
+	// redacted keys sent back unchanged keep their hash, omitted keys are kept
+	data, err := json.Marshal(settings)
+	assert.NilError(t, err)
+	code = request(t, api, "PUT", "/settings/s1", string(data), &settings)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, storedSettings(t, kv, "s1").Keys[0].Hash, hash)
+
+	code = request(t, api, "PUT", "/settings/s1", `{"public":true}`, &settings)
+	assert.Equal(t, code, http.StatusOK)
+	stored = storedSettings(t, kv, "s1")
+	assert.Assert(t, stored.Public)
+	assert.Equal(t, stored.Keys[0].Hash, hash)
+
+	// a new secret replaces the stored keys
+	code = request(t, api, "PUT", "/settings/s1", `{"secret":"pw2"}`, &settings)
+	assert.Equal(t, code, http.StatusOK)
+	stored = storedSettings(t, kv, "s1")
+	assert.Equal(t, len(stored.Keys), 1)
+	assert.Assert(t, stored.Keys[0].Hash != hash)
+
+	code = request(t, api, "PUT", "/settings/s1", `{"keys":[{"id":"unknown"}]}`, &apiErr)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	code = request(t, api, "PUT", "/settings/s1", `{"slug":"s2"}`, &apiErr)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	var list []stream.Settings
+	code = request(t, api, "GET", "/settings", "", &list)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(list), 1)
+
+	assert.Equal(t, request(t, api, "DELETE", "/settings/s1", "", nil), http.StatusNoContent)
+	assert.Equal(t, request(t, api, "GET", "/settings/s1", "", &apiErr), http.StatusNotFound)
+	assert.Equal(t, request(t, api, "DELETE", "/settings/s1", "", &apiErr), http.StatusNotFound)
+	assert.Equal(t, request(t, api, "GET", "/unknown", "", &apiErr), http.StatusNotFound)
+}
+
+func TestSettingsHistory(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	api := newTestAPI(kv)
+
+	var settings stream.Settings
+	assert.Equal(t, request(t, api, "PUT", "/settings/s1", `{"ingestType":"rtmp","secret":"pw"}`, &settings), http.StatusOK)
+	assert.Equal(t, settings.Version, 1)
+	assert.Equal(t, request(t, api, "PUT", "/settings/s1", `{"ingestType":"srt","version":1}`, &settings), http.StatusOK)
+	assert.Equal(t, settings.Version, 2)
+
+	// stale versions are rejected
+	var apiErr apiError
+	assert.Equal(t, request(t, api, "PUT", "/settings/s1", `{"public":true,"version":1}`, &apiErr), http.StatusPreconditionFailed)
+	req := httptest.NewRequest("DELETE", apiPrefix+"/settings/s1", nil)
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusPreconditionFailed)
+
+	var history []settingsVersion
+	assert.Equal(t, request(t, api, "GET", "/settings/s1/history", "", &history), http.StatusOK)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[0].Version, 2)
+	assert.Equal(t, history[0].Author, "anonymous")
+	assert.Equal(t, history[0].Action, "update")
+	assert.DeepEqual(t, history[0].Changes, []settingsChange{{Field: "ingestType", Old: "rtmp", New: "srt"}})
+	assert.Equal(t, history[1].Action, "create")
+	assert.Equal(t, history[1].Settings.Keys[0].Hash, stream.RedactedValue)
+
+	// restore keeps the key hashes of the old version
+	assert.Equal(t, request(t, api, "POST", "/settings/s1/history/1/restore", "", &settings), http.StatusOK)
+	assert.Equal(t, settings.Version, 3)
+	stored := storedSettings(t, kv, "s1")
+	assert.Equal(t, stored.IngestType, "rtmp")
+	assert.Assert(t, strings.HasPrefix(stored.Keys[0].Hash, "pbkdf2"))
+
+	var v settingsVersion
+	assert.Equal(t, request(t, api, "GET", "/settings/s1/history/3", "", &v), http.StatusOK)
+	assert.Equal(t, v.Action, "restore")
+	assert.Equal(t, v.RestoredFrom, 1)
+
+	// versions continue after delete and old versions are pruned
+	assert.Equal(t, request(t, api, "DELETE", "/settings/s1", "", nil), http.StatusNoContent)
+	history = nil
+	assert.Equal(t, request(t, api, "GET", "/settings/s1/history", "", &history), http.StatusOK)
+	assert.Equal(t, len(history), 3)
+	assert.Equal(t, history[0].Action, "delete")
+	assert.Assert(t, history[0].Settings == nil)
+	assert.Equal(t, request(t, api, "GET", "/settings/s1/history/1", "", &apiErr), http.StatusNotFound)
+	assert.Equal(t, request(t, api, "POST", "/settings/s1/history/4/restore", "", &apiErr), http.StatusUnprocessableEntity)
+	assert.Equal(t, request(t, api, "POST", "/settings/s1/keys", `{"secret":"pw2"}`, &settings), http.StatusOK)
+	assert.Equal(t, settings.Version, 5)
+
+	// restore doesn't bring back revoked keys
+	assert.Equal(t, request(t, api, "POST", "/settings/s1/keys", `{"id":"k2","secret":"pw3"}`, &settings), http.StatusOK)
+	assert.Equal(t, request(t, api, "DELETE", "/settings/s1/keys/k2", "", &settings), http.StatusOK)
+	assert.Equal(t, request(t, api, "POST", "/settings/s1/history/6/restore", "", &settings), http.StatusOK)
+	assert.Equal(t, len(settings.Keys), 1)
+	assert.Assert(t, settings.Keys[0].ID != "k2")
+}
+
+func TestConcurrentSettings(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	ctx := context.Background()
+	_, err := SetSettings(ctx, kv, "s1", &stream.Settings{IngestType: "rtmp"}, "cli")
+	assert.NilError(t, err)
+
+	// another writer changes the settings between read and write, the update is applied again
+	store := newSettingsStore(kv, 0)
+	attempts := 0
+	stored, err := store.update(ctx, "s1", 0, settingsVersion{}, func(current *stream.Settings) (*stream.Settings, error) {
+		attempts++
+		if attempts == 1 {
+			_, err := SetSettings(ctx, kv, "s1", &stream.Settings{IngestType: "srt"}, "cli")
+			assert.NilError(t, err)
+		}
+		next := *current
+		next.Public = true
+		return &next, nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, attempts, 2)
+	assert.Equal(t, stored.Version, 3)
+	assert.Equal(t, storedSettings(t, kv, "s1").IngestType, "srt")
+	assert.Assert(t, storedSettings(t, kv, "s1").Public)
+
+	// an expected version fails after a concurrent change
+	_, err = store.update(ctx, "s1", 3, settingsVersion{}, func(current *stream.Settings) (*stream.Settings, error) {
+		_, err := SetSettings(ctx, kv, "s1", &stream.Settings{IngestType: "rtmp"}, "cli")
+		assert.NilError(t, err)
+		return current, nil
+	})
+	assert.Equal(t, errorStatus(err), http.StatusPreconditionFailed)
+}
+
+func TestClaimsAPI(t *testing.T) {
+	kv := clienttest.NewKV(map[string][]byte{
+		client.StreamPath("s1"):               []byte(`{"slug":"s1","source":"http://a"}`),
+		client.StreamTranscoderPath("s1"):     []byte("t1"),
+		client.ServicePath("transcode", "t1"): []byte(`{"name":"t1","capacity":2,"streams":1}`),
+	})
+	api := newTestAPI(kv)
+
+	var streams []stream.Stream
+	assert.Equal(t, request(t, api, "GET", "/streams", "", &streams), http.StatusOK)
+	assert.Equal(t, len(streams), 1)
+	assert.Equal(t, streams[0].Source, "http://a")
+
+	var claims []claim
+	assert.Equal(t, request(t, api, "GET", "/claims", "", &claims), http.StatusOK)
+	assert.DeepEqual(t, claims, []claim{{Slug: "s1", Transcoder: "t1"}})
+
+	var transcoders []map[string]interface{}
+	assert.Equal(t, request(t, api, "GET", "/transcoders", "", &transcoders), http.StatusOK)
+	assert.Equal(t, transcoders[0]["name"], "t1")
+
+	assert.Equal(t, request(t, api, "DELETE", "/streams/s1/claim", "", nil), http.StatusNoContent)
+	_, ok := kv.Value(client.StreamTranscoderPath("s1"))
+	assert.Assert(t, !ok)
+	var apiErr apiError
+	assert.Equal(t, request(t, api, "DELETE", "/streams/s1/claim", "", &apiErr), http.StatusNotFound)
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	api := newTestAPI(clienttest.NewKV(nil))
+	var doc map[string]interface{}
+	assert.Equal(t, request(t, api, "GET", "/openapi.json", "", &doc), http.StatusOK)
+
+	paths := doc["paths"].(map[string]interface{})
+	op := paths["/settings/{slug}"].(map[string]interface{})["put"].(map[string]interface{})
+	assert.Equal(t, op["parameters"].([]interface{})[0].(map[string]interface{})["name"], "slug")
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	key := schemas["StreamKey"].(map[string]interface{})
+	assert.DeepEqual(t, key["required"], []interface{}{"id", "hash"})
+	notBefore := key["properties"].(map[string]interface{})["notBefore"].(map[string]interface{})
+	assert.Equal(t, notBefore["format"], "date-time")
+}
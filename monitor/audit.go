@@ -0,0 +1,78 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/voc/stream-api/auth"
+)
+
+type auditEntry struct {
+	auth.AuditEntry
+	Source string `json:"source"`
+}
+
+type auditResponse struct {
+	Entries []auditEntry `json:"entries"`
+	Errors  []string     `json:"errors,omitempty"` // sources that couldn't be queried
+}
+
+// HandleGetAuditLog queries the publish audit log of all auth servers and merges the results
+func HandleGetAuditLog(sources []string, token string) http.HandlerFunc {
+	httpClient := &http.Client{Timeout: time.Second * 5}
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := auth.ParseAuditFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := auditResponse{Entries: []auditEntry{}}
+		for _, source := range sources {
+			entries, err := queryAuditLog(r.Context(), httpClient, source, token, filter)
+			if err != nil {
+				log.Error().Err(err).Str("source", source).Msg("audit query")
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", source, err.Error()))
+				continue
+			}
+			for _, entry := range entries {
+				res.Entries = append(res.Entries, auditEntry{AuditEntry: entry, Source: source})
+			}
+		}
+
+		sort.SliceStable(res.Entries, func(i, j int) bool {
+			return res.Entries[i].Time.After(res.Entries[j].Time)
+		})
+		if filter.Limit > 0 && len(res.Entries) > filter.Limit {
+			res.Entries = res.Entries[:filter.Limit]
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func queryAuditLog(ctx context.Context, httpClient *http.Client, source string, token string, filter auth.AuditFilter) ([]auth.AuditEntry, error) {
+	url := strings.TrimSuffix(source, "/") + "/audit?" + filter.Values().Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var entries []auth.AuditEntry
+	if err := decodeJSON(resp.Body, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
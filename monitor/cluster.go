@@ -0,0 +1,319 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// sinkStatus is the upload health of a stream on an upload server
+type sinkStatus struct {
+	Target           string  `json:"target"`
+	DeviationMax     float64 `json:"segmentDeviationMax"`  // maximum difference between target duration and upload interval in seconds
+	DeviationMean    float64 `json:"segmentDeviationMean"` // mean difference between target duration and upload interval in seconds
+	InvalidDurations float64 `json:"invalidDurations"`     // playlists with a target duration not matching the other variants
+}
+
+// streamMetrics is the scraped exporter data of a stream
+type streamMetrics struct {
+	Sinks   []sinkStatus `json:"sinks"`
+	Viewers int          `json:"viewers"`
+}
+
+// streamStatus joins the state of a stream from all sources
+type streamStatus struct {
+	Slug       string         `json:"slug"`
+	Source     string         `json:"source,omitempty"`
+	Format     string         `json:"format,omitempty"`
+	Health     *stream.Health `json:"health,omitempty"`
+	Transcoder string         `json:"transcoder,omitempty"`
+	Sinks      []sinkStatus   `json:"sinks"`
+	Viewers    int            `json:"viewers"`
+}
+
+// joinStatus builds the status document of slug from the hub state, it returns nil for unknown streams
+func (h *hub) joinStatus(slug string) *streamStatus {
+	s, published := h.state["streams"][slug].(stream.Stream)
+	metrics, scraped := h.state["streamMetrics"][slug].(streamMetrics)
+	if !published && !scraped {
+		return nil
+	}
+	status := &streamStatus{Slug: slug, Sinks: []sinkStatus{}}
+	if published {
+		status.Source = s.Source
+		status.Format = s.Format
+		status.Health = s.Health
+	}
+	status.Transcoder, _ = h.state["streamTranscoders"][slug].(string)
+	if scraped {
+		if metrics.Sinks != nil {
+			status.Sinks = metrics.Sinks
+		}
+		status.Viewers = metrics.Viewers
+	}
+	return status
+}
+
+// updateStatus recomputes the status of slug and applies it if it changed
+func (h *hub) updateStatus(slug string) {
+	next := h.joinStatus(slug)
+	current, exists := h.state["status"][slug].(streamStatus)
+	switch {
+	case next == nil && exists:
+		h.apply(change{Topic: "status", Key: slug})
+	case next != nil && (!exists || !reflect.DeepEqual(current, *next)):
+		h.apply(change{Topic: "status", Key: slug, Value: *next})
+	}
+}
+
+// handleListStatus returns the status of all streams sorted by slug
+func (s *server) handleListStatus(w http.ResponseWriter, r *http.Request) {
+	list := []streamStatus{}
+	ok := s.inspect(r.Context(), func(h *hub) {
+		for _, value := range h.state["status"] {
+			list = append(list, value.(streamStatus))
+		}
+	})
+	if !ok {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Slug < list[j].Slug })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleGetStatus returns the status of a stream
+func (s *server) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	var status streamStatus
+	var found bool
+	ok := s.inspect(r.Context(), func(h *hub) {
+		status, found = h.state["status"][slug].(streamStatus)
+	})
+	if !ok {
+		return
+	}
+	if !found {
+		writeError(w, fmt.Sprintf("stream %s not found", slug), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// scraper periodically collects the per stream metrics of the upload servers and viewer counters
+type scraper struct {
+	conf    config.MonitorScrapeConfig
+	client  *http.Client
+	updates chan<- change
+	done    sync.WaitGroup
+
+	// last scrape result
+	metrics map[string]streamMetrics
+}
+
+func newScraper(ctx context.Context, conf config.MonitorScrapeConfig, updates chan<- change) *scraper {
+	s := &scraper{
+		conf:    conf,
+		client:  &http.Client{Timeout: conf.Timeout},
+		updates: updates,
+		metrics: make(map[string]streamMetrics),
+	}
+	s.done.Add(1)
+	go s.run(ctx)
+	return s
+}
+
+func (s *scraper) Wait() {
+	s.done.Wait()
+}
+
+func (s *scraper) run(ctx context.Context) {
+	defer s.done.Done()
+	ticker := time.NewTicker(s.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if !s.publish(ctx, s.scrape(ctx)) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrape collects the metrics of all targets, failing targets are left out
+func (s *scraper) scrape(ctx context.Context) map[string]streamMetrics {
+	type result struct {
+		target   string
+		viewers  bool
+		families map[string]*dto.MetricFamily
+	}
+	targets := len(s.conf.Upload) + len(s.conf.Viewers)
+	results := make(chan result, targets)
+	fetch := func(target string, viewers bool) {
+		families, err := s.fetch(ctx, target)
+		if err != nil {
+			log.Warn().Err(err).Str("target", target).Msg("monitor: scrape")
+		}
+		results <- result{target, viewers, families}
+	}
+	for _, target := range s.conf.Upload {
+		go fetch(target, false)
+	}
+	for _, target := range s.conf.Viewers {
+		go fetch(target, true)
+	}
+
+	metrics := make(map[string]streamMetrics)
+	for i := 0; i < targets; i++ {
+		res := <-results
+		if res.viewers {
+			addViewers(metrics, res.families)
+		} else {
+			addSinks(metrics, targetName(res.target), res.families)
+		}
+	}
+	for _, m := range metrics {
+		sort.Slice(m.Sinks, func(i, j int) bool { return m.Sinks[i].Target < m.Sinks[j].Target })
+	}
+	return metrics
+}
+
+func (s *scraper) fetch(ctx context.Context, target string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	return parser.TextToMetricFamilies(res.Body)
+}
+
+// publish sends the changed metrics to the hub, it returns false if ctx is done
+func (s *scraper) publish(ctx context.Context, metrics map[string]streamMetrics) bool {
+	var changes []change
+	for slug, m := range metrics {
+		if old, ok := s.metrics[slug]; !ok || !reflect.DeepEqual(old, m) {
+			changes = append(changes, change{Topic: "streamMetrics", Key: slug, Value: m})
+		}
+	}
+	for slug := range s.metrics {
+		if _, ok := metrics[slug]; !ok {
+			changes = append(changes, change{Topic: "streamMetrics", Key: slug})
+		}
+	}
+	for _, ch := range changes {
+		select {
+		case s.updates <- ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	s.metrics = metrics
+	return true
+}
+
+// targetName returns the host of a target url
+func targetName(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Host
+}
+
+func label(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	return 0
+}
+
+// addSinks adds the upload health reported by an upload server
+func addSinks(metrics map[string]streamMetrics, target string, families map[string]*dto.MetricFamily) {
+	sinks := make(map[string]*sinkStatus)
+	means := make(map[string][]float64)
+	sink := func(slug string) *sinkStatus {
+		if sinks[slug] == nil {
+			sinks[slug] = &sinkStatus{Target: target}
+		}
+		return sinks[slug]
+	}
+	for _, m := range families["playlist_duration_diff_max_seconds"].GetMetric() {
+		if slug := label(m, "slug"); slug != "" {
+			sink(slug).DeviationMax = max(sink(slug).DeviationMax, value(m))
+		}
+	}
+	for _, m := range families["playlist_duration_diff_mean_seconds"].GetMetric() {
+		if slug := label(m, "slug"); slug != "" {
+			sink(slug)
+			means[slug] = append(means[slug], value(m))
+		}
+	}
+	for _, m := range families["upload_total_invalid_playlist_durations"].GetMetric() {
+		if slug := label(m, "slug"); slug != "" {
+			sink(slug).InvalidDurations += value(m)
+		}
+	}
+	for slug, sink := range sinks {
+		if len(means[slug]) > 0 {
+			sum := 0.0
+			for _, mean := range means[slug] {
+				sum += mean
+			}
+			sink.DeviationMean = sum / float64(len(means[slug]))
+		}
+		m := metrics[slug]
+		m.Sinks = append(m.Sinks, *sink)
+		metrics[slug] = m
+	}
+}
+
+// addViewers adds the viewer counts of a relay
+func addViewers(metrics map[string]streamMetrics, families map[string]*dto.MetricFamily) {
+	for _, m := range families["viewers"].GetMetric() {
+		slug := label(m, "stream")
+		if slug == "" {
+			continue
+		}
+		s := metrics[slug]
+		s.Viewers += int(value(m))
+		metrics[slug] = s
+	}
+}
@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+const uploadMetrics = `# TYPE playlist_duration_diff_max_seconds gauge
+playlist_duration_diff_max_seconds{slug="s1",playlist_name="a.m3u8"} 0.5
+playlist_duration_diff_max_seconds{slug="s1",playlist_name="b.m3u8"} 1.5
+# TYPE playlist_duration_diff_mean_seconds gauge
+playlist_duration_diff_mean_seconds{slug="s1",playlist_name="a.m3u8"} 0.25
+playlist_duration_diff_mean_seconds{slug="s1",playlist_name="b.m3u8"} 0.75
+# TYPE upload_total_invalid_playlist_durations counter
+upload_total_invalid_playlist_durations{slug="s1",playlist_name="b.m3u8"} 3
+`
+
+const viewerMetrics = `# TYPE viewers gauge
+viewers{stream="s1",type="hls",quality="hd",meta="",transport="https",variant="native"} 10
+viewers{stream="s1",type="dash",quality="sd",meta="",transport="https",variant="native"} 5
+viewers{stream="s2",type="hls",quality="hd",meta="",transport="https",variant="native"} 1
+`
+
+func TestScrape(t *testing.T) {
+	serve := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+	}
+	upload := serve(uploadMetrics)
+	defer upload.Close()
+	viewers := serve(viewerMetrics)
+	defer viewers.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	s := &scraper{
+		conf: config.MonitorScrapeConfig{
+			Upload:  []string{upload.URL, broken.URL},
+			Viewers: []string{viewers.URL},
+		},
+		client: &http.Client{Timeout: time.Second},
+	}
+	metrics := s.scrape(context.Background())
+	assert.DeepEqual(t, metrics, map[string]streamMetrics{
+		"s1": {
+			Sinks:   []sinkStatus{{Target: targetName(upload.URL), DeviationMax: 1.5, DeviationMean: 0.5, InvalidDurations: 3}},
+			Viewers: 15,
+		},
+		"s2": {Viewers: 1},
+	})
+}
+
+func TestStatus(t *testing.T) {
+	s, updates := newStateServer(t)
+	updates <- change{Topic: "streams", Key: "s1", Value: stream.Stream{Slug: "s1", Source: "ingest1", Format: "matroska"}}
+	updates <- change{Topic: "streamTranscoders", Key: "s1", Value: "transcoder1"}
+	updates <- change{Topic: "streamMetrics", Key: "s1", Value: streamMetrics{Viewers: 3}}
+	updates <- change{Topic: "streamMetrics", Key: "s2", Value: streamMetrics{Viewers: 1}}
+
+	api := mux.NewRouter()
+	s.registerAPI(api, &config.MonitorConfig{})
+
+	var status streamStatus
+	assert.Equal(t, request(t, api, "GET", "/status/s1", "", &status), http.StatusOK)
+	assert.DeepEqual(t, status, streamStatus{Slug: "s1", Source: "ingest1", Format: "matroska", Transcoder: "transcoder1", Sinks: []sinkStatus{}, Viewers: 3})
+
+	var list []streamStatus
+	assert.Equal(t, request(t, api, "GET", "/status", "", &list), http.StatusOK)
+	assert.Equal(t, len(list), 2)
+	assert.Equal(t, list[1].Slug, "s2")
+
+	// status is removed with its last source
+	updates <- change{Topic: "streamMetrics", Key: "s2"}
+	assert.Equal(t, request(t, api, "GET", "/status/s2", "", nil), http.StatusNotFound)
+
+	res := poll(t, s, "topics=status&slugs=s1")
+	assert.Equal(t, len(res.Snapshot["status"]), 1)
+}
@@ -0,0 +1,250 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPollWait is the time a long-poll request waits for changes without wait parameter
+	defaultPollWait = 30 * time.Second
+	maxPollWait     = 2 * time.Minute
+)
+
+// pollResponse is the result of a long-poll request
+type pollResponse struct {
+	Epoch    string                            `json:"epoch"`
+	Index    uint64                            `json:"index"`              // pass as index to the next request
+	Snapshot map[string]map[string]interface{} `json:"snapshot,omitempty"` // complete state if the index couldn't be resumed
+	Changes  []serverMessage                   `json:"changes"`
+}
+
+// subscriptionFromQuery parses the subscription of plain http clients,
+// topics and slugs are comma separated or repeated
+func subscriptionFromQuery(query url.Values, sinceParam string) (clientMessage, error) {
+	req := clientMessage{Type: "subscribe", Epoch: query.Get("epoch")}
+	for _, param := range query["topics"] {
+		req.Topics = append(req.Topics, splitList(param)...)
+	}
+	for _, param := range query["slugs"] {
+		req.Slugs = append(req.Slugs, splitList(param)...)
+	}
+	if since := query.Get(sinceParam); since != "" {
+		n, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return req, fmt.Errorf("invalid %s", sinceParam)
+		}
+		req.Since = n
+	}
+	return req, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// subscribe registers a subscriber for req and returns once the initial messages are queued,
+// it returns nil if the hub stopped
+func (s *server) subscribe(r *http.Request, req clientMessage) *subscriber {
+	sub := newSubscriber(userFromContext(r.Context()).role, false)
+	if !s.register(sub) {
+		return nil
+	}
+	done := make(chan struct{})
+	if !s.request(subscriberRequest{client: sub, req: req, done: done}) {
+		return nil
+	}
+	select {
+	case <-done:
+		return sub
+	case <-s.stop:
+		return nil
+	}
+}
+
+// queued returns the messages already queued for sub
+func queued(sub *subscriber) [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case data, ok := <-sub.send:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, data)
+		default:
+			return msgs
+		}
+	}
+}
+
+// subscriptionError returns the error sent in reply to the subscription, if any
+func subscriptionError(msgs [][]byte) string {
+	if len(msgs) == 0 {
+		return ""
+	}
+	var msg serverMessage
+	if err := json.Unmarshal(msgs[0], &msg); err != nil || msg.Type != "error" {
+		return ""
+	}
+	return msg.Error
+}
+
+// handleEvents streams the state messages as server-sent events
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	req, err := subscriptionFromQuery(r.URL.Query(), "since")
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// browsers resume with the id of the last event
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		epoch, seq, _ := strings.Cut(id, ":")
+		req.Epoch = epoch
+		req.Since, _ = strconv.ParseUint(seq, 10, 64)
+	}
+
+	sub := s.subscribe(r, req)
+	if sub == nil {
+		writeError(w, "monitor stopped", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unregister(sub)
+	initial := queued(sub)
+	if msg := subscriptionError(initial); msg != "" {
+		writeError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, data := range initial {
+		writeEvent(w, data)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-sub.send:
+			if !ok {
+				// dropped by the hub, the client reconnects with Last-Event-ID
+				return
+			}
+			writeEvent(w, data)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a state message as server-sent event, the id allows resuming
+func writeEvent(w http.ResponseWriter, data []byte) {
+	var msg serverMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Error().Err(err).Msg("monitor: event")
+		return
+	}
+	if msg.Seq > 0 {
+		fmt.Fprintf(w, "id: %s:%d\n", msg.Epoch, msg.Seq)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data)
+}
+
+// handlePoll returns the changes after index, waiting for the next change if there are none
+func (s *server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req, err := subscriptionFromQuery(query, "index")
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait := defaultPollWait
+	if param := query.Get("wait"); param != "" {
+		wait, err = time.ParseDuration(param)
+		if err != nil || wait < 0 {
+			writeError(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+	}
+
+	sub := s.subscribe(r, req)
+	if sub == nil {
+		writeError(w, "monitor stopped", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unregister(sub)
+	msgs := queued(sub)
+	if msg := subscriptionError(msgs); msg != "" {
+		writeError(w, msg, http.StatusBadRequest)
+		return
+	}
+	if len(msgs) == 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+		case data, ok := <-sub.send:
+			if ok {
+				msgs = append([][]byte{data}, queued(sub)...)
+			}
+		}
+	}
+
+	res := pollResponse{Epoch: req.Epoch, Index: req.Since, Changes: []serverMessage{}}
+	for _, data := range msgs {
+		var msg serverMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Error().Err(err).Msg("monitor: poll")
+			continue
+		}
+		res.Epoch = msg.Epoch
+		if msg.Type == "snapshot" && res.Snapshot == nil {
+			// a snapshot starts over, after a restart its seq is lower than the requested index
+			res.Index = msg.Seq
+		}
+		if msg.Seq > res.Index {
+			res.Index = msg.Seq
+		}
+		switch msg.Type {
+		case "snapshot":
+			if res.Snapshot == nil {
+				res.Snapshot = make(map[string]map[string]interface{})
+			}
+			state, _ := msg.Value.(map[string]interface{})
+			res.Snapshot[msg.Topic] = state
+		case "delta":
+			msg.Type, msg.Epoch = "", ""
+			res.Changes = append(res.Changes, msg)
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
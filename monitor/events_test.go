@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// newStateServer returns a server running the state hub and its update channel
+func newStateServer(t *testing.T) (*server, chan<- change) {
+	updates := make(chan change)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &server{
+		auth:         &noAuth{role: roleAdmin},
+		addClient:    make(chan *subscriber),
+		removeClient: make(chan *subscriber, 1),
+		requests:     make(chan subscriberRequest, 1),
+		queries:      make(chan func(*hub)),
+		updates:      updates,
+		stop:         ctx.Done(),
+	}
+	go s.runHub(ctx)
+	return s, updates
+}
+
+func poll(t *testing.T, s *server, query string) pollResponse {
+	var res pollResponse
+	req := httptest.NewRequest("GET", "/api/v1/state?"+query, nil)
+	rec := httptest.NewRecorder()
+	s.require(roleViewer, s.handlePoll)(rec, req)
+	assert.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	return res
+}
+
+func TestPoll(t *testing.T) {
+	s, updates := newStateServer(t)
+	updates <- change{Topic: "streams", Key: "s1", Value: "a"}
+
+	res := poll(t, s, "topics=streams")
+	assert.Equal(t, res.Index, uint64(1))
+	assert.DeepEqual(t, res.Snapshot, map[string]map[string]interface{}{"streams": {"s1": "a"}})
+
+	// no changes
+	next := poll(t, s, "topics=streams&wait=10ms&epoch="+res.Epoch+"&index=1")
+	assert.Equal(t, next.Index, uint64(1))
+	assert.Equal(t, len(next.Changes), 0)
+	assert.Assert(t, next.Snapshot == nil)
+
+	done := make(chan pollResponse)
+	go func() {
+		done <- poll(t, s, "topics=streams&slugs=s2&epoch="+res.Epoch+"&index=1")
+	}()
+	updates <- change{Topic: "streams", Key: "s1", Value: "b"}
+	updates <- change{Topic: "streams", Key: "s2", Value: "c"}
+	next = <-done
+	assert.Equal(t, next.Index, uint64(3))
+	assert.Equal(t, len(next.Changes), 1)
+	assert.Equal(t, next.Changes[0].Key, "s2")
+
+	// the index of another epoch is replaced by the snapshot index
+	next = poll(t, s, "topics=streams&epoch=old&index=100")
+	assert.Equal(t, next.Index, uint64(3))
+	assert.Assert(t, next.Snapshot != nil)
+
+	rec := httptest.NewRecorder()
+	s.require(roleViewer, s.handlePoll)(rec, httptest.NewRequest("GET", "/api/v1/state?topics=unknown", nil))
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+}
+
+func TestEvents(t *testing.T) {
+	s, updates := newStateServer(t)
+	updates <- change{Topic: "streams", Key: "s1", Value: "a"}
+	srv := httptest.NewServer(s.require(roleViewer, s.handleEvents))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"?topics=streams", nil)
+	assert.NilError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	// readEvent returns the id, type and data of the next event
+	scanner := bufio.NewScanner(res.Body)
+	readEvent := func() (string, string, string) {
+		var id, event, data string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				return id, event, data
+			}
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				event = value
+			case "data":
+				data = value
+			}
+		}
+		t.Fatal("stream ended", scanner.Err())
+		return "", "", ""
+	}
+
+	id, event, data := readEvent()
+	assert.Assert(t, strings.HasSuffix(id, ":1"))
+	assert.Equal(t, event, "snapshot")
+	assert.Assert(t, strings.Contains(data, `"s1":"a"`))
+
+	updates <- change{Topic: "streams", Key: "s1"}
+	id, event, data = readEvent()
+	assert.Assert(t, strings.HasSuffix(id, ":2"))
+	assert.Equal(t, event, "delta")
+	assert.Assert(t, strings.Contains(data, `"op":"delete"`))
+}
+
+func TestStoppedHub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &server{
+		auth:         &noAuth{role: roleAdmin},
+		addClient:    make(chan *subscriber),
+		removeClient: make(chan *subscriber, 1),
+		requests:     make(chan subscriberRequest, 1),
+		queries:      make(chan func(*hub)),
+		updates:      make(chan change),
+		stop:         ctx.Done(),
+	}
+	go s.runHub(ctx)
+	cancel()
+
+	// handlers don't block once the hub stopped
+	rec := httptest.NewRecorder()
+	s.require(roleViewer, s.handlePoll)(rec, httptest.NewRequest("GET", "/api/v1/state?topics=streams", nil))
+	assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+	s.unregister(newSubscriber(roleViewer, false))
+}
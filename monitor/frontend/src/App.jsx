@@ -8,6 +8,7 @@ import Header from './widgets/Header';
 import SpinnerOverlay from './widgets/SpinnerOverlay'
 import Monitor from './Monitor';
 import Settings from './Settings';
+import StreamTimeline from './widgets/StreamTimeline';
 
 function App() {
 
@@ -19,6 +20,9 @@ function App() {
         <Route path="/settings">
           <Settings />
         </Route>
+        <Route path="/streams/:slug/events">
+          <StreamTimeline />
+        </Route>
         <Route path="/">
           <Monitor />
         </Route>
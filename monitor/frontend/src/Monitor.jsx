@@ -1,11 +1,13 @@
 import React from 'react';
 import StreamList from './widgets/StreamList';
+import RejectedStreamList from './widgets/RejectedStreamList';
 import TranscoderList from './widgets/TranscoderList';
 import FanoutList from './widgets/FanoutList';
 
 function Monitor() {
     return <>
       <StreamList />
+      <RejectedStreamList />
       <TranscoderList />
       <FanoutList />
     </>;
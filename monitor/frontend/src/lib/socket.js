@@ -6,13 +6,13 @@ export default class Socket extends EventEmitter {
     this.reconnect()
   }
 
-  send() {
-    this.socket.apply(this.socket, arguments);
+  send(data) {
+    this.socket.send(data);
   }
 
   reconnect() {
     const proto = location.protocol == "http:" ? "ws:" : "wss:"
-    this.socket = new WebSocket(`${proto}//${location.host}/ws`);
+    this.socket = new WebSocket(`${proto}//${location.host}/ws`, ["stream-api.v1"]);
     this.socket.onopen = this.handleOpen.bind(this)
     this.socket.onmessage = this.handleMessage.bind(this)
     this.socket.onclose = this.handleClose.bind(this)
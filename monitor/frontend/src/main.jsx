@@ -2,7 +2,7 @@ import React from 'react'
 import ReactDOM from 'react-dom'
 import {Provider} from 'react-redux'
 import store from './redux/store'
-import {updateState, socketConnected, socketDisconnected} from './redux/actions'
+import {stateSnapshot, stateDelta, socketConnected, socketDisconnected} from './redux/actions'
 import App from './App'
 import Socket from './lib/socket'
 
@@ -15,6 +15,9 @@ ReactDOM.render(
 )
 
 const socket = new Socket();
+// position in the change stream, used to resume after reconnects
+let epoch = ""
+let seq = 0
 socket.on("message", (msg) => {
   if (typeof msg !== "string") {
     return
@@ -23,9 +26,26 @@ socket.on("message", (msg) => {
     msg = JSON.parse(msg)
   } catch(err) {
     console.log("json parse", err)
+    return
+  }
+  switch (msg.type) {
+    case "snapshot":
+      store.dispatch(stateSnapshot(msg.topic, msg.value))
+      break
+    case "delta":
+      store.dispatch(stateDelta(msg.topic, msg.key, msg.value))
+      break
+    case "error":
+      console.log("socket error", msg.error)
+      return
+    default:
+      return
   }
-  console.log("msg", msg)
-  store.dispatch(updateState(msg))
+  epoch = msg.epoch
+  seq = msg.seq || 0
 })
-socket.on("connect", () => store.dispatch(socketConnected()));
+socket.on("connect", () => {
+  socket.send(JSON.stringify({type: "subscribe", epoch, since: seq}))
+  store.dispatch(socketConnected())
+});
 socket.on("disconnect", () => store.dispatch(socketDisconnected()));
@@ -1,4 +1,4 @@
-import { get, post } from "../lib/ajax";
+import { get, put } from "../lib/ajax";
 
 export const UPDATE_STATE = 'UPDATE_STATE';
 
@@ -10,6 +10,14 @@ export const updateState = update => {
 };
 
 
+export const STATE_SNAPSHOT = 'STATE_SNAPSHOT';
+export const STATE_DELTA = 'STATE_DELTA';
+
+// stateSnapshot replaces the state of a topic
+export const stateSnapshot = (topic, value) => ({ type: STATE_SNAPSHOT, topic, value })
+// stateDelta changes a single key of a topic, value is undefined for deletes
+export const stateDelta = (topic, key, value) => ({ type: STATE_DELTA, topic, key, value })
+
 export const SOCKET_CONNECTED = 'SOCKET_CONNECTED';
 export const SOCKET_DISCONNECTED = 'SOCKET_DISCONNECTED';
 
@@ -22,7 +30,7 @@ export const FETCH_ERROR = 'FETCH_ERROR'
 
 export const setStreamSettings = (settings) => {
   return function (dispatch) {
-    post(`/stream/${settings.slug}/settings`, settings)
+    put(`/api/v1/settings/${settings.slug}`, settings)
       .then((res) => {
         dispatch({ type: SET_STREAM_SETTINGS, settings: res })
       })
@@ -34,7 +42,7 @@ export const setStreamSettings = (settings) => {
 
 export const getAllStreamSettings = () => {
   return function (dispatch) {
-    get(`/stream/settings`)
+    get(`/api/v1/settings`)
       .then((res) => {
         dispatch({ type: UPDATED_STREAM_SETTINGS, settings: res })
       })
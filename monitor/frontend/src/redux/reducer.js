@@ -1,4 +1,4 @@
-import { SOCKET_CONNECTED, SOCKET_DISCONNECTED, UPDATE_STATE, UPDATED_STREAM_SETTINGS } from "./actions"
+import { SET_STREAM_SETTINGS, STATE_DELTA, STATE_SNAPSHOT, SOCKET_CONNECTED, SOCKET_DISCONNECTED, UPDATE_STATE, UPDATED_STREAM_SETTINGS } from "./actions"
 
 const INITIAL_STATE = {
   streams: {},
@@ -6,6 +6,7 @@ const INITIAL_STATE = {
   streamTranscoders: {},
   streamSettings: {},
   fanouts: {},
+  rejectedStreams: {},
   socketConnected: false,
 };
 
@@ -17,6 +18,23 @@ export const reducer = (state = INITIAL_STATE, action) => {
         ...state,
         ...action,
       }
+    case STATE_SNAPSHOT:
+      return {
+        ...state,
+        [action.topic]: action.value,
+      }
+    case STATE_DELTA: {
+      const topic = { ...state[action.topic] }
+      if (action.value === undefined) {
+        delete topic[action.key]
+      } else {
+        topic[action.key] = action.value
+      }
+      return {
+        ...state,
+        [action.topic]: topic,
+      }
+    }
     case UPDATED_STREAM_SETTINGS:
       const settings = {};
       action.settings.forEach((item) => {
@@ -26,6 +44,18 @@ export const reducer = (state = INITIAL_STATE, action) => {
         ...state,
         streamSettings: settings,
       }
+    case SET_STREAM_SETTINGS:
+      // keep the stored version for the next change, errors have no slug
+      if (!action.settings.slug) {
+        return state
+      }
+      return {
+        ...state,
+        streamSettings: {
+          ...state.streamSettings,
+          [action.settings.slug]: action.settings,
+        },
+      }
     case SOCKET_CONNECTED:
       return {
         ...state,
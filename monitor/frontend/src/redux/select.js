@@ -3,5 +3,6 @@ export const selectTranscoders = state => state.transcoders
 export const selectStreamTranscoders = state => state.streamTranscoders
 export const selectStreamSettings = state => state.streamSettings
 export const selectFanouts = state => state.fanouts
+export const selectRejectedStreams = state => state.rejectedStreams
 
 export const selectSocketConnected = state => state.socketConnected
\ No newline at end of file
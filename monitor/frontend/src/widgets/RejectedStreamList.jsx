@@ -0,0 +1,35 @@
+import React from 'react';
+import {useSelector} from 'react-redux'
+import {selectRejectedStreams} from '../redux/select'
+
+function RejectedStreamItem(props) {
+  const {rejection} = props;
+  return <li className="card fluid warning">
+    <div className="section">
+      <h4>{rejection.slug}</h4>
+    </div>
+    <div className="section">
+      <p>Source: {rejection.source}</p>
+      <p>Reason: {rejection.reason}</p>
+    </div>
+  </li>
+}
+
+function RejectedStreamList() {
+  const rejectedStreams = useSelector(selectRejectedStreams);
+
+  if (Object.values(rejectedStreams).length == 0) {
+    return null
+  }
+
+  return (<div>
+    <h2>Rejected Streams</h2>
+    <ul style={{listStyleType: "none", paddingLeft: 0, display: "flex", flexFlow: "row wrap"}}>
+      {Object.entries(rejectedStreams).map(([slug, rejection]) => {
+        return <RejectedStreamItem key={slug} rejection={rejection}/>
+      })}
+    </ul>
+  </div>)
+}
+
+export default RejectedStreamList
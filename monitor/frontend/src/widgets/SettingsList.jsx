@@ -19,7 +19,8 @@ function SettingsItem(props) {
       {settings.slug}
     </td>
     <td data-label="Auth">
-      <input className="authKey" size="5" value={settings.secret} readOnly /><button className="secondary copyToClipboard inputAddon">Copy</button>
+      {/* secrets are only stored hashed, list the key ids instead */}
+      {(settings.keys || []).map((key) => key.id).join(", ") || (settings.secret ? "legacy" : "no auth")}
     </td>
     <td data-label="Notes">{settings.description}</td>
     <td style={{ textAlign: "right" }}>
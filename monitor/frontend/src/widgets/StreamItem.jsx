@@ -1,14 +1,17 @@
 import React from 'react';
+import {Link} from 'react-router-dom';
 
 function StreamItem(props) {
   const {stream, transcoder} = props;
   return <li className="card fluid">
     <div className="section">
-      <h4>{stream.slug}</h4>
+      <h4>{stream.slug} <Link to={`/streams/${stream.slug}/events`} className="button small">Timeline</Link></h4>
     </div>
     <div className="section">
       <p>Format: {stream.format}</p>
       <p>Source: {stream.source}</p>
+      <p>Visibility: {stream.public ? "public" : "private"}</p>
+      {stream.health ? <p>Health: {stream.health.status}{stream.health.error ? ` (${stream.health.error})` : null}</p> : null}
     </div>
     {transcoder ?
     <div className="section">
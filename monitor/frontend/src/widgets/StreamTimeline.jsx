@@ -0,0 +1,50 @@
+import React, {useEffect, useState} from 'react';
+import {Link, useParams} from 'react-router-dom';
+import {get} from '../lib/ajax';
+
+function formatFields(fields) {
+  if (!fields) {
+    return null
+  }
+  return Object.entries(fields).map(([key, value]) => `${key}=${value}`).join(" ")
+}
+
+function StreamTimeline() {
+  const {slug} = useParams();
+  const [events, setEvents] = useState(null);
+  const [error, setError] = useState(null);
+
+  useEffect(() => {
+    get(`/api/v1/streams/${encodeURIComponent(slug)}/events`).then((res) => {
+      if (!Array.isArray(res)) {
+        setError(res.error)
+        return
+      }
+      setEvents(res)
+    }).catch((err) => setError(err.toString()))
+  }, [slug]);
+
+  return <div>
+    <h2>Timeline of {slug} <Link to="/" className="button small">Back</Link></h2>
+    {error ? <mark className="secondary">{error}</mark> : null}
+    {events && events.length == 0 ? <p>No events recorded</p> : null}
+    {events && events.length > 0 ?
+    <table className="striped">
+      <thead>
+        <tr><th>Time</th><th>Module</th><th>Source</th><th>Event</th><th>Details</th></tr>
+      </thead>
+      <tbody>
+        {events.slice().reverse().map((e, i) => <tr key={i}>
+          <td data-label="Time">{new Date(e.time).toLocaleString()}</td>
+          <td data-label="Module">{e.module}</td>
+          <td data-label="Source">{e.source}</td>
+          <td data-label="Event">{e.type}</td>
+          <td data-label="Details">{e.message} {formatFields(e.fields)}</td>
+        </tr>)}
+      </tbody>
+    </table>
+    : null}
+  </div>
+}
+
+export default StreamTimeline
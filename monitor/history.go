@@ -0,0 +1,333 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/logging"
+	"github.com/voc/stream-api/stream"
+)
+
+// settingsVersion is a history entry recorded for every settings change
+type settingsVersion struct {
+	Version      int              `json:"version"`
+	Time         time.Time        `json:"time"`
+	Author       string           `json:"author"`
+	Action       string           `json:"action"` // create, update, delete, restore, addKey or revokeKey
+	RestoredFrom int              `json:"restoredFrom,omitempty"`
+	Changes      []settingsChange `json:"changes"`
+	Settings     *stream.Settings `json:"settings,omitempty"` // unset after delete
+}
+
+// settingsChange is the change of a single settings field, nested fields are joined by dots
+type settingsChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+// redacted returns a copy of the version safe for api responses
+func (v settingsVersion) redacted() settingsVersion {
+	if v.Settings != nil {
+		settings := v.Settings.Redacted()
+		v.Settings = &settings
+	}
+	return v
+}
+
+// settingsStore writes stream settings and records their history
+type settingsStore struct {
+	api  client.KVAPI
+	size int // versions kept per stream, 0 keeps all
+
+	// serializes local changes, concurrent writers are detected by compare-and-swap
+	mutex sync.Mutex
+}
+
+// settingsRetries is the number of attempts of an update conflicting with concurrent writers
+const settingsRetries = 3
+
+func newSettingsStore(api client.KVAPI, size int) *settingsStore {
+	return &settingsStore{api: api, size: size}
+}
+
+// update applies fn to the current settings of slug, stores the result and records it in the history.
+// The change is rejected if expected is set and doesn't match the current version.
+// fn gets nil if there are no settings and returns nil to delete them.
+func (st *settingsStore) update(ctx context.Context, slug string, expected int, entry settingsVersion, fn func(current *stream.Settings) (*stream.Settings, error)) (*stream.Settings, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for i := 0; ; i++ {
+		next, err := st.tryUpdate(ctx, slug, expected, entry, fn)
+		if errors.Is(err, client.ErrModified) && i < settingsRetries-1 {
+			// fn is applied again to the new settings, a set expected version fails now
+			continue
+		}
+		if errors.Is(err, client.ErrModified) {
+			return nil, &httpError{http.StatusConflict, "settings were changed concurrently"}
+		}
+		return next, err
+	}
+}
+
+func (st *settingsStore) tryUpdate(ctx context.Context, slug string, expected int, entry settingsVersion, fn func(current *stream.Settings) (*stream.Settings, error)) (*stream.Settings, error) {
+	current, index, err := getStreamSettingsWithIndex(ctx, st.api, slug)
+	if err != nil {
+		return nil, err
+	}
+	if expected > 0 && (current == nil || current.Version != expected) {
+		version := 0
+		if current != nil {
+			version = current.Version
+		}
+		return nil, &httpError{http.StatusPreconditionFailed, fmt.Sprintf("settings were changed, current version is %d", version)}
+	}
+	next, err := fn(current)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := st.versions(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	entry.Version = 1
+	if len(history) > 0 {
+		entry.Version = history[len(history)-1].Version + 1
+	}
+	if current != nil && current.Version >= entry.Version {
+		entry.Version = current.Version + 1
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	path := client.StreamSettingsPath(slug)
+	if next != nil {
+		next.Slug = slug
+		next.Version = entry.Version
+		// never store plaintext secrets
+		if err := next.HashSecret(newKeyID()); err != nil {
+			return nil, fmt.Errorf("hash failed: %w", err)
+		}
+		if err := next.Validate(); err != nil {
+			return nil, &httpError{http.StatusUnprocessableEntity, err.Error()}
+		}
+		data, err := json.Marshal(next)
+		if err != nil {
+			return nil, fmt.Errorf("marshal failed: %w", err)
+		}
+		if err := st.api.CompareAndSwap(ctx, path, data, index); err != nil {
+			return nil, fmt.Errorf("put failed: %w", err)
+		}
+	} else if current != nil {
+		if err := st.api.CompareAndDelete(ctx, path, index); err != nil {
+			return nil, fmt.Errorf("delete failed: %w", err)
+		}
+	}
+
+	switch {
+	case next == nil:
+		entry.Action = "delete"
+	case entry.Action != "":
+	case current == nil:
+		entry.Action = "create"
+	default:
+		entry.Action = "update"
+	}
+	entry.Time = time.Now().UTC()
+	entry.Changes = diffSettings(current, next)
+	entry.Settings = next
+	st.record(ctx, slug, entry, history)
+	return next, nil
+}
+
+// SetSettings stores the settings of slug outside of the monitor and records the change by author in the history,
+// nil settings delete the stored settings
+func SetSettings(ctx context.Context, api client.KVAPI, slug string, settings *stream.Settings, author string) (*stream.Settings, error) {
+	store := newSettingsStore(api, 0)
+	return store.update(ctx, slug, 0, settingsVersion{Author: author}, func(current *stream.Settings) (*stream.Settings, error) {
+		if settings == nil {
+			if current == nil {
+				return nil, fmt.Errorf("no settings for %s", slug)
+			}
+			return nil, nil
+		}
+		return settings, mergeKeys(settings, current)
+	})
+}
+
+// record appends entry to the history and removes the versions exceeding the history size
+func (st *settingsStore) record(ctx context.Context, slug string, entry settingsVersion, history []settingsVersion) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Err(err).Msg("history marshal")
+		return
+	}
+	if err := st.api.Put(ctx, client.SettingsHistoryPath(slug, entry.Version), data); err != nil {
+		log.Error().Err(err).Str(logging.SlugField, slug).Msg("history put")
+		return
+	}
+	if st.size <= 0 {
+		return
+	}
+	// history doesn't contain entry yet
+	for i := 0; i <= len(history)-st.size; i++ {
+		if err := st.api.Delete(ctx, client.SettingsHistoryPath(slug, history[i].Version)); err != nil {
+			log.Error().Err(err).Str(logging.SlugField, slug).Msg("history prune")
+		}
+	}
+}
+
+// versions returns the recorded history of slug, oldest first
+func (st *settingsStore) versions(ctx context.Context, slug string) ([]settingsVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	fields, err := st.api.GetWithPrefix(ctx, client.SettingsHistoryPrefix+slug+"/")
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+	versions := make([]settingsVersion, 0, len(fields))
+	for _, field := range fields {
+		var v settingsVersion
+		if err := json.Unmarshal(field.Value, &v); err != nil {
+			log.Error().Err(err).Str("key", string(field.Key)).Msg("history unmarshal")
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+// revokedKeys returns the hashes of the keys of v which were removed by a later version,
+// deleting the settings doesn't revoke their keys
+func (st *settingsStore) revokedKeys(ctx context.Context, slug string, v *settingsVersion) (map[string]bool, error) {
+	history, err := st.versions(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, key := range v.Settings.Keys {
+		keys[key.Hash] = true
+	}
+	for _, later := range history {
+		if later.Version <= v.Version || later.Settings == nil {
+			continue
+		}
+		kept := make(map[string]bool)
+		for _, key := range later.Settings.Keys {
+			kept[key.Hash] = true
+		}
+		for hash := range keys {
+			if !kept[hash] {
+				revoked[hash] = true
+				delete(keys, hash)
+			}
+		}
+	}
+	return revoked, nil
+}
+
+// version returns a recorded version of slug, or nil if it doesn't exist
+func (st *settingsStore) version(ctx context.Context, slug string, version int) (*settingsVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	data, err := st.api.Get(ctx, client.SettingsHistoryPath(slug, version))
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var v settingsVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("unmarshal failed: %w", err)
+	}
+	return &v, nil
+}
+
+// diffSettings returns the changed fields between two settings, key hashes are not compared
+func diffSettings(old *stream.Settings, new *stream.Settings) []settingsChange {
+	before := flattenSettings(old)
+	after := flattenSettings(new)
+	fields := make(map[string]struct{})
+	for field := range before {
+		fields[field] = struct{}{}
+	}
+	for field := range after {
+		fields[field] = struct{}{}
+	}
+
+	changes := []settingsChange{}
+	for field := range fields {
+		if field == "version" || reflect.DeepEqual(before[field], after[field]) {
+			continue
+		}
+		changes = append(changes, settingsChange{Field: field, Old: before[field], New: after[field]})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// flattenSettings returns the json fields of the redacted settings by dotted path
+func flattenSettings(settings *stream.Settings) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if settings == nil {
+		return fields
+	}
+	data, err := json.Marshal(settings.Redacted())
+	if err != nil {
+		log.Error().Err(err).Msg("diff marshal")
+		return fields
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		log.Error().Err(err).Msg("diff unmarshal")
+		return fields
+	}
+	flatten("", v, fields)
+	return fields
+}
+
+func flatten(prefix string, v interface{}, out map[string]interface{}) {
+	object, ok := v.(map[string]interface{})
+	if !ok {
+		out[prefix] = v
+		return
+	}
+	for key, value := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flatten(key, value, out)
+	}
+}
+
+// ifMatch returns the settings version required by the If-Match header, or 0 if there is none
+func ifMatch(r *http.Request) (int, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil || version <= 0 {
+		return 0, &httpError{http.StatusBadRequest, "invalid If-Match header"}
+	}
+	return version, nil
+}
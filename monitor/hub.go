@@ -0,0 +1,327 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// protocolV1 is the websocket subprotocol of the incremental protocol,
+	// clients without subprotocol receive the complete state of every changed topic
+	protocolV1 = "stream-api.v1"
+
+	// sendQueueSize is the number of messages queued per client, slower clients are disconnected
+	sendQueueSize = 256
+
+	// changeBacklog is the number of changes kept for clients resuming after a reconnect
+	changeBacklog = 1024
+)
+
+// topics are the state topics clients can subscribe to
+var topics = []string{"streams", "transcoders", "streamTranscoders", "rejectedStreams", "streamMetrics", "status", "alerts"}
+
+// slugTopics are keyed by stream slug and support slug filters
+var slugTopics = map[string]bool{
+	"streams":           true,
+	"streamTranscoders": true,
+	"rejectedStreams":   true,
+	"streamMetrics":     true,
+	"status":            true,
+}
+
+// statusSources are the topics joined into the stream status
+var statusSources = map[string]bool{
+	"streams":           true,
+	"streamTranscoders": true,
+	"streamMetrics":     true,
+}
+
+// change is the change of a single state key
+type change struct {
+	Topic string
+	Key   string
+	Value interface{} // nil if the key was deleted
+}
+
+// sequencedChange is a change with its position in the change stream
+type sequencedChange struct {
+	change
+	seq uint64
+}
+
+// serverMessage is sent from the server to v1 clients
+type serverMessage struct {
+	Type  string      `json:"type"` // snapshot, delta or error
+	Epoch string      `json:"epoch,omitempty"`
+	Seq   uint64      `json:"seq,omitempty"`
+	Topic string      `json:"topic,omitempty"`
+	Key   string      `json:"key,omitempty"`
+	Op    string      `json:"op,omitempty"`    // put or delete
+	Value interface{} `json:"value,omitempty"` // the new value or the filtered topic state for snapshots
+	Error string      `json:"error,omitempty"`
+}
+
+// clientMessage is sent from v1 clients to the server
+type clientMessage struct {
+	Type   string   `json:"type"`   // subscribe or resync
+	Topics []string `json:"topics"` // defaults to all topics permitted for the client
+	Slugs  []string `json:"slugs"`  // only receive these streams, empty for all
+	Epoch  string   `json:"epoch"`  // epoch and seq of the last received message when resuming
+	Since  uint64   `json:"since"`
+}
+
+// subscriber is a client receiving state updates
+type subscriber struct {
+	role   role
+	legacy bool
+	send   chan []byte
+
+	// subscription, only accessed by the hub
+	topics map[string]bool
+	slugs  map[string]bool
+	closed bool
+}
+
+func newSubscriber(r role, legacy bool) *subscriber {
+	return &subscriber{
+		role:   r,
+		legacy: legacy,
+		send:   make(chan []byte, sendQueueSize),
+		topics: make(map[string]bool),
+	}
+}
+
+// wants reports whether the subscriber receives changes of key in topic
+func (c *subscriber) wants(topic string, key string) bool {
+	if !c.topics[topic] {
+		return false
+	}
+	return len(c.slugs) == 0 || !slugTopics[topic] || c.slugs[key]
+}
+
+// subscriberRequest is a request received from a subscriber
+type subscriberRequest struct {
+	client *subscriber
+	req    clientMessage
+	done   chan struct{} // closed after the request was handled, optional
+}
+
+// hub keeps the monitor state and distributes changes to the subscribers,
+// it is only accessed from the server loop
+type hub struct {
+	epoch   string
+	seq     uint64
+	state   map[string]map[string]interface{}
+	backlog []sequencedChange
+	clients map[*subscriber]bool
+}
+
+func newHub() *hub {
+	h := &hub{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		state:   make(map[string]map[string]interface{}),
+		clients: make(map[*subscriber]bool),
+	}
+	for _, topic := range topics {
+		h.state[topic] = make(map[string]interface{})
+	}
+	return h
+}
+
+// add registers a client, legacy clients are subscribed to all permitted topics
+func (h *hub) add(c *subscriber) {
+	h.clients[c] = true
+	if !c.legacy {
+		return
+	}
+	state := make(map[string]interface{}, len(h.state))
+	for topic, values := range h.state {
+		state[topic] = values
+	}
+	state = filterState(state, c.role)
+	for topic := range state {
+		c.topics[topic] = true
+	}
+	h.sendJSON(c, state)
+}
+
+// remove unregisters a client and closes its queue
+func (h *hub) remove(c *subscriber) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// permitted reports whether the role may subscribe to topic
+func permitted(topic string, r role) bool {
+	required, ok := stateRoles[topic]
+	return !ok || r >= required
+}
+
+// handle applies a subscription request of a v1 client
+func (h *hub) handle(c *subscriber, req clientMessage) {
+	if !h.clients[c] || c.legacy {
+		return
+	}
+	switch req.Type {
+	case "subscribe":
+	case "resync":
+		h.snapshot(c)
+		return
+	default:
+		h.sendJSON(c, serverMessage{Type: "error", Error: fmt.Sprintf("unknown request '%s'", req.Type)})
+		return
+	}
+
+	subscribed := make(map[string]bool)
+	explicit := len(req.Topics) > 0
+	if !explicit {
+		req.Topics = topics
+	}
+	for _, topic := range req.Topics {
+		if _, ok := h.state[topic]; !ok {
+			h.sendJSON(c, serverMessage{Type: "error", Error: fmt.Sprintf("unknown topic '%s'", topic)})
+			return
+		}
+		if !permitted(topic, c.role) {
+			if explicit {
+				h.sendJSON(c, serverMessage{Type: "error", Error: fmt.Sprintf("topic '%s' not permitted", topic)})
+				return
+			}
+			continue
+		}
+		subscribed[topic] = true
+	}
+	c.topics = subscribed
+	c.slugs = nil
+	if len(req.Slugs) > 0 {
+		c.slugs = make(map[string]bool)
+		for _, slug := range req.Slugs {
+			c.slugs[slug] = true
+		}
+	}
+
+	if !h.resume(c, req.Epoch, req.Since) {
+		h.snapshot(c)
+	}
+}
+
+// resume replays the changes after since, it fails if they are not in the backlog anymore
+func (h *hub) resume(c *subscriber, epoch string, since uint64) bool {
+	if epoch != h.epoch || since > h.seq {
+		return false
+	}
+	if since < h.seq && (len(h.backlog) == 0 || h.backlog[0].seq > since+1) {
+		return false
+	}
+	var missed []sequencedChange
+	for _, ch := range h.backlog {
+		if ch.seq > since && c.wants(ch.Topic, ch.Key) {
+			missed = append(missed, ch)
+		}
+	}
+	// a snapshot is smaller than replaying many changes and doesn't overflow the queue
+	if len(missed) > sendQueueSize/2 {
+		return false
+	}
+	for _, ch := range missed {
+		h.sendJSON(c, h.delta(ch))
+	}
+	return true
+}
+
+// snapshot sends the filtered state of all subscribed topics
+func (h *hub) snapshot(c *subscriber) {
+	for _, topic := range topics {
+		if !c.topics[topic] {
+			continue
+		}
+		state := make(map[string]interface{})
+		for key, value := range h.state[topic] {
+			if c.wants(topic, key) {
+				state[key] = value
+			}
+		}
+		h.sendJSON(c, serverMessage{Type: "snapshot", Epoch: h.epoch, Seq: h.seq, Topic: topic, Value: state})
+	}
+}
+
+func (h *hub) delta(ch sequencedChange) serverMessage {
+	msg := serverMessage{Type: "delta", Epoch: h.epoch, Seq: ch.seq, Topic: ch.Topic, Key: ch.Key, Op: "put", Value: ch.Value}
+	if ch.Value == nil {
+		msg.Op = "delete"
+	}
+	return msg
+}
+
+// apply updates the state and sends the change to the subscribers
+func (h *hub) apply(ch change) {
+	state, ok := h.state[ch.Topic]
+	if !ok {
+		log.Error().Str("topic", ch.Topic).Msg("monitor: unknown topic")
+		return
+	}
+	if ch.Value == nil {
+		delete(state, ch.Key)
+	} else {
+		state[ch.Key] = ch.Value
+	}
+	h.seq++
+	sc := sequencedChange{change: ch, seq: h.seq}
+	h.backlog = append(h.backlog, sc)
+	if len(h.backlog) > changeBacklog {
+		h.backlog = h.backlog[len(h.backlog)-changeBacklog:]
+	}
+
+	var delta, legacy []byte
+	for c := range h.clients {
+		if !c.wants(ch.Topic, ch.Key) {
+			continue
+		}
+		var err error
+		if c.legacy {
+			if legacy == nil {
+				legacy, err = json.Marshal(map[string]interface{}{ch.Topic: state})
+			}
+			h.send(c, legacy, err)
+		} else {
+			if delta == nil {
+				delta, err = json.Marshal(h.delta(sc))
+			}
+			h.send(c, delta, err)
+		}
+	}
+
+	if statusSources[ch.Topic] {
+		h.updateStatus(ch.Key)
+	}
+}
+
+func (h *hub) sendJSON(c *subscriber, v interface{}) {
+	data, err := json.Marshal(v)
+	h.send(c, data, err)
+}
+
+// send queues a message without blocking, clients with a full queue are dropped and have to resync
+func (h *hub) send(c *subscriber, data []byte, err error) {
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: marshal")
+		return
+	}
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		log.Warn().Msg("monitor: dropping slow client")
+		h.remove(c)
+	}
+}
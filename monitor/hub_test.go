@@ -0,0 +1,144 @@
+package monitor
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// received decodes the queued messages of c
+func received(t *testing.T, c *subscriber) []serverMessage {
+	var msgs []serverMessage
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				return msgs
+			}
+			var msg serverMessage
+			assert.NilError(t, json.Unmarshal(data, &msg))
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// viewerTopics are the topics sent to viewers, all but rejectedStreams
+var viewerTopics = []string{"alerts", "status", "streamMetrics", "streamTranscoders", "streams", "transcoders"}
+
+// snapshotTopics returns the sorted topics of the snapshots in msgs
+func snapshotTopics(msgs []serverMessage) []string {
+	var names []string
+	for _, msg := range msgs {
+		if msg.Type == "snapshot" {
+			names = append(names, msg.Topic)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestHubSubscribe(t *testing.T) {
+	h := newHub()
+	h.apply(change{Topic: "streams", Key: "s1", Value: "a"})
+	h.apply(change{Topic: "streams", Key: "s2", Value: "b"})
+
+	c := newSubscriber(roleViewer, false)
+	h.add(c)
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"streams"}, Slugs: []string{"s1"}})
+	msgs := received(t, c)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Type, "snapshot")
+	assert.Equal(t, msgs[0].Seq, uint64(2))
+	assert.DeepEqual(t, msgs[0].Value, map[string]interface{}{"s1": "a"})
+
+	// only subscribed topics and slugs are sent
+	h.apply(change{Topic: "streams", Key: "s2", Value: "c"})
+	h.apply(change{Topic: "transcoders", Key: "t1", Value: "d"})
+	h.apply(change{Topic: "streams", Key: "s1"})
+	msgs = received(t, c)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Type, "delta")
+	assert.Equal(t, msgs[0].Seq, uint64(5))
+	assert.Equal(t, msgs[0].Op, "delete")
+
+	// viewers can't subscribe to rejected streams
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"rejectedStreams"}})
+	msgs = received(t, c)
+	assert.Equal(t, msgs[0].Type, "error")
+	h.handle(c, clientMessage{Type: "subscribe"})
+	msgs = received(t, c)
+	assert.Equal(t, len(msgs), len(viewerTopics))
+	assert.DeepEqual(t, snapshotTopics(msgs), viewerTopics)
+}
+
+func TestHubResume(t *testing.T) {
+	h := newHub()
+	c := newSubscriber(roleOperator, false)
+	h.add(c)
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"streams"}})
+	msgs := received(t, c)
+	epoch := msgs[0].Epoch
+
+	h.apply(change{Topic: "streams", Key: "s1", Value: "a"})
+	h.apply(change{Topic: "streams", Key: "s2", Value: "b"})
+	received(t, c)
+	h.remove(c)
+
+	// reconnect with the last received sequence
+	c = newSubscriber(roleOperator, false)
+	h.add(c)
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"streams"}, Epoch: epoch, Since: 1})
+	msgs = received(t, c)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Type, "delta")
+	assert.Equal(t, msgs[0].Key, "s2")
+
+	// gaps and other epochs resync
+	for i := 0; i <= changeBacklog; i++ {
+		h.apply(change{Topic: "transcoders", Key: "t1", Value: i})
+	}
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"streams"}, Epoch: epoch, Since: 2})
+	msgs = received(t, c)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].Type, "snapshot")
+	h.handle(c, clientMessage{Type: "subscribe", Topics: []string{"streams"}, Epoch: "other", Since: h.seq})
+	assert.Equal(t, received(t, c)[0].Type, "snapshot")
+}
+
+func TestHubSlowClient(t *testing.T) {
+	h := newHub()
+	c := newSubscriber(roleViewer, false)
+	h.add(c)
+	h.handle(c, clientMessage{Type: "subscribe"})
+	for i := 0; i <= sendQueueSize; i++ {
+		h.apply(change{Topic: "streams", Key: "s1", Value: i})
+	}
+	assert.Assert(t, !h.clients[c])
+	assert.Equal(t, len(received(t, c)), sendQueueSize)
+	// further changes are not sent to the closed queue
+	h.apply(change{Topic: "streams", Key: "s1", Value: "a"})
+}
+
+func TestHubLegacy(t *testing.T) {
+	h := newHub()
+	h.apply(change{Topic: "rejectedStreams", Key: "s1", Value: "a"})
+	c := newSubscriber(roleViewer, true)
+	h.add(c)
+	var state map[string]interface{}
+	assert.NilError(t, json.Unmarshal(<-c.send, &state))
+	var names []string
+	for topic := range state {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+	assert.DeepEqual(t, names, viewerTopics)
+
+	h.apply(change{Topic: "streams", Key: "s1", Value: "a"})
+	state = nil
+	assert.NilError(t, json.Unmarshal(<-c.send, &state))
+	assert.DeepEqual(t, state, map[string]interface{}{"streams": map[string]interface{}{"s1": "a"}})
+}
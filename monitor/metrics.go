@@ -0,0 +1,25 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// registerMetrics registers the monitor metrics, they are read from the server when scraped
+func (s *server) registerMetrics(reg prometheus.Registerer) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "monitor_subscribers",
+		Help: "Number of websocket and plain http clients subscribed to the monitor state",
+	}, func() float64 {
+		return float64(s.subscribers.Load())
+	})
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "monitor_alerts_firing",
+		Help: "Number of firing alerts, including silenced alerts",
+	}, func() float64 {
+		return float64(s.alerts.count())
+	})
+}
@@ -2,27 +2,55 @@ package monitor
 
 import (
 	"context"
+	"fmt"
 
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/voc/stream-api/auth/token"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("monitor")
+
 type Monitor struct {
-	server *server
+	server  *server
+	watcher *watcher
 }
 
-func New(ctx context.Context, conf config.MonitorConfig, api client.ServiceAPI) *Monitor {
+// New starts the monitor, it returns an error if the config can't be applied or the address can't be listened on
+func New(ctx context.Context, conf config.MonitorConfig, tokenConf config.TokenConfig, api client.ServiceAPI, reg prometheus.Registerer) (*Monitor, error) {
 	log.Debug().Msgf("monitor config %v", conf)
-	watcher := newWatcher(ctx, api)
+	tokens, err := token.NewKeyring(tokenConf)
+	if err != nil {
+		return nil, fmt.Errorf("tokens: %w", err)
+	}
+	auth, err := newAuthenticator(conf.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	if a, ok := auth.(*noAuth); ok {
+		log.Warn().Stringer("role", a.role).Msg("monitor: authentication disabled, everyone reaching the monitor has this role")
+	}
+	// state changes of the watcher and scraper
+	updates := make(chan change, 16)
+	server, err := newServer(ctx, api, tokens, auth, updates, conf, reg)
+	if err != nil {
+		return nil, err
+	}
 	m := &Monitor{
-		server: newServer(ctx, api, watcher.listen(), conf),
+		server:  server,
+		watcher: newWatcher(ctx, api, updates),
+	}
+	if len(conf.Scrape.Upload) > 0 || len(conf.Scrape.Viewers) > 0 {
+		newScraper(ctx, conf.Scrape, updates)
 	}
 
-	return m
+	return m, nil
 }
 
 func (m *Monitor) Wait() {
 	m.server.Wait()
+	m.watcher.Wait()
 }
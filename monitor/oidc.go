@@ -0,0 +1,467 @@
+package monitor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voc/stream-api/config"
+)
+
+const (
+	sessionCookie = "monitor_session"
+	stateCookie   = "monitor_oidc_state"
+)
+
+var b64 = base64.RawURLEncoding
+
+// oidcAuth authenticates users via OpenID Connect authorization code flow and keeps them in a signed session cookie,
+// API clients may also send an id token as bearer token
+type oidcAuth struct {
+	conf          config.MonitorOIDCConfig
+	roles         *roleMap
+	sessionSecret []byte
+	client        *http.Client
+
+	mutex       sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// minimum time between key set fetches, limits refetches caused by tokens with unknown key ids
+const keysRefetchInterval = time.Minute
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type session struct {
+	User      string `json:"user"`
+	Role      role   `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func newOIDCAuth(conf config.MonitorOIDCConfig, roles *roleMap) (*oidcAuth, error) {
+	if conf.Issuer == "" || conf.ClientID == "" || conf.RedirectURL == "" {
+		return nil, errors.New("oidc auth requires issuer, clientID and redirectURL")
+	}
+	secret := []byte(conf.SessionSecret)
+	if len(secret) == 0 {
+		// sessions won't survive a restart
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &oidcAuth{
+		conf:          conf,
+		roles:         roles,
+		sessionSecret: secret,
+		client:        &http.Client{Timeout: time.Second * 10},
+	}, nil
+}
+
+func (a *oidcAuth) authenticate(r *http.Request) (*principal, error) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := a.verifyIDToken(bearer, time.Now())
+		if err != nil {
+			log.Debug().Err(err).Msg("monitor: bearer token")
+			return nil, errUnauthenticated
+		}
+		return a.principal(claims), nil
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	var s session
+	if !a.open(cookie.Value, &s) || time.Now().Unix() >= s.ExpiresAt {
+		return nil, errUnauthenticated
+	}
+	return &principal{name: s.User, role: s.Role}, nil
+}
+
+// challenge redirects browsers to the login, api clients just get 401
+func (a *oidcAuth) challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Location", "/auth/login")
+	}
+}
+
+func (a *oidcAuth) principal(claims map[string]interface{}) *principal {
+	user, _ := claims["preferred_username"].(string)
+	if user == "" {
+		user, _ = claims["sub"].(string)
+	}
+	var groups []string
+	switch v := claims[a.conf.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, group := range v {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+	return &principal{name: user, role: a.roles.resolve(user, groups)}
+}
+
+// seal signs v into a cookie value
+func (a *oidcAuth) seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := b64.EncodeToString(data)
+	mac := hmac.New(sha256.New, a.sessionSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + b64.EncodeToString(mac.Sum(nil)), nil
+}
+
+// open verifies a cookie value created by seal and decodes it into v
+func (a *oidcAuth) open(value string, v interface{}) bool {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	sig, err := b64.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.sessionSecret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false
+	}
+	data, err := b64.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (a *oidcAuth) getDiscovery() (*oidcDiscovery, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.discovery != nil {
+		return a.discovery, nil
+	}
+	var d oidcDiscovery
+	err := a.getJSON(strings.TrimSuffix(a.conf.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.Issuer != a.conf.Issuer {
+		return nil, fmt.Errorf("discovery: issuer mismatch '%s'", d.Issuer)
+	}
+	a.discovery = &d
+	return a.discovery, nil
+}
+
+func (a *oidcAuth) getJSON(url string, v interface{}) error {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return decodeJSON(resp.Body, v)
+}
+
+// key returns the provider key with the given id, the key set is refetched for unknown ids
+func (a *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mutex.Lock()
+	key, ok := a.keys[kid]
+	recent := time.Since(a.keysFetched) < keysRefetchInterval
+	a.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	if recent {
+		return nil, fmt.Errorf("unknown key '%s'", kid)
+	}
+
+	d, err := a.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := a.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		parsed, err := k.publicKey()
+		if err != nil {
+			log.Debug().Err(err).Str("kid", k.Kid).Msg("monitor: skipping jwk")
+			continue
+		}
+		keys[k.Kid] = parsed
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys = keys
+	a.keysFetched = time.Now()
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", kid)
+	}
+	return key, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// verifyIDToken checks signature, issuer, audience and expiry of an id token and returns its claims
+func (a *oidcAuth) verifyIDToken(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed header")
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected algorithm '%s'", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unexpected algorithm '%s'", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	data, err = b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != a.conf.Issuer {
+		return nil, fmt.Errorf("issuer mismatch '%s'", iss)
+	}
+	if !audienceContains(claims["aud"], a.conf.ClientID) {
+		return nil, errors.New("audience mismatch")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.Unix() >= int64(exp) {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, entry := range v {
+			if entry == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleLogin redirects to the provider
+func (a *oidcAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	d, err := a.getDiscovery()
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: oidc")
+		http.Error(w, "login unavailable", http.StatusBadGateway)
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "login unavailable", http.StatusInternalServerError)
+		return
+	}
+	state := b64.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(a.conf.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.conf.ClientID},
+		"redirect_uri":  {a.conf.RedirectURL},
+		"scope":         {"openid profile " + a.conf.GroupsClaim},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// handleCallback exchanges the authorization code and creates the session
+func (a *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(stateCookie)
+	state := r.URL.Query().Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	d, err := a.getDiscovery()
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: oidc")
+		http.Error(w, "login unavailable", http.StatusBadGateway)
+		return
+	}
+
+	resp, err := a.client.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {a.conf.RedirectURL},
+		"client_id":     {a.conf.ClientID},
+		"client_secret": {a.conf.ClientSecret},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: oidc token")
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Msgf("monitor: oidc token status %s", resp.Status)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if err := decodeJSON(resp.Body, &tokenResponse); err != nil {
+		log.Error().Err(err).Msg("monitor: oidc token")
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := a.verifyIDToken(tokenResponse.IDToken, time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("monitor: oidc id token")
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state {
+		http.Error(w, "invalid nonce", http.StatusUnauthorized)
+		return
+	}
+
+	user := a.principal(claims)
+	if user.role == roleNone {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	value, err := a.seal(session{User: user.name, Role: user.role, ExpiresAt: time.Now().Add(a.conf.SessionTTL).Unix()})
+	if err != nil {
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(a.conf.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(a.conf.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Info().Msgf("monitor: %s logged in as %s", user.name, user.role)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,202 @@
+package monitor
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schema is a subset of the OpenAPI 3 schema object
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+}
+
+// schemaBuilder derives schemas from go types, named structs are collected as components
+type schemaBuilder struct {
+	components map[string]*schema
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) *schema {
+	switch t {
+	case timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &schema{Type: "integer", Format: "int64"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: b.schema(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := b.components[name]; !ok {
+			// reserve name before descending for recursive types
+			b.components[name] = &schema{}
+			*b.components[name] = *b.structSchema(t)
+		}
+		return &schema{Ref: "#/components/schemas/" + name}
+	}
+	// interface{} and others allow any value
+	return &schema{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: make(map[string]*schema)}
+	b.addFields(s, t)
+	return s
+}
+
+// addFields adds the json encoded fields of t to s, embedded structs are inlined like encoding/json does
+func (b *schemaBuilder) addFields(s *schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(s, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = b.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+type openAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *schema `json:"schema"`
+}
+
+type openAPIContent map[string]struct {
+	Schema *schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Content     openAPIContent `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                  `json:"summary"`
+	Description string                  `json:"description,omitempty"`
+	Parameters  []openAPIParameter      `json:"parameters,omitempty"`
+	RequestBody *openAPIBody            `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIBody `json:"responses"`
+}
+
+type openAPI struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Servers    []map[string]string                     `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+func jsonContent(s *schema) openAPIContent {
+	return openAPIContent{"application/json": {Schema: s}}
+}
+
+// openAPIDocument describes the api routes as OpenAPI 3 document
+func openAPIDocument(routes []apiRoute) *openAPI {
+	b := &schemaBuilder{components: make(map[string]*schema)}
+	errorSchema := b.schema(reflect.TypeOf(apiError{}))
+
+	doc := &openAPI{
+		OpenAPI: "3.0.3",
+		Servers: []map[string]string{{"url": apiPrefix}},
+		Paths:   make(map[string]map[string]*openAPIOperation),
+	}
+	doc.Info.Title = "stream-api monitor"
+	doc.Info.Version = "1"
+
+	for _, route := range routes {
+		op := &openAPIOperation{
+			Summary:     route.summary,
+			Description: "Requires the " + route.role.String() + " role.",
+			Responses: map[string]*openAPIBody{
+				"default": {Description: "error", Content: jsonContent(errorSchema)},
+			},
+		}
+		for _, segment := range strings.Split(route.path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				op.Parameters = append(op.Parameters, openAPIParameter{
+					Name:     strings.Trim(segment, "{}"),
+					In:       "path",
+					Required: true,
+					Schema:   &schema{Type: "string"},
+				})
+			}
+		}
+		for _, name := range route.query {
+			op.Parameters = append(op.Parameters, openAPIParameter{Name: name, In: "query", Schema: &schema{Type: "string"}})
+		}
+		if route.request != nil {
+			op.RequestBody = &openAPIBody{Required: true, Content: jsonContent(b.schema(reflect.TypeOf(route.request)))}
+		}
+		success := &openAPIBody{Description: http.StatusText(route.status)}
+		if route.response != nil {
+			success.Content = jsonContent(b.schema(reflect.TypeOf(route.response)))
+		}
+		op.Responses[strconv.Itoa(route.status)] = success
+
+		if doc.Paths[route.path] == nil {
+			doc.Paths[route.path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[route.path][strings.ToLower(route.method)] = op
+	}
+	doc.Components.Schemas = b.components
+	return doc
+}
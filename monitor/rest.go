@@ -6,15 +6,63 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/voc/stream-api/auth/token"
 	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/logging"
 	"github.com/voc/stream-api/stream"
 )
 
+// apiError is the json body of failed requests
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+// writeError replies with a json error body, it mirrors http.Error
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeJSON(w, status, apiError{Status: status, Message: message})
+}
+
+// writeJSON replies with v encoded as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("encode")
+	}
+}
+
+// httpError is an error with the status code to reply with
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+// errorStatus returns the status code for err, internal server error if it has none
+func errorStatus(err error) int {
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		return httpErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeSettings replies with the redacted settings and their version as ETag
+func writeSettings(w http.ResponseWriter, status int, settings *stream.Settings) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, settings.Version))
+	writeJSON(w, status, settings.Redacted())
+}
+
 func decodeJSON(rd io.Reader, out interface{}) error {
 	content, err := io.ReadAll(io.LimitReader(rd, 1048576))
 	if err != nil {
@@ -33,76 +81,261 @@ func decodeJSON(rd io.Reader, out interface{}) error {
 
 func HandleGetAllStreamSettings(api client.KVAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		slug := params["slug"]
-		log.Println("slug", slug)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-
-		var settings []stream.Settings
-		var tmp stream.Settings
-		data, err := api.GetWithPrefix(ctx, client.StreamSettingsPath(slug))
+		settings, err := listStreamSettings(r.Context(), api)
 		if err != nil {
-			log.Println("err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		for _, field := range data {
-			log.Println("got", string(field.Key), string(field.Value))
-			err := json.Unmarshal(field.Value, &tmp)
-			log.Println("foo", tmp, err)
-			if err != nil {
-				continue
-			}
+		writeJSON(w, http.StatusOK, settings)
+	}
+}
 
-			settings = append(settings, tmp)
+func HandleGetStreamSettings(api client.KVAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		settings, err := getStreamSettings(r.Context(), api, slug)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings == nil {
+			writeError(w, fmt.Sprintf("no settings for %s", slug), http.StatusNotFound)
+			return
 		}
-		fmt.Printf("return %v\n", settings)
+		writeSettings(w, http.StatusOK, settings)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(settings)
+// listStreamSettings returns all stored stream settings sorted by slug with redacted keys
+func listStreamSettings(ctx context.Context, api client.KVAPI) ([]stream.Settings, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	data, err := api.GetWithPrefix(ctx, client.StreamSettingsPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("get failed: %w", err)
 	}
+	settings := make([]stream.Settings, 0, len(data))
+	for _, field := range data {
+		var s stream.Settings
+		if err := json.Unmarshal(field.Value, &s); err != nil {
+			log.Error().Err(err).Str("key", string(field.Key)).Msg("settings unmarshal")
+			continue
+		}
+		settings = append(settings, s.Redacted())
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Slug < settings[j].Slug
+	})
+	return settings, nil
 }
 
-func HandleGetStreamSettings(api client.KVAPI) http.HandlerFunc {
+// getStreamSettings returns the stored settings of slug, or nil if there are none
+func getStreamSettings(ctx context.Context, api client.KVAPI, slug string) (*stream.Settings, error) {
+	settings, _, err := getStreamSettingsWithIndex(ctx, api, slug)
+	return settings, err
+}
+
+// getStreamSettingsWithIndex also returns the modify index of the settings for compare-and-swap writes
+func getStreamSettingsWithIndex(ctx context.Context, api client.KVAPI, slug string) (*stream.Settings, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	data, index, err := api.GetWithIndex(ctx, client.StreamSettingsPath(slug))
+	if err != nil {
+		return nil, 0, fmt.Errorf("get failed: %w", err)
+	}
+	if data == nil {
+		return nil, 0, nil
+	}
+	var settings stream.Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal failed: %w", err)
+	}
+	return &settings, index, nil
+}
+
+// newKeyID generates a key id from the current time
+func newKeyID() string {
+	return time.Now().UTC().Format("20060102T150405.000")
+}
+
+type addStreamKeyRequest struct {
+	ID        string     `json:"id"`
+	Secret    string     `json:"secret"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	Scheduled bool       `json:"scheduled,omitempty"`
+}
+
+// HandleAddStreamKey adds a hashed secret to the stream settings,
+// existing keys stay valid to allow rotation
+func HandleAddStreamKey(store *settingsStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		slug := params["slug"]
-		log.Println("slug", slug)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
+		defer r.Body.Close()
+		slug := mux.Vars(r)["slug"]
+		expected, err := ifMatch(r)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		var req addStreamKeyRequest
+		err = decodeJSON(r.Body, &req)
+		if err != nil {
+			writeError(w, fmt.Sprintf("parse failed: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		if req.Secret == "" {
+			writeError(w, "missing secret", http.StatusUnprocessableEntity)
+			return
+		}
+		if req.ID == "" {
+			req.ID = newKeyID()
+		}
+		hash, err := stream.HashSecret(req.Secret)
+		if err != nil {
+			writeError(w, fmt.Sprintf("hash failed: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
 
-		data, err := api.Get(ctx, client.StreamSettingsPath(slug))
+		entry := settingsVersion{Author: userName(r), Action: "addKey"}
+		settings, err := store.update(r.Context(), slug, expected, entry, func(settings *stream.Settings) (*stream.Settings, error) {
+			if settings == nil {
+				settings = &stream.Settings{Slug: slug}
+			}
+			for _, key := range settings.Keys {
+				if key.ID == req.ID {
+					return nil, &httpError{http.StatusConflict, fmt.Sprintf("key %s already exists", req.ID)}
+				}
+			}
+			settings.Keys = append(settings.Keys, stream.StreamKey{
+				ID:        req.ID,
+				Hash:      hash,
+				NotBefore: req.NotBefore,
+				NotAfter:  req.NotAfter,
+				Scheduled: req.Scheduled,
+			})
+			return settings, nil
+		})
 		if err != nil {
-			log.Println("err", err)
+			writeError(w, err.Error(), errorStatus(err))
 			return
 		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Str("key", req.ID).Msg("added key")
+		writeSettings(w, http.StatusOK, settings)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(data)
+// HandleDeleteStreamKey revokes a key from the stream settings
+func HandleDeleteStreamKey(store *settingsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		slug, id := params["slug"], params["id"]
+		expected, err := ifMatch(r)
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		entry := settingsVersion{Author: userName(r), Action: "revokeKey"}
+		settings, err := store.update(r.Context(), slug, expected, entry, func(settings *stream.Settings) (*stream.Settings, error) {
+			if settings != nil {
+				for i, key := range settings.Keys {
+					if key.ID == id {
+						settings.Keys = append(settings.Keys[:i], settings.Keys[i+1:]...)
+						return settings, nil
+					}
+				}
+			}
+			return nil, &httpError{http.StatusNotFound, fmt.Sprintf("key %s not found", id)}
+		})
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Str("key", id).Msg("deleted key")
+		writeSettings(w, http.StatusOK, settings)
 	}
 }
 
-func HandleSetStreamSettings(api client.KVAPI) http.HandlerFunc {
+// defaultTokenTTL is the lifetime of tokens minted without explicit ttl
+const defaultTokenTTL = time.Hour * 6
+
+type mintTokenRequest struct {
+	IngestType string `json:"ingestType"` // defaults to the ingest type of the stream settings
+	TTL        string `json:"ttl"`        // go duration, e.g. "2h"
+}
+
+type mintTokenResponse struct {
+	Token     string    `json:"token"`
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// HandleMintToken issues a signed publish token for a stream
+func HandleMintToken(api client.KVAPI, tokens *token.Keyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		var settings stream.Settings
-		err := decodeJSON(r.Body, &settings)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("parse failed: %s", err.Error()), http.StatusUnprocessableEntity)
+		if tokens == nil {
+			writeError(w, "tokens not configured", http.StatusNotImplemented)
 			return
 		}
-		data, err := json.Marshal(settings)
+		slug := mux.Vars(r)["slug"]
+		var req mintTokenRequest
+		err := decodeJSON(r.Body, &req)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("marshal failed: %s", err.Error()), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("parse failed: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
 		}
-		log.Println("set", settings)
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		err = api.Put(ctx, client.StreamSettingsPath(settings.Slug), data)
+		ttl := defaultTokenTTL
+		if req.TTL != "" {
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeError(w, "invalid ttl", http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if maxTTL := tokens.MaxTTL(); maxTTL > 0 && ttl > maxTTL {
+			writeError(w, fmt.Sprintf("ttl exceeds maximum of %s", maxTTL), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if req.IngestType == "" {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			data, err := api.Get(ctx, client.StreamSettingsPath(slug))
+			if err != nil {
+				writeError(w, fmt.Sprintf("get failed: %s", err.Error()), http.StatusInternalServerError)
+				return
+			}
+			var settings stream.Settings
+			if len(data) > 0 {
+				if err := json.Unmarshal(data, &settings); err != nil {
+					writeError(w, fmt.Sprintf("unmarshal failed: %s", err.Error()), http.StatusInternalServerError)
+					return
+				}
+			}
+			if settings.IngestType == "" {
+				writeError(w, "missing ingestType", http.StatusUnprocessableEntity)
+				return
+			}
+			req.IngestType = settings.IngestType
+		}
+
+		claims, err := token.NewClaims(slug, req.IngestType, time.Now(), ttl)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("put failed: %s", err.Error()), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("claims failed: %s", err.Error()), http.StatusInternalServerError)
 			return
 		}
+		signed, err := tokens.Sign(claims)
+		if err != nil {
+			writeError(w, fmt.Sprintf("sign failed: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		log.Info().Str("user", userName(r)).Str(logging.SlugField, slug).Str("token", claims.ID).Msg("minted token")
+
+		writeJSON(w, http.StatusOK, mintTokenResponse{
+			Token:     signed,
+			ID:        claims.ID,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		})
 	}
 }
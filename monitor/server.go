@@ -2,135 +2,251 @@ package monitor
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/voc/stream-api/auth/token"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
 )
 
-type clientMap map[*websocket.Conn]bool
+// stateRoles are the minimum roles required to receive a state topic over the websocket,
+// topics not listed are sent to all viewers
+var stateRoles = map[string]role{
+	"rejectedStreams": roleOperator,
+}
+
+// filterState returns the part of state the role may see
+func filterState(state map[string]interface{}, r role) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		if required, ok := stateRoles[k]; ok && r < required {
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
 
 type server struct {
 	upgrader websocket.Upgrader
 	done     sync.WaitGroup
 	api      client.KVAPI
+	tokens   *token.Keyring
+	auth     authenticator
+	settings *settingsStore
+	alerts   *alertEngine
 
 	// update channels
-	addClient    chan *websocket.Conn
-	removeClient chan *websocket.Conn
-	updates      <-chan map[string]interface{}
-
-	// local state
-	transcoders       *transcodersJson
-	streams           *streamsJson
-	streamTranscoders *streamTranscodersJson
-	state             map[string]interface{}
+	addClient    chan *subscriber // unbuffered, so requests of a client are handled after it was added
+	removeClient chan *subscriber
+	requests     chan subscriberRequest
+	queries      chan func(*hub)
+	updates      <-chan change
+	stop         <-chan struct{} // closed when the hub loop returns
+	subscribers  atomic.Int64
 }
 
-func newServer(ctx context.Context, api client.KVAPI, updates <-chan map[string]interface{}, conf config.MonitorConfig) *server {
+// newServer starts serving the monitor, it returns an error if the address can't be listened on
+func newServer(ctx context.Context, api client.KVAPI, tokens *token.Keyring, auth authenticator, updates <-chan change, conf config.MonitorConfig, reg prometheus.Registerer) (*server, error) {
 	s := &server{
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin:  checkOrigin(conf.Auth.AllowedOrigins),
+			Subprotocols: []string{protocolV1},
 		},
+		auth:         auth,
 		updates:      updates,
-		addClient:    make(chan *websocket.Conn, 1),
-		removeClient: make(chan *websocket.Conn, 1),
-		state:        make(map[string]interface{}),
+		addClient:    make(chan *subscriber),
+		removeClient: make(chan *subscriber, 1),
+		requests:     make(chan subscriberRequest, 1),
+		queries:      make(chan func(*hub)),
+		stop:         ctx.Done(),
 		api:          api,
+		tokens:       tokens,
+		settings:     newSettingsStore(api, conf.SettingsHistory),
 	}
+	s.alerts = newAlertEngine(conf.Alerts, api, s.inspect)
+	router, err := s.router(&conf)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", conf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	s.registerMetrics(reg)
 	s.done.Add(1)
-	go s.run(ctx, &conf)
-	return s
+	go s.run(ctx, listener, router)
+	return s, nil
 }
 
 func (s *server) Wait() {
-	s.done.Done()
+	s.done.Wait()
 }
 
-func (s *server) run(parentContext context.Context, conf *config.MonitorConfig) {
-	defer s.done.Done()
-
+// router returns the handler of the web interface and API
+func (s *server) router(conf *config.MonitorConfig) (*mux.Router, error) {
+	index, err := handleIndex()
+	if err != nil {
+		return nil, err
+	}
 	router := mux.NewRouter()
-	router.HandleFunc("/", handleIndex()).Methods("GET")
-	router.HandleFunc("/ws", s.handleWebsocket)
-	router.HandleFunc("/stream/settings", HandleGetAllStreamSettings(s.api)).Methods("GET")
-	router.HandleFunc("/stream/{slug}/settings", HandleGetStreamSettings(s.api)).Methods("GET")
-	router.HandleFunc("/stream/{slug}/settings", HandleSetStreamSettings(s.api)).Methods("POST")
-	router.PathPrefix("/").Handler(http.FileServer(http.FS(static)))
+	if oidc, ok := s.auth.(*oidcAuth); ok {
+		router.HandleFunc("/auth/login", oidc.handleLogin).Methods("GET")
+		router.HandleFunc("/auth/callback", oidc.handleCallback).Methods("GET")
+	}
+	router.HandleFunc("/", s.require(roleViewer, index)).Methods("GET")
+	router.HandleFunc("/ws", s.require(roleViewer, s.handleWebsocket))
+	router.HandleFunc("/stream/settings", s.require(roleOperator, HandleGetAllStreamSettings(s.api))).Methods("GET")
+	router.HandleFunc("/stream/{slug}/settings", s.require(roleOperator, HandleGetStreamSettings(s.api))).Methods("GET")
+	router.HandleFunc("/stream/{slug}/settings", s.require(roleAdmin, HandleSetStreamSettings(s.settings))).Methods("POST")
+	router.HandleFunc("/stream/{slug}/keys", s.require(roleAdmin, HandleAddStreamKey(s.settings))).Methods("POST")
+	router.HandleFunc("/stream/{slug}/keys/{id}", s.require(roleAdmin, HandleDeleteStreamKey(s.settings))).Methods("DELETE")
+	router.HandleFunc("/stream/{slug}/token", s.require(roleAdmin, HandleMintToken(s.api, s.tokens))).Methods("POST")
+	router.HandleFunc("/auth/audit", s.require(roleOperator, HandleGetAuditLog(conf.AuditSources, conf.AuditToken))).Methods("GET")
+	s.registerAPI(router, conf)
+	router.PathPrefix("/").Handler(s.require(roleViewer, http.FileServer(http.FS(static)).ServeHTTP))
+	return router, nil
+}
 
-	srv := &http.Server{Addr: conf.Address, Handler: router}
+func (s *server) run(parentContext context.Context, listener net.Listener, router http.Handler) {
+	defer s.done.Done()
 
-	s.done.Add(1)
+	srv := &http.Server{Handler: router}
+
+	s.done.Add(3)
 	go func() {
 		defer s.done.Done()
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal().Msgf("ListenAndServe(): %v", err)
+		s.alerts.run(parentContext)
+	}()
+	go func() {
+		defer s.done.Done()
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("monitor: serve")
 		}
 	}()
+	go func() {
+		defer s.done.Done()
+		s.runHub(parentContext)
+	}()
+
+	<-parentContext.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("server shutdown")
+	}
+}
 
-	clients := make(clientMap)
+// runHub applies state changes and client requests until ctx is done
+func (s *server) runHub(ctx context.Context) {
+	state := newHub()
 	for {
 		select {
-		case <-parentContext.Done():
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-			defer cancel()
-			err := srv.Shutdown(ctx)
-			if err != nil {
-				log.Error().Err(err).Msg("server shutdown")
+		case <-ctx.Done():
+			return
+		case c := <-s.addClient:
+			state.add(c)
+		case c := <-s.removeClient:
+			state.remove(c)
+		case r := <-s.requests:
+			state.handle(r.client, r.req)
+			if r.done != nil {
+				close(r.done)
 			}
-		case ws := <-s.addClient:
-			ws.WriteJSON(s.state)
-			clients[ws] = true
-		case ws := <-s.removeClient:
-			delete(clients, ws)
-		// generic send
+		case query := <-s.queries:
+			query(state)
 		case update := <-s.updates:
-			for k, v := range update {
-				s.state[k] = v
-			}
-			s.broadcast(clients, update)
+			state.apply(update)
 		}
+		s.subscribers.Store(int64(len(state.clients)))
+	}
+}
+
+// register adds a subscriber to the hub, it returns false if the hub stopped
+func (s *server) register(sub *subscriber) bool {
+	select {
+	case s.addClient <- sub:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// unregister removes a subscriber from the hub
+func (s *server) unregister(sub *subscriber) {
+	select {
+	case s.removeClient <- sub:
+	case <-s.stop:
 	}
 }
 
+// request passes a subscriber request to the hub, it returns false if the hub stopped
+func (s *server) request(r subscriberRequest) bool {
+	select {
+	case s.requests <- r:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// inspect runs fn in the hub loop, it returns false if ctx is done first
+func (s *server) inspect(ctx context.Context, fn func(*hub)) bool {
+	done := make(chan struct{})
+	select {
+	case s.queries <- func(h *hub) { fn(h); close(done) }:
+	case <-ctx.Done():
+		return false
+	}
+	<-done
+	return true
+}
+
 type templateData struct {
 	Prefix string
 	Errors []error
 }
 
-func handleIndex() http.HandlerFunc {
+func handleIndex() (http.HandlerFunc, error) {
 	data, err := static.ReadFile("frontend/public/index.html")
 	if err != nil {
-		log.Fatal().Err(err).Msg("index read")
+		return nil, fmt.Errorf("index read: %w", err)
 	}
 	tmpl, err := template.New("index").Parse(string(data))
 	if err != nil {
-		log.Fatal().Err(err).Msg("index template")
+		return nil, fmt.Errorf("index template: %w", err)
 	}
 
 	tmplData := templateData{}
 	return func(w http.ResponseWriter, r *http.Request) {
 		tmpl.Execute(w, tmplData)
 		// w.Write(data)
-	}
+	}, nil
 }
 
-func (s *server) broadcast(clients clientMap, v interface{}) {
-	for ws := range clients {
-		err := ws.WriteJSON(v)
-		if err != nil {
-			log.Error().Err(err).Msg("write")
-		}
-	}
-}
+const (
+	// writeWait is the time allowed to write a message
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed between pongs from the client
+	pongWait = 60 * time.Second
+	// pingInterval must be less than pongWait
+	pingInterval = pongWait * 9 / 10
+	// maxRequestSize limits client requests
+	maxRequestSize = 64 * 1024
+)
 
 func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	c, err := s.upgrader.Upgrade(w, r, nil)
@@ -141,16 +257,87 @@ func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	defer c.Close()
 
 	// register client
-	s.addClient <- c
-	defer func() { s.removeClient <- c }()
+	user := userFromContext(r.Context())
+	sub := newSubscriber(user.role, c.Subprotocol() != protocolV1)
+	if !s.register(sub) {
+		return
+	}
+	defer s.unregister(sub)
+	go writeWebsocket(c, sub)
 
+	c.SetReadLimit(maxRequestSize)
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		_, _, err := c.ReadMessage()
+		_, data, err := c.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Error().Err(err).Msg("ws read")
 			}
 			break
 		}
+		if sub.legacy {
+			continue
+		}
+		var req clientMessage
+		if err := json.Unmarshal(data, &req); err != nil {
+			log.Debug().Err(err).Msg("ws request")
+			req.Type = "invalid"
+		}
+		if !s.request(subscriberRequest{client: sub, req: req}) {
+			break
+		}
+	}
+}
+
+// writeWebsocket sends the queued messages and keepalive pings until the queue is closed
+func writeWebsocket(c *websocket.Conn, sub *subscriber) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-sub.send:
+			c.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// dropped by the hub
+				c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Debug().Err(err).Msg("ws write")
+				return
+			}
+		case <-ticker.C:
+			c.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin allows websocket connections from the monitor itself and the allowed origins
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// not a browser
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, o := range allowed {
+			if o == origin {
+				return true
+			}
+		}
+		return false
 	}
 }
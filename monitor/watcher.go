@@ -5,43 +5,24 @@ import (
 	"encoding/json"
 	"sync"
 
-	"github.com/rs/zerolog/log"
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/stream"
 	"github.com/voc/stream-api/transcode"
 )
 
-type streamsJson struct {
-	Streams map[string]stream.Stream `json:"streams"`
-}
-
-type transcodersJson struct {
-	Transcoders map[string]transcode.TranscoderStatus `json:"transcoders"`
-}
-
-type streamTranscodersJson struct {
-	StreamTranscoders map[string]string `json:"streamTranscoders"`
-}
-
 type watcher struct {
 	api  client.WatchAPI
 	done sync.WaitGroup
 
-	// local state
-	transcoders       map[string]*transcode.TranscoderStatus
-	streams           map[string]*stream.Stream
-	streamTranscoders map[string]string
-
-	updates chan map[string]interface{}
+	updates chan<- change
+	stop    <-chan struct{} // done once the watcher is stopped
 }
 
-func newWatcher(ctx context.Context, api client.ServiceAPI) *watcher {
+func newWatcher(ctx context.Context, api client.ServiceAPI, updates chan<- change) *watcher {
 	t := &watcher{
-		api:               api,
-		transcoders:       make(map[string]*transcode.TranscoderStatus),
-		streams:           make(map[string]*stream.Stream),
-		streamTranscoders: make(map[string]string),
-		updates:           make(chan map[string]interface{}, 1),
+		api:     api,
+		updates: updates,
+		stop:    ctx.Done(),
 	}
 
 	// watch source updates
@@ -55,17 +36,13 @@ func (w *watcher) Wait() {
 	w.done.Wait()
 }
 
-func (w *watcher) listen() <-chan map[string]interface{} {
-	return w.updates
-}
-
 // run keeps the communication to etcd
 func (w *watcher) run(parentContext context.Context) {
 	defer w.done.Done()
 	ctx, cancel := context.WithCancel(parentContext)
 	defer cancel()
 
-	transcoderChan, err := w.api.Watch(ctx, client.TranscoderPrefix)
+	transcoderChan, err := w.api.Watch(ctx, client.ServicePrefix("transcode")+"/")
 	if err != nil {
 		log.Fatal().Err(err).Msg("transcoder watch")
 		return
@@ -75,6 +52,11 @@ func (w *watcher) run(parentContext context.Context) {
 		log.Fatal().Err(err).Msg("stream watch")
 		return
 	}
+	rejectedChan, err := w.api.Watch(ctx, client.RejectedStreamPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("rejected stream watch")
+		return
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -95,15 +77,24 @@ func (w *watcher) run(parentContext context.Context) {
 			for _, update := range updates {
 				w.handleStream(ctx, update)
 			}
+		case updates, ok := <-rejectedChan:
+			if !ok {
+				log.Fatal().Msg("rejected stream watch closed")
+				return
+			}
+			for _, update := range updates {
+				w.handleRejectedStream(update)
+			}
 		}
 	}
 }
 
-// sendUpdate relays a state update
-func (w *watcher) sendUpdate(key string, update interface{}) {
-	tmp := make(map[string]interface{})
-	tmp[key] = update
-	w.updates <- tmp
+// sendUpdate relays the change of a single key, value is nil if the key was deleted
+func (w *watcher) sendUpdate(topic string, key string, value interface{}) {
+	select {
+	case w.updates <- change{Topic: topic, Key: key, Value: value}:
+	case <-w.stop:
+	}
 }
 
 // handleTranscoder handles an etcd transcoder update
@@ -124,17 +115,10 @@ func (w *watcher) handleTranscoder(update *client.WatchUpdate) {
 			log.Error().Err(err).Msg("transcoder unmarshal")
 			return
 		}
-		w.transcoders[name] = &status
+		w.sendUpdate("transcoders", name, status)
 	case client.UpdateTypeDelete:
-		delete(w.transcoders, name)
+		w.sendUpdate("transcoders", name, nil)
 	}
-	log.Debug().Msgf("monitor/transcoders %v", w.transcoders)
-
-	tmp := make(map[string]transcode.TranscoderStatus)
-	for k, v := range w.transcoders {
-		tmp[k] = *v
-	}
-	w.sendUpdate("transcoders", tmp)
 }
 
 // handleStream handles an update in the etcd stream prefix
@@ -165,33 +149,42 @@ func (w *watcher) handleStreamUpdate(ctx context.Context, key string, update *cl
 			log.Error().Err(err).Msg("stream unmarshal")
 			return
 		}
-		w.streams[key] = &str
-
+		w.sendUpdate("streams", key, str)
 	case client.UpdateTypeDelete:
-		delete(w.streams, key)
+		w.sendUpdate("streams", key, nil)
 	}
-	log.Debug().Msgf("monitor/streams %v", w.streams)
-
-	tmp := make(map[string]stream.Stream)
-	for k, v := range w.streams {
-		tmp[k] = *v
-	}
-	w.sendUpdate("streams", tmp)
 }
 
 // handleStreamTranscoder handles an etcd stream transcoder update
 func (w *watcher) handleStreamTranscoder(ctx context.Context, key string, update *client.WatchUpdate) {
 	switch update.Type {
 	case client.UpdateTypePut:
-		w.streamTranscoders[key] = string(update.KV.Value())
+		w.sendUpdate("streamTranscoders", key, string(update.KV.Value()))
 	case client.UpdateTypeDelete:
-		delete(w.streamTranscoders, key)
+		w.sendUpdate("streamTranscoders", key, nil)
+	}
+}
+
+// handleRejectedStream handles an update in the rejected stream prefix
+func (w *watcher) handleRejectedStream(update *client.WatchUpdate) {
+	if update.KV == nil {
+		return
+	}
+	name := client.ParseStreamName(update.KV.Key())
+	if name == "" {
+		return
 	}
-	log.Debug().Msgf("monitor/streamTranscoders %v", w.streamTranscoders)
 
-	tmp := make(map[string]string)
-	for k, v := range w.streamTranscoders {
-		tmp[k] = v
+	switch update.Type {
+	case client.UpdateTypePut:
+		var rejection stream.Rejection
+		err := json.Unmarshal(update.KV.Value(), &rejection)
+		if err != nil {
+			log.Error().Err(err).Msg("rejected stream unmarshal")
+			return
+		}
+		w.sendUpdate("rejectedStreams", name, rejection)
+	case client.UpdateTypeDelete:
+		w.sendUpdate("rejectedStreams", name, nil)
 	}
-	w.sendUpdate("streamTranscoders", tmp)
 }
@@ -0,0 +1,55 @@
+package publish
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the prometheus metrics of the publisher
+type Metrics struct {
+	conflicts      prometheus.Counter
+	failovers      prometheus.Counter
+	scrapeDuration *prometheus.HistogramVec
+	scrapeErrors   *prometheus.CounterVec
+	streams        prometheus.Gauge
+	published      prometheus.Counter
+	expired        prometheus.Counter
+}
+
+// NewMetrics creates and registers the publisher metrics
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Metrics{
+		conflicts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "publisher_stream_conflicts_total",
+			Help: "Total number of times more than one source announced the same stream slug",
+		}),
+		failovers: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "publisher_stream_failovers_total",
+			Help: "Total number of times a stream registration switched to a different source",
+		}),
+		scrapeDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "publisher_scrape_duration_seconds",
+			Help:    "Duration of source scrapes",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1},
+		}, []string{"source"}),
+		scrapeErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "publisher_scrape_errors_total",
+			Help: "Total number of failed source scrapes",
+		}, []string{"source"}),
+		streams: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "publisher_streams",
+			Help: "Number of currently published streams",
+		}),
+		published: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "publisher_streams_published_total",
+			Help: "Total number of newly published streams",
+		}),
+		expired: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "publisher_streams_expired_total",
+			Help: "Total number of streams unpublished after their sources disappeared",
+		}),
+	}
+}
@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"bytes"
+	"errors"
+)
+
+// EBML element ids
+const (
+	idEBML       = 0x1A45DFA3
+	idDocType    = 0x4282
+	idSegment    = 0x18538067
+	idTracks     = 0x1654AE6B
+	idTrackEntry = 0xAE
+	idCodecID    = 0x86
+	idCluster    = 0x1F43B675
+)
+
+var errTruncated = errors.New("truncated data")
+
+func isMatroska(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3})
+}
+
+// readVint reads an EBML variable size integer,
+// if keepMarker is set the length marker bit is kept (as used in element ids)
+func readVint(data []byte, keepMarker bool) (value uint64, length int, unknown bool, err error) {
+	if len(data) == 0 {
+		return 0, 0, false, errTruncated
+	}
+	first := data[0]
+	length = 1
+	for mask := byte(0x80); mask != 0 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, false, errors.New("invalid vint")
+	}
+	if len(data) < length {
+		return 0, 0, false, errTruncated
+	}
+	value = uint64(first)
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	return value, length, allOnes && !keepMarker, nil
+}
+
+// ebmlElement is a parsed element header
+type ebmlElement struct {
+	id      uint64
+	header  int // length of id and size
+	size    uint64
+	unknown bool // size is unknown, as used by live streams
+}
+
+func readElement(data []byte) (*ebmlElement, error) {
+	id, idLen, _, err := readVint(data, true)
+	if err != nil {
+		return nil, err
+	}
+	size, sizeLen, unknown, err := readVint(data[idLen:], false)
+	if err != nil {
+		return nil, err
+	}
+	return &ebmlElement{id: id, header: idLen + sizeLen, size: size, unknown: unknown}, nil
+}
+
+// parseMatroska extracts the doctype and track codec ids from a matroska/webm stream header
+func parseMatroska(data []byte) (*mediaInfo, error) {
+	info := &mediaInfo{container: "matroska"}
+	err := walkEBML(data, func(id uint64, payload []byte) bool {
+		switch id {
+		case idDocType:
+			info.container = string(bytes.TrimRight(payload, "\x00"))
+		case idCodecID:
+			info.codecs = append(info.codecs, string(bytes.TrimRight(payload, "\x00")))
+		case idCluster:
+			// media data follows, header is complete
+			return false
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, errTruncated) {
+		return nil, err
+	}
+	if len(info.codecs) == 0 && err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// walkEBML calls fn for every leaf element of interest,
+// descending into the master elements leading to the track codec ids
+func walkEBML(data []byte, fn func(id uint64, payload []byte) bool) error {
+	for len(data) > 0 {
+		el, err := readElement(data)
+		if err != nil {
+			return err
+		}
+		data = data[el.header:]
+
+		switch el.id {
+		case idEBML, idSegment, idTracks, idTrackEntry:
+			// descend into master element
+			if !el.unknown && el.size < uint64(len(data)) {
+				if err := walkEBML(data[:el.size], fn); err != nil {
+					return err
+				}
+				data = data[el.size:]
+			}
+			continue
+		case idCluster:
+			fn(el.id, nil)
+			return nil
+		}
+
+		if el.unknown || el.size > uint64(len(data)) {
+			return errTruncated
+		}
+		if !fn(el.id, data[:el.size]) {
+			return nil
+		}
+		data = data[el.size:]
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// stream types as defined in ISO/IEC 13818-1 and ATSC
+var tsStreamTypes = map[byte]string{
+	0x01: "mpeg1video",
+	0x02: "mpeg2video",
+	0x03: "mp2",
+	0x04: "mp2",
+	0x0f: "aac",
+	0x11: "aac_latm",
+	0x15: "id3",
+	0x1b: "h264",
+	0x24: "hevc",
+	0x81: "ac3",
+	0x87: "eac3",
+}
+
+func isMPEGTS(data []byte) bool {
+	return findSync(data) >= 0
+}
+
+// findSync returns the offset of the first of three consecutive ts packets
+func findSync(data []byte) int {
+	for i := 0; i < tsPacketSize && i+2*tsPacketSize < len(data); i++ {
+		if data[i] == tsSyncByte && data[i+tsPacketSize] == tsSyncByte && data[i+2*tsPacketSize] == tsSyncByte {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseMPEGTS reads the program tables and returns the elementary stream codecs
+func parseMPEGTS(data []byte) (*mediaInfo, error) {
+	offset := findSync(data)
+	if offset < 0 {
+		return nil, errors.New("no ts sync")
+	}
+
+	pmtPIDs := make(map[uint16]bool)
+	for ; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		pkt := data[offset : offset+tsPacketSize]
+		if pkt[0] != tsSyncByte {
+			return nil, fmt.Errorf("lost ts sync at %d", offset)
+		}
+		// only parse table starts
+		if pkt[1]&0x40 == 0 {
+			continue
+		}
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if pid != 0 && !pmtPIDs[pid] {
+			continue
+		}
+		section := tsPayload(pkt)
+		if len(section) < 1 || int(section[0])+1 > len(section) {
+			continue
+		}
+		// skip pointer field
+		section = section[int(section[0])+1:]
+
+		if pid == 0 {
+			for _, p := range parsePAT(section) {
+				pmtPIDs[p] = true
+			}
+			continue
+		}
+		if codecs, ok := parsePMT(section); ok {
+			return &mediaInfo{container: "mpegts", codecs: codecs}, nil
+		}
+	}
+	return nil, errors.New("no program map found")
+}
+
+// tsPayload returns the payload of a ts packet, skipping the adaptation field
+func tsPayload(pkt []byte) []byte {
+	payload := pkt[4:]
+	control := (pkt[3] >> 4) & 0x3
+	if control&0x1 == 0 {
+		return nil
+	}
+	if control&0x2 != 0 {
+		if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+			return nil
+		}
+		payload = payload[int(payload[0])+1:]
+	}
+	return payload
+}
+
+// sectionBody returns the table section after the common header (excluding CRC)
+func sectionBody(section []byte, tableID byte) ([]byte, bool) {
+	if len(section) < 8 || section[0] != tableID {
+		return nil, false
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if length < 9 || 3+length > len(section) {
+		return nil, false
+	}
+	return section[8 : 3+length-4], true
+}
+
+// parsePAT returns the pids of all program map tables
+func parsePAT(section []byte) []uint16 {
+	body, ok := sectionBody(section, 0x00)
+	if !ok {
+		return nil
+	}
+	var pids []uint16
+	for i := 0; i+4 <= len(body); i += 4 {
+		program := uint16(body[i])<<8 | uint16(body[i+1])
+		if program == 0 {
+			// network pid
+			continue
+		}
+		pids = append(pids, uint16(body[i+2]&0x1f)<<8|uint16(body[i+3]))
+	}
+	return pids
+}
+
+// parsePMT returns the codecs of all elementary streams in the program
+func parsePMT(section []byte) ([]string, bool) {
+	body, ok := sectionBody(section, 0x02)
+	if !ok || len(body) < 4 {
+		return nil, false
+	}
+	infoLength := int(body[2]&0x0f)<<8 | int(body[3])
+	if 4+infoLength > len(body) {
+		return nil, false
+	}
+	codecs := []string{}
+	for i := 4 + infoLength; i+5 <= len(body); {
+		streamType := body[i]
+		esInfoLength := int(body[i+3]&0x0f)<<8 | int(body[i+4])
+		name, ok := tsStreamTypes[streamType]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", streamType)
+		}
+		codecs = append(codecs, name)
+		i += 5 + esInfoLength
+	}
+	return codecs, true
+}
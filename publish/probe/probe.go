@@ -0,0 +1,130 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// maximum amount of data read from a single source
+const maxProbeSize = 8 * 1024 * 1024
+
+var errNoData = errors.New("no data received")
+
+// Probe reads from the source url for the configured duration and reports
+// the detected container, codecs and bitrate.
+// Sources that can't be opened over http are reported with an unknown status.
+func Probe(ctx context.Context, conf config.ProbeConfig, sourceURL string) *stream.Health {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return unhealthy(fmt.Errorf("parse url: %w", err))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &stream.Health{
+			Status: stream.HealthUnknown,
+			Error:  fmt.Sprintf("unsupported scheme %s", u.Scheme),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Duration+conf.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
+	if err != nil {
+		return unhealthy(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return unhealthy(fmt.Errorf("get: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return unhealthy(fmt.Errorf("get: unexpected status %s", resp.Status))
+	}
+
+	data, elapsed, err := readFor(resp.Body, conf.Duration)
+	if err != nil {
+		return unhealthy(fmt.Errorf("read: %w", err))
+	}
+	return analyze(conf, data, elapsed)
+}
+
+// readFor reads from r until duration has elapsed or the source ended
+func readFor(r io.Reader, duration time.Duration) ([]byte, time.Duration, error) {
+	start := time.Now()
+	deadline := start.Add(duration)
+	buf := make([]byte, 0, 64*1024)
+	chunk := make([]byte, 32*1024)
+	for time.Now().Before(deadline) && len(buf) < maxProbeSize {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// the request context may end the read after the deadline
+			if len(buf) > 0 && !time.Now().Before(deadline) {
+				break
+			}
+			return nil, 0, err
+		}
+	}
+	return buf, time.Since(start), nil
+}
+
+// analyze parses the probed data and rates the stream
+func analyze(conf config.ProbeConfig, data []byte, elapsed time.Duration) *stream.Health {
+	if len(data) == 0 {
+		return unhealthy(errNoData)
+	}
+
+	var info *mediaInfo
+	var err error
+	switch {
+	case isMatroska(data):
+		info, err = parseMatroska(data)
+	case isMPEGTS(data):
+		info, err = parseMPEGTS(data)
+	default:
+		err = errors.New("unrecognized container")
+	}
+	if err != nil {
+		return unhealthy(err)
+	}
+
+	health := &stream.Health{
+		Status:    stream.HealthHealthy,
+		Container: info.container,
+		Codecs:    info.codecs,
+	}
+	if elapsed > 0 {
+		health.Bitrate = int(float64(len(data)*8) / elapsed.Seconds())
+	}
+	if len(info.codecs) == 0 {
+		health.Status = stream.HealthUnhealthy
+		health.Error = "no media tracks found"
+	} else if conf.MinBitrate > 0 && health.Bitrate < conf.MinBitrate {
+		health.Status = stream.HealthUnhealthy
+		health.Error = fmt.Sprintf("bitrate %d below minimum %d", health.Bitrate, conf.MinBitrate)
+	}
+	return health
+}
+
+func unhealthy(err error) *stream.Health {
+	return &stream.Health{
+		Status: stream.HealthUnhealthy,
+		Error:  err.Error(),
+	}
+}
+
+// mediaInfo holds the parsed container information
+type mediaInfo struct {
+	container string
+	codecs    []string
+}
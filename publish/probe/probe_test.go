@@ -0,0 +1,114 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// element encodes an ebml element with a one byte size
+func element(id []byte, payload ...[]byte) []byte {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	out := append([]byte{}, id...)
+	out = append(out, 0x80|byte(len(body)))
+	return append(out, body...)
+}
+
+func testMatroska() []byte {
+	header := element([]byte{0x1A, 0x45, 0xDF, 0xA3},
+		element([]byte{0x42, 0x82}, []byte("webm")),
+	)
+	tracks := element([]byte{0x16, 0x54, 0xAE, 0x6B},
+		element([]byte{0xAE}, element([]byte{0xD7}, []byte{1}), element([]byte{0x86}, []byte("V_VP9"))),
+		element([]byte{0xAE}, element([]byte{0xD7}, []byte{2}), element([]byte{0x86}, []byte("A_OPUS"))),
+	)
+	// live segment with unknown size
+	segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, tracks...)
+	segment = append(segment, 0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(header, segment...)
+}
+
+// tsPacket builds a ts packet carrying a table section
+func tsPacket(pid uint16, section []byte) []byte {
+	pkt := make([]byte, tsPacketSize)
+	pkt[0] = tsSyncByte
+	pkt[1] = 0x40 | byte(pid>>8)
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10
+	pkt[4] = 0 // pointer field
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		pkt[i] = 0xff
+	}
+	return pkt
+}
+
+func testMPEGTS() []byte {
+	pat := []byte{0x00, 0xb0, 13, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0x02, 0xb0, 23, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x1b, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+		0, 0, 0, 0}
+	var data []byte
+	data = append(data, tsPacket(0, pat)...)
+	data = append(data, tsPacket(0x1000, pmt)...)
+	data = append(data, tsPacket(0x1fff, nil)...)
+	return data
+}
+
+func TestParseMatroska(t *testing.T) {
+	data := testMatroska()
+	assert.Assert(t, isMatroska(data))
+	info, err := parseMatroska(data)
+	assert.NilError(t, err)
+	assert.Equal(t, info.container, "webm")
+	assert.DeepEqual(t, info.codecs, []string{"V_VP9", "A_OPUS"})
+}
+
+func TestParseMPEGTS(t *testing.T) {
+	data := testMPEGTS()
+	assert.Assert(t, isMPEGTS(data))
+	info, err := parseMPEGTS(data)
+	assert.NilError(t, err)
+	assert.Equal(t, info.container, "mpegts")
+	assert.DeepEqual(t, info.codecs, []string{"h264", "aac"})
+}
+
+func TestAnalyze(t *testing.T) {
+	conf := config.ProbeConfig{MinBitrate: 1000}
+	health := analyze(conf, testMatroska(), time.Second)
+	assert.Equal(t, health.Status, stream.HealthUnhealthy)
+	assert.Equal(t, health.Container, "webm")
+
+	conf.MinBitrate = 100
+	health = analyze(conf, testMatroska(), time.Second)
+	assert.Equal(t, health.Status, stream.HealthHealthy)
+
+	health = analyze(conf, []byte("garbage"), time.Second)
+	assert.Equal(t, health.Status, stream.HealthUnhealthy)
+}
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(testMPEGTS())
+	}))
+	defer srv.Close()
+	conf := config.ProbeConfig{Duration: time.Second, Timeout: time.Second}
+
+	health := Probe(context.Background(), conf, srv.URL+"/s1")
+	assert.Equal(t, health.Status, stream.HealthHealthy, health.Error)
+	assert.Equal(t, health.Container, "mpegts")
+
+	health = Probe(context.Background(), conf, "srt://localhost:1337?streamid=play/s1")
+	assert.Equal(t, health.Status, stream.HealthUnknown)
+}
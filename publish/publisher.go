@@ -3,107 +3,255 @@ package publish
 import (
 	"context"
 	"encoding/json"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/minio/pkg/wildcard"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
+	"github.com/voc/stream-api/publish/probe"
 	"github.com/voc/stream-api/publish/source"
 	"github.com/voc/stream-api/stream"
 )
 
+var log = logging.Module("publisher")
+
+// candidate is a stream announced by a single source
+type candidate struct {
+	st       *stream.Stream
+	source   int // index of the announcing source in the config
+	priority int
+	ttl      int
+	seen     bool // whether the source announced the stream in the current scrape
+}
+
 type storedStream struct {
-	st  *stream.Stream
-	ttl int
+	st         *stream.Stream // currently published registration
+	candidates map[int]*candidate
+	conflict   bool
+	rejection  *stream.Rejection // currently published rejection
+
+	// probe state of the primary source
+	health       *stream.Health
+	healthSource string
+	probing      bool
+	probedAt     time.Time
+}
+
+type probeResult struct {
+	slug   string
+	source string
+	health *stream.Health
+}
+
+type scraper struct {
+	source.Scraper
+	conf config.SourceConfig
 }
 
 // Publisher publishes streams to the etcd store and keeps them refreshed
 type Publisher struct {
-	conf    *config.PublisherConfig
-	ttl     int
-	streams map[string]*storedStream
-	update  chan struct{}
-	name    string
-	api     client.ServiceAPI
-	done    sync.WaitGroup
+	conf     *config.PublisherConfig
+	ttl      int
+	streams  map[string]*storedStream
+	settings map[string]*stream.Settings
+	scrapers []*scraper
+	probes   chan probeResult
+	update   chan struct{}
+	reload   chan *config.PublisherConfig
+	stopped  chan struct{} // closed when run returns
+	name     string
+	api      client.ServiceAPI
+	metrics  *Metrics
+	events   *eventlog.Log
+	done     sync.WaitGroup
 }
 
 var defaultScrapeInterval = time.Second * 3
 
 // New creates a new Publisher
-func New(ctx context.Context, conf *config.PublisherConfig, api client.ServiceAPI, name string) *Publisher {
+func New(ctx context.Context, conf *config.PublisherConfig, api client.ServiceAPI, name string, reg prometheus.Registerer, events *eventlog.Log) *Publisher {
+	p := &Publisher{
+		conf:     conf,
+		ttl:      int(conf.Timeout / conf.Interval),
+		update:   make(chan struct{}),
+		reload:   make(chan *config.PublisherConfig),
+		stopped:  make(chan struct{}),
+		probes:   make(chan probeResult),
+		streams:  make(map[string]*storedStream),
+		settings: make(map[string]*stream.Settings),
+		name:     name,
+		api:      api,
+		metrics:  NewMetrics(reg),
+		events:   events,
+	}
+
 	// create stream publishers
-	var scrapers []source.Scraper
 	for _, sourceConfig := range conf.Sources {
-		switch sourceConfig.Type {
-		case "icecast":
-			scrapers = append(scrapers, source.NewIcecastScraper(sourceConfig))
-		case "srtrelay":
-			scrapers = append(scrapers, source.NewSrtrelayScraper(sourceConfig))
-		default:
-			log.Error().Msgf("publisher: unknown source type %s", sourceConfig.Type)
+		if s := newScraper(sourceConfig); s != nil {
+			p.scrapers = append(p.scrapers, s)
 		}
 	}
 
-	p := &Publisher{
-		conf:    conf,
-		ttl:     int(conf.Timeout / conf.Interval),
-		update:  make(chan struct{}),
-		streams: make(map[string]*storedStream),
-		name:    name,
-		api:     api,
-	}
-
 	// watch source updates
 	p.done.Add(1)
-	go p.run(ctx, scrapers)
+	go p.run(ctx)
 
 	return p
 }
 
+// newScraper creates the scraper of a source, it returns nil for unknown source types
+func newScraper(conf config.SourceConfig) *scraper {
+	var s source.Scraper
+	switch conf.Type {
+	case "icecast":
+		s = source.NewIcecastScraper(conf)
+	case "srtrelay":
+		s = source.NewSrtrelayScraper(conf)
+	default:
+		log.Error().Msgf("publisher: unknown source type %s", conf.Type)
+		return nil
+	}
+	return &scraper{Scraper: s, conf: conf}
+}
+
 func (p *Publisher) Wait() {
 	p.done.Wait()
 }
 
-func (p *Publisher) run(parentContext context.Context, scrapers []source.Scraper) {
+// Reload applies a changed config, streams only announced by removed sources expire immediately.
+// It returns without effect once the publisher stopped.
+func (p *Publisher) Reload(conf *config.PublisherConfig) {
+	select {
+	case p.reload <- conf:
+	case <-p.stopped:
+	}
+}
+
+func (p *Publisher) run(parentContext context.Context) {
 	ctx, cancel := context.WithCancel(parentContext)
 	defer cancel()
 
-	ticker := time.NewTicker(defaultScrapeInterval)
 	defer p.done.Done()
+	defer close(p.stopped)
+	settingsChan, err := p.api.Watch(ctx, client.StreamSettingsPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("publisher: settings watch")
+		return
+	}
+
+	ticker := time.NewTicker(defaultScrapeInterval)
 	for {
 		select {
 		case <-ctx.Done():
 			ticker.Stop()
+			p.withdraw()
 			return
+		case conf := <-p.reload:
+			p.applyConfig(conf)
+		case updates, ok := <-settingsChan:
+			if !ok {
+				log.Fatal().Msg("publisher: settings watch closed")
+				return
+			}
+			for _, update := range updates {
+				p.handleSettings(update)
+			}
 		case <-ticker.C:
-			for _, scraper := range scrapers {
+			for _, stored := range p.streams {
+				for _, c := range stored.candidates {
+					c.seen = false
+				}
+			}
+			for index, scraper := range p.scrapers {
 				timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+				start := time.Now()
 				streams, err := scraper.Scrape(timeoutCtx)
 				cancel()
+				p.metrics.scrapeDuration.WithLabelValues(scraper.conf.URL).Observe(time.Since(start).Seconds())
 				if err != nil {
-					log.Error().Err(err).Msg("publisher/scrape")
+					log.Error().Err(err).Str("url", scraper.conf.URL).Msg("publisher/scrape")
+					p.metrics.scrapeErrors.WithLabelValues(scraper.conf.URL).Inc()
 					continue
 				}
-				p.processUpdate(ctx, streams)
+				p.processUpdate(index, streams)
+			}
+			p.resolve(ctx)
+			p.updateGauge()
+			if p.conf.Probe.Enable {
+				p.scheduleProbes(ctx)
 			}
+		case res := <-p.probes:
+			p.handleProbe(ctx, res)
+		}
+	}
+}
 
-			// expire old streams
-			for key, stream := range p.streams {
-				stream.ttl--
-				if stream.ttl > 0 {
-					continue
-				}
-				err := p.unpublishStream(ctx, stream)
-				if err != nil {
-					log.Error().Err(err).Msg("publisher/unpublish")
-					continue
-				}
-				delete(p.streams, key)
+// applyConfig replaces the config, scrapers and candidates of unchanged sources are kept
+func (p *Publisher) applyConfig(conf *config.PublisherConfig) {
+	type sourceKey struct{ typ, url string }
+	previous := make(map[sourceKey]int)
+	for index, s := range p.scrapers {
+		previous[sourceKey{s.conf.Type, s.conf.URL}] = index
+	}
+
+	// maps old to new source indices
+	moved := make(map[int]int)
+	var scrapers []*scraper
+	for _, sourceConfig := range conf.Sources {
+		key := sourceKey{sourceConfig.Type, sourceConfig.URL}
+		if index, ok := previous[key]; ok {
+			moved[index] = len(scrapers)
+			scrapers = append(scrapers, &scraper{Scraper: p.scrapers[index].Scraper, conf: sourceConfig})
+			delete(previous, key)
+			continue
+		}
+		if s := newScraper(sourceConfig); s != nil {
+			log.Info().Str("url", sourceConfig.URL).Msg("publisher: added source")
+			scrapers = append(scrapers, s)
+		}
+	}
+	for key := range previous {
+		log.Info().Str("url", key.url).Msg("publisher: removed source")
+		p.metrics.scrapeDuration.DeleteLabelValues(key.url)
+		p.metrics.scrapeErrors.DeleteLabelValues(key.url)
+	}
+
+	for _, stored := range p.streams {
+		candidates := make(map[int]*candidate, len(stored.candidates))
+		for index, c := range stored.candidates {
+			next, ok := moved[index]
+			if !ok {
+				continue
+			}
+			c.source = next
+			c.priority = scrapers[next].conf.Priority
+			candidates[next] = c
+		}
+		stored.candidates = candidates
+	}
+	p.scrapers = scrapers
+	p.conf = conf
+	p.ttl = int(conf.Timeout / conf.Interval)
+}
+
+// withdraw removes the published streams and rejections on shutdown
+func (p *Publisher) withdraw() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	for slug, stored := range p.streams {
+		if stored.st != nil {
+			if err := p.unpublishStream(ctx, stored); err != nil {
+				log.Error().Err(err).Msg("publisher/unpublish")
 			}
 		}
+		p.clearRejection(ctx, slug, stored)
 	}
 }
 
@@ -122,33 +270,300 @@ func (p *Publisher) publishStream(ctx context.Context, stream *stream.Stream) er
 	return p.api.PutWithSession(ctx, key, val)
 }
 
-// TODO: handle local updates to stream data (e.g. more than one source with the same slug -> do a flat comparison)
-func (p *Publisher) processUpdate(ctx context.Context, streams []*stream.Stream) {
-	var newStreams []*storedStream
-	for _, stream := range streams {
-		stored, exists := p.streams[stream.Slug]
-		if exists {
-			// renew timeout
-			stored.ttl = p.ttl
+// processUpdate records the streams announced by the source at index
+func (p *Publisher) processUpdate(index int, streams []*stream.Stream) {
+	conf := p.scrapers[index].conf
+	for _, st := range streams {
+		stored, exists := p.streams[st.Slug]
+		if !exists {
+			stored = &storedStream{candidates: make(map[int]*candidate)}
+			p.streams[st.Slug] = stored
+		}
+		// renew timeout
+		stored.candidates[index] = &candidate{
+			st:       st,
+			source:   index,
+			priority: conf.Priority,
+			ttl:      p.ttl,
+			seen:     true,
+		}
+	}
+}
+
+// resolve expires stale candidates, picks the primary source for every slug and publishes the result
+func (p *Publisher) resolve(ctx context.Context) {
+	for slug, stored := range p.streams {
+		fresh := false
+		for index, c := range stored.candidates {
+			fresh = fresh || c.seen
+			c.ttl--
+			if c.ttl <= 0 {
+				delete(stored.candidates, index)
+			}
+		}
+
+		// expire old streams
+		if len(stored.candidates) == 0 {
+			if stored.st != nil {
+				err := p.unpublishStream(ctx, stored)
+				if err != nil {
+					log.Error().Err(err).Msg("publisher/unpublish")
+					continue
+				}
+				stored.st = nil
+				p.metrics.expired.Inc()
+				p.events.Append(eventlog.Event{Slug: slug, Module: "publisher", Type: eventlog.Expired})
+			}
+			if !p.clearRejection(ctx, slug, stored) {
+				continue
+			}
+			delete(p.streams, slug)
+			continue
+		}
+
+		ranked := rankCandidates(stored.candidates)
+		p.checkConflict(slug, stored, ranked)
+		settings, ok := p.permitted(slug)
+		if !ok {
+			p.reject(ctx, slug, stored, ranked[0], "no stream settings")
+			continue
+		}
+		if !p.clearRejection(ctx, slug, stored) {
+			continue
+		}
+		st := p.registration(stored, settings, ranked)
+		if !fresh && reflect.DeepEqual(st, stored.st) {
+			continue
+		}
+
+		err := p.publishStream(ctx, st)
+		if err != nil {
+			log.Error().Str("slug", slug).Err(err).Msg("publisher/publish")
+			continue
+		}
+		if stored.st == nil {
+			log.Debug().Str("slug", slug).Str("source", st.Source).Msg("publisher/publish")
+			p.metrics.published.Inc()
+			p.events.Append(eventlog.Event{Slug: slug, Module: "publisher", Type: eventlog.Registered,
+				Fields: map[string]string{"source": st.Source, "format": st.Format}})
+		} else if stored.st.Source != st.Source {
+			log.Warn().Str("slug", slug).Str("from", stored.st.Source).Str("to", st.Source).Msg("publisher/failover")
+			p.metrics.failovers.Inc()
+			p.events.Append(eventlog.Event{Slug: slug, Module: "publisher", Type: eventlog.Failover,
+				Fields: map[string]string{"from": stored.st.Source, "to": st.Source}})
+		}
+		stored.st = st
+	}
+}
+
+// updateGauge updates the published streams gauge
+func (p *Publisher) updateGauge() {
+	count := 0
+	for _, stored := range p.streams {
+		if stored.st != nil {
+			count++
+		}
+	}
+	p.metrics.streams.Set(float64(count))
+}
+
+// checkConflict logs and counts slugs announced by more than one source
+func (p *Publisher) checkConflict(slug string, stored *storedStream, ranked []*candidate) {
+	conflict := len(ranked) > 1
+	if conflict && !stored.conflict {
+		sources := make([]string, 0, len(ranked))
+		for _, c := range ranked {
+			sources = append(sources, c.st.Source)
 		}
-		err := p.publishStream(ctx, stream)
+		log.Warn().Str("slug", slug).Strs("sources", sources).Msg("publisher/conflict")
+		p.metrics.conflicts.Inc()
+	}
+	stored.conflict = conflict
+}
+
+// handleSettings tracks stream settings updates
+func (p *Publisher) handleSettings(update *client.WatchUpdate) {
+	if update.KV == nil {
+		return
+	}
+	name := client.ParseStreamName(update.KV.Key())
+	if name == "" {
+		return
+	}
+
+	switch update.Type {
+	case client.UpdateTypePut:
+		var s stream.Settings
+		err := json.Unmarshal(update.KV.Value(), &s)
+		if err != nil {
+			log.Error().Err(err).Msg("publisher: settings unmarshal")
+			return
+		}
+		p.settings[name] = &s
+	case client.UpdateTypeDelete:
+		delete(p.settings, name)
+	}
+}
+
+// permitted returns the stream settings and whether the slug may be published
+func (p *Publisher) permitted(slug string) (*stream.Settings, bool) {
+	if settings, ok := p.settings[slug]; ok {
+		return settings, true
+	}
+	if !p.conf.RequireSettings {
+		return nil, true
+	}
+	for _, pattern := range p.conf.Allowlist {
+		if wildcard.MatchSimple(pattern, slug) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// reject withdraws the stream registration and reports the rejected stream instead
+func (p *Publisher) reject(ctx context.Context, slug string, stored *storedStream, c *candidate, reason string) {
+	if stored.st != nil {
+		err := p.unpublishStream(ctx, stored)
 		if err != nil {
-			log.Error().Str("slug", stream.Slug).Err(err).Msg("publisher/publish")
+			log.Error().Err(err).Msg("publisher/unpublish")
+			return
+		}
+		stored.st = nil
+	}
+
+	rejection := &stream.Rejection{
+		Slug:   slug,
+		Source: c.st.Source,
+		Reason: reason,
+	}
+	if reflect.DeepEqual(rejection, stored.rejection) {
+		return
+	}
+	val, err := json.Marshal(rejection)
+	if err != nil {
+		log.Error().Err(err).Msg("publisher/reject")
+		return
+	}
+	err = p.api.PutWithSession(ctx, client.RejectedStreamPath(slug), val)
+	if err != nil {
+		log.Error().Str("slug", slug).Err(err).Msg("publisher/reject")
+		return
+	}
+	log.Warn().Str("slug", slug).Str("source", rejection.Source).Str("reason", reason).Msg("publisher/reject")
+	p.events.Append(eventlog.Event{Slug: slug, Module: "publisher", Type: eventlog.Rejected, Message: reason,
+		Fields: map[string]string{"source": rejection.Source}})
+	stored.rejection = rejection
+}
+
+// clearRejection removes a previously reported rejection, returns false on failure
+func (p *Publisher) clearRejection(ctx context.Context, slug string, stored *storedStream) bool {
+	if stored.rejection == nil {
+		return true
+	}
+	err := p.api.Delete(ctx, client.RejectedStreamPath(slug))
+	if err != nil {
+		log.Error().Str("slug", slug).Err(err).Msg("publisher/reject")
+		return false
+	}
+	stored.rejection = nil
+	return true
+}
+
+// registration builds the stream registration from the ranked candidates
+func (p *Publisher) registration(stored *storedStream, settings *stream.Settings, ranked []*candidate) *stream.Stream {
+	st := *ranked[0].st
+	st.Backups = nil
+	st.Public = settings != nil && settings.Public
+	if p.conf.Probe.Enable {
+		st.Health = &stream.Health{Status: stream.HealthPending}
+		if stored.healthSource == st.Source && stored.health != nil {
+			st.Health = stored.health
+		}
+	}
+	if !p.conf.KeepBackups {
+		return &st
+	}
+	for _, c := range ranked[1:] {
+		st.Backups = append(st.Backups, stream.BackupSource{
+			Format: c.st.Format,
+			Source: c.st.Source,
+		})
+	}
+	return &st
+}
+
+// rankCandidates orders candidates by preference:
+// currently announced before stale, then by priority, then by config order
+func rankCandidates(candidates map[int]*candidate) []*candidate {
+	ranked := make([]*candidate, 0, len(candidates))
+	for _, c := range candidates {
+		ranked = append(ranked, c)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.seen != b.seen {
+			return a.seen
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.source < b.source
+	})
+	return ranked
+}
+
+// scheduleProbes starts probing published streams whose source changed or whose last probe is outdated
+func (p *Publisher) scheduleProbes(ctx context.Context) {
+	for slug, stored := range p.streams {
+		if stored.st == nil || stored.probing {
 			continue
 		}
-		if !exists {
-			log.Debug().Str("slug", stream.Slug).Str("source", stream.Source).Err(err).Msg("publisher/publish")
-			newStreams = append(newStreams, &storedStream{
-				st:  stream,
-				ttl: p.ttl,
-			})
+		if stored.healthSource == stored.st.Source && time.Since(stored.probedAt) < p.conf.Probe.Interval {
 			continue
 		}
+		stored.probing = true
+		conf := p.conf.Probe
+		p.done.Add(1)
+		go func(slug string, source string) {
+			defer p.done.Done()
+			health := probe.Probe(ctx, conf, source)
+			select {
+			case p.probes <- probeResult{slug: slug, source: source, health: health}:
+			case <-ctx.Done():
+			}
+		}(slug, stored.st.Source)
+	}
+}
 
+// handleProbe stores a probe result and republishes the affected stream
+func (p *Publisher) handleProbe(ctx context.Context, res probeResult) {
+	stored, ok := p.streams[res.slug]
+	if !ok {
+		return
 	}
+	stored.probing = false
+	stored.probedAt = time.Now()
+	stored.health = res.health
+	stored.healthSource = res.source
 
-	// add new streams
-	for _, s := range newStreams {
-		p.streams[s.st.Slug] = s
+	if stored.st == nil || stored.st.Source != res.source || reflect.DeepEqual(stored.st.Health, res.health) {
+		return
+	}
+	if res.health.Status == stream.HealthUnhealthy {
+		log.Warn().Str("slug", res.slug).Str("source", res.source).Str("reason", res.health.Error).Msg("publisher/probe: unhealthy")
+		p.events.Append(eventlog.Event{Slug: res.slug, Module: "publisher", Type: eventlog.Unhealthy, Message: res.health.Error,
+			Fields: map[string]string{"source": res.source}})
+	} else {
+		log.Debug().Str("slug", res.slug).Str("source", res.source).Interface("health", res.health).Msg("publisher/probe")
+	}
+
+	st := *stored.st
+	st.Health = res.health
+	err := p.publishStream(ctx, &st)
+	if err != nil {
+		log.Error().Str("slug", res.slug).Err(err).Msg("publisher/publish")
+		return
 	}
+	stored.st = &st
 }
@@ -0,0 +1,187 @@
+package publish
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/stream"
+)
+
+// publishedStream returns the published stream of slug, or nil
+func publishedStream(t *testing.T, kv *clienttest.KV, slug string) *stream.Stream {
+	var s stream.Stream
+	if !kv.GetJSON(t, client.StreamPath(slug), &s) {
+		return nil
+	}
+	return &s
+}
+
+func newTestPublisher(kv *clienttest.KV, keepBackups bool) *Publisher {
+	conf := &config.PublisherConfig{
+		Sources: []config.SourceConfig{
+			{Type: "icecast", URL: "http://a"},
+			{Type: "srtrelay", URL: "http://b", Priority: 10},
+		},
+		KeepBackups: keepBackups,
+	}
+	p := &Publisher{
+		conf:     conf,
+		ttl:      3,
+		streams:  make(map[string]*storedStream),
+		settings: make(map[string]*stream.Settings),
+		api:      kv,
+		metrics:  NewMetrics(prometheus.NewRegistry()),
+	}
+	for _, c := range conf.Sources {
+		p.scrapers = append(p.scrapers, &scraper{conf: c})
+	}
+	return p
+}
+
+// tick simulates a single scrape round, sources maps source index to announced streams
+func tick(p *Publisher, sources map[int][]*stream.Stream) {
+	for _, stored := range p.streams {
+		for _, c := range stored.candidates {
+			c.seen = false
+		}
+	}
+	for index, streams := range sources {
+		p.processUpdate(index, streams)
+	}
+	p.resolve(context.Background())
+}
+
+func TestConflictPriority(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	p := newTestPublisher(kv, true)
+	a := &stream.Stream{Slug: "s1", Source: "http://a/s1", Format: "matroska"}
+	b := &stream.Stream{Slug: "s1", Source: "srt://b/s1", Format: "mpegts"}
+
+	tick(p, map[int][]*stream.Stream{0: {a}, 1: {b}})
+	s := publishedStream(t, kv, "s1")
+	assert.Equal(t, s.Source, b.Source)
+	assert.DeepEqual(t, s.Backups, []stream.BackupSource{{Format: "matroska", Source: a.Source}})
+	assert.Equal(t, testutil.ToFloat64(p.metrics.conflicts), 1.0)
+
+	// primary disappears, fail over to backup
+	tick(p, map[int][]*stream.Stream{0: {a}})
+	s = publishedStream(t, kv, "s1")
+	assert.Equal(t, s.Source, a.Source)
+	assert.DeepEqual(t, s.Backups, []stream.BackupSource{{Format: "mpegts", Source: b.Source}})
+	assert.Equal(t, testutil.ToFloat64(p.metrics.failovers), 1.0)
+
+	// stale primary expires
+	tick(p, map[int][]*stream.Stream{0: {a}})
+	s = publishedStream(t, kv, "s1")
+	assert.Equal(t, s.Source, a.Source)
+	assert.Assert(t, s.Backups == nil)
+
+	// primary returns
+	tick(p, map[int][]*stream.Stream{0: {a}, 1: {b}})
+	assert.Equal(t, publishedStream(t, kv, "s1").Source, b.Source)
+	assert.Equal(t, testutil.ToFloat64(p.metrics.failovers), 2.0)
+
+	// everything expires
+	tick(p, nil)
+	tick(p, nil)
+	tick(p, nil)
+	assert.Assert(t, publishedStream(t, kv, "s1") == nil)
+	assert.Equal(t, len(p.streams), 0)
+}
+
+func TestConflictWithoutBackups(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	p := newTestPublisher(kv, false)
+	p.conf.Sources[1].Priority = 0
+	p.scrapers[1].conf.Priority = 0
+	a := &stream.Stream{Slug: "s1", Source: "http://a/s1"}
+	b := &stream.Stream{Slug: "s1", Source: "srt://b/s1"}
+
+	// equal priority falls back to config order
+	tick(p, map[int][]*stream.Stream{0: {a}, 1: {b}})
+	s := publishedStream(t, kv, "s1")
+	assert.Equal(t, s.Source, a.Source)
+	assert.Assert(t, s.Backups == nil)
+}
+
+func TestRequireSettings(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	p := newTestPublisher(kv, false)
+	p.conf.RequireSettings = true
+	p.conf.Allowlist = []string{"test-*"}
+	p.settings["s1"] = &stream.Settings{Slug: "s1", Public: true}
+	s1 := &stream.Stream{Slug: "s1", Source: "http://a/s1"}
+	s2 := &stream.Stream{Slug: "s2", Source: "http://a/s2"}
+	s3 := &stream.Stream{Slug: "test-1", Source: "http://a/test-1"}
+
+	tick(p, map[int][]*stream.Stream{0: {s1, s2, s3}})
+	assert.Assert(t, publishedStream(t, kv, "s1").Public)
+	assert.Assert(t, publishedStream(t, kv, "s2") == nil)
+	assert.Assert(t, !publishedStream(t, kv, "test-1").Public)
+	var rejection stream.Rejection
+	assert.Assert(t, kv.GetJSON(t, client.RejectedStreamPath("s2"), &rejection))
+	assert.Equal(t, rejection.Source, s2.Source)
+
+	// settings removed, stream gets rejected
+	delete(p.settings, "s1")
+	p.settings["s2"] = &stream.Settings{Slug: "s2"}
+	tick(p, map[int][]*stream.Stream{0: {s1, s2, s3}})
+	assert.Assert(t, publishedStream(t, kv, "s1") == nil)
+	assert.Assert(t, publishedStream(t, kv, "s2") != nil)
+	_, ok := kv.Value(client.RejectedStreamPath("s2"))
+	assert.Assert(t, !ok)
+	_, ok = kv.Value(client.RejectedStreamPath("s1"))
+	assert.Assert(t, ok)
+}
+
+func TestReload(t *testing.T) {
+	kv := clienttest.NewKV(nil)
+	p := newTestPublisher(kv, false)
+	a := &stream.Stream{Slug: "s1", Source: "http://a/s1"}
+	b := &stream.Stream{Slug: "s2", Source: "srt://b/s2"}
+	tick(p, map[int][]*stream.Stream{0: {a}, 1: {b}})
+
+	// the remaining source moves to index 0, streams of the removed source expire
+	p.applyConfig(&config.PublisherConfig{
+		Interval: time.Second,
+		Timeout:  time.Second * 5,
+		Sources: []config.SourceConfig{
+			{Type: "srtrelay", URL: "http://b", Priority: 5},
+			{Type: "icecast", URL: "http://c"},
+		},
+	})
+	assert.Equal(t, len(p.scrapers), 2)
+	assert.Equal(t, p.scrapers[0].conf.Priority, 5)
+	assert.Equal(t, p.ttl, 5)
+	tick(p, map[int][]*stream.Stream{0: {b}})
+	assert.Assert(t, publishedStream(t, kv, "s1") == nil)
+	assert.Equal(t, publishedStream(t, kv, "s2").Source, b.Source)
+	assert.Equal(t, p.streams["s2"].candidates[0].priority, 5)
+}
+
+func TestReloadAfterStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conf := &config.PublisherConfig{Interval: time.Second, Timeout: time.Second * 3}
+	p := New(ctx, conf, clienttest.NewKV(nil), "test", prometheus.NewRegistry(), nil)
+	cancel()
+	p.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		p.Reload(conf)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reload blocked after stop")
+	}
+}
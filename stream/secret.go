@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 20000
+	hashSaltSize   = 16
+	hashKeySize    = 32
+)
+
+var errInvalidHash = errors.New("invalid secret hash")
+
+// RedactedValue replaces secrets and hashes in redacted settings
+const RedactedValue = "<redacted>"
+
+// StreamKey is a hashed stream secret with an optional validity window
+type StreamKey struct {
+	ID        string     `json:"id"`                  // key identifier, used for rotation and logging
+	Hash      string     `json:"hash"`                // salted secret hash as produced by HashSecret
+	NotBefore *time.Time `json:"notBefore,omitempty"` // key is invalid before this time
+	NotAfter  *time.Time `json:"notAfter,omitempty"`  // key is invalid after this time
+	Scheduled bool       `json:"scheduled,omitempty"` // key is only valid around the stream schedule
+}
+
+// Schedule is the planned airing window of a stream
+type Schedule struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// ScheduleWindow widens the stream schedule for scheduled keys
+type ScheduleWindow struct {
+	Lead  time.Duration // how long before the scheduled start publishing is allowed
+	Grace time.Duration // how long after the scheduled end publishing is allowed
+}
+
+// HashSecret returns a salted hash of secret for storage in StreamKey.Hash
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, hashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, salt, hashIterations, hashKeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifySecret checks secret against a hash produced by HashSecret in constant time
+func VerifySecret(hash string, secret string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false, errInvalidHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, errInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false, errInvalidHash
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, salt, iterations, len(expected))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// Verifier checks secrets against key hashes and caches the results,
+// so repeated attempts with the same secret don't rerun the key derivation
+type Verifier struct {
+	mutex   sync.Mutex
+	size    int
+	results map[[sha256.Size]byte]bool
+}
+
+// NewVerifier returns a verifier caching up to size results
+func NewVerifier(size int) *Verifier {
+	return &Verifier{size: size, results: make(map[[sha256.Size]byte]bool)}
+}
+
+// Verify checks secret against hash like VerifySecret, invalid hashes never match
+func (v *Verifier) Verify(hash string, secret string) bool {
+	if v == nil {
+		ok, err := VerifySecret(hash, secret)
+		return err == nil && ok
+	}
+	// the hash is part of the cache key, changed or revoked keys never hit stale results
+	id := sha256.Sum256([]byte(hash + "$" + secret))
+	v.mutex.Lock()
+	ok, cached := v.results[id]
+	v.mutex.Unlock()
+	if cached {
+		return ok
+	}
+
+	ok, err := VerifySecret(hash, secret)
+	ok = err == nil && ok
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if len(v.results) >= v.size {
+		clear(v.results)
+	}
+	v.results[id] = ok
+	return ok
+}
+
+// Valid reports whether the key may be used at time now
+func (k *StreamKey) Valid(now time.Time, schedule *Schedule, window ScheduleWindow) bool {
+	if k.NotBefore != nil && now.Before(*k.NotBefore) {
+		return false
+	}
+	if k.NotAfter != nil && now.After(*k.NotAfter) {
+		return false
+	}
+	if k.Scheduled {
+		if schedule == nil {
+			return false
+		}
+		if now.Before(schedule.Start.Add(-window.Lead)) || now.After(schedule.End.Add(window.Grace)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate checks secret against all currently valid keys and the legacy plaintext secret,
+// it returns the id of the matching key. The verifier may be nil.
+func (s *Settings) Authenticate(secret string, now time.Time, window ScheduleWindow, verifier *Verifier) (string, bool) {
+	if secret == "" {
+		return "", false
+	}
+	for _, key := range s.Keys {
+		if !key.Valid(now, s.Schedule, window) {
+			continue
+		}
+		if verifier.Verify(key.Hash, secret) {
+			return key.ID, true
+		}
+	}
+	if s.Secret != "" && subtle.ConstantTimeCompare([]byte(s.Secret), []byte(secret)) == 1 {
+		return "legacy", true
+	}
+	return "", false
+}
+
+// HashSecret replaces the plaintext secret with a hashed key of the given id
+func (s *Settings) HashSecret(id string) error {
+	if s.Secret == "" {
+		return nil
+	}
+	hash, err := HashSecret(s.Secret)
+	if err != nil {
+		return err
+	}
+	s.Keys = append(s.Keys, StreamKey{ID: id, Hash: hash})
+	s.Secret = ""
+	return nil
+}
+
+// Redacted returns a copy of the settings safe for logging
+func (s Settings) Redacted() Settings {
+	if s.Secret != "" {
+		s.Secret = RedactedValue
+	}
+	keys := make([]StreamKey, len(s.Keys))
+	for i, key := range s.Keys {
+		key.Hash = RedactedValue
+		keys[i] = key
+	}
+	s.Keys = keys
+	return s
+}
+
+// validHash reports whether hash has the format produced by HashSecret
+func validHash(hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	return err == nil && iterations > 0
+}
@@ -1,10 +1,52 @@
 package stream
 
 type Stream struct {
-	Format      string `json:"format"`      // ffmpeg format descriptor
-	Source      string `json:"source"`      // complete source URL
-	Slug        string `json:"slug"`        // stream slug
-	PublishedAt int    `json:"publishedAt"` // publish timestamp in unix format
+	Format      string         `json:"format"`            // ffmpeg format descriptor
+	Source      string         `json:"source"`            // complete source URL
+	Slug        string         `json:"slug"`              // stream slug
+	PublishedAt int            `json:"publishedAt"`       // publish timestamp in unix format
+	Backups     []BackupSource `json:"backups,omitempty"` // alternative sources ordered by preference
+	Health      *Health        `json:"health,omitempty"`  // ingest probe result, unset if probing is disabled
+	Public      bool           `json:"public"`            // whether the stream should be available publically
+}
+
+// Healthy reports whether the stream may be handed to transcoders
+func (s *Stream) Healthy() bool {
+	if s.Health == nil {
+		return true
+	}
+	return s.Health.Status == HealthHealthy || s.Health.Status == HealthUnknown
+}
+
+// BackupSource describes an alternative ingest for the same stream slug
+type BackupSource struct {
+	Format string `json:"format"` // ffmpeg format descriptor
+	Source string `json:"source"` // complete source URL
+}
+
+type HealthStatus string
+
+const (
+	HealthPending   HealthStatus = "pending"   // source has not been probed yet
+	HealthHealthy   HealthStatus = "healthy"   // media is flowing
+	HealthUnhealthy HealthStatus = "unhealthy" // source is unreachable or has no usable media
+	HealthUnknown   HealthStatus = "unknown"   // source can't be probed
+)
+
+// Health describes the result of probing a stream source
+type Health struct {
+	Status    HealthStatus `json:"status"`
+	Container string       `json:"container,omitempty"` // detected container format
+	Codecs    []string     `json:"codecs,omitempty"`    // detected track codecs
+	Bitrate   int          `json:"bitrate,omitempty"`   // measured bitrate in bits per second
+	Error     string       `json:"error,omitempty"`     // reason for an unhealthy status
+}
+
+// Rejection describes a stream announced by a source which the publisher refused to register
+type Rejection struct {
+	Slug   string `json:"slug"`   // stream slug
+	Source string `json:"source"` // complete source URL
+	Reason string `json:"reason"` // why the stream was not registered
 }
 
 type StreamOptions struct {
@@ -13,11 +55,14 @@ type StreamOptions struct {
 }
 
 type Settings struct {
-	Slug       string        `json:"slug"`       // stream slug
-	IngestType string        `json:"ingestType"` // mode: ingest vs. relay
-	Secret     string        `json:"secret"`     // stream secret for authentication
-	Public     bool          `json:"public"`     // whether the stream should be available publically
-	Options    StreamOptions `json:"options"`    // additional stream options
+	Slug       string        `json:"slug"`               // stream slug
+	IngestType string        `json:"ingestType"`         // mode: ingest vs. relay
+	Secret     string        `json:"secret,omitempty"`   // legacy plaintext secret, hashed into Keys when written through the monitor
+	Keys       []StreamKey   `json:"keys,omitempty"`     // hashed stream secrets for authentication
+	Schedule   *Schedule     `json:"schedule,omitempty"` // planned airing window for scheduled keys
+	Public     bool          `json:"public"`             // whether the stream should be available publically
+	Options    StreamOptions `json:"options"`            // additional stream options
+	Version    int           `json:"version,omitempty"`  // incremented on every change through the monitor
 }
 
 type GlobalConfig struct {
@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidSlug reports whether slug can be used as stream slug
+func ValidSlug(slug string) bool {
+	return len(slug) <= 64 && slugPattern.MatchString(slug)
+}
+
+// Validate checks the settings for consistency, it reports all problems at once
+func (s *Settings) Validate() error {
+	var errs []error
+	if !ValidSlug(s.Slug) {
+		errs = append(errs, fmt.Errorf("invalid slug '%s'", s.Slug))
+	}
+	if s.Schedule != nil && !s.Schedule.End.After(s.Schedule.Start) {
+		errs = append(errs, errors.New("schedule must end after its start"))
+	}
+	ids := make(map[string]bool)
+	for _, key := range s.Keys {
+		if key.ID == "" {
+			errs = append(errs, errors.New("key without id"))
+		} else if ids[key.ID] {
+			errs = append(errs, fmt.Errorf("duplicate key id '%s'", key.ID))
+		}
+		ids[key.ID] = true
+		if !validHash(key.Hash) {
+			errs = append(errs, fmt.Errorf("key '%s': invalid hash", key.ID))
+		}
+		if key.NotBefore != nil && key.NotAfter != nil && !key.NotAfter.After(*key.NotBefore) {
+			errs = append(errs, fmt.Errorf("key '%s': notAfter must be after notBefore", key.ID))
+		}
+		if key.Scheduled && s.Schedule == nil {
+			errs = append(errs, fmt.Errorf("key '%s': scheduled key requires a schedule", key.ID))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -9,9 +9,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("systemd")
+
 type CleanupFunc func()
 
 // ServiceConfig represents config for a systemd service
@@ -0,0 +1,34 @@
+package transcode
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the prometheus metrics of the transcoder
+type Metrics struct {
+	claimAttempts prometheus.Counter
+	claimFailures prometheus.Counter
+	units         prometheus.Gauge
+}
+
+// NewMetrics creates and registers the transcoder metrics
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Metrics{
+		claimAttempts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "transcoder_claim_attempts_total",
+			Help: "Total number of attempts to claim a stream",
+		}),
+		claimFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "transcoder_claim_failures_total",
+			Help: "Total number of failed stream claims, including streams already claimed by another transcoder",
+		}),
+		units: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "transcoder_running_units",
+			Help: "Number of transcoding units managed by this transcoder",
+		}),
+	}
+}
@@ -5,6 +5,7 @@ type TranscoderStatus struct {
 	Name       string `json:"name"`
 	Capacity   int    `json:"capacity"`
 	NumStreams int    `json:"streams"`
+	Draining   bool   `json:"draining,omitempty"` // transcoder releases its streams and claims no new ones
 }
 
 // ByLoad implements sort.Interface for transcoders based on job load
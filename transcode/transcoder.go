@@ -13,18 +13,23 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/voc/stream-api/client"
 	"github.com/voc/stream-api/config"
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
 	"github.com/voc/stream-api/stream"
 	"github.com/voc/stream-api/systemd"
 )
 
+var log = logging.Module("transcoder")
+
 var transcoderTTL = 10 * time.Second
 
 type Transcoder struct {
@@ -34,25 +39,37 @@ type Transcoder struct {
 	capacity   int
 	configPath string
 	sink       string // TODO: replace with dynamic discovery
+	metrics    *Metrics
+	events     *eventlog.Log
+	reload     chan config.TranscodeConfig
+	stopped    chan struct{} // closed when run returns
 
 	// local state
 	services          map[string]*systemd.Service
 	transcoders       map[string]*TranscoderStatus
 	streams           map[string]*stream.Stream
 	streamTranscoders map[string]string
+	placements        map[string]string // target transcoders of streams being moved
+	drained           map[string]bool
 }
 
-func New(ctx context.Context, conf config.TranscodeConfig, api client.ServiceAPI, name string) *Transcoder {
+func New(ctx context.Context, conf config.TranscodeConfig, api client.ServiceAPI, name string, reg prometheus.Registerer, events *eventlog.Log) *Transcoder {
 	t := &Transcoder{
 		api:               api,
 		services:          make(map[string]*systemd.Service),
 		transcoders:       make(map[string]*TranscoderStatus),
 		streams:           make(map[string]*stream.Stream),
 		streamTranscoders: make(map[string]string),
+		placements:        make(map[string]string),
+		drained:           make(map[string]bool),
 		name:              name,
 		capacity:          conf.Capacity,
 		configPath:        conf.ConfigPath,
 		sink:              conf.Sink,
+		metrics:           NewMetrics(reg),
+		events:            events,
+		reload:            make(chan config.TranscodeConfig),
+		stopped:           make(chan struct{}),
 	}
 
 	// watch source updates
@@ -63,15 +80,25 @@ func New(ctx context.Context, conf config.TranscodeConfig, api client.ServiceAPI
 }
 
 func (t *Transcoder) Wait() {
+	t.done.Wait()
 	for _, service := range t.services {
 		service.Wait()
 	}
-	t.done.Wait()
+}
+
+// Reload applies a changed config, streams exceeding a lowered capacity are handed off to other transcoders.
+// Changes of the config path and sink apply to jobs started afterwards. It returns without effect once the transcoder stopped.
+func (t *Transcoder) Reload(conf config.TranscodeConfig) {
+	select {
+	case t.reload <- conf:
+	case <-t.stopped:
+	}
 }
 
 // run keeps the communication to etcd
 func (t *Transcoder) run(parentContext context.Context) {
 	defer t.done.Done()
+	defer close(t.stopped)
 	ctx, cancel := context.WithCancel(parentContext)
 	defer cancel()
 
@@ -89,11 +116,16 @@ func (t *Transcoder) run(parentContext context.Context) {
 		}
 		break
 	}
-	transcoderChan, err := t.api.Watch(ctx, client.TranscoderPrefix)
+	transcoderChan, err := t.api.Watch(ctx, client.ServicePrefix("transcode")+"/")
 	if err != nil {
 		log.Fatal().Err(err).Msg("transcoder watch")
 		return
 	}
+	drainChan, err := t.api.Watch(ctx, client.TranscoderDrainPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("drain watch")
+		return
+	}
 	streamChan, err := t.api.Watch(ctx, client.StreamPrefix)
 	if err != nil {
 		log.Fatal().Err(err).Msg("stream watch")
@@ -104,7 +136,10 @@ func (t *Transcoder) run(parentContext context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			t.withdraw()
 			return
+		case conf := <-t.reload:
+			t.applyConfig(ctx, conf)
 		case updates, ok := <-transcoderChan:
 			if !ok {
 				log.Fatal().Msg("transcoder watch closed")
@@ -113,6 +148,14 @@ func (t *Transcoder) run(parentContext context.Context) {
 			for _, update := range updates {
 				t.handleTranscoder(update)
 			}
+		case updates, ok := <-drainChan:
+			if !ok {
+				log.Fatal().Msg("drain watch closed")
+				return
+			}
+			for _, update := range updates {
+				t.handleDrain(ctx, update)
+			}
 		case updates, ok := <-streamChan:
 			if !ok {
 				log.Fatal().Msg("stream watch closed")
@@ -126,7 +169,8 @@ func (t *Transcoder) run(parentContext context.Context) {
 			for key, service := range t.services {
 				// cleanup stopped services
 				if service.Stopped() {
-					log.Info().Msgf("transcode/service: stopped %s", key)
+					log.Info().Str(logging.SlugField, key).Msg("transcode/service: stopped")
+					t.events.Append(eventlog.Event{Slug: key, Module: "transcoder", Type: eventlog.Stopped})
 					delete(t.services, key)
 					err = t.publishStatus(ctx)
 					if err != nil {
@@ -137,10 +181,14 @@ func (t *Transcoder) run(parentContext context.Context) {
 				if _, found := t.streams[key]; !found {
 					service.Stop()
 				}
+				// stop services of streams claimed by another transcoder or when drained
+				if owner, found := t.streamTranscoders[key]; found && owner != t.name || t.drained[t.name] {
+					service.Stop()
+				}
 			}
 
 			// check whether we have capacity
-			if !t.shouldClaim() {
+			if !t.hasCapacity() {
 				break
 			}
 			for key, stream := range t.streams {
@@ -154,12 +202,49 @@ func (t *Transcoder) run(parentContext context.Context) {
 	}
 }
 
-// publishStatus announces the transcoder to the network
+// applyConfig updates the capacity and stops the newest jobs exceeding it
+func (t *Transcoder) applyConfig(ctx context.Context, conf config.TranscodeConfig) {
+	if conf.Capacity != t.capacity {
+		log.Info().Int("from", t.capacity).Int("to", conf.Capacity).Msg("transcoder: capacity changed")
+	}
+	t.capacity = conf.Capacity
+	t.configPath = conf.ConfigPath
+	t.sink = conf.Sink
+
+	var running []string
+	for key, service := range t.services {
+		if !service.Stopping() {
+			running = append(running, key)
+		}
+	}
+	sort.Strings(running)
+	for i := t.capacity; i < len(running); i++ {
+		log.Info().Str(logging.SlugField, running[i]).Msg("transcoder: handing off")
+		t.services[running[i]].Stop()
+	}
+	if err := t.publishStatus(ctx); err != nil {
+		log.Error().Err(err).Msg("transcoder/publish")
+	}
+}
+
+// withdraw removes the transcoder announcement on shutdown, the jobs release their claims when stopping
+func (t *Transcoder) withdraw() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := t.api.Delete(ctx, client.ServicePath("transcode", t.name)); err != nil {
+		log.Error().Err(err).Msg("transcoder/withdraw")
+	}
+}
+
+// publishStatus announces the transcoder to the network as service "transcode",
+// the monitor and the other transcoders watch the service prefix for it
 func (t *Transcoder) publishStatus(ctx context.Context) error {
+	t.metrics.units.Set(float64(len(t.services)))
 	status := &TranscoderStatus{
 		Name:       t.name,
 		Capacity:   t.capacity,
 		NumStreams: len(t.services),
+		Draining:   t.drained[t.name],
 	}
 	data, err := json.Marshal(status)
 	if err != nil {
@@ -176,12 +261,11 @@ func (t *Transcoder) publishStatus(ctx context.Context) error {
 
 // handleTranscoder handles an etcd transcoder update
 func (t *Transcoder) handleTranscoder(update *client.WatchUpdate) {
-	log.Debug().Msgf("foobar?! %v", update)
 	if update.KV == nil {
 		return
 	}
-	name, ok := client.ParseTranscoderName(string(update.KV.Key()))
-	if !ok {
+	name := client.ParseServiceName(string(update.KV.Key()))
+	if name == "" {
 		return
 	}
 	log.Debug().Msgf("got transcoder update: %v name: %s", update, name)
@@ -201,6 +285,35 @@ func (t *Transcoder) handleTranscoder(update *client.WatchUpdate) {
 	log.Debug().Msgf("transcoders %v", t.transcoders)
 }
 
+// handleDrain handles an update in the drain prefix, drained transcoders release their streams
+func (t *Transcoder) handleDrain(ctx context.Context, update *client.WatchUpdate) {
+	if update.KV == nil {
+		return
+	}
+	name := strings.TrimPrefix(update.KV.Key(), client.TranscoderDrainPrefix)
+	if name == "" {
+		return
+	}
+
+	switch update.Type {
+	case client.UpdateTypePut:
+		t.drained[name] = true
+	case client.UpdateTypeDelete:
+		delete(t.drained, name)
+	}
+	if name != t.name {
+		return
+	}
+	if t.drained[name] {
+		log.Info().Msg("transcoder: draining")
+	} else {
+		log.Info().Msg("transcoder: drain cancelled")
+	}
+	if err := t.publishStatus(ctx); err != nil {
+		log.Error().Err(err).Msg("transcoder/publish")
+	}
+}
+
 // handleStream handles an update in the etcd stream prefix
 func (t *Transcoder) handleStream(ctx context.Context, update *client.WatchUpdate) {
 	if update.KV == nil {
@@ -217,6 +330,8 @@ func (t *Transcoder) handleStream(ctx context.Context, update *client.WatchUpdat
 		t.handleStreamUpdate(ctx, name, update)
 	} else if client.PathIsStreamTranscoder(path) {
 		t.handleStreamTranscoder(ctx, name, update)
+	} else if client.PathIsStreamPlacement(path) {
+		t.handleStreamPlacement(ctx, name, update)
 	}
 }
 
@@ -259,15 +374,57 @@ func (t *Transcoder) handleStreamTranscoder(ctx context.Context, key string, upd
 	log.Debug().Msgf("transcoder/streamTranscoders %v", t.streamTranscoders)
 }
 
-// shouldClaim computes whether we should claim a slot for a certain service
-func (t *Transcoder) shouldClaim() bool {
+// handleStreamPlacement handles an update of the transcoder a stream should be moved to
+func (t *Transcoder) handleStreamPlacement(ctx context.Context, key string, update *client.WatchUpdate) {
+	switch update.Type {
+	case client.UpdateTypePut:
+		t.placements[key] = string(update.KV.Value())
+		// the target claims the stream as soon as it is released
+		if stream, found := t.streams[key]; found {
+			if _, claimed := t.streamTranscoders[key]; !claimed {
+				t.claimStream(ctx, stream)
+			}
+		}
+	case client.UpdateTypeDelete:
+		delete(t.placements, key)
+	}
+	log.Debug().Msgf("transcoder/placements %v", t.placements)
+}
+
+// hasCapacity reports whether we may start another service
+func (t *Transcoder) hasCapacity() bool {
+	if t.drained[t.name] {
+		return false
+	}
 	if t.capacity-len(t.services) <= 0 {
 		log.Info().Msg("Full capacity reached")
 		return false
 	}
+	return true
+}
+
+// available reports whether a transcoder is announced and not drained
+func (t *Transcoder) available(name string) bool {
+	_, found := t.transcoders[name]
+	return found && !t.drained[name]
+}
+
+// shouldClaim computes whether we should claim a slot for a certain stream
+func (t *Transcoder) shouldClaim(slug string) bool {
+	if !t.hasCapacity() {
+		return false
+	}
+
+	// streams being moved are only claimed by their target
+	if target, found := t.placements[slug]; found && t.available(target) {
+		return target == t.name
+	}
 
 	transcoders := make([]*TranscoderStatus, 0, len(t.transcoders))
 	for _, transcoder := range t.transcoders {
+		if t.drained[transcoder.Name] {
+			continue
+		}
 		transcoders = append(transcoders, transcoder)
 	}
 	sort.Sort(ByLoad(transcoders))
@@ -285,30 +442,47 @@ func (t *Transcoder) shouldClaim() bool {
 
 // claimStream claims a stream for the current transcoder
 func (t *Transcoder) claimStream(ctx context.Context, s *stream.Stream) {
-	if !t.shouldClaim() {
+	// don't transcode streams without usable media
+	if !s.Healthy() {
+		log.Debug().Str(logging.SlugField, s.Slug).Msgf("transcoder/claim: ignore as stream is %s", s.Health.Status)
+		return
+	}
+	if !t.shouldClaim(s.Slug) {
 		return
 	}
 	// wait for reclaim
 	if service, ok := t.services[s.Slug]; ok && service.Stopping() {
-		log.Debug().Msgf("transcoder/claim: ignore %s as service is stopping", s.Slug)
+		log.Debug().Str(logging.SlugField, s.Slug).Msg("transcoder/claim: ignore as service is stopping")
 		return
 	}
 
 	key := client.StreamTranscoderPath(s.Slug)
+	t.metrics.claimAttempts.Inc()
 	err := t.api.PutWithSession(ctx, key, []byte(t.name))
 	if err != nil {
-		log.Error().Err(err).Msgf("transcoder/claim: %s", s.Slug)
+		log.Error().Err(err).Str(logging.SlugField, s.Slug).Msg("transcoder/claim")
+		t.metrics.claimFailures.Inc()
 		return
 	}
+	if t.placements[s.Slug] == t.name {
+		// the move is complete
+		if err := t.api.Delete(ctx, client.StreamPlacementPath(s.Slug)); err != nil {
+			log.Error().Err(err).Str(logging.SlugField, s.Slug).Msg("transcoder/placement")
+		}
+	}
 
 	// already claimed for us
 	if service, ok := t.services[s.Slug]; ok {
-		log.Debug().Msgf("transcoder/claim: restart %s", s.Slug)
+		log.Debug().Str(logging.SlugField, s.Slug).Msg("transcoder/claim: restart")
 		service.Restart(t.templateConfig(s))
+		t.events.Append(eventlog.Event{Slug: s.Slug, Module: "transcoder", Type: eventlog.Restarted,
+			Fields: map[string]string{"source": s.Source}})
 		return
 	}
 
-	log.Info().Msgf("transcoder: claimed %s", s.Slug)
+	log.Info().Str(logging.SlugField, s.Slug).Msg("transcoder: claimed")
+	t.events.Append(eventlog.Event{Slug: s.Slug, Module: "transcoder", Type: eventlog.Claimed,
+		Fields: map[string]string{"source": s.Source}})
 	t.startService(ctx, s)
 }
 
@@ -346,10 +520,10 @@ func (t *Transcoder) templateConfig(s *stream.Stream) []byte {
 }
 
 func (t *Transcoder) startService(ctx context.Context, s *stream.Stream) {
-	log.Info().Msgf("transcoder/service: start %s", s.Slug)
+	log.Info().Str(logging.SlugField, s.Slug).Msg("transcoder/service: start")
 	service, err := t.createService(ctx, s)
 	if err != nil {
-		log.Error().Err(err).Msgf("transcoder/service: %s", s.Slug)
+		log.Error().Err(err).Str(logging.SlugField, s.Slug).Msg("transcoder/service")
 	}
 	t.services[s.Slug] = service
 	err = t.publishStatus(ctx)
@@ -364,12 +538,21 @@ func (t *Transcoder) createService(ctx context.Context, s *stream.Stream) (*syst
 		ConfigPath: path.Join(t.configPath, s.Slug),
 		UnitName:   fmt.Sprintf("transcode@%s.target", s.Slug),
 		Cleanup: func() {
+			// the transcoder context is already done on shutdown
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			key := client.StreamTranscoderPath(s.Slug)
-			err := t.api.Delete(ctx, key)
+			// keep the claim if the stream was moved to another transcoder
+			owner, err := t.api.Get(ctx, key)
+			if err == nil && owner != nil && string(owner) != t.name {
+				return
+			}
+			err = t.api.Delete(ctx, key)
 			if err != nil {
-				log.Error().Err(err).Msgf("transcoder/unclaim: %s", s.Slug)
+				log.Error().Err(err).Str(logging.SlugField, s.Slug).Msg("transcoder/unclaim")
 				return
 			}
+			t.events.Append(eventlog.Event{Slug: s.Slug, Module: "transcoder", Type: eventlog.Released})
 		},
 	})
 }
@@ -0,0 +1,102 @@
+package transcode
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+	"github.com/voc/stream-api/stream"
+	"github.com/voc/stream-api/systemd"
+)
+
+type keyValue struct {
+	key   string
+	value []byte
+}
+
+func (kv keyValue) Key() string   { return kv.key }
+func (kv keyValue) Value() []byte { return kv.value }
+
+func put(key string, value string) *client.WatchUpdate {
+	return &client.WatchUpdate{Type: client.UpdateTypePut, KV: keyValue{key: key, value: []byte(value)}}
+}
+
+func del(key string) *client.WatchUpdate {
+	return &client.WatchUpdate{Type: client.UpdateTypeDelete, KV: keyValue{key: key}}
+}
+
+// newTestTranscoder returns a transcoder without running its watches
+func newTestTranscoder(api client.ServiceAPI, name string, capacity int) *Transcoder {
+	return &Transcoder{
+		api:               api,
+		services:          make(map[string]*systemd.Service),
+		transcoders:       make(map[string]*TranscoderStatus),
+		streams:           make(map[string]*stream.Stream),
+		streamTranscoders: make(map[string]string),
+		placements:        make(map[string]string),
+		drained:           make(map[string]bool),
+		name:              name,
+		capacity:          capacity,
+		metrics:           NewMetrics(prometheus.NewRegistry()),
+	}
+}
+
+func announce(t *testing.T, tr *Transcoder, statuses ...TranscoderStatus) {
+	for _, status := range statuses {
+		data, err := json.Marshal(status)
+		assert.NilError(t, err)
+		tr.handleTranscoder(put(client.ServicePath("transcode", status.Name), string(data)))
+	}
+}
+
+func TestShouldClaim(t *testing.T) {
+	ctx := context.Background()
+	t2 := newTestTranscoder(clienttest.NewKV(nil), "t2", 4)
+	announce(t, t2,
+		TranscoderStatus{Name: "t1", Capacity: 4, NumStreams: 0},
+		TranscoderStatus{Name: "t2", Capacity: 4, NumStreams: 1},
+	)
+	assert.Assert(t, !t2.shouldClaim("s1"), "least loaded transcoder claims")
+
+	// placements move streams to their target
+	t2.handleStream(ctx, put(client.StreamPlacementPath("s1"), "t2"))
+	assert.Assert(t, t2.shouldClaim("s1"))
+	assert.Assert(t, !t2.shouldClaim("s2"))
+	t2.handleStream(ctx, put(client.StreamPlacementPath("s2"), "t3"))
+	assert.Assert(t, !t2.shouldClaim("s2"), "unknown targets fall back to the load")
+	t2.handleStream(ctx, del(client.StreamPlacementPath("s1")))
+	assert.Assert(t, !t2.shouldClaim("s1"))
+
+	// drained transcoders are skipped
+	t2.handleDrain(ctx, put(client.TranscoderDrainPath("t1"), ""))
+	assert.Assert(t, t2.shouldClaim("s1"))
+	t2.handleStream(ctx, put(client.StreamPlacementPath("s1"), "t1"))
+	assert.Assert(t, t2.shouldClaim("s1"), "drained targets fall back to the load")
+	t2.handleDrain(ctx, del(client.TranscoderDrainPath("t1")))
+	assert.Assert(t, !t2.shouldClaim("s1"))
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	kv := clienttest.NewKV(nil)
+	t1 := newTestTranscoder(kv, "t1", 4)
+	announce(t, t1, TranscoderStatus{Name: "t1", Capacity: 4})
+	assert.Assert(t, t1.shouldClaim("s1"))
+
+	t1.handleDrain(ctx, put(client.TranscoderDrainPath("t1"), ""))
+	assert.Assert(t, !t1.shouldClaim("s1"))
+	var status TranscoderStatus
+	assert.Assert(t, kv.GetJSON(t, client.ServicePath("transcode", "t1"), &status))
+	assert.Assert(t, status.Draining)
+
+	t1.handleDrain(ctx, del(client.TranscoderDrainPath("t1")))
+	assert.Assert(t, t1.shouldClaim("s1"))
+	status = TranscoderStatus{}
+	assert.Assert(t, kv.GetJSON(t, client.ServicePath("transcode", "t1"), &status))
+	assert.Assert(t, !status.Draining)
+}
@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
-
-	"github.com/rs/zerolog/log"
 )
 
 type APIServer struct {
@@ -0,0 +1,540 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zencoder/go-dash/mpd"
+)
+
+type DASHConfiguration struct {
+	Slug           string
+	BasePath       string
+	PlaylistConfig PlaylistConfig
+	Writer         FileWriter
+	Registry       *FileRegistry
+}
+
+type DASHParser struct {
+	mutex          sync.Mutex
+	slug           string
+	basePath       string
+	playlistConfig PlaylistConfig
+	writer         FileWriter
+	registry       *FileRegistry
+	manifests      map[string]*dashManifest // tracked manifests by path
+	files          *fileKeeper              // tracked files
+}
+
+// Tracks a dynamic source manifest and produces an output manifest with a stable window,
+// every encoder restart starts a new period
+type dashManifest struct {
+	window  int
+	start   time.Time // availability start of the output manifest
+	periods []*dashPeriod
+	nextID  int
+}
+
+type dashPeriod struct {
+	id          string
+	source      *mpd.Period
+	sourceStart time.Time     // availability start of the encoder run
+	start       time.Duration // relative to the output availability start
+	timelines   map[string]*dashTimeline
+}
+
+// Tracks the segments of a segment template,
+// a template of an adaptation set is shared by all its representations
+type dashTimeline struct {
+	template  *mpd.SegmentTemplate
+	timescale int64
+	init      []string // initialization segment paths
+	segments  []dashSegment
+}
+
+type dashSegment struct {
+	number   int64
+	time     uint64
+	duration uint64
+	files    []string // media segment paths of all representations
+}
+
+// segment template with the representations using it
+type dashTemplate struct {
+	key             string
+	template        *mpd.SegmentTemplate
+	representations []*mpd.Representation
+}
+
+func NewDASHParser(config DASHConfiguration) *DASHParser {
+	return &DASHParser{
+		slug:           config.Slug,
+		basePath:       config.BasePath,
+		playlistConfig: config.PlaylistConfig,
+		writer:         config.Writer,
+		registry:       config.Registry,
+		manifests:      make(map[string]*dashManifest),
+		files:          newFileKeeper(config.Registry),
+	}
+}
+
+func (d *DASHParser) Cleanup() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.files.close()
+}
+
+/*
+Process dash manifest
+ 1. parse manifest
+ 2. if static manifest: output unchanged
+ 3. if dynamic manifest:
+    - start a new period if the encoder restarted
+    - append new segments to the output timelines and drop segments outside the window
+    - keep all referenced segments alive
+*/
+func (d *DASHParser) ParsePlaylist(path string, reader io.Reader) error {
+	if filepath.Dir(path) != d.basePath {
+		return fmt.Errorf("invalid manifest directory %s", path)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	source, err := mpd.Read(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// static manifests describe complete presentations
+	if source.Type == nil || *source.Type != "dynamic" || len(source.Periods) == 0 {
+		if err := d.writer.WriteFile(path, data); err != nil {
+			return err
+		}
+		d.files.keep(path)
+		return nil
+	}
+
+	m, ok := d.manifests[path]
+	if !ok {
+		m = &dashManifest{window: d.playlistConfig.Size}
+		d.manifests[path] = m
+	}
+	restarted, err := m.update(source, d.basePath)
+	if err != nil {
+		return err
+	}
+	if restarted && len(m.periods) > 1 {
+		log.Warn().Str("slug", d.slug).Str("path", path).Str("period", m.current().id).Msg("encoder restarted, starting new period")
+	}
+
+	str, err := m.render(source).WriteToString()
+	if err != nil {
+		return err
+	}
+	if err := d.writer.WriteFile(path, []byte(str)); err != nil {
+		return err
+	}
+	d.sync()
+	return nil
+}
+
+// sync keeps the files of all output manifests alive
+func (d *DASHParser) sync() {
+	referenced := make(map[string]bool)
+	for path, m := range d.manifests {
+		referenced[path] = true
+		m.references(referenced)
+	}
+	d.files.sync(referenced)
+}
+
+func (m *dashManifest) current() *dashPeriod {
+	if len(m.periods) == 0 {
+		return nil
+	}
+	return m.periods[len(m.periods)-1]
+}
+
+// update applies a source manifest, it returns true if a new period was started
+func (m *dashManifest) update(source *mpd.MPD, basePath string) (bool, error) {
+	period := source.Periods[len(source.Periods)-1]
+	var sourceStart time.Time
+	if source.AvailabilityStartTime != nil {
+		var err error
+		sourceStart, err = time.Parse(time.RFC3339Nano, *source.AvailabilityStartTime)
+		if err != nil {
+			return false, fmt.Errorf("invalid availabilityStartTime: %w", err)
+		}
+	}
+
+	templates := periodTemplates(period)
+	segments := make(map[string][]dashSegment, len(templates))
+	for _, t := range templates {
+		s, err := timelineSegments(t, basePath)
+		if err != nil {
+			return false, err
+		}
+		segments[t.key] = s
+	}
+
+	current := m.current()
+	restarted := current == nil || current.restarted(sourceStart, segments)
+	if restarted {
+		current = m.startPeriod(period, sourceStart)
+	}
+	current.source = period
+
+	for _, t := range templates {
+		tl, ok := current.timelines[t.key]
+		if !ok {
+			tl = &dashTimeline{}
+			current.timelines[t.key] = tl
+		}
+		init, err := initPaths(t, basePath)
+		if err != nil {
+			return false, err
+		}
+		tl.template = t.template
+		tl.timescale = 1
+		if t.template.Timescale != nil && *t.template.Timescale > 0 {
+			tl.timescale = *t.template.Timescale
+		}
+		tl.init = init
+		tl.append(segments[t.key], m.window)
+	}
+	m.trim()
+	return restarted, nil
+}
+
+// restarted returns true if the encoder started a new presentation
+func (p *dashPeriod) restarted(sourceStart time.Time, segments map[string][]dashSegment) bool {
+	if !sourceStart.Equal(p.sourceStart) {
+		return true
+	}
+	for key, s := range segments {
+		tl, ok := p.timelines[key]
+		if !ok {
+			// representations changed
+			return len(p.timelines) > 0
+		}
+		if len(s) > 0 && len(tl.segments) > 0 && s[len(s)-1].number < tl.segments[len(tl.segments)-1].number {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *dashManifest) startPeriod(source *mpd.Period, sourceStart time.Time) *dashPeriod {
+	var start time.Duration
+	previous := m.current()
+	switch {
+	case previous == nil:
+		m.start = sourceStart
+	case !sourceStart.IsZero() && !m.start.IsZero():
+		start = sourceStart.Sub(m.start)
+	default:
+		start = previous.end()
+	}
+	if source.Start != nil {
+		start += time.Duration(*source.Start)
+	}
+	// periods must not overlap
+	if previous != nil && start < previous.end() {
+		start = previous.end()
+	}
+
+	p := &dashPeriod{
+		id:          fmt.Sprint(m.nextID),
+		sourceStart: sourceStart,
+		start:       start,
+		timelines:   make(map[string]*dashTimeline),
+	}
+	m.nextID++
+	m.periods = append(m.periods, p)
+	return p
+}
+
+// end returns the end of the last segment relative to the output availability start
+func (p *dashPeriod) end() time.Duration {
+	end := p.start
+	for _, tl := range p.timelines {
+		if len(tl.segments) == 0 {
+			continue
+		}
+		last := tl.segments[len(tl.segments)-1]
+		end = max(end, p.start+tl.duration(last.time+last.duration-tl.offset()))
+	}
+	return end
+}
+
+// trim drops segments of previous periods exceeding the window and removes empty periods
+func (m *dashManifest) trim() {
+	budget := m.window
+	for i := len(m.periods) - 1; i >= 0; i-- {
+		n := 0
+		for _, tl := range m.periods[i].timelines {
+			if len(tl.segments) > budget {
+				tl.segments = tl.segments[len(tl.segments)-budget:]
+			}
+			n = max(n, len(tl.segments))
+		}
+		budget -= n
+	}
+
+	var periods []*dashPeriod
+	for i, p := range m.periods {
+		if i == len(m.periods)-1 || p.end() > p.start {
+			periods = append(periods, p)
+		}
+	}
+	m.periods = periods
+}
+
+// references adds all files referenced by the output manifest
+func (m *dashManifest) references(files map[string]bool) {
+	for _, p := range m.periods {
+		for _, tl := range p.timelines {
+			for _, path := range tl.init {
+				files[path] = true
+			}
+			for _, s := range tl.segments {
+				for _, path := range s.files {
+					files[path] = true
+				}
+			}
+		}
+	}
+}
+
+// render returns the output manifest based on the latest source manifest
+func (m *dashManifest) render(source *mpd.MPD) *mpd.MPD {
+	out := *source
+	if !m.start.IsZero() {
+		start := m.start.UTC().Format("2006-01-02T15:04:05.000Z")
+		out.AvailabilityStartTime = &start
+	}
+
+	var depth time.Duration
+	out.Periods = nil
+	for _, p := range m.periods {
+		period := *p.source
+		period.ID = p.id
+		start := mpd.Duration(p.start)
+		period.Start = &start
+		var length time.Duration
+		for _, tl := range p.timelines {
+			tl.render()
+			length = max(length, tl.length())
+		}
+		depth += length
+		out.Periods = append(out.Periods, &period)
+	}
+	if depth > 0 {
+		// segments outside the window are deleted
+		timeShift := fmt.Sprintf("PT%.1fS", depth.Seconds())
+		out.TimeShiftBufferDepth = &timeShift
+	}
+	return &out
+}
+
+// append adds segments newer than the last tracked segment, keeping at most window segments
+func (tl *dashTimeline) append(segments []dashSegment, window int) {
+	for _, s := range segments {
+		if len(tl.segments) > 0 {
+			last := tl.segments[len(tl.segments)-1]
+			if s.number <= last.number {
+				continue
+			}
+			// timelines can't express gaps in the numbering
+			if s.number != last.number+1 {
+				tl.segments = nil
+			}
+		}
+		tl.segments = append(tl.segments, s)
+	}
+	if len(tl.segments) > window {
+		tl.segments = tl.segments[len(tl.segments)-window:]
+	}
+}
+
+// render writes the tracked segments into the template
+func (tl *dashTimeline) render() {
+	timeline := &mpd.SegmentTimeline{}
+	var previous *mpd.SegmentTimelineSegment
+	var next uint64 // start of the following segment
+	for _, s := range tl.segments {
+		if previous != nil && s.time == next && s.duration == previous.Duration {
+			repeat := 1
+			if previous.RepeatCount != nil {
+				repeat = *previous.RepeatCount + 1
+			}
+			previous.RepeatCount = &repeat
+		} else {
+			t := s.time
+			previous = &mpd.SegmentTimelineSegment{StartTime: &t, Duration: s.duration}
+			timeline.Segments = append(timeline.Segments, previous)
+		}
+		next = s.time + s.duration
+	}
+	tl.template.SegmentTimeline = timeline
+	if len(tl.segments) > 0 {
+		number := tl.segments[0].number
+		tl.template.StartNumber = &number
+	}
+}
+
+// length returns the duration of all tracked segments
+func (tl *dashTimeline) length() time.Duration {
+	var length uint64
+	for _, s := range tl.segments {
+		length += s.duration
+	}
+	return tl.duration(length)
+}
+
+func (tl *dashTimeline) offset() uint64 {
+	if tl.template.PresentationTimeOffset == nil {
+		return 0
+	}
+	return *tl.template.PresentationTimeOffset
+}
+
+// duration converts a timescale value
+func (tl *dashTimeline) duration(value uint64) time.Duration {
+	return time.Duration(float64(value) / float64(tl.timescale) * float64(time.Second))
+}
+
+// periodTemplates returns the segment templates of all adaptation sets and representations
+func periodTemplates(period *mpd.Period) []dashTemplate {
+	var templates []dashTemplate
+	for i, set := range period.AdaptationSets {
+		if set == nil {
+			continue
+		}
+		var shared []*mpd.Representation
+		for _, rep := range set.Representations {
+			if rep == nil {
+				continue
+			}
+			if rep.SegmentTemplate == nil {
+				shared = append(shared, rep)
+				continue
+			}
+			id := ""
+			if rep.ID != nil {
+				id = *rep.ID
+			}
+			templates = append(templates, dashTemplate{
+				key:             fmt.Sprintf("%d/%s", i, id),
+				template:        rep.SegmentTemplate,
+				representations: []*mpd.Representation{rep},
+			})
+		}
+		if set.SegmentTemplate != nil && len(shared) > 0 {
+			templates = append(templates, dashTemplate{
+				key:             fmt.Sprint(i),
+				template:        set.SegmentTemplate,
+				representations: shared,
+			})
+		}
+	}
+	return templates
+}
+
+// timelineSegments expands the segment timeline of a template,
+// templates without timeline are passed through untracked
+func timelineSegments(t dashTemplate, basePath string) ([]dashSegment, error) {
+	template := t.template
+	if template.SegmentTimeline == nil || template.Media == nil {
+		return nil, nil
+	}
+	number := int64(1)
+	if template.StartNumber != nil {
+		number = *template.StartNumber
+	}
+	var time uint64
+	var segments []dashSegment
+	for _, s := range template.SegmentTimeline.Segments {
+		if s.StartTime != nil {
+			time = *s.StartTime
+		}
+		repeat := 0
+		if s.RepeatCount != nil && *s.RepeatCount > 0 {
+			repeat = *s.RepeatCount
+		}
+		for i := 0; i <= repeat; i++ {
+			segment := dashSegment{number: number, time: time, duration: s.Duration}
+			for _, rep := range t.representations {
+				path, err := templatePath(basePath, *template.Media, rep, number, time)
+				if err != nil {
+					return nil, err
+				}
+				segment.files = append(segment.files, path)
+			}
+			segments = append(segments, segment)
+			number++
+			time += s.Duration
+		}
+	}
+	return segments, nil
+}
+
+func initPaths(t dashTemplate, basePath string) ([]string, error) {
+	if t.template.Initialization == nil {
+		return nil, nil
+	}
+	var paths []string
+	for _, rep := range t.representations {
+		path, err := templatePath(basePath, *t.template.Initialization, rep, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+var dashTemplatePattern = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|)(%0\d+d)?\$`)
+
+// templatePath expands a segment template to a path within basePath
+func templatePath(basePath string, template string, rep *mpd.Representation, number int64, time uint64) (string, error) {
+	name := dashTemplatePattern.ReplaceAllStringFunc(template, func(match string) string {
+		parts := dashTemplatePattern.FindStringSubmatch(match)
+		format := "%d"
+		if parts[2] != "" {
+			format = parts[2]
+		}
+		switch parts[1] {
+		case "RepresentationID":
+			if rep.ID != nil {
+				return *rep.ID
+			}
+			return ""
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, time)
+		case "Bandwidth":
+			if rep.Bandwidth != nil {
+				return fmt.Sprintf(format, *rep.Bandwidth)
+			}
+			return ""
+		}
+		return "$"
+	})
+	path := filepath.Join(basePath, name)
+	if !strings.HasPrefix(path, basePath+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid segment path %s", name)
+	}
+	return path, nil
+}
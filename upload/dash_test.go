@@ -0,0 +1,133 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zencoder/go-dash/mpd"
+	"gotest.tools/v3/assert"
+)
+
+type memoryWriter struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func (w *memoryWriter) WriteFile(path string, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.files[path] = data
+	return nil
+}
+
+func (w *memoryWriter) manifest(t *testing.T, path string) *mpd.MPD {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	m, err := mpd.Read(bytes.NewReader(w.files[path]))
+	assert.NilError(t, err)
+	return m
+}
+
+// liveManifest returns a single representation manifest as written by ffmpeg
+func liveManifest(start string, startNumber int, count int) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic" availabilityStartTime="%s" minBufferTime="PT8.0S">
+	<Period id="0" start="PT0.0S">
+		<AdaptationSet id="0" contentType="video">
+			<Representation id="0" mimeType="video/mp4" bandwidth="4000000">
+				<SegmentTemplate timescale="1000" initialization="init-stream$RepresentationID$.m4s" media="chunk-stream$RepresentationID$-$Number%%05d$.m4s" startNumber="%d">
+					<SegmentTimeline>
+						<S t="%d" d="4000" r="%d" />
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`, start, startNumber, (startNumber-1)*4000, count-1)
+}
+
+func newTestDASHParser(size int) (*DASHParser, *memoryWriter) {
+	w := &memoryWriter{files: make(map[string][]byte)}
+	return NewDASHParser(DASHConfiguration{
+		Slug:           "foo",
+		BasePath:       "/dash/foo",
+		PlaylistConfig: PlaylistConfig{Size: size},
+		Writer:         w,
+		Registry:       NewFileRegistry(FileRegistryConfig{ExpireInterval: time.Second, KeepDelay: time.Second}),
+	}), w
+}
+
+func TestDASHWindow(t *testing.T) {
+	d, w := newTestDASHParser(3)
+	defer d.registry.Stop()
+
+	f, err := os.Open("fixtures/ffmpeg_live.mpd")
+	assert.NilError(t, err)
+	defer f.Close()
+	assert.NilError(t, d.ParsePlaylist("/dash/foo/out.mpd", f))
+
+	out := w.manifest(t, "/dash/foo/out.mpd")
+	assert.Equal(t, *out.TimeShiftBufferDepth, "PT12.0S")
+	video := out.Periods[0].AdaptationSets[0].Representations[0].SegmentTemplate
+	assert.Equal(t, *video.StartNumber, int64(8))
+	assert.Equal(t, *video.SegmentTimeline.Segments[0].StartTime, uint64(7*51200))
+	assert.Equal(t, *video.SegmentTimeline.Segments[0].RepeatCount, 2)
+
+	// referenced segments are kept, others may expire
+	for _, path := range []string{"out.mpd", "init-stream0.m4s", "init-stream1.m4s", "chunk-stream0-00008.m4s", "chunk-stream1-00010.m4s"} {
+		_, ok := d.files.files["/dash/foo/"+path]
+		assert.Assert(t, ok, path)
+	}
+	assert.Equal(t, len(d.files.files), 9)
+	keep := d.files.files["/dash/foo/chunk-stream0-00008.m4s"]
+
+	assert.NilError(t, d.ParsePlaylist("/dash/foo/out.mpd", bytes.NewBufferString(liveManifest("2023-08-15T13:40:28Z", 2, 10))))
+	_, ok := d.files.files["/dash/foo/chunk-stream0-00008.m4s"]
+	assert.Assert(t, !ok)
+	_, open := <-keep
+	assert.Assert(t, !open)
+}
+
+func TestDASHRestart(t *testing.T) {
+	d, w := newTestDASHParser(3)
+	defer d.registry.Stop()
+
+	assert.NilError(t, d.ParsePlaylist("/dash/foo/out.mpd", bytes.NewBufferString(liveManifest("2023-08-15T13:40:00Z", 1, 5))))
+
+	// encoder restarted a minute later
+	assert.NilError(t, d.ParsePlaylist("/dash/foo/out.mpd", bytes.NewBufferString(liveManifest("2023-08-15T13:41:00Z", 1, 1))))
+	out := w.manifest(t, "/dash/foo/out.mpd")
+	assert.Equal(t, *out.AvailabilityStartTime, "2023-08-15T13:40:00.000Z")
+	assert.Equal(t, len(out.Periods), 2)
+	assert.Equal(t, out.Periods[0].ID, "0")
+	assert.Equal(t, out.Periods[1].ID, "1")
+	assert.Equal(t, time.Duration(*out.Periods[1].Start), time.Minute)
+
+	// previous period is shortened to keep the window
+	old := out.Periods[0].AdaptationSets[0].Representations[0].SegmentTemplate
+	assert.Equal(t, *old.StartNumber, int64(4))
+	assert.Equal(t, *old.SegmentTimeline.Segments[0].RepeatCount, 1)
+
+	// and removed once the new period fills the window
+	assert.NilError(t, d.ParsePlaylist("/dash/foo/out.mpd", bytes.NewBufferString(liveManifest("2023-08-15T13:41:00Z", 1, 3))))
+	out = w.manifest(t, "/dash/foo/out.mpd")
+	assert.Equal(t, len(out.Periods), 1)
+	assert.Equal(t, out.Periods[0].ID, "1")
+	_, ok := d.files.files["/dash/foo/chunk-stream0-00005.m4s"]
+	assert.Assert(t, !ok)
+	_, ok = d.files.files["/dash/foo/chunk-stream0-00001.m4s"]
+	assert.Assert(t, ok)
+}
+
+func TestDASHInvalidPath(t *testing.T) {
+	d, _ := newTestDASHParser(3)
+	defer d.registry.Stop()
+
+	manifest := bytes.ReplaceAll([]byte(liveManifest("2023-08-15T13:40:00Z", 1, 1)), []byte("chunk-stream"), []byte("../../chunk-stream"))
+	assert.ErrorContains(t, d.ParsePlaylist("/dash/foo/out.mpd", bytes.NewReader(manifest)), "invalid segment path")
+	assert.ErrorContains(t, d.ParsePlaylist("/dash/bar/out.mpd", bytes.NewBufferString(liveManifest("2023-08-15T13:40:00Z", 1, 1))), "invalid manifest directory")
+}
@@ -5,8 +5,6 @@ import (
 	"os"
 	"sync"
 	"time"
-
-	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -18,9 +16,22 @@ const (
 )
 
 type FileEntry struct {
-	path     string          // path to the file
-	deadline time.Time       // deadline for file deletion
-	keep     <-chan struct{} // keep file as long as channel is active
+	path     string            // path to the file
+	deadline time.Time         // deadline for file deletion
+	keep     []<-chan struct{} // keep file as long as any channel is active
+}
+
+// addKeep adds keep channels not yet tracked by the entry
+func (e *FileEntry) addKeep(keep ...<-chan struct{}) {
+outer:
+	for _, ch := range keep {
+		for _, existing := range e.keep {
+			if existing == ch {
+				continue outer
+			}
+		}
+		e.keep = append(e.keep, ch)
+	}
 }
 
 type FileRegistryConfig struct {
@@ -80,9 +91,13 @@ func (r *FileRegistry) run(ctx context.Context) {
 		case <-ticker.C:
 			r.expire()
 		case new := <-r.add:
-			// avoid dropping keep channel
+			// avoid dropping keep channels, files shared by parsers are kept by each of them
 			if entry, ok := r.files[new.path]; ok {
-				if new.keep == nil && entry.keep != nil {
+				if new.keep != nil {
+					entry.addKeep(new.keep...)
+					continue
+				}
+				if entry.keep != nil {
 					continue
 				}
 			}
@@ -112,12 +127,18 @@ func (r *FileRegistry) expire() {
 	for path, entry := range r.files {
 		// prevents removing files with keep
 		if entry.keep != nil {
-			select {
-			case <-entry.keep:
+			var active []<-chan struct{}
+			for _, keep := range entry.keep {
+				select {
+				case <-keep:
+				default:
+					active = append(active, keep)
+				}
+			}
+			entry.keep = active
+			if active == nil {
 				// expire a while from now
 				entry.deadline = time.Now().Add(r.config.KeepDelay)
-				entry.keep = nil
-			default:
 			}
 			continue
 		}
@@ -143,11 +164,11 @@ func (r *FileRegistry) RegisterFile(path string, deadline time.Time) {
 	}
 }
 
-// Keep file until keep channel is closed
+// Keep file until all of its keep channels are closed
 func (r *FileRegistry) KeepFile(path string, keep <-chan struct{}) {
 	r.add <- &FileEntry{
 		path: path,
-		keep: keep,
+		keep: []<-chan struct{}{keep},
 	}
 }
 
@@ -96,3 +96,32 @@ func TestKeepPriority(t *testing.T) {
 	// should exist still
 	assert.Assert(t, exists(t, path))
 }
+
+// TestKeepShared tests that a file kept by multiple parsers stays until all of them release it
+func TestKeepShared(t *testing.T) {
+	t.Parallel()
+	r := NewFileRegistry(FileRegistryConfig{ExpireInterval: time.Millisecond * 50, KeepDelay: time.Millisecond})
+	defer r.Stop()
+
+	hls := make(chan struct{})
+	dash := make(chan struct{})
+
+	// create file
+	dir := t.TempDir()
+	path := dir + "/test"
+	_, err := os.Create(path)
+	assert.NilError(t, err)
+
+	r.KeepFile(path, hls)
+	r.KeepFile(path, dash)
+
+	// should exist while dash keeps it
+	close(hls)
+	time.Sleep(time.Millisecond * 200)
+	assert.Assert(t, exists(t, path))
+
+	// should be gone
+	close(dash)
+	time.Sleep(time.Millisecond * 200)
+	assert.Assert(t, !exists(t, path))
+}
@@ -1,9 +1,13 @@
 package upload
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,25 +18,38 @@ type Handler struct {
 	copier   FileCopier
 	registry *FileRegistry
 	store    *StreamStore
+	updates  *PlaylistUpdates
 
 	playlistConfig  PlaylistConfig
+	recordings      []RecordingConfig
+	archivePath     string
 	registerer      prometheus.Registerer
 	maxPlaylistSize int
 	maxSegmentSize  int
+	blockingReload  bool
 }
 
 func NewHandler(config ServerConfig) *Handler {
 	return &Handler{
 		copier:   AtomicWriter{},
 		registry: NewFileRegistry(FileRegistryConfig{}),
-		store:    NewStreamStore(StreamStoreConfig{StreamTimeout: config.StreamTimeout, StreamOriginDuration: config.StreamOriginDuration}),
+		store: NewStreamStore(StreamStoreConfig{
+			StreamTimeout:        config.StreamTimeout,
+			StreamOriginDuration: config.StreamOriginDuration,
+			Events:               config.Events,
+			Origins:              config.Origins,
+		}),
+		updates: NewPlaylistUpdates(),
 
 		playlistConfig: PlaylistConfig{
 			Size: config.PlaylistSize,
 		},
+		recordings:      config.Recordings,
+		archivePath:     config.ArchivePath,
 		registerer:      config.Registerer,
 		maxPlaylistSize: config.MaxPlaylistSize,
 		maxSegmentSize:  config.MaxSegmentSize,
+		blockingReload:  config.ServePlaylists,
 	}
 }
 
@@ -70,11 +87,23 @@ func (h *Handler) HandleFile(input io.Reader, slug string, outputPath string) er
 			Registry:       h.registry,
 			PlaylistConfig: h.playlistConfig,
 			Registerer:     h.registerer,
+			Updates:        h.updates,
+			BlockingReload: h.blockingReload,
+			Recording:      matchRecording(h.recordings, slug),
+			ArchivePath:    h.archivePath,
 		})
 		src := LimitReads(input, int64(h.maxPlaylistSize))
 		err = hls.ParsePlaylist(outputPath, src)
 	case ".mpd":
-		// err = s.HandlePlaylist(, file, , slug)
+		dash := stream.GetDASHParser(DASHConfiguration{
+			Slug:           slug,
+			BasePath:       dir,
+			Writer:         AtomicWriter{},
+			Registry:       h.registry,
+			PlaylistConfig: h.playlistConfig,
+		})
+		src := LimitReads(input, int64(h.maxPlaylistSize))
+		err = dash.ParsePlaylist(outputPath, src)
 
 		// keep thumbnails/posters around
 	case ".jpg":
@@ -92,3 +121,30 @@ func (h *Handler) HandleFile(input io.Reader, slug string, outputPath string) er
 
 	return err
 }
+
+var errInvalidBlockingRequest = errors.New("invalid blocking playlist request")
+
+// WaitPlaylist blocks until the playlist contains the media requested by the _HLS_msn and _HLS_part parameters
+func (h *Handler) WaitPlaylist(ctx context.Context, path string, query url.Values) error {
+	if !query.Has("_HLS_msn") {
+		if query.Has("_HLS_part") {
+			return errInvalidBlockingRequest
+		}
+		if !h.updates.published(path) {
+			return errPlaylistUnknown
+		}
+		return nil
+	}
+	msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return errInvalidBlockingRequest
+	}
+	part := -1
+	if query.Has("_HLS_part") {
+		part, err = strconv.Atoi(query.Get("_HLS_part"))
+		if err != nil || part < 0 {
+			return errInvalidBlockingRequest
+		}
+	}
+	return h.updates.Wait(ctx, path, msn, part)
+}
@@ -2,7 +2,6 @@ package upload
 
 import (
 	"io"
-	"log"
 	"testing"
 	"time"
 
@@ -43,6 +42,6 @@ func TestHandler(t *testing.T) {
 	res, ok := h.registry.FileStatus(t.Context(), "thumbnail/s1/thumb.jpeg")
 	assert.Assert(t, ok)
 	assert.Assert(t, res != nil)
-	log.Println(ok, *res)
+	t.Log(ok, *res)
 	assert.Assert(t, res.keep != nil)
 }
@@ -1,15 +1,16 @@
 package upload
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/quangngotan95/go-m3u8/m3u8"
-	"github.com/rs/zerolog/log"
 )
 
 type HLSConfiguration struct {
@@ -19,6 +20,15 @@ type HLSConfiguration struct {
 	Writer         FileWriter
 	Registry       *FileRegistry
 	Registerer     prometheus.Registerer
+
+	// wakes up blocking playlist requests, optional
+	Updates *PlaylistUpdates
+	// the upload-server serves the playlists with blocking reload, announced as CAN-BLOCK-RELOAD
+	BlockingReload bool
+
+	// timeshift and archive of the stream, archives are written below ArchivePath
+	Recording   RecordingConfig
+	ArchivePath string
 }
 
 type HLSParser struct {
@@ -29,6 +39,10 @@ type HLSParser struct {
 	writer         FileWriter
 	registry       *FileRegistry
 	metrics        *HLSMetrics
+	updates        *PlaylistUpdates
+	blockingReload bool
+	dvrWindow      time.Duration
+	archive        *archive
 	subs           map[string]*VariantPlaylist // tracked playlists
 	files          map[string]chan struct{}    // tracked files
 }
@@ -44,6 +58,11 @@ type VariantPlaylist struct {
 	lastSize     int
 	lastSequence int
 	output       *LivePlaylist
+	lowLatency   *lowLatencyPlaylist // latest LL-HLS state of the source, nil for classic playlists
+	references   map[string]bool     // part and init segment files referenced by the output
+	dvr          *LivePlaylist       // timeshift playlist, nil if disabled
+	dvrFiles     *fileKeeper
+	archive      *archivePlaylist // nil if disabled
 }
 
 func NewHLSParser(config HLSConfiguration) *HLSParser {
@@ -54,18 +73,34 @@ func NewHLSParser(config HLSConfiguration) *HLSParser {
 		writer:         config.Writer,
 		registry:       config.Registry,
 		metrics:        NewHLSMetrics(config.Slug, config.Registerer),
+		updates:        config.Updates,
+		blockingReload: config.BlockingReload,
+		dvrWindow:      config.Recording.DVRWindow,
 		subs:           make(map[string]*VariantPlaylist),
 		files:          make(map[string]chan struct{}),
 	}
+	if config.Recording.Archive {
+		if config.ArchivePath == "" {
+			log.Warn().Str("slug", config.Slug).Msg("archive enabled without archive path")
+		} else {
+			h.archive = newArchive(config.ArchivePath, config.Slug)
+		}
+	}
 
 	return h
 }
 
 func (h *HLSParser) Cleanup() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.finalizeRecordings()
 	for _, keep := range h.files {
 		close(keep)
 	}
 	h.files = nil
+	for name := range h.subs {
+		h.updates.remove(filepath.Join(h.basePath, name))
+	}
 	h.metrics.Unregister()
 }
 
@@ -77,10 +112,15 @@ Process hls playlist
     - output unchanged and generate language specific/sd master playlists
  3. if segment playlist:
     - insert discontinuity if sequence went backwards
-    - append new segments to output playlist
+    - append new segments to output playlist, keeping fMP4 init segments
+    - carry over LL-HLS parts and announce blocking playlist reload
 */
 func (h *HLSParser) ParsePlaylist(path string, reader io.Reader) error {
-	playlist, err := m3u8.Read(reader)
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	playlist, err := m3u8.Read(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -94,6 +134,9 @@ func (h *HLSParser) ParsePlaylist(path string, reader io.Reader) error {
 		if err := h.writePlaylist(path, playlist); err != nil {
 			return err
 		}
+		if err := h.writeRecordingMasters(path, playlist); err != nil {
+			return err
+		}
 		if err := h.generateLanguageMasters(path, "hd", playlist); err != nil {
 			return err
 		}
@@ -107,16 +150,26 @@ func (h *HLSParser) ParsePlaylist(path string, reader io.Reader) error {
 		return nil
 	}
 
-	out, err := h.processVariant(path, playlist)
+	// go-m3u8 drops the LL-HLS tags, parse them separately
+	ll, err := parseLowLatency(data)
+	if err != nil {
+		return err
+	}
+	out, err := h.processVariant(path, playlist, ll)
 	if err != nil {
 		return err
 	}
 
 	// write to disk
-	return h.writePlaylist(path, out)
+	if err := h.writePlaylist(path, out); err != nil {
+		return err
+	}
+	v := h.subs[filepath.Base(path)]
+	h.updates.update(path, v.position(), time.Duration(v.output.Target)*time.Second)
+	return h.writeRecordings(path, v)
 }
 
-func (h *HLSParser) processVariant(path string, playlist *m3u8.Playlist) (*m3u8.Playlist, error) {
+func (h *HLSParser) processVariant(path string, playlist *m3u8.Playlist, ll *lowLatencyPlaylist) (*m3u8.Playlist, error) {
 	// lookup playlist by path
 	v, err := h.getVariantPlaylist(path)
 	if err != nil {
@@ -125,9 +178,80 @@ func (h *HLSParser) processVariant(path string, playlist *m3u8.Playlist) (*m3u8.
 	// Store targetDuration for metrics
 	h.metrics.RecordTargetDuration(playlist.Target, filepath.Base(path))
 	h.checkDiscontinuity(v, playlist, path)
-	h.appendItems(v, playlist)
+	h.appendItems(v, playlist, ll)
 	v.output.setSegmentTarget(playlist.Target)
-	return &v.output.Playlist, nil
+	h.updateReferences(v, ll)
+	v.output.setVersion(requiredVersion(&v.output.Playlist, playlist, ll))
+	h.updateRecordings(v, playlist)
+	return h.outputPlaylist(v), nil
+}
+
+// requiredVersion returns the playlist version needed for the output, classic playlists stay at version 3
+func requiredVersion(output *m3u8.Playlist, source *m3u8.Playlist, ll *lowLatencyPlaylist) int {
+	version := 3
+	for _, item := range output.Items {
+		if _, ok := item.(*m3u8.MapItem); ok {
+			// EXT-X-MAP without EXT-X-I-FRAMES-ONLY
+			version = 6
+			break
+		}
+	}
+	if version == 3 && ll == nil {
+		return version
+	}
+	// the source may depend on newer features for fMP4 and LL-HLS
+	if source.Version != nil && *source.Version > version {
+		version = *source.Version
+	}
+	return version
+}
+
+// outputPlaylist adds the low latency tags to the output playlist
+func (h *HLSParser) outputPlaylist(v *VariantPlaylist) *m3u8.Playlist {
+	ll := v.lowLatency
+	if ll == nil {
+		return &v.output.Playlist
+	}
+
+	partHoldBack := ll.partHoldBack
+	if partHoldBack == 0 {
+		partHoldBack = 3 * ll.partTarget
+	}
+	out := v.output.Playlist
+	out.Items = []m3u8.Item{
+		&ServerControlItem{CanBlockReload: h.blockingReload, PartHoldBack: partHoldBack, HoldBack: ll.holdBack},
+		&PartInfItem{PartTarget: ll.partTarget},
+	}
+	out.Items = append(out.Items, v.output.Items...)
+	for _, part := range ll.pending {
+		out.Items = append(out.Items, part)
+	}
+	if ll.hint != nil {
+		out.Items = append(out.Items, ll.hint)
+	}
+	for _, report := range ll.reports {
+		if item := h.renditionReport(report.URI); item != nil {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return &out
+}
+
+// renditionReport reports our own output position of another variant
+func (h *HLSParser) renditionReport(uri string) *RenditionReportItem {
+	if filepath.Dir(filepath.Join(h.basePath, uri)) != h.basePath {
+		return nil
+	}
+	sub, ok := h.subs[filepath.Base(uri)]
+	if !ok || sub.lowLatency == nil {
+		return nil
+	}
+	pos := sub.position()
+	report := &RenditionReportItem{URI: uri, LastMSN: pos.msn}
+	if pos.part >= 0 {
+		report.LastPart = &pos.part
+	}
+	return report
 }
 
 // Beware special VOC hack:
@@ -209,6 +333,13 @@ func (h *HLSParser) getVariantPlaylist(path string) (*VariantPlaylist, error) {
 			name:   name,
 			output: newLivePlaylist(h.playlistConfig.Size),
 		}
+		if h.dvrWindow > 0 {
+			sub.dvr = newDVRPlaylist(h.dvrWindow)
+			sub.dvrFiles = newFileKeeper(h.registry)
+		}
+		if h.archive != nil {
+			sub.archive = newArchivePlaylist()
+		}
 		h.subs[name] = sub
 	}
 	return sub, nil
@@ -222,12 +353,9 @@ func (h *HLSParser) checkDiscontinuity(v *VariantPlaylist, source *m3u8.Playlist
 
 	if newSegments < oldSegments {
 		log.Warn().Str("slug", h.slug).Int("last", oldSegments).Int("current", newSegments).Str("path", path).Msg("sequence went backwards, inserting discontinuity")
-		res := v.output.applyDiscontinuity()
 		// if the playlist is full we need to move the last segment out of the way
-		switch deleted := res.(type) {
-		case *m3u8.SegmentItem:
-			h.expireFile(deleted.Segment)
-		}
+		h.expireSegments(v, v.output.applyDiscontinuity())
+		h.recordDiscontinuity(v)
 		v.lastIndex = 0
 	} else {
 		// only copy new segments
@@ -241,27 +369,114 @@ func (h *HLSParser) checkDiscontinuity(v *VariantPlaylist, source *m3u8.Playlist
 }
 
 // append new items from source playlist
-func (h *HLSParser) appendItems(v *VariantPlaylist, source *m3u8.Playlist) {
+func (h *HLSParser) appendItems(v *VariantPlaylist, source *m3u8.Playlist, ll *lowLatencyPlaylist) {
+	segmentIndex := -1
+	var initMap *m3u8.MapItem
 	for index, item := range source.Items {
+		switch item := item.(type) {
+		case *m3u8.MapItem:
+			// applies to all following segments
+			initMap = item
+			continue
+		case *m3u8.SegmentItem:
+			segmentIndex++
+			if index < v.lastIndex {
+				continue
+			}
+			h.metrics.RecordSegmentDuration(v.name, item.Duration)
+			h.keepFile(item.Segment)
+			if initMap != nil {
+				v.output.setMap(initMap)
+			}
+			h.expireSegments(v, v.output.append(item, ll.segmentParts(segmentIndex)...))
+			h.recordSegment(v, item, initMap)
+		}
+	}
+	v.lastIndex = len(source.Items)
+}
+
+// allow segments removed from the output to be deleted
+func (h *HLSParser) expireSegments(v *VariantPlaylist, items []m3u8.Item) {
+	for _, item := range items {
 		segment, ok := item.(*m3u8.SegmentItem)
-		if !ok || index < v.lastIndex {
+		// byte range parts may still reference the segment file
+		if !ok || v.references[segment.Segment] {
 			continue
 		}
-		h.metrics.RecordSegmentDuration(v.name, segment.Duration)
-		h.keepFile(segment.Segment)
-		res := v.output.append(segment)
-		switch deleted := res.(type) {
+		h.expireFile(segment.Segment)
+	}
+}
+
+// updateReferences stores the low latency state and keeps the files of referenced parts and init segments
+func (h *HLSParser) updateReferences(v *VariantPlaylist, ll *lowLatencyPlaylist) {
+	v.lowLatency = ll
+	if ll != nil {
+		v.output.trimParts(3 * float64(v.output.Target))
+	}
+
+	referenced := make(map[string]bool)
+	segments := make(map[string]bool)
+	for _, item := range v.output.Items {
+		switch item := item.(type) {
+		case *PartItem:
+			referenced[item.URI] = true
+		case *m3u8.MapItem:
+			referenced[item.URI] = true
 		case *m3u8.SegmentItem:
-			h.expireFile(deleted.Segment)
+			segments[item.Segment] = true
 		}
 	}
-	v.lastIndex = len(source.Items)
+	if ll != nil {
+		for _, part := range ll.pending {
+			referenced[part.URI] = true
+		}
+		if ll.hint != nil {
+			referenced[ll.hint.URI] = true
+		}
+	}
+
+	for name := range referenced {
+		h.keepFile(name)
+	}
+	for name := range v.references {
+		if !referenced[name] && !segments[name] {
+			h.expireFile(name)
+		}
+	}
+	v.references = referenced
+}
+
+// position returns the latest media of the output playlist
+func (v *VariantPlaylist) position() playlistPosition {
+	next := v.output.Sequence + v.output.SegmentSize()
+	if v.lowLatency != nil && len(v.lowLatency.pending) > 0 {
+		return playlistPosition{msn: next, part: len(v.lowLatency.pending) - 1}
+	}
+
+	// count the parts of the last segment
+	parts := 0
+	found := false
+	for i := len(v.output.Items) - 1; i >= 0; i-- {
+		_, isPart := v.output.Items[i].(*PartItem)
+		if !found {
+			_, found = v.output.Items[i].(*m3u8.SegmentItem)
+			continue
+		}
+		if !isPart {
+			break
+		}
+		parts++
+	}
+	return playlistPosition{msn: next - 1, part: parts - 1, complete: true}
 }
 
 // keep segment alive
 func (h *HLSParser) keepFile(name string) {
-	keep := make(chan struct{})
 	path := filepath.Join(h.basePath, name)
+	if _, ok := h.files[path]; ok {
+		return
+	}
+	keep := make(chan struct{})
 	h.files[path] = keep
 	h.registry.KeepFile(path, keep)
 }
@@ -304,7 +519,9 @@ func getLanguages(playlist *m3u8.Playlist) []string {
 
 type LivePlaylist struct {
 	m3u8.Playlist
-	size int
+	size    int
+	window  float64       // maximum duration in seconds instead of size, 0 if unused
+	initMap *m3u8.MapItem // init segment of the last appended segment
 }
 
 func newLivePlaylist(size int) *LivePlaylist {
@@ -320,27 +537,154 @@ func newLivePlaylist(size int) *LivePlaylist {
 	}
 }
 
-// returns removed item when max size is reached
-func (lp *LivePlaylist) append(item m3u8.Item) (deleted m3u8.Item) {
-	if len(lp.Items) == lp.size {
-		deleted = lp.Items[0]
-		switch deleted.(type) {
+// newDVRPlaylist returns a playlist limited by duration instead of size
+func newDVRPlaylist(window time.Duration) *LivePlaylist {
+	lp := newLivePlaylist(0)
+	lp.window = window.Seconds()
+	return lp
+}
+
+// returns removed items when max size or window is reached, parts are not counted and precede their segment
+func (lp *LivePlaylist) append(item m3u8.Item, parts ...*PartItem) (deleted []m3u8.Item) {
+	if lp.size > 0 && lp.entries() == lp.size {
+		deleted = lp.removeFirst()
+	}
+	for _, part := range parts {
+		lp.Items = append(lp.Items, part)
+	}
+	lp.Items = append(lp.Items, item)
+	for lp.window > 0 && lp.entries() > 1 && lp.duration() > lp.window {
+		deleted = append(deleted, lp.removeFirst()...)
+	}
+	return
+}
+
+// removes the first entry together with its parts and init segment
+func (lp *LivePlaylist) removeFirst() (deleted []m3u8.Item) {
+	var initMap *m3u8.MapItem
+	for len(lp.Items) > 0 {
+		first := lp.Items[0]
+		lp.Items = lp.Items[1:]
+		deleted = append(deleted, first)
+		if !isEntry(first) {
+			if m, ok := first.(*m3u8.MapItem); ok {
+				initMap = m
+			}
+			continue
+		}
+		switch first.(type) {
 		case *m3u8.SegmentItem:
 			lp.Sequence++
 		case *m3u8.DiscontinuityItem:
 			*lp.DiscontinuitySequence++
 		}
-		lp.Items = lp.Items[1:]
+		break
+	}
+	// the following segments still need the init segment
+	if _, ok := lp.firstEntry().(*m3u8.SegmentItem); ok && initMap != nil && lp.nextMap() == nil {
+		lp.Items = append([]m3u8.Item{initMap}, lp.Items...)
 	}
-	lp.Items = append(lp.Items, item)
 	return
 }
 
-// returns removed item when max size is reached
-func (lp *LivePlaylist) applyDiscontinuity() m3u8.Item {
+// total duration of all segments in seconds
+func (lp *LivePlaylist) duration() float64 {
+	var duration float64
+	for _, item := range lp.Items {
+		if segment, ok := item.(*m3u8.SegmentItem); ok {
+			duration += segment.Duration
+		}
+	}
+	return duration
+}
+
+// returns removed items when max size is reached
+func (lp *LivePlaylist) applyDiscontinuity() []m3u8.Item {
+	// the encoder may have rewritten the init segment
+	lp.initMap = nil
 	return lp.append(&m3u8.DiscontinuityItem{})
 }
 
+// setMap announces the init segment of the following segments if it changed
+func (lp *LivePlaylist) setMap(initMap *m3u8.MapItem) {
+	if lp.initMap != nil && lp.initMap.String() == initMap.String() {
+		return
+	}
+	lp.initMap = initMap
+	lp.Items = append(lp.Items, initMap)
+}
+
+// nextMap returns the init segment announced before the first entry
+func (lp *LivePlaylist) nextMap() *m3u8.MapItem {
+	for _, item := range lp.Items {
+		if m, ok := item.(*m3u8.MapItem); ok {
+			return m
+		}
+		if isEntry(item) {
+			break
+		}
+	}
+	return nil
+}
+
+// firstEntry returns the first item counting towards the size
+func (lp *LivePlaylist) firstEntry() m3u8.Item {
+	for _, item := range lp.Items {
+		if isEntry(item) {
+			return item
+		}
+	}
+	return nil
+}
+
+// parts and init segments belong to the following segment and don't count towards the size
+func isEntry(item m3u8.Item) bool {
+	switch item.(type) {
+	case *PartItem, *m3u8.MapItem:
+		return false
+	}
+	return true
+}
+
+// number of items excluding parts and init segments
+func (lp *LivePlaylist) entries() int {
+	count := 0
+	for _, item := range lp.Items {
+		if isEntry(item) {
+			count++
+		}
+	}
+	return count
+}
+
+// removes the parts of segments more than maxAge seconds from the end of the playlist
+func (lp *LivePlaylist) trimParts(maxAge float64) {
+	keep := make([]bool, len(lp.Items))
+	var age float64
+	for i := len(lp.Items) - 1; i >= 0; i-- {
+		switch item := lp.Items[i].(type) {
+		case *m3u8.SegmentItem:
+			age += item.Duration
+			keep[i] = true
+		case *PartItem:
+			keep[i] = age <= maxAge
+		default:
+			keep[i] = true
+		}
+	}
+	items := lp.Items[:0]
+	for i, item := range lp.Items {
+		if keep[i] {
+			items = append(items, item)
+		}
+	}
+	lp.Items = items
+}
+
 func (lp *LivePlaylist) setSegmentTarget(target int) {
 	lp.Target = target
 }
+
+func (lp *LivePlaylist) setVersion(version int) {
+	*lp.Version = version
+}
@@ -2,8 +2,10 @@ package upload
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -127,7 +129,7 @@ func Test_VariantSequenceRollback(t *testing.T) {
 #EXTINF:2.986,
 segment_Native85.ts
 #EXTINF:3.008,
-segment_Native86.ts`))
+segment_Native86.ts`), nil)
 	assert.NilError(t, err)
 
 	// expect playlist to start at discont 0
@@ -149,7 +151,7 @@ segment_Native86.ts
 #EXTINF:3,
 segment_Native1.ts
 #EXTINF:3,
-segment_Native2.ts`))
+segment_Native2.ts`), nil)
 	assert.NilError(t, err)
 
 	// expect playlist to start at discont 0
@@ -189,7 +191,7 @@ segment_Native02.ts
 #EXTINF:3.000,
 segment_Native03.ts
 #EXTINF:3.000,
-segment_Native04.ts`))
+segment_Native04.ts`), nil)
 	assert.NilError(t, err)
 
 	// expect playlist to start at discont 0
@@ -213,7 +215,7 @@ segment_Native04.ts
 #EXTINF:3.000,
 segment_Native01.ts
 #EXTINF:3.000,
-segment_Native02.ts`))
+segment_Native02.ts`), nil)
 	assert.NilError(t, err)
 
 	// expect playlist to start at discont 0
@@ -237,7 +239,7 @@ segment_Native02.ts
 #EXTINF:3.000,
 segment_Native03.ts
 #EXTINF:3.000,
-segment_Native04.ts`))
+segment_Native04.ts`), nil)
 	assert.NilError(t, err)
 
 	// expect playlist to start at discont 0
@@ -254,3 +256,51 @@ segment_Native03.ts
 segment_Native04.ts
 `, "should continue to append")
 }
+
+func fmp4Source(sequence int, count int, init string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-MAP:URI=\"%s\"\n", sequence, init)
+	for i := sequence; i < sequence+count; i++ {
+		fmt.Fprintf(&sb, "#EXTINF:4,\nseg%d.m4s\n", i)
+	}
+	return sb.String()
+}
+
+// Init segments are kept in front of the window as long as segments reference them
+func TestFMP4InitSegment(t *testing.T) {
+	h, w := newTestHLSParser(2)
+	defer h.registry.Stop()
+
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(fmp4Source(0, 3, "init.mp4"))))
+	assert.Equal(t, string(w.files["/foo/foo.m3u8"]), `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+seg1.m4s
+#EXTINF:4,
+seg2.m4s
+`)
+	keep, ok := h.files["/foo/init.mp4"]
+	assert.Assert(t, ok)
+
+	// the encoder restarted with a new init segment
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(fmp4Source(0, 1, "init2.mp4"))))
+	assert.Equal(t, string(w.files["/foo/foo.m3u8"]), `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA-SEQUENCE:3
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-TARGETDURATION:4
+#EXT-X-DISCONTINUITY
+
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:4,
+seg0.m4s
+`)
+	_, open := <-keep
+	assert.Assert(t, !open)
+	_, ok = h.files["/foo/init2.mp4"]
+	assert.Assert(t, ok)
+}
@@ -0,0 +1,363 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quangngotan95/go-m3u8/m3u8"
+)
+
+// LL-HLS tags, go-m3u8 ignores them while parsing
+const (
+	PartInfTag         = "#EXT-X-PART-INF"
+	ServerControlTag   = "#EXT-X-SERVER-CONTROL"
+	PartTag            = "#EXT-X-PART"
+	PreloadHintTag     = "#EXT-X-PRELOAD-HINT"
+	RenditionReportTag = "#EXT-X-RENDITION-REPORT"
+)
+
+var (
+	errPlaylistUnknown = errors.New("unknown playlist")
+	errPlaylistAhead   = errors.New("requested media sequence is too far ahead")
+	errPlaylistTimeout = errors.New("playlist update timed out")
+)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// PartItem is a partial segment, parts are listed before their parent segment
+type PartItem struct {
+	Duration    float64
+	URI         string
+	Independent bool
+	ByteRange   string
+	Gap         bool
+}
+
+func NewPartItem(text string) (*PartItem, error) {
+	attrs := m3u8.ParseAttributes(strings.TrimPrefix(text, PartTag+":"))
+	duration, err := strconv.ParseFloat(attrs["DURATION"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid part duration: %w", err)
+	}
+	if attrs["URI"] == "" {
+		return nil, errors.New("part without uri")
+	}
+	return &PartItem{
+		Duration:    duration,
+		URI:         attrs["URI"],
+		Independent: attrs["INDEPENDENT"] == m3u8.YesValue,
+		ByteRange:   attrs["BYTERANGE"],
+		Gap:         attrs["GAP"] == m3u8.YesValue,
+	}, nil
+}
+
+func (p *PartItem) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `%s:DURATION=%s,URI="%s"`, PartTag, formatFloat(p.Duration), p.URI)
+	if p.Independent {
+		sb.WriteString(",INDEPENDENT=YES")
+	}
+	if p.ByteRange != "" {
+		fmt.Fprintf(&sb, `,BYTERANGE="%s"`, p.ByteRange)
+	}
+	if p.Gap {
+		sb.WriteString(",GAP=YES")
+	}
+	return sb.String()
+}
+
+// PreloadHintItem announces the next part before it is available
+type PreloadHintItem struct {
+	Type            string
+	URI             string
+	ByteRangeStart  *int
+	ByteRangeLength *int
+}
+
+func NewPreloadHintItem(text string) (*PreloadHintItem, error) {
+	attrs := m3u8.ParseAttributes(strings.TrimPrefix(text, PreloadHintTag+":"))
+	if attrs["TYPE"] == "" || attrs["URI"] == "" {
+		return nil, errors.New("preload hint without type or uri")
+	}
+	hint := &PreloadHintItem{Type: attrs["TYPE"], URI: attrs["URI"]}
+	var err error
+	if hint.ByteRangeStart, err = parseOptionalInt(attrs, "BYTERANGE-START"); err != nil {
+		return nil, err
+	}
+	if hint.ByteRangeLength, err = parseOptionalInt(attrs, "BYTERANGE-LENGTH"); err != nil {
+		return nil, err
+	}
+	return hint, nil
+}
+
+func (h *PreloadHintItem) String() string {
+	s := fmt.Sprintf(`%s:TYPE=%s,URI="%s"`, PreloadHintTag, h.Type, h.URI)
+	if h.ByteRangeStart != nil {
+		s += fmt.Sprintf(",BYTERANGE-START=%d", *h.ByteRangeStart)
+	}
+	if h.ByteRangeLength != nil {
+		s += fmt.Sprintf(",BYTERANGE-LENGTH=%d", *h.ByteRangeLength)
+	}
+	return s
+}
+
+// RenditionReportItem reports the latest media of another rendition
+type RenditionReportItem struct {
+	URI      string
+	LastMSN  int
+	LastPart *int
+}
+
+func NewRenditionReportItem(text string) (*RenditionReportItem, error) {
+	attrs := m3u8.ParseAttributes(strings.TrimPrefix(text, RenditionReportTag+":"))
+	if attrs["URI"] == "" {
+		return nil, errors.New("rendition report without uri")
+	}
+	report := &RenditionReportItem{URI: attrs["URI"]}
+	msn, err := parseOptionalInt(attrs, "LAST-MSN")
+	if err != nil {
+		return nil, err
+	}
+	if msn != nil {
+		report.LastMSN = *msn
+	}
+	if report.LastPart, err = parseOptionalInt(attrs, "LAST-PART"); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (r *RenditionReportItem) String() string {
+	s := fmt.Sprintf(`%s:URI="%s",LAST-MSN=%d`, RenditionReportTag, r.URI, r.LastMSN)
+	if r.LastPart != nil {
+		s += fmt.Sprintf(",LAST-PART=%d", *r.LastPart)
+	}
+	return s
+}
+
+// ServerControlItem carries the hold back of the output playlist and announces the
+// blocking playlist reload of the upload-server if it serves the playlists
+type ServerControlItem struct {
+	CanBlockReload bool
+	PartHoldBack   float64
+	HoldBack       float64
+}
+
+func (s *ServerControlItem) String() string {
+	str := ServerControlTag + ":"
+	if s.CanBlockReload {
+		str += "CAN-BLOCK-RELOAD=YES,"
+	}
+	str += "PART-HOLD-BACK=" + formatFloat(s.PartHoldBack)
+	if s.HoldBack > 0 {
+		str += ",HOLD-BACK=" + formatFloat(s.HoldBack)
+	}
+	return str
+}
+
+// PartInfItem carries the part target duration
+type PartInfItem struct {
+	PartTarget float64
+}
+
+func (p *PartInfItem) String() string {
+	return fmt.Sprintf("%s:PART-TARGET=%s", PartInfTag, formatFloat(p.PartTarget))
+}
+
+func parseOptionalInt(attrs map[string]string, key string) (*int, error) {
+	value, ok := attrs[key]
+	if !ok {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return &i, nil
+}
+
+func parseOptionalFloat(attrs map[string]string, key string) (float64, error) {
+	value, ok := attrs[key]
+	if !ok {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// lowLatencyPlaylist holds the LL-HLS tags of a media playlist
+type lowLatencyPlaylist struct {
+	partTarget   float64
+	partHoldBack float64
+	holdBack     float64
+	parts        [][]*PartItem // parts by segment index
+	pending      []*PartItem   // parts of the segment in progress
+	hint         *PreloadHintItem
+	reports      []*RenditionReportItem
+}
+
+// parseLowLatency parses the LL-HLS tags of a media playlist, it returns nil for classic playlists
+func parseLowLatency(data []byte) (*lowLatencyPlaylist, error) {
+	ll := &lowLatencyPlaylist{}
+	var parts []*PartItem
+	var err error
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, PartInfTag+":"):
+			attrs := m3u8.ParseAttributes(strings.TrimPrefix(line, PartInfTag+":"))
+			ll.partTarget, err = parseOptionalFloat(attrs, "PART-TARGET")
+		case strings.HasPrefix(line, ServerControlTag+":"):
+			attrs := m3u8.ParseAttributes(strings.TrimPrefix(line, ServerControlTag+":"))
+			if ll.partHoldBack, err = parseOptionalFloat(attrs, "PART-HOLD-BACK"); err == nil {
+				ll.holdBack, err = parseOptionalFloat(attrs, "HOLD-BACK")
+			}
+		case strings.HasPrefix(line, PartTag+":"):
+			var part *PartItem
+			if part, err = NewPartItem(line); err == nil {
+				parts = append(parts, part)
+			}
+		case strings.HasPrefix(line, PreloadHintTag+":"):
+			ll.hint, err = NewPreloadHintItem(line)
+		case strings.HasPrefix(line, RenditionReportTag+":"):
+			var report *RenditionReportItem
+			if report, err = NewRenditionReportItem(line); err == nil {
+				ll.reports = append(ll.reports, report)
+			}
+		case !strings.HasPrefix(line, "#"):
+			// segment uri completes the parent segment of the preceding parts
+			ll.parts = append(ll.parts, parts)
+			parts = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w in line: %s", err, line)
+		}
+	}
+	if ll.partTarget == 0 {
+		return nil, nil
+	}
+	ll.pending = parts
+	return ll, nil
+}
+
+// segmentParts returns the parts of the segment at index
+func (ll *lowLatencyPlaylist) segmentParts(index int) []*PartItem {
+	if ll == nil || index >= len(ll.parts) {
+		return nil
+	}
+	return ll.parts[index]
+}
+
+// playlistPosition is the latest media of a playlist
+type playlistPosition struct {
+	msn      int
+	part     int  // index of the latest part of segment msn, -1 without parts
+	complete bool // segment msn is complete
+}
+
+// reached reports whether the playlist contains part of segment msn, part -1 requests the complete segment
+func (p playlistPosition) reached(msn int, part int) bool {
+	if p.msn != msn {
+		return p.msn > msn
+	}
+	if part < 0 {
+		return p.complete
+	}
+	// parts beyond the last part of a complete segment are part 0 of the next segment
+	return p.part >= part
+}
+
+type playlistUpdate struct {
+	position playlistPosition
+	target   time.Duration
+	changed  chan struct{} // closed on update
+}
+
+// PlaylistUpdates lets playlist requests block until the requested media is available
+type PlaylistUpdates struct {
+	mutex     sync.Mutex
+	playlists map[string]*playlistUpdate // by path
+}
+
+func NewPlaylistUpdates() *PlaylistUpdates {
+	return &PlaylistUpdates{playlists: make(map[string]*playlistUpdate)}
+}
+
+// update stores the position of a written playlist and wakes up waiting requests
+func (u *PlaylistUpdates) update(path string, position playlistPosition, target time.Duration) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if pl, ok := u.playlists[path]; ok {
+		close(pl.changed)
+	}
+	u.playlists[path] = &playlistUpdate{position: position, target: target, changed: make(chan struct{})}
+}
+
+// remove wakes up waiting requests of a removed playlist
+func (u *PlaylistUpdates) remove(path string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if pl, ok := u.playlists[path]; ok {
+		close(pl.changed)
+		delete(u.playlists, path)
+	}
+}
+
+// published reports whether path is a playlist written by the server
+func (u *PlaylistUpdates) published(path string) bool {
+	if u == nil {
+		return false
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	_, ok := u.playlists[path]
+	return ok
+}
+
+// Wait blocks until the playlist at path contains part of segment msn, for at most three target durations
+func (u *PlaylistUpdates) Wait(ctx context.Context, path string, msn int, part int) error {
+	var timeout <-chan time.Time
+	for {
+		u.mutex.Lock()
+		pl, ok := u.playlists[path]
+		u.mutex.Unlock()
+		if !ok {
+			return errPlaylistUnknown
+		}
+		if pl.position.reached(msn, part) {
+			return nil
+		}
+		if msn > pl.position.msn+2 {
+			return errPlaylistAhead
+		}
+		if timeout == nil {
+			timer := time.NewTimer(pl.target * 3)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return errPlaylistTimeout
+		case <-pl.changed:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/v3/assert"
+)
+
+// lowLatencySource returns a playlist with parts for the last two complete segments and the segment in progress
+func lowLatencySource(sequence int, segments int, pending int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3
+#EXT-X-PART-INF:PART-TARGET=1
+#EXT-X-MEDIA-SEQUENCE:%d
+`, sequence)
+	for i := sequence; i < sequence+segments; i++ {
+		if i >= sequence+segments-2 {
+			for p := 0; p < 4; p++ {
+				fmt.Fprintf(&sb, "#EXT-X-PART:DURATION=1,URI=\"seg%d.%d.m4s\"%s\n", i, p, map[bool]string{true: ",INDEPENDENT=YES"}[p == 0])
+			}
+		}
+		fmt.Fprintf(&sb, "#EXTINF:4,\nseg%d.m4s\n", i)
+	}
+	next := sequence + segments
+	for p := 0; p < pending; p++ {
+		fmt.Fprintf(&sb, "#EXT-X-PART:DURATION=1,URI=\"seg%d.%d.m4s\"\n", next, p)
+	}
+	fmt.Fprintf(&sb, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg%d.%d.m4s\"\n", next, pending)
+	sb.WriteString("#EXT-X-RENDITION-REPORT:URI=\"other.m3u8\",LAST-MSN=1,LAST-PART=0\n")
+	return sb.String()
+}
+
+func newTestHLSParser(size int) (*HLSParser, *memoryWriter) {
+	w := &memoryWriter{files: make(map[string][]byte)}
+	return NewHLSParser(HLSConfiguration{
+		Slug:           "foo",
+		BasePath:       "/foo",
+		PlaylistConfig: PlaylistConfig{Size: size},
+		Writer:         w,
+		Registry:       NewFileRegistry(FileRegistryConfig{ExpireInterval: time.Second, KeepDelay: time.Second}),
+		Registerer:     prometheus.NewRegistry(),
+		Updates:        NewPlaylistUpdates(),
+	}), w
+}
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	h, w := newTestHLSParser(5)
+	defer h.registry.Stop()
+
+	assert.NilError(t, h.ParsePlaylist("/foo/other.m3u8", bytes.NewBufferString(lowLatencySource(0, 3, 1))))
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(lowLatencySource(10, 4, 2))))
+	assert.Equal(t, string(w.files["/foo/foo.m3u8"]), `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=3
+#EXT-X-PART-INF:PART-TARGET=1
+#EXTINF:4,
+seg10.m4s
+#EXTINF:4,
+seg11.m4s
+#EXT-X-PART:DURATION=1,URI="seg12.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1,URI="seg12.1.m4s"
+#EXT-X-PART:DURATION=1,URI="seg12.2.m4s"
+#EXT-X-PART:DURATION=1,URI="seg12.3.m4s"
+#EXTINF:4,
+seg12.m4s
+#EXT-X-PART:DURATION=1,URI="seg13.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1,URI="seg13.1.m4s"
+#EXT-X-PART:DURATION=1,URI="seg13.2.m4s"
+#EXT-X-PART:DURATION=1,URI="seg13.3.m4s"
+#EXTINF:4,
+seg13.m4s
+#EXT-X-PART:DURATION=1,URI="seg14.0.m4s"
+#EXT-X-PART:DURATION=1,URI="seg14.1.m4s"
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg14.2.m4s"
+#EXT-X-RENDITION-REPORT:URI="other.m3u8",LAST-MSN=3,LAST-PART=0
+`)
+	_, ok := h.files["/foo/seg14.2.m4s"]
+	assert.Assert(t, ok)
+
+	// parts are removed three target durations from the end
+	keep := h.files["/foo/seg12.0.m4s"]
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(lowLatencySource(12, 4, 0))))
+	out := string(w.files["/foo/foo.m3u8"])
+	assert.Assert(t, strings.Contains(out, "#EXT-X-MEDIA-SEQUENCE:1\n"))
+	assert.Assert(t, strings.Contains(out, "\nseg12.m4s\n"))
+	assert.Assert(t, !strings.Contains(out, `URI="seg12.0.m4s"`))
+	assert.Assert(t, strings.Contains(out, `URI="seg13.0.m4s"`))
+	_, open := <-keep
+	assert.Assert(t, !open)
+
+	pos := h.subs["foo.m3u8"].position()
+	assert.Equal(t, pos, playlistPosition{msn: 5, part: 3, complete: true})
+}
+
+func TestBlockingReload(t *testing.T) {
+	h, w := newTestHLSParser(3)
+	defer h.registry.Stop()
+	h.blockingReload = true
+	ctx := context.Background()
+
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(lowLatencySource(0, 3, 1))))
+	assert.Assert(t, strings.Contains(string(w.files["/foo/foo.m3u8"]), "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3\n"))
+	assert.Assert(t, h.updates.published("/foo/foo.m3u8"))
+	assert.Assert(t, !h.updates.published("/foo/bar.m3u8"))
+	assert.NilError(t, h.updates.Wait(ctx, "/foo/foo.m3u8", 3, 0))
+	assert.NilError(t, h.updates.Wait(ctx, "/foo/foo.m3u8", 2, -1))
+	assert.ErrorIs(t, h.updates.Wait(ctx, "/foo/foo.m3u8", 6, 0), errPlaylistAhead)
+	assert.ErrorIs(t, h.updates.Wait(ctx, "/foo/bar.m3u8", 0, 0), errPlaylistUnknown)
+
+	done := make(chan error)
+	go func() {
+		done <- h.updates.Wait(ctx, "/foo/foo.m3u8", 3, 2)
+	}()
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(lowLatencySource(0, 3, 2))))
+	select {
+	case <-done:
+		t.Fatal("returned before the part was available")
+	case <-time.After(time.Millisecond * 50):
+	}
+	assert.NilError(t, h.ParsePlaylist("/foo/foo.m3u8", bytes.NewBufferString(lowLatencySource(0, 3, 3))))
+	assert.NilError(t, <-done)
+
+	// waiting requests are released when the stream is removed
+	go func() {
+		done <- h.updates.Wait(ctx, "/foo/foo.m3u8", 4, -1)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	h.Cleanup()
+	assert.ErrorIs(t, <-done, errPlaylistUnknown)
+	assert.Assert(t, !h.updates.published("/foo/foo.m3u8"))
+}
@@ -0,0 +1,290 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voc/stream-api/client"
+)
+
+const (
+	// timeout of kv requests during an upload
+	originRequestTimeout = time.Second * 2
+
+	// attempts of a claim conflicting with concurrent claims
+	originClaimRetries = 3
+
+	// records not refreshed for this long are removed from the kv store
+	originPruneAge      = time.Hour
+	originPruneInterval = time.Minute
+)
+
+// originRecord is the cluster-wide origin of a stream
+type originRecord struct {
+	Origin  string    `json:"origin"`
+	Server  string    `json:"server"` // upload-server which last refreshed the record
+	Updated time.Time `json:"updated"`
+}
+
+func (r originRecord) equal(other originRecord) bool {
+	return r.Origin == other.Origin && r.Server == other.Server && r.Updated.Equal(other.Updated)
+}
+
+type originEntry struct {
+	record originRecord
+	// local time the record was last written, so expiry doesn't depend on synchronized clocks
+	seen time.Time
+}
+
+// OriginRegistry enforces stream origin exclusivity across all upload-servers sharing a kv store.
+// Records are replicated via a watch instead of sessions, an origin owns a stream until it
+// stopped uploading for the origin duration. Records are written with a compare-and-swap,
+// so only one of concurrent claims succeeds.
+type OriginRegistry struct {
+	api      client.ServiceAPI
+	name     string
+	duration time.Duration
+
+	mutex   sync.Mutex
+	origins map[string]originEntry // by slug
+
+	ctx  context.Context
+	done sync.WaitGroup
+}
+
+// NewOriginRegistry loads the current origins and keeps them updated until ctx is cancelled
+func NewOriginRegistry(ctx context.Context, api client.ServiceAPI, name string, duration time.Duration) (*OriginRegistry, error) {
+	if duration == 0 {
+		duration = DefaultStreamOriginDuration
+	}
+	r := &OriginRegistry{
+		api:      api,
+		name:     name,
+		duration: duration,
+		origins:  make(map[string]originEntry),
+		ctx:      ctx,
+	}
+
+	fields, err := api.GetWithPrefix(ctx, client.UploadOriginPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("origins: %w", err)
+	}
+	now := time.Now()
+	for _, field := range fields {
+		r.handlePut(string(field.Key), field.Value, now)
+	}
+	updates, err := api.Watch(ctx, client.UploadOriginPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("origins watch: %w", err)
+	}
+
+	r.done.Add(1)
+	go r.run(updates)
+	return r, nil
+}
+
+// Wait waits until the registry stopped
+func (r *OriginRegistry) Wait() {
+	if r == nil {
+		return
+	}
+	r.done.Wait()
+}
+
+func (r *OriginRegistry) run(updates client.UpdateChan) {
+	defer r.done.Done()
+	ticker := time.NewTicker(originPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case batch, ok := <-updates:
+			if !ok {
+				log.Error().Msg("origins: watch closed")
+				return
+			}
+			now := time.Now()
+			for _, update := range batch {
+				if update.KV == nil {
+					continue
+				}
+				switch update.Type {
+				case client.UpdateTypePut:
+					r.handlePut(update.KV.Key(), update.KV.Value(), now)
+				case client.UpdateTypeDelete:
+					r.mutex.Lock()
+					delete(r.origins, slugFromOriginPath(update.KV.Key()))
+					r.mutex.Unlock()
+				}
+			}
+		case <-ticker.C:
+			r.prune()
+		}
+	}
+}
+
+func slugFromOriginPath(path string) string {
+	return strings.TrimPrefix(path, client.UploadOriginPrefix)
+}
+
+func (r *OriginRegistry) handlePut(path string, value []byte, now time.Time) {
+	var record originRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		log.Error().Err(err).Str("key", path).Msg("origins: unmarshal")
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.origins[slugFromOriginPath(path)] = originEntry{record: record, seen: now}
+}
+
+// prune removes records of streams which stopped long ago
+func (r *OriginRegistry) prune() {
+	r.mutex.Lock()
+	var stale []string
+	for slug, entry := range r.origins {
+		if time.Since(entry.seen) > originPruneAge {
+			stale = append(stale, slug)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, slug := range stale {
+		if err := r.api.Delete(r.ctx, client.UploadOriginPath(slug)); err != nil {
+			log.Error().Err(err).Str("slug", slug).Msg("origins: prune")
+		}
+	}
+}
+
+// Claim returns errInvalidOrigin if another origin uploaded the stream within the origin duration,
+// otherwise origin becomes the owner of the stream. If the kv store is unavailable uploads are
+// accepted, so only the local origin check applies.
+func (r *OriginRegistry) Claim(slug string, origin string) error {
+	now := time.Now()
+	r.mutex.Lock()
+	entry, ok := r.origins[slug]
+	r.mutex.Unlock()
+	if ok && entry.record.Origin != origin && r.fresh(entry, now) {
+		return errInvalidOrigin
+	}
+	// refresh once half of the duration passed instead of writing on every upload
+	if ok && entry.record.Origin == origin && now.Sub(entry.seen) < r.duration/2 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, originRequestTimeout)
+	defer cancel()
+	for i := 0; i < originClaimRetries; i++ {
+		err := r.tryClaim(ctx, slug, origin, now)
+		if errors.Is(err, client.ErrModified) {
+			// another server wrote the record concurrently, check it again
+			continue
+		}
+		return err
+	}
+	return errInvalidOrigin
+}
+
+// tryClaim writes the record of origin with a compare-and-swap, so only one of concurrent claims succeeds
+func (r *OriginRegistry) tryClaim(ctx context.Context, slug string, origin string, now time.Time) error {
+	path := client.UploadOriginPath(slug)
+	stored, index, err := r.api.GetWithIndex(ctx, path)
+	if err != nil {
+		log.Warn().Err(err).Str("slug", slug).Msg("origins: claim")
+		return nil
+	}
+	var previous *originRecord
+	if stored != nil {
+		var current originRecord
+		if err := json.Unmarshal(stored, &current); err != nil {
+			log.Error().Err(err).Str("slug", slug).Msg("origins: unmarshal")
+		} else {
+			previous = &current
+			entry := r.observe(slug, current, now)
+			if current.Origin != origin && r.fresh(entry, now) {
+				return errInvalidOrigin
+			}
+		}
+	}
+
+	record := originRecord{Origin: origin, Server: r.name, Updated: now}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := r.api.CompareAndSwap(ctx, path, data, index); errors.Is(err, client.ErrModified) {
+		return err
+	} else if err != nil {
+		log.Warn().Err(err).Str("slug", slug).Msg("origins: claim")
+		return nil
+	}
+	r.mutex.Lock()
+	r.origins[slug] = originEntry{record: record, seen: now}
+	r.mutex.Unlock()
+	if previous != nil && previous.Origin != origin {
+		log.Info().
+			Str("slug", slug).
+			Str("old-origin", previous.Origin).
+			Str("new-origin", origin).
+			Str("old-server", previous.Server).
+			Msg("origins: claimed stream")
+	}
+	return nil
+}
+
+// observe stores a record read from the kv store, a record not seen before counts as just written
+func (r *OriginRegistry) observe(slug string, record originRecord, now time.Time) originEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.origins[slug]
+	if !ok || !entry.record.equal(record) {
+		entry = originEntry{record: record, seen: now}
+		r.origins[slug] = entry
+	}
+	return entry
+}
+
+// fresh reports whether the origin of entry may still be uploading
+func (r *OriginRegistry) fresh(entry originEntry, now time.Time) bool {
+	return entry.seen.Add(r.duration).After(now)
+}
+
+// Release removes the record of a stream if this server refreshed it last
+func (r *OriginRegistry) Release(slug string) {
+	r.mutex.Lock()
+	entry, ok := r.origins[slug]
+	r.mutex.Unlock()
+	if !ok || entry.record.Server != r.name {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), originRequestTimeout)
+	defer cancel()
+	path := client.UploadOriginPath(slug)
+	stored, index, err := r.api.GetWithIndex(ctx, path)
+	if err != nil {
+		log.Error().Err(err).Str("slug", slug).Msg("origins: release")
+		return
+	}
+	var current originRecord
+	if stored != nil && json.Unmarshal(stored, &current) == nil && current.Server != r.name {
+		// another server took over in the meantime
+		return
+	}
+	if stored != nil {
+		// don't delete a record written concurrently by another server
+		err = r.api.CompareAndDelete(ctx, path, index)
+		if err != nil && !errors.Is(err, client.ErrModified) {
+			log.Error().Err(err).Str("slug", slug).Msg("origins: release")
+			return
+		}
+	}
+	r.mutex.Lock()
+	delete(r.origins, slug)
+	r.mutex.Unlock()
+}
@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/voc/stream-api/client"
+	"github.com/voc/stream-api/client/clienttest"
+)
+
+func TestClusterOrigin(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kv := clienttest.NewKV(nil)
+	newStore := func(name string) *StreamStore {
+		origins, err := NewOriginRegistry(ctx, kv, name, time.Millisecond*100)
+		assert.NilError(t, err)
+		s := NewStreamStore(StreamStoreConfig{
+			StreamTimeout:        time.Millisecond * 300,
+			StreamExpireInterval: time.Millisecond * 50,
+			StreamOriginDuration: time.Millisecond * 100,
+			Origins:              origins,
+		})
+		t.Cleanup(s.Stop)
+		return s
+	}
+	s1 := newStore("upload1")
+	s2 := newStore("upload2")
+
+	// a second origin is rejected by the other server
+	assert.NilError(t, s1.UpdateStream("test", "foo.com"))
+	time.Sleep(time.Millisecond * 10)
+	assert.ErrorIs(t, s2.UpdateStream("test", "bar.com"), errInvalidOrigin)
+	assert.NilError(t, s2.UpdateStream("test", "foo.com"))
+	assert.NilError(t, s2.UpdateStream("other", "bar.com"))
+
+	// allow after the origin stopped uploading
+	time.Sleep(time.Millisecond * 150)
+	assert.NilError(t, s2.UpdateStream("test", "bar.com"))
+	time.Sleep(time.Millisecond * 10)
+	assert.ErrorIs(t, s1.UpdateStream("test", "foo.com"), errInvalidOrigin)
+
+	// expired streams are released
+	time.Sleep(time.Millisecond * 400)
+	stored, err := kv.Get(ctx, client.UploadOriginPath("test"))
+	assert.NilError(t, err)
+	assert.Assert(t, stored == nil)
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kv := clienttest.NewKV(nil)
+	var registries []*OriginRegistry
+	for _, name := range []string{"upload1", "upload2", "upload3"} {
+		r, err := NewOriginRegistry(ctx, kv, name, time.Minute)
+		assert.NilError(t, err)
+		registries = append(registries, r)
+	}
+
+	// exactly one of the racing origins wins
+	errs := make(chan error, len(registries))
+	for i, r := range registries {
+		go func() {
+			errs <- r.Claim("test", fmt.Sprintf("origin%d.com", i))
+		}()
+	}
+	accepted := 0
+	for range registries {
+		if err := <-errs; err == nil {
+			accepted++
+		} else {
+			assert.ErrorIs(t, err, errInvalidOrigin)
+		}
+	}
+	assert.Equal(t, accepted, 1)
+}
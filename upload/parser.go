@@ -10,5 +10,6 @@ type Parser interface {
 type ParserType string
 
 const (
-	ParserTypeHLS ParserType = "hls"
+	ParserTypeHLS  ParserType = "hls"
+	ParserTypeDASH ParserType = "dash"
 )
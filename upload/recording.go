@@ -0,0 +1,316 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/pkg/wildcard"
+	"github.com/quangngotan95/go-m3u8/m3u8"
+)
+
+// RecordingConfig configures the timeshift window and archive of streams matching a slug
+type RecordingConfig struct {
+	Match string `toml:"match"`
+
+	// length of the separate timeshift playlist, 0 disables it
+	DVRWindow time.Duration `toml:"dvrWindow"`
+
+	// keep all segments of a session and write a VOD playlist when the stream ends
+	Archive bool `toml:"archive"`
+}
+
+// matchRecording returns the first recording config matching the slug
+func matchRecording(configs []RecordingConfig, slug string) RecordingConfig {
+	for _, conf := range configs {
+		if wildcard.MatchSimple(conf.Match, slug) {
+			return conf
+		}
+	}
+	return RecordingConfig{}
+}
+
+// dvrName returns the name of the timeshift playlist of a playlist
+func dvrName(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_dvr" + ext
+}
+
+// dvrMaster returns a master playlist referencing the timeshift playlists
+func dvrMaster(playlist *m3u8.Playlist) *m3u8.Playlist {
+	out := *playlist
+	out.Items = nil
+	for _, item := range playlist.Items {
+		switch item := item.(type) {
+		case *m3u8.PlaylistItem:
+			copied := *item
+			copied.URI = dvrName(item.URI)
+			out.Items = append(out.Items, &copied)
+		case *m3u8.MediaItem:
+			copied := *item
+			if item.URI != nil {
+				uri := dvrName(*item.URI)
+				copied.URI = &uri
+			}
+			out.Items = append(out.Items, &copied)
+		default:
+			out.Items = append(out.Items, item)
+		}
+	}
+	return &out
+}
+
+// fileKeeper keeps the files of a single output alive, independent of other outputs referencing them
+type fileKeeper struct {
+	registry *FileRegistry
+	files    map[string]chan struct{}
+}
+
+func newFileKeeper(registry *FileRegistry) *fileKeeper {
+	return &fileKeeper{registry: registry, files: make(map[string]chan struct{})}
+}
+
+// keep keeps a file alive until the next sync not referencing it
+func (k *fileKeeper) keep(path string) {
+	if _, ok := k.files[path]; ok {
+		return
+	}
+	keep := make(chan struct{})
+	k.files[path] = keep
+	k.registry.KeepFile(path, keep)
+}
+
+// sync keeps all referenced files alive and allows the others to be deleted
+func (k *fileKeeper) sync(referenced map[string]bool) {
+	for path := range referenced {
+		k.keep(path)
+	}
+	for path, keep := range k.files {
+		if !referenced[path] {
+			close(keep)
+			delete(k.files, path)
+		}
+	}
+}
+
+func (k *fileKeeper) close() {
+	k.sync(nil)
+}
+
+// archive records all segments of a stream session
+type archive struct {
+	dir   string
+	names map[string]bool // archived file names
+}
+
+func newArchive(archivePath string, slug string) *archive {
+	return &archive{
+		dir:   filepath.Join(archivePath, slug, time.Now().Format("2006-01-02_15-04-05")),
+		names: make(map[string]bool),
+	}
+}
+
+// add links a file into the archive, files with reused names are prefixed with a counter
+func (a *archive) add(path string) (string, error) {
+	name := filepath.Base(path)
+	for i := 1; a.names[name]; i++ {
+		name = fmt.Sprintf("%d_%s", i, filepath.Base(path))
+	}
+	if err := linkFile(path, filepath.Join(a.dir, name)); err != nil {
+		return "", err
+	}
+	a.names[name] = true
+	return name, nil
+}
+
+// linkFile hard links src to dst so it outlives the live files, falling back to a copy
+func linkFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	err := os.Link(src, dst)
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return AtomicWriter{}.CopyFile(dst, f)
+}
+
+// archivePlaylist is the VOD playlist of a variant, it is written as event playlist while the stream is live
+type archivePlaylist struct {
+	m3u8.Playlist
+	initMap string    // source uri of the current init segment
+	next    time.Time // program date time of the following continuous segment
+}
+
+func newArchivePlaylist() *archivePlaylist {
+	version := 3
+	playlistType := "EVENT"
+	return &archivePlaylist{
+		Playlist: m3u8.Playlist{
+			Version: &version,
+			Type:    &playlistType,
+			Live:    true,
+		},
+	}
+}
+
+// append archives a segment and its init segment
+func (ap *archivePlaylist) append(a *archive, basePath string, segment *m3u8.SegmentItem, initMap *m3u8.MapItem) error {
+	if initMap != nil && initMap.URI != ap.initMap {
+		name, err := a.add(filepath.Join(basePath, initMap.URI))
+		if err != nil {
+			return fmt.Errorf("init segment: %w", err)
+		}
+		archived := *initMap
+		archived.URI = name
+		ap.Items = append(ap.Items, &archived)
+		ap.initMap = initMap.URI
+	}
+
+	name, err := a.add(filepath.Join(basePath, segment.Segment))
+	if err != nil {
+		// continue after the gap
+		ap.applyDiscontinuity()
+		return err
+	}
+	duration := time.Duration(segment.Duration * float64(time.Second))
+	archived := *segment
+	archived.Segment = name
+	if archived.ProgramDateTime == nil {
+		if ap.next.IsZero() {
+			// the segment was just completed
+			ap.next = time.Now().Add(-duration)
+		}
+		archived.ProgramDateTime = &m3u8.TimeItem{Time: ap.next}
+	}
+	ap.next = archived.ProgramDateTime.Time.Add(duration)
+	ap.Items = append(ap.Items, &archived)
+	return nil
+}
+
+func (ap *archivePlaylist) applyDiscontinuity() {
+	ap.next = time.Time{}
+	ap.initMap = ""
+	if len(ap.Items) == 0 {
+		return
+	}
+	if _, ok := ap.Items[len(ap.Items)-1].(*m3u8.DiscontinuityItem); ok {
+		return
+	}
+	ap.Items = append(ap.Items, &m3u8.DiscontinuityItem{})
+}
+
+// finalize turns the playlist into a VOD playlist
+func (ap *archivePlaylist) finalize() {
+	playlistType := "VOD"
+	ap.Type = &playlistType
+	ap.Live = false
+}
+
+// recordSegment appends a new segment to the timeshift and archive playlists
+func (h *HLSParser) recordSegment(v *VariantPlaylist, segment *m3u8.SegmentItem, initMap *m3u8.MapItem) {
+	if v.dvr != nil {
+		if initMap != nil {
+			v.dvr.setMap(initMap)
+		}
+		v.dvr.append(segment)
+	}
+	if v.archive != nil {
+		if err := v.archive.append(h.archive, h.basePath, segment, initMap); err != nil {
+			log.Warn().Err(err).Str("slug", h.slug).Str("segment", segment.Segment).Msg("archive failed")
+		}
+	}
+}
+
+func (h *HLSParser) recordDiscontinuity(v *VariantPlaylist) {
+	if v.dvr != nil {
+		v.dvr.applyDiscontinuity()
+	}
+	if v.archive != nil {
+		v.archive.applyDiscontinuity()
+	}
+}
+
+// updateRecordings updates the playlist headers and keeps the files of the timeshift playlist
+func (h *HLSParser) updateRecordings(v *VariantPlaylist, source *m3u8.Playlist) {
+	if v.dvr != nil {
+		v.dvr.setSegmentTarget(source.Target)
+		v.dvr.setVersion(requiredVersion(&v.dvr.Playlist, source, nil))
+		referenced := make(map[string]bool)
+		for _, item := range v.dvr.Items {
+			switch item := item.(type) {
+			case *m3u8.SegmentItem:
+				referenced[filepath.Join(h.basePath, item.Segment)] = true
+			case *m3u8.MapItem:
+				referenced[filepath.Join(h.basePath, item.URI)] = true
+			}
+		}
+		v.dvrFiles.sync(referenced)
+	}
+	if v.archive != nil {
+		if source.Target > v.archive.Target {
+			v.archive.Target = source.Target
+		}
+		*v.archive.Version = requiredVersion(&v.archive.Playlist, source, nil)
+	}
+}
+
+// writeRecordings writes the timeshift and archive playlists of a variant
+func (h *HLSParser) writeRecordings(path string, v *VariantPlaylist) error {
+	if v.dvr != nil {
+		if err := h.writePlaylist(filepath.Join(filepath.Dir(path), dvrName(v.name)), &v.dvr.Playlist); err != nil {
+			return err
+		}
+	}
+	if v.archive != nil {
+		return h.writeArchive(v.name, &v.archive.Playlist)
+	}
+	return nil
+}
+
+// writeRecordingMasters writes the master playlists of the timeshift playlists and the archive
+func (h *HLSParser) writeRecordingMasters(path string, playlist *m3u8.Playlist) error {
+	if h.dvrWindow > 0 {
+		if err := h.writePlaylist(filepath.Join(filepath.Dir(path), dvrName(filepath.Base(path))), dvrMaster(playlist)); err != nil {
+			return err
+		}
+	}
+	if h.archive != nil {
+		return h.writeArchive(filepath.Base(path), playlist)
+	}
+	return nil
+}
+
+// write playlist into the archive, it is not tracked by the registry
+func (h *HLSParser) writeArchive(name string, playlist *m3u8.Playlist) error {
+	str, err := m3u8.Write(playlist)
+	if err != nil {
+		return err
+	}
+	return h.writer.WriteFile(filepath.Join(h.archive.dir, name), []byte(str))
+}
+
+// finalizeRecordings releases the timeshift files and writes the VOD playlists of the archive
+func (h *HLSParser) finalizeRecordings() {
+	for _, v := range h.subs {
+		if v.dvrFiles != nil {
+			v.dvrFiles.close()
+		}
+		if v.archive == nil || v.archive.SegmentSize() == 0 {
+			continue
+		}
+		v.archive.finalize()
+		if err := h.writeArchive(v.name, &v.archive.Playlist); err != nil {
+			log.Error().Err(err).Str("slug", h.slug).Str("playlist", v.name).Msg("archive finalize failed")
+			continue
+		}
+		log.Info().Str("slug", h.slug).Str("playlist", v.name).Str("dir", h.archive.dir).Msg("archive finalized")
+	}
+}
@@ -0,0 +1,79 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quangngotan95/go-m3u8/m3u8"
+	"gotest.tools/v3/assert"
+)
+
+func recordingSource(sequence int, count int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	for i := sequence; i < sequence+count; i++ {
+		fmt.Fprintf(&sb, "#EXTINF:4,\nseg%d.ts\n", i)
+	}
+	return sb.String()
+}
+
+func TestRecording(t *testing.T) {
+	basePath := t.TempDir()
+	archivePath := t.TempDir()
+	w := &memoryWriter{files: make(map[string][]byte)}
+	h := NewHLSParser(HLSConfiguration{
+		Slug:           "foo",
+		BasePath:       basePath,
+		PlaylistConfig: PlaylistConfig{Size: 2},
+		Writer:         w,
+		Registry:       NewFileRegistry(FileRegistryConfig{ExpireInterval: time.Second, KeepDelay: time.Second}),
+		Registerer:     prometheus.NewRegistry(),
+		Recording:      RecordingConfig{DVRWindow: time.Second * 12, Archive: true},
+		ArchivePath:    archivePath,
+	})
+	defer h.registry.Stop()
+
+	upload := func(sequence int, count int) {
+		for i := sequence; i < sequence+count; i++ {
+			assert.NilError(t, os.WriteFile(filepath.Join(basePath, fmt.Sprintf("seg%d.ts", i)), []byte("ts"), 0o644))
+		}
+		assert.NilError(t, h.ParsePlaylist(filepath.Join(basePath, "foo.m3u8"), bytes.NewBufferString(recordingSource(sequence, count))))
+	}
+	upload(0, 2)
+	upload(2, 2)
+
+	// the timeshift playlist covers the window
+	dvr, err := m3u8.Read(bytes.NewReader(w.files[filepath.Join(basePath, "foo_dvr.m3u8")]))
+	assert.NilError(t, err)
+	assert.Equal(t, dvr.Sequence, 1)
+	assert.Equal(t, dvr.SegmentSize(), 3)
+	_, ok := h.subs["foo.m3u8"].dvrFiles.files[filepath.Join(basePath, "seg1.ts")]
+	assert.Assert(t, ok)
+	live, err := m3u8.Read(bytes.NewReader(w.files[filepath.Join(basePath, "foo.m3u8")]))
+	assert.NilError(t, err)
+	assert.Equal(t, live.SegmentSize(), 2)
+
+	// the archive keeps everything and is finalized when the stream ends
+	h.Cleanup()
+	dir := h.archive.dir
+	assert.Assert(t, strings.HasPrefix(dir, filepath.Join(archivePath, "foo")))
+	vod, err := m3u8.Read(bytes.NewReader(w.files[filepath.Join(dir, "foo.m3u8")]))
+	assert.NilError(t, err)
+	assert.Assert(t, !vod.Live)
+	assert.Equal(t, *vod.Type, "VOD")
+	assert.Equal(t, vod.SegmentSize(), 4)
+	first := vod.Items[0].(*m3u8.SegmentItem)
+	last := vod.Items[3].(*m3u8.SegmentItem)
+	assert.Assert(t, first.ProgramDateTime != nil)
+	assert.Equal(t, last.ProgramDateTime.Time.Sub(first.ProgramDateTime.Time), time.Second*12)
+	for i := 0; i < 4; i++ {
+		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("seg%d.ts", i)))
+		assert.NilError(t, err)
+	}
+}
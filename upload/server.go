@@ -13,9 +13,13 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog/log"
+
+	"github.com/voc/stream-api/eventlog"
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("upload")
+
 func fail(w http.ResponseWriter, err error) {
 	log.Error().Err(err).Msg("fail")
 	w.WriteHeader(500)
@@ -36,26 +40,39 @@ type ServerConfig struct {
 
 	PlaylistSize int
 
+	// serve the published media playlists via GET without auth, for blocking playlist reload
+	ServePlaylists bool
+
+	// archived stream sessions are stored below this path
+	ArchivePath string
+
+	// timeshift window and archive per stream, the first matching entry applies
+	Recordings []RecordingConfig
+
 	Registerer prometheus.Registerer
+	Events     *eventlog.Log
+	Origins    *OriginRegistry
 }
 
 type Server struct {
-	handler    *Handler
-	auth       Auth
-	outputPath string
-	errors     chan error
-	cancel     context.CancelFunc
-	done       sync.WaitGroup
+	handler        *Handler
+	auth           Auth
+	outputPath     string
+	servePlaylists bool
+	errors         chan error
+	cancel         context.CancelFunc
+	done           sync.WaitGroup
 }
 
 func NewServer(auth Auth, config ServerConfig) (*Server, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
-		handler:    NewHandler(config),
-		auth:       auth,
-		outputPath: config.OutputPath,
-		errors:     make(chan error, 1),
-		cancel:     cancel,
+		handler:        NewHandler(config),
+		auth:           auth,
+		outputPath:     config.OutputPath,
+		servePlaylists: config.ServePlaylists,
+		errors:         make(chan error, 1),
+		cancel:         cancel,
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.HandleUpload)
@@ -115,6 +132,12 @@ func (s *Server) HandleUpload(w http.ResponseWriter, req *http.Request) {
 	// register path-timeout
 	// -> cleanup if path times out
 
+	// published playlists are readable without auth for blocking playlist reload
+	if s.servePlaylists && (req.Method == "GET" || req.Method == "HEAD") && filepath.Ext(req.URL.Path) == ".m3u8" {
+		s.HandlePlaylist(w, req)
+		return
+	}
+
 	slug, ok := s.authenticate(w, req)
 	if !ok {
 		log.Debug().Str("method", req.Method).Str("path", req.URL.Path).Msg("deny auth")
@@ -164,6 +187,29 @@ func (s *Server) HandleUpload(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Serve a published media playlist once it contains the media requested by a blocking playlist reload
+func (s *Server) HandlePlaylist(w http.ResponseWriter, req *http.Request) {
+	path := filepath.Join(s.outputPath, filepath.Clean("/"+req.URL.Path))
+	err := s.handler.WaitPlaylist(req.Context(), path, req.URL.Query())
+	switch {
+	case err == nil:
+	case errors.Is(err, errPlaylistUnknown):
+		http.NotFound(w, req)
+		return
+	case errors.Is(err, errInvalidBlockingRequest), errors.Is(err, errPlaylistAhead):
+		http.Error(w, err.Error(), 400)
+		return
+	case errors.Is(err, errPlaylistTimeout):
+		http.Error(w, err.Error(), 503)
+		return
+	default:
+		// client went away
+		return
+	}
+	log.Debug().Str("path", req.URL.Path).Str("query", req.URL.RawQuery).Msg("serve playlist")
+	http.ServeFile(w, req, path)
+}
+
 // Authenticate using basic auth
 func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
 	w.Header().Add("WWW-Authenticate", `Basic realm=upload, charset="UTF-8"`)
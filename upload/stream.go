@@ -4,8 +4,6 @@ import (
 	"errors"
 	"sync"
 	"time"
-
-	"github.com/rs/zerolog/log"
 )
 
 var errInvalidOrigin = errors.New("invalid origin - this stream is already being uploaded from a different location")
@@ -50,7 +48,7 @@ func (s *Stream) Update(origin string) error {
 			return errInvalidOrigin
 		}
 		log.Info().
-			Str("stream", s.slug).
+			Str("slug", s.slug).
 			Str("old-origin", s.origin).
 			Str("new-origin", origin).
 			Bool("expired", originDeadline.After(now)).
@@ -87,3 +85,12 @@ func (s *Stream) GetHLSParser(config HLSConfiguration) Parser {
 	}
 	return s.parsers[ParserTypeHLS]
 }
+
+func (s *Stream) GetDASHParser(config DASHConfiguration) Parser {
+	s.parserMutex.Lock()
+	defer s.parserMutex.Unlock()
+	if s.parsers[ParserTypeDASH] == nil {
+		s.parsers[ParserTypeDASH] = NewDASHParser(config)
+	}
+	return s.parsers[ParserTypeDASH]
+}
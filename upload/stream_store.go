@@ -6,7 +6,8 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+
+	"github.com/voc/stream-api/eventlog"
 )
 
 const (
@@ -24,6 +25,12 @@ type StreamStoreConfig struct {
 
 	// for how long to keep the stream origin, after no more data is received
 	StreamOriginDuration time.Duration
+
+	// records stream lifecycle events, optional
+	Events *eventlog.Log
+
+	// enforces origin exclusivity across upload-servers, optional
+	Origins *OriginRegistry
 }
 
 type StreamStore struct {
@@ -69,10 +76,13 @@ func (s *StreamStore) run(ctx context.Context) {
 		case <-ctx.Done():
 			// cleanup all
 			s.mutex.Lock()
+			var removed []string
 			for slug := range s.data {
 				s.removeStream(slug)
+				removed = append(removed, slug)
 			}
 			s.mutex.Unlock()
+			s.release(removed)
 			return
 		case <-ticker.C:
 			// count down timeout
@@ -84,16 +94,20 @@ func (s *StreamStore) run(ctx context.Context) {
 // timeout removes all expired streams and files
 func (s *StreamStore) timeout() {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	var removed []string
 	for slug, stream := range s.data {
 		if stream.Age(s.config.StreamExpireInterval) {
 			s.removeStream(slug)
+			removed = append(removed, slug)
+			s.config.Events.Append(eventlog.Event{Slug: slug, Module: "upload", Type: eventlog.UploadExpired})
 		}
 	}
+	s.mutex.Unlock()
+	s.release(removed)
 }
 
 // remove tracked stream
-// lock must be held by caller
+// lock must be held by caller, the origin is released separately
 func (s *StreamStore) removeStream(slug string) {
 	s.log.Info().Str("slug", slug).Msg("removing stream")
 	stream, ok := s.data[slug]
@@ -104,6 +118,17 @@ func (s *StreamStore) removeStream(slug string) {
 	delete(s.data, slug)
 }
 
+// release gives up the cluster-wide origins of removed streams
+// lock must not be held, releasing waits for the kv store
+func (s *StreamStore) release(slugs []string) {
+	if s.config.Origins == nil {
+		return
+	}
+	for _, slug := range slugs {
+		s.config.Origins.Release(slug)
+	}
+}
+
 // Wait for store to stop
 func (s *StreamStore) Stop() {
 	s.cancel()
@@ -112,6 +137,12 @@ func (s *StreamStore) Stop() {
 
 // Check request origin and register stream if required
 func (s *StreamStore) UpdateStream(slug string, origin string) error {
+	// claim without holding the lock, so a slow kv store doesn't stall other streams
+	if s.config.Origins != nil {
+		if err := s.config.Origins.Claim(slug, origin); err != nil {
+			return err
+		}
+	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	stream, ok := s.data[slug]
@@ -119,9 +150,17 @@ func (s *StreamStore) UpdateStream(slug string, origin string) error {
 		s.log.Info().Str("slug", slug).Msg("registering stream")
 		stream = NewStream(slug, s.config.StreamTimeout, s.config.StreamOriginDuration)
 		s.data[slug] = stream
+		s.config.Events.Append(eventlog.Event{Slug: slug, Module: "upload", Type: eventlog.UploadStarted,
+			Fields: map[string]string{"origin": origin}})
 	}
 
-	return stream.Update(origin)
+	previous := stream.origin
+	err := stream.Update(origin)
+	if err == nil && ok && previous != origin {
+		s.config.Events.Append(eventlog.Event{Slug: slug, Module: "upload", Type: eventlog.OriginChanged,
+			Fields: map[string]string{"from": previous, "to": origin}})
+	}
+	return err
 }
 
 // Get stream by slug
@@ -2,13 +2,16 @@ package util
 
 import (
 	"context"
-	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/voc/stream-api/logging"
 )
 
+var log = logging.Module("util")
+
 // GracefulShutdown waits for a signal or context close and then calls the shutdown function in a blocking fashion.
 // If the shutdown function does not complete within the timeout, the function exits early.
 func GracefulShutdown(ctx context.Context, handleShutdown func(), timeout time.Duration) {
@@ -39,8 +42,8 @@ loop:
 
 	select {
 	case <-done:
-		log.Println("graceful shutdown complete")
+		log.Info().Msg("graceful shutdown complete")
 	case <-time.After(timeout):
-		log.Println("graceful shutdown timed out")
+		log.Warn().Msg("graceful shutdown timed out")
 	}
 }